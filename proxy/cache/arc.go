@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"container/list"
+)
+
+// ARCPolicy  Adaptive Replacement Cache, after Megiddo and Modha.  Keys seen once live in t1, keys seen more than once live in t2.  Keys recently evicted from each are remembered, without their values, in the ghost lists b1 and b2.  A miss that turns up in a ghost list means we evicted from the wrong side, and the target size of t1, p, is nudged accordingly.
+//
+// The upshot is a cache that leans towards recency or frequency as the workload demands, and that a one off scan can't flush.
+type ARCPolicy struct {
+	capacity int
+	p        int
+	t1       *list.List
+	t2       *list.List
+	b1       *list.List
+	b2       *list.List
+	elements map[string]*list.Element
+	lists    map[string]*list.List
+	// fromB2  Whether the last key added came back from b2.  ARC uses it to break a tie when choosing which side to evict from.
+	fromB2 bool
+}
+
+// NewARCPolicy  Creates an ARC policy for a cache of the given capacity.
+func NewARCPolicy(capacity int) EvictionPolicy {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return &ARCPolicy{
+		capacity: capacity,
+		t1:       list.New(),
+		t2:       list.New(),
+		b1:       list.New(),
+		b2:       list.New(),
+		elements: make(map[string]*list.Element),
+		lists:    make(map[string]*list.List),
+	}
+}
+
+// Add  A key we've evicted recently comes back into t2, and adjusts p.  Anything else goes in t1.
+func (p *ARCPolicy) Add(key string) {
+	p.fromB2 = false
+
+	switch p.lists[key] {
+	case p.t1, p.t2:
+		p.Access(key)
+		return
+
+	case p.b1:
+		// we shouldn't have evicted it from t1.  Give t1 more room.
+		delta := 1
+		if p.b1.Len() < p.b2.Len() {
+			delta = p.b2.Len() / p.b1.Len()
+		}
+
+		p.p = minInt(p.capacity, p.p+delta)
+		p.forget(key)
+		p.push(p.t2, key)
+		return
+
+	case p.b2:
+		// we shouldn't have evicted it from t2.  Give t2 more room.
+		delta := 1
+		if p.b2.Len() < p.b1.Len() {
+			delta = p.b1.Len() / p.b2.Len()
+		}
+
+		p.p = maxInt(0, p.p-delta)
+		p.forget(key)
+		p.push(p.t2, key)
+		p.fromB2 = true
+		return
+	}
+
+	p.push(p.t1, key)
+	p.trimGhosts()
+}
+
+// Access  A key read a second time is promoted to t2.  One already in t2 goes to the head of it.
+func (p *ARCPolicy) Access(key string) {
+	switch p.lists[key] {
+	case p.t1, p.t2:
+		p.forget(key)
+		p.push(p.t2, key)
+	}
+}
+
+// Remove  Forgets about a key entirely.  Ghosts aren't made of keys that are removed rather than evicted.
+func (p *ARCPolicy) Remove(key string) {
+	switch p.lists[key] {
+	case p.t1, p.t2:
+		p.forget(key)
+	}
+}
+
+// Victim  Evicts from t1 if it's bigger than it's target, otherwise from t2.  The victim is remembered in the matching ghost list.
+func (p *ARCPolicy) Victim() (key string, ok bool) {
+	var from, ghost *list.List
+
+	t1Len := p.t1.Len()
+
+	switch {
+	case t1Len > 0 && (t1Len > p.p || (p.fromB2 && t1Len == p.p)):
+		from, ghost = p.t1, p.b1
+	case p.t2.Len() > 0:
+		from, ghost = p.t2, p.b2
+	case t1Len > 0:
+		from, ghost = p.t1, p.b1
+	default:
+		return key, ok
+	}
+
+	key = from.Back().Value.(string)
+	p.forget(key)
+	p.push(ghost, key)
+	p.trimGhosts()
+
+	return key, true
+}
+
+// Len  The number of keys actually in the cache.  Ghosts don't count.
+func (p *ARCPolicy) Len() int {
+	return p.t1.Len() + p.t2.Len()
+}
+
+// trimGhosts  Keeps t1 plus b1 within capacity, and the whole lot within twice capacity, so the ghosts don't grow without limit.
+func (p *ARCPolicy) trimGhosts() {
+	for p.t1.Len()+p.b1.Len() > p.capacity && p.b1.Len() > 0 {
+		p.forget(p.b1.Back().Value.(string))
+	}
+
+	for p.t1.Len()+p.t2.Len()+p.b1.Len()+p.b2.Len() > 2*p.capacity && p.b2.Len() > 0 {
+		p.forget(p.b2.Back().Value.(string))
+	}
+}
+
+// push  Puts a key at the head of one of the lists.
+func (p *ARCPolicy) push(l *list.List, key string) {
+	p.elements[key] = l.PushFront(key)
+	p.lists[key] = l
+}
+
+// forget  Takes a key out of whichever list it's in.
+func (p *ARCPolicy) forget(key string) {
+	l, ok := p.lists[key]
+	if !ok {
+		return
+	}
+
+	l.Remove(p.elements[key])
+	delete(p.elements, key)
+	delete(p.lists, key)
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
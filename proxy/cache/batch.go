@@ -0,0 +1,232 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"sync/atomic"
+	"time"
+)
+
+// BatchFetchFunc  Fetches a number of keys in one go, in as few round trips as it can manage.  Implemented separately, like FetchFunc, so that I can make a mock one for testing.
+//
+// results has one BatchResult per key, in the same order.  err is for the whole batch failing, in which case every key fails with it.
+type BatchFetchFunc func(keys []string, redisAddr string) (results []BatchResult, err error)
+
+// BatchResult  What a BatchFetchFunc found for one key.  Err is set if that key, and only that key, couldn't be fetched.
+type BatchResult struct {
+	FetchResult
+	Err error
+}
+
+// LookupResult  What LookupMany found for one key.  The same as Lookup's entry, hit and err.
+type LookupResult struct {
+	Key   string
+	Entry *CacheEntry
+	Hit   bool
+	Err   error
+}
+
+// WithBatchFetchFunc  Have LookupMany fetch whatever it's missing with batchFetch, all in one go, rather than a key at a time.
+func WithBatchFetchFunc(batchFetch BatchFetchFunc) Option {
+	return func(c *Cache) {
+		c.BatchFetchFunc = batchFetch
+	}
+}
+
+// LookupMany  Just like Lookup, for a number of keys at once.  Results are in the same order as the keys.
+//
+// Whatever's in the cache, or can be served stale, is served straight from it.  Everything else is fetched by a single call to BatchFetchFunc, and cached as it would be by Get.  Keys that are already being fetched aren't fetched again, but waited on, and fetches for the batch are waited on in turn by anybody else who wants those keys meanwhile.  Nobody waits longer than the fetch timeout, for the whole batch.
+func (c *Cache) LookupMany(keys []string) (results []LookupResult) {
+	return lookupMany(keys, func(key string) *Cache { return c })
+}
+
+// LookupMany  Just like Cache.LookupMany, with each key looked up on whichever shard owns it.  Misses from every shard are fetched together, in one batch.
+func (s *ShardedCache) LookupMany(keys []string) (results []LookupResult) {
+	return lookupMany(keys, s.Shard)
+}
+
+// batchFetch  A fetch that LookupMany is waiting on.  fallback is the stale entry to serve if the fetch fails, as with StaleIfError.
+type batchFetch struct {
+	cache    *Cache
+	key      string
+	call     *fetchCall
+	fallback *CacheEntry
+	// started  Whether LookupMany started the fetch, and is responsible for it, rather than finding it underway.
+	started bool
+	now     time.Time
+}
+
+// lookupMany  Does the work of LookupMany, for whichever cache shardFor says owns each key.
+func lookupMany(keys []string, shardFor func(key string) *Cache) (results []LookupResult) {
+	results = make([]LookupResult, len(keys))
+
+	if len(keys) == 0 {
+		return results
+	}
+
+	fetches := make(map[int]*batchFetch)
+	started := make([]*batchFetch, 0)
+
+	for i, key := range keys {
+		results[i].Key = key
+
+		c := shardFor(key)
+
+		fetch, cached := c.claimFetch(key)
+		if cached {
+			results[i].Entry, results[i].Hit, results[i].Err = c.Lookup(key)
+			continue
+		}
+
+		fetches[i] = fetch
+
+		if fetch.started {
+			started = append(started, fetch)
+		}
+	}
+
+	if len(started) > 0 {
+		first := started[0].cache
+
+		if first.BatchFetchFunc == nil {
+			for _, fetch := range started {
+				go fetch.cache.runSingleFetch(fetch)
+			}
+		} else {
+			go runBatchFetch(first.BatchFetchFunc, first.RedisAddr, started)
+		}
+	}
+
+	// one timeout for the lot, rather than one each, one after another
+	c := shardFor(keys[0])
+
+	var expired <-chan time.Time
+
+	if c.FetchTimeout > 0 {
+		timer := c.clock.NewTimer(c.FetchTimeout)
+		defer timer.Stop()
+
+		expired = timer.Chan()
+	}
+
+	timedOut := false
+
+	for i, key := range keys {
+		fetch, ok := fetches[i]
+		if !ok {
+			continue
+		}
+
+		done := false
+
+		if timedOut {
+			select {
+			case <-fetch.call.done:
+				done = true
+			default:
+			}
+		} else {
+			select {
+			case <-fetch.call.done:
+				done = true
+			case <-expired:
+				timedOut = true
+			}
+		}
+
+		if !done {
+			atomic.AddUint64(&fetch.cache.counters.fetchTimeouts, 1)
+			fetch.cache.countLookup(false)
+			results[i].Err = errors.Wrap(ErrFetchTimeout, fmt.Sprintf("Timeout fetching %s.  is fetchTimeout too short?", key))
+			continue
+		}
+
+		results[i].Entry, results[i].Err = fetch.call.entry, fetch.call.err
+
+		if results[i].Err != nil && fetch.fallback != nil {
+			fetch.cache.logger.Printf("Serving stale %s, as fetching it failed: %s", key, results[i].Err)
+			results[i].Entry, results[i].Hit, results[i].Err = fetch.fallback, true, nil
+		}
+
+		fetch.cache.countLookup(results[i].Hit)
+	}
+
+	return results
+}
+
+// claimFetch  Sees whether a key can be served from the cache, fresh, or stale while it's revalidated, which is as good as a hit, as far as waiting goes.  If not, starts fetching it, unless somebody already has, and hands back the fetch.  Fetches started here are left for the caller to run.
+func (c *Cache) claimFetch(key string) (fetch *batchFetch, cached bool) {
+	fetch = &batchFetch{
+		cache: c,
+		key:   key,
+	}
+
+	c.Lock()
+
+	entry, exists := c.Entries[key]
+	if exists {
+		overdue := c.clock.Now().Sub(entry.Expires)
+
+		if entry.Fresh() || overdue < c.StaleWhileRevalidate {
+			c.Unlock()
+			return fetch, true
+		}
+
+		// Same as Lookup.  Hang on to it in case the fetch fails, if that's what we've been asked to do.  Otherwise it's expired.
+		if overdue < c.StaleIfError {
+			fetch.fallback = entry.staleCopy()
+		} else {
+			c.expire(entry)
+		}
+	}
+
+	c.Unlock()
+
+	c.fetchLock.Lock()
+	defer c.fetchLock.Unlock()
+
+	call, underway := c.inFlight[key]
+	if underway {
+		c.logger.Printf("We are already fetching %s.  Waiting on that.", key)
+		fetch.call = call
+		return fetch, false
+	}
+
+	fetch.call = c.newFetchCall(key, false)
+	fetch.started = true
+	fetch.now = c.clock.Now()
+
+	return fetch, false
+}
+
+// runSingleFetch  Fetches a single key of a batch, with FetchFunc, for caches that have no BatchFetchFunc.
+func (c *Cache) runSingleFetch(fetch *batchFetch) {
+	result, err := c.FetchFunc(fetch.key, c.RedisAddr)
+
+	c.finishFetch(fetch.key, fetch.call, fetch.now, result, err)
+}
+
+// runBatchFetch  Fetches all the keys of a batch with one call to fetchMany, and has each one's cache store it.
+func runBatchFetch(fetchMany BatchFetchFunc, redisAddr string, fetches []*batchFetch) {
+	keys := make([]string, len(fetches))
+	for i, fetch := range fetches {
+		keys[i] = fetch.key
+	}
+
+	results, err := fetchMany(keys, redisAddr)
+	if err == nil && len(results) != len(keys) {
+		err = errors.New(fmt.Sprintf("asked for %d keys, and got %d results", len(keys), len(results)))
+	}
+
+	for i, fetch := range fetches {
+		var result BatchResult
+
+		if err != nil {
+			result.Err = err
+		} else {
+			result = results[i]
+		}
+
+		fetch.cache.finishFetch(fetch.key, fetch.call, fetch.now, result.FetchResult, result.Err)
+	}
+}
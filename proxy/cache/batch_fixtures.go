@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+)
+
+// testBrokenKey  A key that testBatchUpstream can't fetch, though it can fetch the rest of the batch it's in
+func testBrokenKey() string {
+	return "broken"
+}
+
+// testMissingKey  A key that isn't in the test data
+func testMissingKey() string {
+	return "nonexistent"
+}
+
+// testBatchKeys  A batch with a bit of everything in it.  Keys that exist, one that doesn't, and one that's there twice.
+func testBatchKeys() []string {
+	return []string{testFoo(), testBar(), testMissingKey(), testWip(), testBar()}
+}
+
+// testBatchUpstream  A pretend upstream that fetches batches of keys from the test data, and remembers what it was asked for.  If it's gated, each batch waits to be allowed through.  If it's failing, whole batches fail.  It fetches each key with fetchFunc, or unitTestFetchFunc if that isn't set.
+type testBatchUpstream struct {
+	sync.Mutex
+	batches   [][]string
+	gate      chan struct{}
+	failing   bool
+	fetchFunc FetchFunc
+}
+
+// fetch  The upstream's BatchFetchFunc
+func (u *testBatchUpstream) fetch(keys []string, redisAddr string) (results []BatchResult, err error) {
+	u.Lock()
+	u.batches = append(u.batches, keys)
+	gate := u.gate
+	failing := u.failing
+	fetchFunc := u.fetchFunc
+	u.Unlock()
+
+	if fetchFunc == nil {
+		fetchFunc = unitTestFetchFunc
+	}
+
+	if gate != nil {
+		<-gate
+	}
+
+	if failing {
+		err = testFetchError()
+		return results, err
+	}
+
+	for _, key := range keys {
+		var result BatchResult
+
+		if key == testBrokenKey() {
+			result.Err = errors.New("can't fetch that one")
+		} else {
+			result.FetchResult, result.Err = fetchFunc(key, redisAddr)
+		}
+
+		results = append(results, result)
+	}
+
+	return results, err
+}
+
+// Batches  What each batch asked for, so far
+func (u *testBatchUpstream) Batches() [][]string {
+	u.Lock()
+	defer u.Unlock()
+
+	return u.batches
+}
@@ -0,0 +1,264 @@
+package cache
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache_LookupMany(t *testing.T) {
+	var calls int32
+
+	upstream := &testBatchUpstream{}
+
+	c := NewCache(10, time.Second*3, slowTestFetchFunc(&calls), time.Second*5, "", WithBatchFetchFunc(upstream.fetch))
+	defer c.Close()
+
+	_, err := c.Get(testFoo())
+	if err != nil {
+		t.Fatalf("Failed to get %s: %s", testFoo(), err)
+	}
+
+	keys := testBatchKeys()
+	results := c.LookupMany(keys)
+
+	if !assert.Len(t, results, len(keys), "a result for every key") {
+		return
+	}
+
+	assert.Equal(t, [][]string{{testBar(), testMissingKey(), testWip()}}, upstream.Batches(), "the misses were fetched in one batch, once apiece")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "and none of them a key at a time")
+
+	for i, result := range results {
+		assert.Equal(t, keys[i], result.Key, "result %d is for %s", i, keys[i])
+		assert.Nil(t, result.Err, "no error for %s", keys[i])
+	}
+
+	assert.True(t, results[0].Hit, "%s was cached already", testFoo())
+	assert.Equal(t, testFoo(), results[0].Entry.Value, "and has it's value")
+
+	assert.False(t, results[1].Hit, "%s wasn't", testBar())
+	assert.Equal(t, testBar(), results[1].Entry.Value, "but was fetched")
+
+	assert.True(t, results[2].Entry.Missing(), "%s doesn't exist", testMissingKey())
+
+	assert.Equal(t, testWip(), results[3].Entry.Value, "%s was fetched", testWip())
+	assert.Equal(t, testBar(), results[4].Entry.Value, "%s asked for twice gets it twice", testBar())
+
+	assert.Equal(t, 3, c.Len(), "what was fetched was cached")
+
+	// second time around, it's all in the cache
+	results = c.LookupMany([]string{testFoo(), testBar(), testWip()})
+
+	for _, result := range results {
+		assert.True(t, result.Hit, "%s was a hit", result.Key)
+	}
+
+	assert.Len(t, upstream.Batches(), 1, "nothing more was fetched")
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(4), stats.Hits, "every key served from the cache is a hit")
+	assert.Equal(t, uint64(5), stats.Misses, "and every one that wasn't is a miss, twice over if it was asked for twice")
+}
+
+func TestCache_LookupManyFailures(t *testing.T) {
+	upstream := &testBatchUpstream{}
+
+	c := NewCache(10, time.Second*3, unitTestFetchFunc, time.Second*5, "", WithBatchFetchFunc(upstream.fetch))
+	defer c.Close()
+
+	results := c.LookupMany([]string{testFoo(), testBrokenKey(), testBar()})
+
+	assert.Nil(t, results[0].Err, "%s was fetched", testFoo())
+	assert.NotNil(t, results[1].Err, "%s wasn't", testBrokenKey())
+	assert.Nil(t, results[2].Err, "and didn't take %s down with it", testBar())
+	assert.Equal(t, 2, c.Len(), "everything that could be fetched was cached")
+
+	upstream.Lock()
+	upstream.failing = true
+	upstream.Unlock()
+
+	results = c.LookupMany([]string{testFoo(), testWip(), testZoz()})
+
+	assert.Nil(t, results[0].Err, "%s was cached", testFoo())
+
+	for _, result := range results[1:] {
+		if assert.NotNil(t, result.Err, "%s failed along with the batch", result.Key) {
+			assert.Equal(t, testFetchError(), errors.Cause(result.Err), "with the batch's error")
+		}
+	}
+}
+
+func TestCache_LookupManyStaleIfError(t *testing.T) {
+	clock := NewFakeClock(testEpoch())
+	upstream := &testBatchUpstream{}
+
+	c := NewCache(10, testStaleTtl(), unitTestFetchFunc, time.Second*5, "", WithClock(clock), WithStaleIfError(testStaleGrace()), WithBatchFetchFunc(upstream.fetch))
+	defer c.Close()
+
+	c.LookupMany([]string{testFoo()})
+
+	clock.Advance(testStaleTtl() + time.Second)
+
+	upstream.Lock()
+	upstream.failing = true
+	upstream.Unlock()
+
+	results := c.LookupMany([]string{testFoo()})
+
+	assert.Len(t, upstream.Batches(), 2, "the expired entry was fetched again")
+	assert.Nil(t, results[0].Err, "but that failing isn't an error")
+
+	if assert.NotNil(t, results[0].Entry, "as there's a stale entry") {
+		assert.True(t, results[0].Entry.Stale, "which is marked stale")
+		assert.Equal(t, testFoo(), results[0].Entry.Value, "and was served instead")
+	}
+}
+
+func TestCache_LookupManyNoBatchFetchFunc(t *testing.T) {
+	var calls int32
+
+	c := NewCache(10, time.Second*3, slowTestFetchFunc(&calls), time.Second*5, "")
+	defer c.Close()
+
+	start := time.Now()
+	results := c.LookupMany([]string{testFoo(), testBar(), testWip()})
+	elapsed := time.Since(start)
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls), "each key was fetched on it's own")
+	assert.True(t, elapsed < testFetchDelay()*2, "but all at the same time, in %s", elapsed)
+
+	for _, result := range results {
+		assert.Nil(t, result.Err, "no error for %s", result.Key)
+		assert.Equal(t, result.Key, result.Entry.Value, "%s was fetched", result.Key)
+	}
+}
+
+func TestCache_LookupManyCoalesced(t *testing.T) {
+	var calls int32
+
+	release := make(chan struct{})
+	upstream := &testBatchUpstream{gate: release}
+
+	c := NewCache(10, time.Second*3, gatedTestFetchFunc(&calls, release), time.Second*5, "", WithBatchFetchFunc(upstream.fetch))
+	defer c.Close()
+
+	// somebody's already fetching foo when the batch comes along
+	done := make(chan struct{})
+
+	go func() {
+		c.Get(testFoo())
+		close(done)
+	}()
+
+	started := waitFor(func() bool {
+		return atomic.LoadInt32(&calls) == 1
+	})
+
+	if !started {
+		t.Fatalf("The fetch of %s never started", testFoo())
+	}
+
+	batched := make(chan []LookupResult)
+
+	go func() {
+		batched <- c.LookupMany([]string{testFoo(), testBar()})
+	}()
+
+	inBatch := waitFor(func() bool {
+		return len(upstream.Batches()) == 1
+	})
+
+	if !inBatch {
+		t.Fatalf("The batch was never fetched")
+	}
+
+	// and a Get of a key in the batch waits for it
+	go c.Get(testBar())
+
+	close(release)
+	<-done
+
+	results := <-batched
+
+	assert.Equal(t, [][]string{{testBar()}}, upstream.Batches(), "the batch didn't fetch what was already being fetched")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "and nobody fetched what the batch was fetching")
+	assert.Equal(t, testFoo(), results[0].Entry.Value, "%s came from the fetch underway", testFoo())
+	assert.Equal(t, testBar(), results[1].Entry.Value, "%s came from the batch", testBar())
+}
+
+func TestCache_LookupManyTimeout(t *testing.T) {
+	clock := NewFakeClock(testEpoch())
+	release := make(chan struct{})
+	upstream := &testBatchUpstream{gate: release}
+
+	c := NewCache(10, time.Second*3, unitTestFetchFunc, testShortTimeout(), "", WithClock(clock), WithBatchFetchFunc(upstream.fetch))
+	defer c.Close()
+
+	c.Get(testFoo())
+
+	batched := make(chan []LookupResult)
+
+	go func() {
+		batched <- c.LookupMany([]string{testFoo(), testBar(), testWip()})
+	}()
+
+	waiting := waitFor(func() bool {
+		return clock.Pending() == 1
+	})
+
+	if !waiting {
+		t.Fatalf("The batch never started waiting")
+	}
+
+	clock.Advance(testShortTimeout())
+
+	results := <-batched
+
+	assert.Nil(t, results[0].Err, "%s was cached, and didn't time out", testFoo())
+
+	for _, result := range results[1:] {
+		if assert.NotNil(t, result.Err, "%s timed out", result.Key) {
+			assert.Equal(t, ErrFetchTimeout, errors.Cause(result.Err), "and says so")
+		}
+	}
+
+	// the batch everyone gave up on still lands in the cache
+	close(release)
+
+	landed := waitFor(func() bool {
+		return c.Len() == 3
+	})
+
+	assert.True(t, landed, "the timed out batch was cached when it finished")
+}
+
+func TestShardedCache_LookupMany(t *testing.T) {
+	upstream := &testBatchUpstream{fetchFunc: keyTestFetchFunc}
+
+	s := NewShardedCache(4, 0, time.Second*3, unitTestFetchFunc, time.Second*5, "", WithBatchFetchFunc(upstream.fetch))
+	defer s.Close()
+
+	keys := testStressKeys()
+	results := s.LookupMany(keys)
+
+	assert.Len(t, upstream.Batches(), 1, "misses on every shard were fetched in one batch")
+	assert.Len(t, upstream.Batches()[0], len(keys), "all of them")
+
+	for i, result := range results {
+		assert.Equal(t, keys[i], result.Key, "results are in order")
+	}
+
+	assert.Equal(t, len(keys), s.Len(), "and cached")
+
+	shardsUsed := 0
+	for _, shard := range s.Shards {
+		if shard.Len() > 0 {
+			shardsUsed++
+		}
+	}
+
+	assert.Equal(t, len(s.Shards), shardsUsed, "on the shards they belong on")
+}
@@ -1,178 +1,572 @@
 package cache
 
 import (
-	"container/list"
 	"fmt"
 	"github.com/pkg/errors"
 	"log"
+	"math/rand"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Cache The actual cache object
 type Cache struct {
 	sync.RWMutex
-	Ttl             time.Duration
-	Entries         map[string]*list.Element
-	MaxEntries      int
-	AgeList         *list.List
-	FetchFunc       FetchFunc
-	fetchLock       sync.Mutex
-	FetchInProgress map[string]time.Time
-	FetchTimeout    time.Duration
-	logger          *log.Logger
-	RedisAddr       string
+	Ttl          time.Duration
+	Entries      map[string]*CacheEntry
+	MaxEntries   int
+	MaxBytes     int64
+	bytes        int64
+	Policy       EvictionPolicy
+	FetchFunc    FetchFunc
+	fetchLock    sync.Mutex
+	inFlight     map[string]*fetchCall
+	FetchTimeout time.Duration
+	observer     FetchObserver
+	logger       *log.Logger
+	RedisAddr    string
+	clock        Clock
+	janitor      *janitor
+	// StaleWhileRevalidate  How long past it's expiry a stale entry may still be served, while a fresh one is fetched in the background.
+	StaleWhileRevalidate time.Duration
+	// StaleIfError  How long past it's expiry a stale entry may still be served, if fetching a fresh one fails.
+	StaleIfError time.Duration
+	// RefreshAhead  The fraction of an entry's life, at the end of it, during which a read will have the entry refreshed in the background.
+	RefreshAhead float64
+	// NegativeTtl  How long to remember that a key doesn't exist upstream.  0 means we don't, and go and look every time.
+	NegativeTtl time.Duration
+	// IgnoreUpstreamTtl  Cache entries for Ttl, even if the key expires upstream before then.
+	IgnoreUpstreamTtl bool
+	// Rules  Per key exceptions to all of the above.  nil if there aren't any.
+	Rules *Rules
+	// BatchFetchFunc  Fetches many keys at once, for LookupMany.  If it's nil, they're fetched one by one, with FetchFunc, all at the same time.
+	BatchFetchFunc BatchFetchFunc
+	// JitterFraction  Up to what fraction of it's ttl is knocked off each entry's expiry, at random.
+	JitterFraction float64
+	// JitterRange  Up to how much is knocked off each entry's expiry, at random, whatever it's ttl.
+	JitterRange time.Duration
+	jitterRand  *rand.Rand
+	negatives   int
+	// subKeys  The sub keys cached for each key, so they can be invalidated along with it.
+	subKeys  map[string]map[string]struct{}
+	counters counters
+}
+
+// ErrFetchTimeout  What a fetch that took longer than FetchTimeout fails with, wrapped up with the key.  errors.Cause tells it apart from anything else that went wrong.
+var ErrFetchTimeout = errors.New("fetch timed out")
+
+// fetchCall  A fetch that's underway.  Everybody who wants the same key waits on done, and gets the same entry and error.
+type fetchCall struct {
+	done  chan struct{}
+	entry *CacheEntry
+	err   error
+	// refreshAhead  Whether the fetch was started to refresh an entry before it expired.
+	refreshAhead bool
+	// invalidated  The key changed upstream while the fetch was underway, so what it fetched may already be out of date.  Waiters still get it, but it isn't cached.  Guarded by fetchLock.
+	invalidated bool
 }
 
 // FetchFunc Fetcher function.  Implemented separately so that I can make a mock one for testing
-type FetchFunc func(key string, redisAddr string) (value interface{}, err error)
+type FetchFunc func(key string, redisAddr string) (result FetchResult, err error)
+
+// FetchObserver  Told about every fetch from upstream once it's done, with how long it took, what it found, and whether it failed.  For keeping metrics.  It's called before anyone waiting on the fetch is let go, so it had better be quick.
+type FetchObserver func(key string, took time.Duration, result FetchResult, err error)
+
+// FetchResult  What a FetchFunc found.  A nil Value means the key doesn't exist upstream.
+type FetchResult struct {
+	Value interface{}
+	// Type  What kind of value it is, in Redis' terms, like "string" or "hash".  Empty if the FetchFunc doesn't say.
+	Type string
+	// TTL  How long the key has left upstream.  0 if it doesn't expire, or we don't know.
+	TTL time.Duration
+	// Truncated  Value is only the start of what's upstream, as the rest was too much to cache.
+	Truncated bool
+}
 
-// NewCache  Creates a new cache.  Requires arguments for maxEntries (number of items in the cache) and maxAge(How long something will reside in the cache)
-func NewCache(maxEntries int, maxAge time.Duration, fetchFunc FetchFunc, fetchTimeout time.Duration, redisAddr string) *Cache {
+// NewCache  Creates a new cache.  Requires arguments for maxEntries (number of items in the cache, 0 for no limit) and maxAge(How long something will reside in the cache).  Anything else is optional, and applied in order.
+func NewCache(maxEntries int, maxAge time.Duration, fetchFunc FetchFunc, fetchTimeout time.Duration, redisAddr string, options ...Option) *Cache {
 
 	logger := log.New(os.Stderr, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
 	c := &Cache{
-		Ttl:             maxAge,
-		Entries:         make(map[string]*list.Element),
-		MaxEntries:      maxEntries,
-		FetchInProgress: make(map[string]time.Time),
-		AgeList:         list.New(),
-		FetchFunc:       fetchFunc,
-		FetchTimeout:    fetchTimeout,
-		logger:          logger,
-		RedisAddr:       redisAddr,
+		Ttl:          maxAge,
+		Entries:      make(map[string]*CacheEntry),
+		MaxEntries:   maxEntries,
+		inFlight:     make(map[string]*fetchCall),
+		subKeys:      make(map[string]map[string]struct{}),
+		Policy:       NewLRUPolicy(policyCapacity(maxEntries)),
+		FetchFunc:    fetchFunc,
+		FetchTimeout: fetchTimeout,
+		logger:       logger,
+		RedisAddr:    redisAddr,
+		clock:        SystemClock{},
+	}
+
+	for _, option := range options {
+		option(c)
 	}
 
+	c.startJanitor()
+
 	return c
 }
 
-// Get Gets an item from the cache, or if it's not in the cache, tries to get it from redis.  Automatically removes oldest entries from entry list if we exceed the maxEntries limit.
+// Get Gets an item from the cache, or if it's not in the cache, tries to get it from redis.  Automatically evicts entries, as chosen by the eviction policy, if we exceed the maxEntries or maxBytes limits.
+//
+// A key that doesn't exist upstream comes back as a nil entry, or, with negative caching on, as an entry marked Negative.  Either way, there's no value.
 func (c *Cache) Get(key string) (entry *CacheEntry, err error) {
+	entry, _, err = c.Lookup(key)
 
-	// lock so it doesn't get written while we're reading it
+	return entry, err
+}
 
-	c.RLock()
-	element, exists := c.Entries[key]
-	c.RUnlock()
+// Lookup  Just like Get, but also says whether the entry was a hit, that came out of the cache, stale or not, rather than from upstream.
+func (c *Cache) Lookup(key string) (entry *CacheEntry, hit bool, err error) {
+	entry, hit, err = c.lookup(key)
+
+	c.countLookup(hit)
+
+	return entry, hit, err
+}
+
+// lookup  Does the work of Lookup, without counting it.
+func (c *Cache) lookup(key string) (entry *CacheEntry, hit bool, err error) {
+	// Even a hit tells the eviction policy something, so this takes the full lock, not just a read lock.
+	c.Lock()
+	entry, exists := c.Entries[key]
 
 	//  If it isn't in the cache, go get it.
 	if !exists {
+		c.Unlock()
 		c.logger.Printf("Item not in cache.  Fetching.")
-		return c.Fetch(key)
+		entry, err = c.Fetch(key)
+		return entry, false, err
 	}
 
 	c.logger.Printf("Retrieving item from cache.")
 
-	// this will, of course blow chunks if the entry's value is not a CacheElement.
-	entry, ok := element.Value.(*CacheEntry)
-	if !ok {
-		err = errors.New("Couldn't extract a CacheEntry from the list element.  Wtf did you put in there?")
-		return entry, err
+	// If it *is* in the cache, return it if it's fresh, letting the eviction policy know it's been used.
+	if entry.Fresh() {
+		c.Policy.Access(key)
+		entry.Hits++
+
+		if entry.Negative {
+			atomic.AddUint64(&c.counters.negativeHits, 1)
+		}
+
+		if entry.refreshedAhead {
+			entry.refreshedAhead = false
+			atomic.AddUint64(&c.counters.usefulRefreshAheads, 1)
+		}
+
+		// Getting on a bit?  Then get a new one now, so that nobody has to wait for it once this one's expired.  Getting on a bit for this entry, that is, which may have been given less than the rule's ttl by upstream.
+		due := c.RefreshAhead > 0 && entry.Remaining() < time.Duration(float64(entry.Expires.Sub(entry.Fetched))*c.RefreshAhead)
+		c.Unlock()
+
+		if due {
+			c.refreshAhead(key)
+		}
+
+		return entry, true, err
 	}
 
-	// If it *is* in the cache, return it if it's fresh, moving it to the head of the age list, since it's now the freshest.
-	if entry.Fresh() {
-		c.RLock()
-		c.AgeList.MoveToFront(element)
-		c.RUnlock()
+	overdue := c.clock.Now().Sub(entry.Expires)
 
-		return entry, err
+	// Stale, but not so stale we can't serve it while we get a fresh one in the background.
+	if overdue < c.StaleWhileRevalidate {
+		c.Policy.Access(key)
+		entry.Hits++
+		stale := entry.staleCopy()
+		c.Unlock()
+
+		c.logger.Printf("Serving stale %s while it's refreshed.", key)
+		c.refresh(key)
+
+		return stale, true, err
 	}
 
-	// At this point it is in the cache, but it's stale.  Get rid of it.
-	// locking and unlocking are performed in the function.
-	c.RemoveElement(element)
+	// Hang on to it in case the fetch fails, if that's what we've been asked to do.  Otherwise it's expired.
+	var fallback *CacheEntry
+
+	if overdue < c.StaleIfError {
+		fallback = entry.staleCopy()
+	} else {
+		c.expire(entry)
+	}
+
+	c.Unlock()
 
 	// Get a fresh version
 	entry, err = c.Fetch(key)
 
+	if err != nil && fallback != nil {
+		c.logger.Printf("Serving stale %s, as fetching it failed: %s", key, err)
+		return fallback, true, nil
+	}
+
 	if err != nil {
 		err = errors.Wrap(err, fmt.Sprintf("failed to fetch key %q", key))
-		return entry, err
+		return entry, false, err
 	}
 
-	return entry, err
+	return entry, false, err
 }
 
-// RemoveElement Removes the element from the list and age list.
-func (c *Cache) RemoveElement(element *list.Element) {
-	entry, ok := element.Value.(*CacheEntry)
-	if ok {
-		c.logger.Printf("Purging %s from cache", entry.Key)
-		c.RLock()
-		key := entry.Key
+// expire  Counts an entry that's past serving, even stale, as expired.  It's left where it is, for the fetch that's coming to replace in place, so that the eviction policy doesn't forget all it's learned about the key.  If that fetch comes back with nothing to replace it with, it goes then.  The caller is responsible for holding the write lock.
+func (c *Cache) expire(entry *CacheEntry) {
+	if entry.expired {
+		return
+	}
 
-		if _, ok := c.Entries[key]; ok {
-			delete(c.Entries, key)
-		}
-		c.AgeList.Remove(element)
+	entry.expired = true
+	atomic.AddUint64(&c.counters.expirations, 1)
+}
+
+// keepStale  How long past expiry an entry might still be served.  Until then, the janitor leaves it be.
+func (c *Cache) keepStale() time.Duration {
+	if c.StaleIfError > c.StaleWhileRevalidate {
+		return c.StaleIfError
+	}
+
+	return c.StaleWhileRevalidate
+}
+
+// Len  The number of entries currently in the cache.
+func (c *Cache) Len() int {
+	c.RLock()
+	defer c.RUnlock()
+
+	return len(c.Entries)
+}
+
+// Bytes  The estimated size of everything currently in the cache.
+func (c *Cache) Bytes() int64 {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.bytes
+}
+
+// Delete Removes a key from the cache.  Returns true if it was there to be removed.
+func (c *Cache) Delete(key string) (deleted bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	deleted = c.remove(key)
+	if deleted {
+		atomic.AddUint64(&c.counters.purges, 1)
+	}
+
+	return deleted
+}
+
+// remove does the actual work of Delete.  The caller is responsible for holding the write lock.
+func (c *Cache) remove(key string) (removed bool) {
+	if _, ok := c.Entries[key]; !ok {
+		return removed
+	}
+
+	c.logger.Printf("Purging %s from cache", key)
+
+	c.forget(key)
+	c.Policy.Remove(key)
+
+	return true
+}
 
-		c.RUnlock()
+// forget  Drops an entry from the map, and it's size from the running total.  The policy is left alone, as when evicting, it already knows.  The caller is responsible for holding the write lock.
+func (c *Cache) forget(key string) {
+	entry, ok := c.Entries[key]
+	if !ok {
 		return
 	}
 
-	c.logger.Printf("Failed to remove element.  WTF did you put in here?")
+	c.bytes -= entry.Size
+	if entry.Negative {
+		c.negatives--
+	}
 
+	delete(c.Entries, key)
+	c.dropSubKey(key)
 }
 
-// Fetch What actually reaches out and gets stuff by locking the cache and running the fetch func
+// overLimit  Whether we've more entries, or more bytes, than we're allowed.  A limit of 0 is no limit at all.  The caller is responsible for holding at least the read lock.
+func (c *Cache) overLimit() bool {
+	if c.MaxEntries > 0 && len(c.Entries) > c.MaxEntries {
+		return true
+	}
+
+	if c.MaxBytes > 0 && c.bytes > c.MaxBytes {
+		return true
+	}
+
+	return false
+}
+
+// insert puts a new entry in the cache, replacing any entry already there for the same key, and has the eviction policy pick entries to evict until we're within MaxEntries and MaxBytes.  The new entry itself might be the one picked, if the policy thinks it's not worth keeping.  Since all of that happens under one lock, nobody ever sees the cache over it's limits.  The caller is responsible for holding the write lock.
+func (c *Cache) insert(entry *CacheEntry) {
+	// Something bigger than the whole budget would evict everything else, and then itself.  Don't bother, and don't leave the old value about either.
+	if c.MaxBytes > 0 && entry.Size > c.MaxBytes {
+		c.logger.Printf("%s is %d bytes, more than the cache's %d.  Not caching it.", entry.Key, entry.Size, c.MaxBytes)
+		c.remove(entry.Key)
+		return
+	}
+
+	// A refetch swaps the value in place.  Taking the key out of the policy and putting it back would have it forget all it's learned about the key, and a frequency based policy would treat a hot key as brand new every time it's TTL came round.
+	if old, ok := c.Entries[entry.Key]; ok {
+		c.bytes -= old.Size
+		if old.Negative {
+			c.negatives--
+		}
+	}
+
+	c.Entries[entry.Key] = entry
+	c.addSubKey(entry.Key)
+	c.bytes += entry.Size
+	if entry.Negative {
+		c.negatives++
+	}
+
+	c.Policy.Add(entry.Key)
+
+	// Finally, check to see if we're over the configured cache size
+	for c.overLimit() {
+		c.logger.Printf("Cache limits reached.  %d of %d entries, %d of %d bytes.", len(c.Entries), c.MaxEntries, c.bytes, c.MaxBytes)
+
+		victim, ok := c.Policy.Victim()
+		if !ok {
+			break
+		}
+
+		c.logger.Printf("Too much in the cache.  Evicting %s.", victim)
+		c.forget(victim)
+		atomic.AddUint64(&c.counters.evictions, 1)
+	}
+}
+
+// Fetch What actually reaches out and gets stuff by running the fetch func.  Concurrent fetches of the same key are coalesced, so only one of them actually hits upstream, and the rest wait for, and share, it's result.  Gives up waiting after FetchTimeout.
 func (c *Cache) Fetch(key string) (entry *CacheEntry, err error) {
-	now := time.Now()
-	// fetch item
+	call, _ := c.startFetch(key, false)
+
+	return c.await(key, call)
+}
+
+// await  Waits for a fetch of key, for up to FetchTimeout, and hands back what it found.
+func (c *Cache) await(key string, call *fetchCall) (entry *CacheEntry, err error) {
+	// no timeout configured?  wait as long as it takes.
+	if c.FetchTimeout <= 0 {
+		<-call.done
+		return call.entry, call.err
+	}
+
+	timer := c.clock.NewTimer(c.FetchTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-call.done:
+		return call.entry, call.err
+
+	case <-timer.Chan():
+		atomic.AddUint64(&c.counters.fetchTimeouts, 1)
+		err = errors.Wrap(ErrFetchTimeout, fmt.Sprintf("Timeout fetching %s.  is fetchTimeout too short?", key))
+		return entry, err
+	}
+}
+
+// refresh  Fetches a key in the background, unless it's being fetched already.  Nobody waits on it.  The result just lands in the cache.
+func (c *Cache) refresh(key string) {
+	c.startFetch(key, false)
+}
+
+// refreshAhead  Refreshes a key in the background, before it expires.  Counted in the stats, unless it was being fetched already.
+func (c *Cache) refreshAhead(key string) {
+	_, started := c.startFetch(key, true)
+	if started {
+		c.logger.Printf("Refreshing %s ahead of it's expiry.", key)
+		atomic.AddUint64(&c.counters.refreshAheads, 1)
+	}
+}
+
+// startFetch  Starts fetching a key, or if somebody else already has, hands back the fetch that's underway.  refreshAhead marks the fetch as a refresh ahead of expiry.
+func (c *Cache) startFetch(key string, refreshAhead bool) (call *fetchCall, started bool) {
 	c.fetchLock.Lock()
+	defer c.fetchLock.Unlock()
 
 	// Are we already fetching it?
-	start, exists := c.FetchInProgress[key]
+	call, exists := c.inFlight[key]
+	if exists {
+		c.logger.Printf("We are already fetching %s.  Waiting on that.", key)
+		return call, started
+	}
 
-	// if so, have we timed out?
-	if exists && start.Add(c.FetchTimeout).Before(now) {
-		c.logger.Printf("We are already fetching %s", key)
-		// if so, screw it, return an error
-		c.fetchLock.Unlock()
-		err = errors.New(fmt.Sprintf("Timeout fetching %s.  is fetchTimeout too short?", key))
+	call = c.newFetchCall(key, refreshAhead)
 
-		return entry, err
+	// The fetch runs on it's own, so that it can finish and populate the cache even if everyone waiting on it gives up.
+	go c.runFetch(key, call)
+
+	return call, true
+}
+
+// newFetchCall  Makes a call for a fetch of key, and marks it as underway.  The caller is responsible for holding fetchLock, and for seeing the fetch through to finishFetch.
+func (c *Cache) newFetchCall(key string, refreshAhead bool) (call *fetchCall) {
+	call = &fetchCall{
+		done:         make(chan struct{}),
+		refreshAhead: refreshAhead,
 	}
 
-	c.FetchInProgress[key] = now
-	c.fetchLock.Unlock()
+	c.inFlight[key] = call
+
+	return call
+}
+
+// ttlFor  How long to cache what was fetched.  Ttl, or the rule's ttl if there is one, unless the key expires upstream before then, in which case we don't want to be serving it after Redis has deleted it.
+func (c *Cache) ttlFor(rule *Rule, result FetchResult) time.Duration {
+	ttl := c.ruleTtl(rule)
+
+	if c.IgnoreUpstreamTtl || result.TTL <= 0 || result.TTL > ttl {
+		return ttl
+	}
+
+	return result.TTL
+}
+
+// ruleTtl  How long keys under the given rule are cached for, before any upstream ttl or jitter.
+func (c *Cache) ruleTtl(rule *Rule) time.Duration {
+	if rule != nil && rule.Ttl > 0 {
+		return rule.Ttl
+	}
+
+	return c.Ttl
+}
+
+// negativeTtlFor  How long to remember that a key under the given rule is missing.  0 if we shouldn't.
+func (c *Cache) negativeTtlFor(rule *Rule) time.Duration {
+	if rule == nil {
+		return c.NegativeTtl
+	}
+
+	if rule.Bypass || rule.NegativeTtl < 0 {
+		return 0
+	}
+
+	if rule.NegativeTtl == 0 {
+		return c.NegativeTtl
+	}
+
+	return rule.NegativeTtl
+}
+
+// runFetch actually gets the thing we're looking for, and has finishFetch store it.
+func (c *Cache) runFetch(key string, call *fetchCall) {
+	now := c.clock.Now()
+
+	result, err := c.FetchFunc(key, c.RedisAddr)
+
+	c.finishFetch(key, call, now, result, err)
+}
+
+// finishFetch  Stores what a fetch that started at now came back with, and lets everyone waiting on the call know it's done.
+func (c *Cache) finishFetch(key string, call *fetchCall, now time.Time, result FetchResult, err error) {
+	if c.observer != nil {
+		c.observer(key, c.clock.Now().Sub(now), result, err)
+	}
+
+	rule := c.Rules.Match(key)
+
+	var entry *CacheEntry
+
+	value := result.Value
 
-	// actually get the thing we're looking for
-	value, err := c.FetchFunc(key, c.RedisAddr)
 	if err != nil {
 		err = errors.Wrap(err, fmt.Sprintf("Failed to fetch %s", key))
-		return entry, err
-	}
 
-	if value != nil { // dont' bother storing nil values.
+		// an expired entry was left for this to replace.  There's nothing to replace it with, so it goes.
+		c.Lock()
+		if expired, ok := c.Entries[key]; ok && expired.expired {
+			c.remove(key)
+		}
+		c.Unlock()
+	} else if value == nil && c.negativeTtlFor(rule) > 0 { // remember that it isn't there, so we don't have to keep asking.
+		entry = &CacheEntry{
+			Expires:  now.Add(c.jittered(c.negativeTtlFor(rule))),
+			Key:      key,
+			Size:     EstimateSize(key, value),
+			Negative: true,
+			Rule:     rule,
+			Fetched:  now,
+			clock:    c.clock,
+		}
+
+		c.Lock()
+		if !c.invalidatedDuring(call) {
+			c.insert(entry)
+		}
+		c.Unlock()
+	} else if value == nil { // dont' bother storing nil values, but don't keep serving a stale one either.
+		c.Lock()
+		if !c.invalidatedDuring(call) {
+			c.remove(key)
+		}
+		c.Unlock()
+	} else {
 		entry = &CacheEntry{
-			Expires: now.Add(c.Ttl),
-			Value:   value,
-			Key:     key,
+			Expires:   now.Add(c.jittered(c.ttlFor(rule, result))),
+			Value:     value,
+			Type:      result.Type,
+			Key:       key,
+			Size:      EstimateSize(key, value),
+			Rule:      rule,
+			Fetched:   now,
+			Hash:      ContentHash(value),
+			Truncated: result.Truncated,
+			clock:     c.clock,
+
+			refreshedAhead: call.refreshAhead,
 		}
 
-		c.RLock()
+		// Some things are only passing through.  Whoever asked gets them, but they don't stay.
+		uncached := ""
 
-		element := c.AgeList.PushFront(entry)
+		switch {
+		case rule == nil:
+		case rule.Bypass:
+			uncached = "it's bypassed"
+		case rule.MaxSize > 0 && valueSize(value) > rule.MaxSize:
+			uncached = fmt.Sprintf("it's bigger than %d bytes", rule.MaxSize)
+		}
 
-		c.Entries[key] = element
+		// We're writing, so we need the cache all to ourselves.
+		c.Lock()
 
-		// Finally, check to see if we're over the configured cache size
-		if len(c.Entries) > c.MaxEntries {
-			c.logger.Printf("Max entries of %d reached.", c.MaxEntries)
-			c.logger.Printf("Too many entries.  Purging the eldest.")
-			eldest := c.AgeList.Back()
-			c.RemoveElement(eldest)
+		// Whatever was cached went when it was invalidated.  Anything there now is newer than this, so it's left be.
+		invalidated := c.invalidatedDuring(call)
+		if invalidated {
+			uncached = "it changed upstream while it was being fetched"
 		}
 
-		c.RUnlock()
+		if uncached == "" {
+			c.insert(entry)
+		} else if !invalidated {
+			c.remove(key)
+		}
+
+		c.Unlock()
+
+		if uncached != "" {
+			c.logger.Printf("Not caching %s, under rule %s, as %s", key, rule, uncached)
+		}
 	}
 
+	// a ForceRefresh may have started another fetch of the key in the meantime, which is that one's to clear up
 	c.fetchLock.Lock()
-	delete(c.FetchInProgress, key)
+	if c.inFlight[key] == call {
+		delete(c.inFlight, key)
+	}
 	c.fetchLock.Unlock()
 
-	return entry, err
-
+	// the results have to be in place before done is closed.  Closing it is what makes them visible to the waiters.
+	call.entry = entry
+	call.err = err
+	close(call.done)
 }
@@ -6,6 +6,14 @@ package cache
 
 // In fact, This fixtures file becomes a spec of sorts for the expected inputs.
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
 func testSlice() []string {
 	stringSlice := make([]string, 0)
 	stringSlice = append(stringSlice, "foo")
@@ -48,12 +56,231 @@ func testCacheData() (info map[string]interface{}) {
 	return info
 }
 
-func unitTestFetchFunc(key string, redisAddr string) (value interface{}, err error) {
+func unitTestFetchFunc(key string, redisAddr string) (result FetchResult, err error) {
 	data := testCacheData()
 
 	if elem, ok := data[key]; ok {
-		return elem, nil
+		result.Value = elem
+		return result, nil
 	}
 
-	return value, err
+	return result, err
+}
+
+// testFetchDelay  How long the slow fetch funcs take to come back
+func testFetchDelay() time.Duration {
+	return time.Millisecond * 200
+}
+
+// testShortTimeout  A fetch timeout that's shorter than testFetchDelay.  The timeout test measures it on a fake clock, so it never actually waits for it.
+func testShortTimeout() time.Duration {
+	return time.Millisecond * 50
+}
+
+func testWaiters() int {
+	return 50
+}
+
+func testFetchError() error {
+	return errors.New("upstream is on fire")
+}
+
+// slowTestFetchFunc  A fetch func that takes testFetchDelay to read from the test data, and counts how many times it's been called.
+func slowTestFetchFunc(calls *int32) FetchFunc {
+	return func(key string, redisAddr string) (result FetchResult, err error) {
+		atomic.AddInt32(calls, 1)
+		time.Sleep(testFetchDelay())
+
+		return unitTestFetchFunc(key, redisAddr)
+	}
+}
+
+// gatedTestFetchFunc  A fetch func that reads from the test data, but not until release is closed.  Counts how many times it's been called.
+func gatedTestFetchFunc(calls *int32, release chan struct{}) FetchFunc {
+	return func(key string, redisAddr string) (result FetchResult, err error) {
+		atomic.AddInt32(calls, 1)
+		<-release
+
+		return unitTestFetchFunc(key, redisAddr)
+	}
+}
+
+// failingTestFetchFunc  Like slowTestFetchFunc, but it always fails.
+func failingTestFetchFunc(calls *int32) FetchFunc {
+	return func(key string, redisAddr string) (result FetchResult, err error) {
+		atomic.AddInt32(calls, 1)
+		time.Sleep(testFetchDelay())
+
+		return result, testFetchError()
+	}
+}
+
+// keyTestFetchFunc  A fetch func that knows about every key there is.  The value is the key itself.
+func keyTestFetchFunc(key string, redisAddr string) (result FetchResult, err error) {
+	return FetchResult{Value: key}, err
+}
+
+// testStressKeys  A key space a good deal bigger than the cache, so there's plenty of eviction going on
+func testStressKeys() []string {
+	keys := make([]string, 0)
+
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("key-%d", i))
+	}
+
+	return keys
+}
+
+func testStressCapacity() int {
+	return 10
+}
+
+func testStressWorkers() int {
+	return 32
+}
+
+func testStressIterations() int {
+	return 2000
+}
+
+// testStressTtl  Short enough that entries go stale, and get removed and refetched, while the stress test is running
+func testStressTtl() time.Duration {
+	return time.Millisecond * 5
+}
+
+// testBlobSize  How big the values from blobTestFetchFunc are
+func testBlobSize() int {
+	return 1000
+}
+
+// blobTestFetchFunc  A fetch func that knows about every key there is.  The value is testBlobSize bytes of x's.
+func blobTestFetchFunc(key string, redisAddr string) (result FetchResult, err error) {
+	return FetchResult{Value: strings.Repeat("x", testBlobSize())}, err
+}
+
+// testBlobKeys  Keys all the same length, so every blob entry is the same size
+func testBlobKeys() []string {
+	keys := make([]string, 0)
+
+	for i := 0; i < 10; i++ {
+		keys = append(keys, fmt.Sprintf("blob-%d", i))
+	}
+
+	return keys
+}
+
+// testBlobsThatFit  How many blob entries fit in testByteBudget
+func testBlobsThatFit() int {
+	return 3
+}
+
+// testByteBudget  Room for testBlobsThatFit blob entries, and a bit, but not another whole one
+func testByteBudget() int64 {
+	entrySize := EstimateSize(testBlobKeys()[0], strings.Repeat("x", testBlobSize()))
+
+	return entrySize*int64(testBlobsThatFit()) + entrySize/2
+}
+
+// testStaleTtl  How long entries live in the stale tests, on a fake clock
+func testStaleTtl() time.Duration {
+	return time.Second * 3
+}
+
+// testStaleGrace  How long past expiry stale entries can be served, on a fake clock
+func testStaleGrace() time.Duration {
+	return time.Second * 10
+}
+
+// testUpstream  A pretend upstream for the stale tests.  Every fetch gets a new version of the value, like foo-1, foo-2 and so on, unless it's been told to fail, or that the key has gone missing.  Keys expire upstream after ttl, if it's set.  If it's gated, each fetch waits to be allowed through.
+type testUpstream struct {
+	calls   int32
+	failing int32
+	missing int32
+	ttl     int64
+	gate    chan struct{}
+}
+
+// newTestUpstream  A testUpstream.  If gated, fetches wait for allow.
+func newTestUpstream(gated bool) *testUpstream {
+	u := &testUpstream{}
+
+	if gated {
+		u.gate = make(chan struct{}, 100)
+	}
+
+	return u
+}
+
+// allow  Lets n more fetches through the gate.
+func (u *testUpstream) allow(n int) {
+	for i := 0; i < n; i++ {
+		u.gate <- struct{}{}
+	}
+}
+
+// Calls  How many fetches have been started.
+func (u *testUpstream) Calls() int32 {
+	return atomic.LoadInt32(&u.calls)
+}
+
+// fetch  The testUpstream's FetchFunc
+func (u *testUpstream) fetch(key string, redisAddr string) (result FetchResult, err error) {
+	version := atomic.AddInt32(&u.calls, 1)
+
+	if u.gate != nil {
+		<-u.gate
+	}
+
+	if atomic.LoadInt32(&u.failing) == 1 {
+		return result, testFetchError()
+	}
+
+	if atomic.LoadInt32(&u.missing) == 1 {
+		return result, err
+	}
+
+	result = FetchResult{
+		Value: testVersion(key, version),
+		TTL:   time.Duration(atomic.LoadInt64(&u.ttl)),
+	}
+
+	return result, err
+}
+
+// testVersion  What the testUpstream hands back for a key on it's nth fetch
+func testVersion(key string, version int32) string {
+	return fmt.Sprintf("%s-%d", key, version)
+}
+
+// testRefreshAhead  Refresh in the last quarter of testStaleTtl
+func testRefreshAhead() float64 {
+	return 0.25
+}
+
+// testShortUpstreamTtl  A ttl upstream that's well inside testRefreshAhead of testStaleTtl, so the cache's entry lives only a fraction as long as it's own ttl.
+func testShortUpstreamTtl() time.Duration {
+	return testStaleTtl() / 10
+}
+
+// testNegativeTtl  How long missing keys are remembered as missing, on a fake clock.  Shorter than testStaleTtl.
+func testNegativeTtl() time.Duration {
+	return time.Second
+}
+
+// testUpstreamTtls  What the cache's ttl for an entry should be, given the key's ttl upstream, and whether it's being ignored.  testStaleTtl is the cache's own.
+func testUpstreamTtls() map[string]struct {
+	upstream time.Duration
+	ignore   bool
+	expected time.Duration
+} {
+	return map[string]struct {
+		upstream time.Duration
+		ignore   bool
+		expected time.Duration
+	}{
+		"no upstream ttl":      {0, false, testStaleTtl()},
+		"shorter upstream ttl": {time.Millisecond * 200, false, time.Millisecond * 200},
+		"longer upstream ttl":  {time.Hour, false, testStaleTtl()},
+		"ignored upstream ttl": {time.Millisecond * 200, true, testStaleTtl()},
+	}
 }
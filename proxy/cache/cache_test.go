@@ -1,14 +1,20 @@
 package cache
 
 import (
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestCache_Get(t *testing.T) {
-	c := NewCache(3, time.Second*3, unitTestFetchFunc, time.Second*1, "")
+	clock := NewFakeClock(testEpoch())
+
+	c := NewCache(3, time.Second*3, unitTestFetchFunc, time.Second*1, "", WithClock(clock))
 
 	key := testFoo()
 
@@ -24,9 +30,9 @@ func TestCache_Get(t *testing.T) {
 
 	assert.Equal(t, expected, actual, "fetched string matches expectations")
 
-	ttl1 := time.Now().Sub(entry.Expires)
+	ttl1 := entry.Remaining()
 
-	time.Sleep(time.Second * 1)
+	clock.Advance(time.Second * 1)
 
 	entry, err = c.Get(key)
 
@@ -34,11 +40,11 @@ func TestCache_Get(t *testing.T) {
 
 	assert.Equal(t, expected, actual, "fetched string matches expectations")
 
-	ttl2 := time.Now().Sub(entry.Expires)
+	ttl2 := entry.Remaining()
 
-	assert.True(t, ttl2 > ttl1, "Time to live is indeed winding down.")
+	assert.Equal(t, ttl1-time.Second, ttl2, "Time to live is indeed winding down.")
 
-	time.Sleep(time.Second * 2)
+	clock.Advance(time.Second * 2)
 
 	assert.False(t, entry.Fresh(), "Entry has expired")
 
@@ -108,3 +114,628 @@ func TestCache_CacheLimit(t *testing.T) {
 
 	assert.True(t, len(c.Entries) == 3, "three entries in cache")
 }
+
+func TestCache_ByteLimit(t *testing.T) {
+	c := NewCache(0, time.Hour, blobTestFetchFunc, time.Second*1, "", WithMaxBytes(testByteBudget()))
+
+	for _, key := range testBlobKeys() {
+		entry, err := c.Get(key)
+		if err != nil {
+			log.Printf("Error fetching key %s: %s", key, err)
+			t.Fail()
+		}
+
+		assert.NotNil(t, entry, "got an entry for %s", key)
+		assert.True(t, c.Bytes() <= testByteBudget(), "cache is within it's byte budget after %s", key)
+	}
+
+	assert.Equal(t, testBlobsThatFit(), c.Len(), "as many entries as fit in the budget")
+
+	var total int64
+	for _, entry := range c.Entries {
+		total += entry.Size
+	}
+
+	assert.Equal(t, total, c.Bytes(), "running total matches the entries")
+
+	last := testBlobKeys()[len(testBlobKeys())-1]
+	size := c.Entries[last].Size
+
+	assert.True(t, c.Delete(last), "deleted the newest entry")
+	assert.Equal(t, total-size, c.Bytes(), "deleting gives the bytes back")
+}
+
+func TestCache_ByteAndCountLimit(t *testing.T) {
+	// plenty of bytes, few entries.  The count limit still wins.
+	c := NewCache(2, time.Hour, blobTestFetchFunc, time.Second*1, "", WithMaxBytes(testByteBudget()))
+
+	for _, key := range testBlobKeys() {
+		_, err := c.Get(key)
+		if err != nil {
+			log.Printf("Error fetching key %s: %s", key, err)
+			t.Fail()
+		}
+	}
+
+	assert.Equal(t, 2, c.Len(), "count limit holds with a byte limit too")
+	assert.True(t, c.Bytes() <= testByteBudget(), "byte limit holds with a count limit too")
+}
+
+func TestCache_TooBigToCache(t *testing.T) {
+	c := NewCache(0, time.Hour, blobTestFetchFunc, time.Second*1, "", WithMaxBytes(int64(testBlobSize()/2)))
+
+	entry, err := c.Get(testFoo())
+	if err != nil {
+		log.Printf("Error fetching key %s: %s", testFoo(), err)
+		t.Fail()
+	}
+
+	if assert.NotNil(t, entry, "a value too big to cache is still handed back") {
+		assert.Equal(t, testBlobSize(), len(entry.Value.(string)), "handed back the whole value")
+	}
+
+	assert.Equal(t, 0, c.Len(), "but not cached")
+	assert.Equal(t, int64(0), c.Bytes(), "and not counted")
+}
+
+// staleTestCache  A cache on a fake clock, over a testUpstream, with whatever stale options the test wants.
+func staleTestCache(gated bool, options ...Option) (c *Cache, clock *FakeClock, upstream *testUpstream) {
+	clock = NewFakeClock(testEpoch())
+	upstream = newTestUpstream(gated)
+
+	options = append([]Option{WithClock(clock), WithLogger(testQuietLogger())}, options...)
+
+	c = NewCache(3, testStaleTtl(), upstream.fetch, time.Second*1, "", options...)
+
+	return c, clock, upstream
+}
+
+func TestCache_StaleWhileRevalidate(t *testing.T) {
+	c, clock, upstream := staleTestCache(true, WithStaleWhileRevalidate(testStaleGrace()))
+
+	upstream.allow(1)
+
+	entry, err := c.Get(testFoo())
+	if assert.Nil(t, err, "no error on first fetch") {
+		assert.Equal(t, testVersion(testFoo(), 1), entry.Value, "first fetch gets the first version")
+		assert.False(t, entry.Stale, "first fetch isn't stale")
+	}
+
+	clock.Advance(testStaleTtl() + time.Second)
+
+	// The refresh is held at the gate, so every one of these gets the stale entry, and there's only the one refresh.
+	for i := 0; i < testWaiters(); i++ {
+		entry, err = c.Get(testFoo())
+		if assert.Nil(t, err, "no error serving stale") {
+			assert.Equal(t, testVersion(testFoo(), 1), entry.Value, "stale get gets the old version")
+			assert.True(t, entry.Stale, "stale get is marked stale")
+		}
+	}
+
+	refreshing := waitFor(func() bool {
+		return upstream.Calls() == 2
+	})
+
+	assert.True(t, refreshing, "a refresh was started")
+	assert.Equal(t, int32(2), upstream.Calls(), "only one refresh was started")
+
+	c.RLock()
+	assert.False(t, c.Entries[testFoo()].Stale, "the entry in the cache isn't marked stale, only the copies")
+	c.RUnlock()
+
+	upstream.allow(1)
+
+	refreshed := waitFor(func() bool {
+		entry, err := c.Get(testFoo())
+		return err == nil && !entry.Stale
+	})
+
+	if assert.True(t, refreshed, "refresh landed") {
+		entry, _ = c.Get(testFoo())
+		assert.Equal(t, testVersion(testFoo(), 2), entry.Value, "and brought the new version")
+	}
+
+	// Too stale to serve, so back to waiting on the fetch.
+	clock.Advance(testStaleTtl() + testStaleGrace())
+	upstream.allow(1)
+
+	entry, err = c.Get(testFoo())
+	if assert.Nil(t, err, "no error fetching past the grace period") {
+		assert.Equal(t, testVersion(testFoo(), 3), entry.Value, "past the grace period gets a new version")
+		assert.False(t, entry.Stale, "and it isn't stale")
+	}
+}
+
+func TestCache_StaleWhileRevalidateMissing(t *testing.T) {
+	c, clock, upstream := staleTestCache(false, WithStaleWhileRevalidate(testStaleGrace()))
+
+	_, err := c.Get(testFoo())
+	assert.Nil(t, err, "no error on first fetch")
+
+	atomic.StoreInt32(&upstream.missing, 1)
+	clock.Advance(testStaleTtl() + time.Second)
+
+	entry, err := c.Get(testFoo())
+	if assert.Nil(t, err, "no error serving stale") {
+		assert.True(t, entry.Stale, "stale get is marked stale")
+	}
+
+	gone := waitFor(func() bool {
+		return c.Len() == 0
+	})
+
+	assert.True(t, gone, "refresh that finds the key missing takes the stale entry away")
+
+	entry, err = c.Get(testFoo())
+	assert.Nil(t, err, "no error for a missing key")
+	assert.Nil(t, entry, "missing key is missing")
+}
+
+func TestCache_StaleIfError(t *testing.T) {
+	c, clock, upstream := staleTestCache(false, WithStaleIfError(testStaleGrace()))
+
+	_, err := c.Get(testFoo())
+	assert.Nil(t, err, "no error on first fetch")
+
+	atomic.StoreInt32(&upstream.failing, 1)
+	clock.Advance(testStaleTtl() + time.Second)
+
+	entry, err := c.Get(testFoo())
+	if assert.Nil(t, err, "a failed fetch serves stale, not an error") {
+		assert.Equal(t, testVersion(testFoo(), 1), entry.Value, "the last good version")
+		assert.True(t, entry.Stale, "marked stale")
+	}
+
+	assert.Equal(t, 1, c.Len(), "stale entry is kept while upstream is failing")
+
+	clock.Advance(testStaleGrace())
+
+	entry, err = c.Get(testFoo())
+	assert.NotNil(t, err, "too stale to serve, so the error comes through")
+	assert.Nil(t, entry, "and no entry")
+	assert.Equal(t, 0, c.Len(), "too stale entry is gone")
+
+	atomic.StoreInt32(&upstream.failing, 0)
+
+	entry, err = c.Get(testFoo())
+	if assert.Nil(t, err, "upstream is back") {
+		assert.Equal(t, testVersion(testFoo(), 4), entry.Value, "with a new version")
+		assert.False(t, entry.Stale, "that isn't stale")
+	}
+}
+
+func TestCache_ExpiredRefetch(t *testing.T) {
+	c, clock, upstream := staleTestCache(true)
+
+	upstream.allow(1)
+
+	_, err := c.Get(testFoo())
+	assert.Nil(t, err, "no error on first fetch")
+
+	clock.Advance(testStaleTtl() + time.Second)
+
+	// The refetch is held at the gate, so everybody finds the expired entry, or none at all once it's swept
+	var wg sync.WaitGroup
+
+	for i := 0; i < testWaiters(); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			entry, err := c.Get(testFoo())
+			if assert.Nil(t, err, "no error refetching") {
+				assert.Equal(t, testVersion(testFoo(), 2), entry.Value, "everybody gets the refetched version")
+			}
+		}()
+	}
+
+	refetching := waitFor(func() bool {
+		return upstream.Calls() == 2
+	})
+
+	assert.True(t, refetching, "a refetch was started")
+	assert.Equal(t, 1, c.Sweep(), "the sweeper can still have the expired entry")
+
+	upstream.allow(1)
+	wg.Wait()
+
+	assert.Equal(t, int32(2), upstream.Calls(), "only one refetch")
+	assert.Equal(t, uint64(1), c.Stats().Expirations, "the entry expired once, however many found it so")
+	assert.Equal(t, 1, c.Len(), "and the refetched entry is in the cache")
+	assert.Equal(t, 1, c.Policy.Len(), "as far as the policy knows too")
+}
+
+func TestCache_RefreshAhead(t *testing.T) {
+	c, clock, upstream := staleTestCache(true, WithRefreshAhead(testRefreshAhead()))
+
+	upstream.allow(1)
+
+	_, err := c.Get(testFoo())
+	assert.Nil(t, err, "no error on first fetch")
+
+	// not yet in the last quarter
+	clock.Advance(testStaleTtl() / 2)
+
+	entry, err := c.Get(testFoo())
+	if assert.Nil(t, err, "no error on a hit") {
+		assert.Equal(t, testVersion(testFoo(), 1), entry.Value, "a hit is a hit")
+	}
+
+	assert.Equal(t, Stats{Hits: 1, Misses: 1}, c.Stats(), "no refresh this early")
+
+	// into the last quarter.  Every read gets the current entry, but there's only one refresh, as it's held up at the gate.
+	clock.Advance(testStaleTtl() / 3)
+
+	for i := 0; i < testWaiters(); i++ {
+		entry, err = c.Get(testFoo())
+		if assert.Nil(t, err, "no error on a hit") {
+			assert.Equal(t, testVersion(testFoo(), 1), entry.Value, "reads don't wait on the refresh")
+			assert.False(t, entry.Stale, "nor are they stale")
+		}
+	}
+
+	assert.Equal(t, uint64(1), c.Stats().RefreshAheads, "one refresh issued")
+
+	upstream.allow(1)
+
+	refreshed := waitFor(func() bool {
+		c.RLock()
+		defer c.RUnlock()
+
+		return c.Entries[testFoo()].Value == testVersion(testFoo(), 2)
+	})
+
+	assert.True(t, refreshed, "refresh landed")
+	assert.Equal(t, uint64(0), c.Stats().UsefulRefreshAheads, "refresh hasn't been used yet")
+
+	// the original would have expired by now, but the refreshed one hasn't
+	clock.Advance(testStaleTtl() / 3)
+
+	entry, err = c.Get(testFoo())
+	if assert.Nil(t, err, "no error on a hit") {
+		assert.Equal(t, testVersion(testFoo(), 2), entry.Value, "a hot key never expires")
+	}
+
+	_, err = c.Get(testFoo())
+	assert.Nil(t, err, "no error on a hit")
+
+	assert.Equal(t, Stats{Hits: uint64(testWaiters()) + 3, Misses: 1, RefreshAheads: 1, UsefulRefreshAheads: 1}, c.Stats(), "refresh was useful, once")
+	assert.Equal(t, int32(2), upstream.Calls(), "and that was all the fetching")
+}
+
+func TestCache_RefreshAheadShortUpstreamTtl(t *testing.T) {
+	c, clock, upstream := staleTestCache(true, WithRefreshAhead(testRefreshAhead()))
+	upstream.ttl = int64(testShortUpstreamTtl())
+
+	upstream.allow(1)
+
+	_, err := c.Get(testFoo())
+	assert.Nil(t, err, "no error on first fetch")
+
+	// only just fetched, so nowhere near the end of it's life, short as that is
+	for i := 0; i < testWaiters(); i++ {
+		_, err = c.Get(testFoo())
+		assert.Nil(t, err, "no error on a hit")
+	}
+
+	assert.Equal(t, uint64(0), c.Stats().RefreshAheads, "no refresh this early")
+
+	// into the last quarter of the entry's life
+	clock.Advance(testShortUpstreamTtl() * 4 / 5)
+
+	for i := 0; i < testWaiters(); i++ {
+		_, err = c.Get(testFoo())
+		assert.Nil(t, err, "no error on a hit")
+	}
+
+	assert.Equal(t, uint64(1), c.Stats().RefreshAheads, "one refresh issued")
+
+	upstream.allow(1)
+
+	refreshed := waitFor(func() bool {
+		c.RLock()
+		defer c.RUnlock()
+
+		return c.Entries[testFoo()].Value == testVersion(testFoo(), 2)
+	})
+
+	assert.True(t, refreshed, "refresh landed")
+
+	// and the refreshed entry starts a window of it's own
+	for i := 0; i < testWaiters(); i++ {
+		_, err = c.Get(testFoo())
+		assert.Nil(t, err, "no error on a hit")
+	}
+
+	assert.Equal(t, uint64(1), c.Stats().RefreshAheads, "one refresh per window")
+	assert.Equal(t, int32(2), upstream.Calls(), "and that was all the fetching")
+}
+
+func TestCache_NegativeCaching(t *testing.T) {
+	c, clock, upstream := staleTestCache(false, WithNegativeTtl(testNegativeTtl()))
+
+	atomic.StoreInt32(&upstream.missing, 1)
+
+	entry, err := c.Get(testFoo())
+	assert.Nil(t, err, "no error for a missing key")
+	if assert.NotNil(t, entry, "missing key gets a negative entry") {
+		assert.True(t, entry.Negative, "marked negative")
+		assert.True(t, entry.Missing(), "and missing")
+		assert.Nil(t, entry.Value, "with no value")
+	}
+
+	for i := 0; i < testWaiters(); i++ {
+		entry, err = c.Get(testFoo())
+		assert.Nil(t, err, "no error for a missing key")
+		assert.True(t, entry.Missing(), "still missing")
+	}
+
+	assert.Equal(t, int32(1), upstream.Calls(), "missing key was only looked for once")
+	assert.Equal(t, Stats{Hits: uint64(testWaiters()), Misses: 1, NegativeHits: uint64(testWaiters()), NegativeEntries: 1}, c.Stats(), "negative hits and entries are counted")
+
+	// the key turns up upstream, and we notice once the negative entry expires
+	atomic.StoreInt32(&upstream.missing, 0)
+	clock.Advance(testNegativeTtl())
+
+	entry, err = c.Get(testFoo())
+	if assert.Nil(t, err, "no error for a present key") {
+		assert.False(t, entry.Missing(), "key isn't missing any more")
+		assert.Equal(t, testVersion(testFoo(), 2), entry.Value, "and has a value")
+	}
+
+	assert.Equal(t, 0, c.Stats().NegativeEntries, "a negative entry replaced by a real one isn't counted")
+
+	// negative entries can be purged like any other
+	atomic.StoreInt32(&upstream.missing, 1)
+
+	entry, err = c.Get(testBar())
+	assert.Nil(t, err, "no error for a missing key")
+	assert.True(t, entry.Missing(), "missing key is missing")
+	assert.Equal(t, 1, c.Stats().NegativeEntries, "negative entry is counted")
+
+	assert.True(t, c.Delete(testBar()), "negative entry can be deleted")
+	assert.Equal(t, 0, c.Stats().NegativeEntries, "deleted negative entry isn't counted")
+}
+
+func TestCache_NoNegativeCaching(t *testing.T) {
+	c, _, upstream := staleTestCache(false)
+
+	atomic.StoreInt32(&upstream.missing, 1)
+
+	for i := 0; i < 3; i++ {
+		entry, err := c.Get(testFoo())
+		assert.Nil(t, err, "no error for a missing key")
+		assert.Nil(t, entry, "no entry for a missing key")
+	}
+
+	assert.Equal(t, int32(3), upstream.Calls(), "without negative caching, missing keys are looked for every time")
+	assert.Equal(t, 0, c.Len(), "and nothing is cached")
+}
+
+func TestCache_UpstreamTtl(t *testing.T) {
+	for name, tc := range testUpstreamTtls() {
+		options := make([]Option, 0)
+		if tc.ignore {
+			options = append(options, WithIgnoreUpstreamTtl())
+		}
+
+		c, clock, upstream := staleTestCache(false, options...)
+		upstream.ttl = int64(tc.upstream)
+
+		entry, err := c.Get(testFoo())
+		if assert.Nil(t, err, "no error fetching for %s", name) {
+			assert.Equal(t, clock.Now().Add(tc.expected), entry.Expires, "expiry is as expected for %s", name)
+		}
+	}
+}
+
+// fetchConcurrently  Fires off testWaiters() simultaneous fetches of a key, and collects what they got back.
+func fetchConcurrently(c *Cache, key string) (entries []*CacheEntry, errs []error) {
+	entries = make([]*CacheEntry, testWaiters())
+	errs = make([]error, testWaiters())
+
+	start := make(chan struct{})
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < testWaiters(); i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			entries[i], errs[i] = c.Fetch(key)
+		}(i)
+	}
+
+	close(start)
+	wg.Wait()
+
+	return entries, errs
+}
+
+func TestCache_FetchCoalesces(t *testing.T) {
+	var calls int32
+
+	c := NewCache(3, time.Second*3, slowTestFetchFunc(&calls), time.Second*1, "")
+
+	entries, errs := fetchConcurrently(c, testFoo())
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "concurrent fetches of one key hit upstream once")
+
+	for i := range entries {
+		assert.Nil(t, errs[i], "no errors")
+		if assert.NotNil(t, entries[i], "got an entry") {
+			assert.Equal(t, testFoo(), entries[i].Value, "fetched string matches expectations")
+			assert.True(t, entries[i] == entries[0], "everybody shares the same entry")
+		}
+	}
+
+	// once that fetch is done, the next one goes upstream again
+	_, err := c.Fetch(testFoo())
+	assert.Nil(t, err, "no error on the follow up fetch")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "fetch after the first completed goes upstream")
+}
+
+func TestCache_FetchCoalescesErrors(t *testing.T) {
+	var calls int32
+
+	c := NewCache(3, time.Second*3, failingTestFetchFunc(&calls), time.Second*1, "")
+
+	entries, errs := fetchConcurrently(c, testFoo())
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "concurrent failing fetches hit upstream once")
+
+	for i := range entries {
+		assert.Nil(t, entries[i], "no entry on error")
+		if assert.NotNil(t, errs[i], "everybody gets the error") {
+			assert.Contains(t, errs[i].Error(), testFetchError().Error(), "it's the upstream error")
+		}
+	}
+}
+
+func TestCache_FetchTimeout(t *testing.T) {
+	var calls int32
+
+	clock := NewFakeClock(testEpoch())
+	release := make(chan struct{})
+
+	c := NewCache(3, time.Second*3, gatedTestFetchFunc(&calls, release), testShortTimeout(), "", WithClock(clock))
+
+	done := make(chan struct{})
+
+	var entries []*CacheEntry
+	var errs []error
+
+	go func() {
+		entries, errs = fetchConcurrently(c, testFoo())
+		close(done)
+	}()
+
+	// everybody has to be waiting before the clock moves, or some would start their timers after it had
+	waiting := waitFor(func() bool {
+		return clock.Pending() == testWaiters()
+	})
+
+	if !waiting {
+		t.Fatalf("Only %d of %d fetches started waiting", clock.Pending(), testWaiters())
+	}
+
+	clock.Advance(testShortTimeout())
+	<-done
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "timed out fetches still only hit upstream once")
+	assert.Equal(t, uint64(testWaiters()), c.Stats().FetchTimeouts, "and every time out was counted")
+
+	for i := range entries {
+		assert.Nil(t, entries[i], "no entry on timeout")
+		if assert.NotNil(t, errs[i], "everybody times out") {
+			assert.Contains(t, errs[i].Error(), "Timeout", "it's a timeout error")
+			assert.Equal(t, ErrFetchTimeout, errors.Cause(errs[i]), "and says so")
+		}
+	}
+
+	// The fetch that everyone gave up on still lands in the cache.
+	close(release)
+
+	landed := waitFor(func() bool {
+		return c.Len() == 1
+	})
+
+	assert.True(t, landed, "slow fetch landed in the cache")
+
+	entry, err := c.Get(testFoo())
+	assert.Nil(t, err, "no error once the slow fetch has landed")
+	if assert.NotNil(t, entry, "slow fetch populated the cache") {
+		assert.Equal(t, testFoo(), entry.Value, "fetched string matches expectations")
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "and that was served from the cache")
+}
+
+// TestCache_ConcurrentStress hammers the cache from a bunch of goroutines at once, with hits, misses, promotions, expiry and eviction all happening concurrently.  Run it with -race.
+func TestCache_ConcurrentStress(t *testing.T) {
+	c := NewCache(testStressCapacity(), testStressTtl(), keyTestFetchFunc, time.Second*1, "")
+
+	keys := testStressKeys()
+
+	var overLimit int32
+
+	wg := sync.WaitGroup{}
+
+	for w := 0; w < testStressWorkers(); w++ {
+		wg.Add(1)
+
+		go func(seed int64) {
+			defer wg.Done()
+
+			r := rand.New(rand.NewSource(seed))
+
+			for i := 0; i < testStressIterations(); i++ {
+				// skew towards the front of the key space, so there are hits as well as misses
+				key := keys[r.Intn(1+r.Intn(len(keys)))]
+
+				entry, err := c.Get(key)
+				if err != nil {
+					log.Printf("Error fetching key %s: %s", key, err)
+					t.Fail()
+					continue
+				}
+
+				if entry == nil || entry.Value != key {
+					log.Printf("Wrong entry for %s: %v", key, entry)
+					t.Fail()
+				}
+
+				if c.Len() > testStressCapacity() {
+					atomic.AddInt32(&overLimit, 1)
+				}
+			}
+		}(int64(w))
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&overLimit), "cache never went over MaxEntries")
+
+	c.RLock()
+	defer c.RUnlock()
+
+	assert.True(t, len(c.Entries) <= testStressCapacity(), "cache is within MaxEntries")
+	assert.Equal(t, len(c.Entries), c.Policy.Len(), "entry map and eviction policy agree")
+}
+
+func TestCache_Lookup(t *testing.T) {
+	c, clock, _ := staleTestCache(false, WithStaleWhileRevalidate(testStaleGrace()))
+
+	_, hit, err := c.Lookup(testFoo())
+	assert.Nil(t, err, "no error on the first lookup")
+	assert.False(t, hit, "the first lookup is a miss")
+
+	_, hit, err = c.Lookup(testFoo())
+	assert.Nil(t, err, "no error on the second lookup")
+	assert.True(t, hit, "the second is a hit")
+
+	clock.Advance(testStaleTtl() + time.Second)
+
+	entry, hit, err := c.Lookup(testFoo())
+	assert.Nil(t, err, "no error on a stale lookup")
+	assert.True(t, hit && entry.Stale, "a stale entry out of the cache is a hit too")
+}
+
+func TestCache_Fetched(t *testing.T) {
+	c, clock, _ := staleTestCache(false)
+
+	entry, err := c.Get(testFoo())
+	if assert.Nil(t, err, "no error fetching") {
+		assert.Equal(t, clock.Now(), entry.Fetched, "the entry knows when it was fetched")
+		assert.Equal(t, ContentHash(testVersion(testFoo(), 1)), entry.Hash, "and has it's value's hash")
+	}
+
+	clock.Advance(time.Second)
+
+	entry, err = c.Get(testFoo())
+	if assert.Nil(t, err, "no error getting") {
+		assert.Equal(t, time.Second, entry.Age(), "it's aged since")
+	}
+}
@@ -0,0 +1,204 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock  Where the cache gets the time from.  Normally that's the system clock, but tests can swap in a FakeClock, and have time pass as fast or as slow as they like.
+type Clock interface {
+	// Now  The current time.
+	Now() time.Time
+
+	// NewTicker  A ticker that ticks every d, as time.NewTicker.
+	NewTicker(d time.Duration) Ticker
+
+	// NewTimer  A timer that goes off once, after d, as time.NewTimer.
+	NewTimer(d time.Duration) Timer
+}
+
+// Ticker  Delivers ticks of a Clock.
+type Ticker interface {
+	// Chan  The channel the ticks arrive on.
+	Chan() <-chan time.Time
+
+	// Stop  Stops the ticks.  The channel isn't closed, just as with time.Ticker.
+	Stop()
+}
+
+// Timer  Delivers a single tick of a Clock.
+type Timer interface {
+	// Chan  The channel the tick arrives on.
+	Chan() <-chan time.Time
+
+	// Stop  Stops the timer, if it hasn't gone off already.
+	Stop()
+}
+
+// SystemClock  The real clock, courtesy of the time package.
+type SystemClock struct{}
+
+// Now  time.Now()
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTicker  time.NewTicker()
+func (SystemClock) NewTicker(d time.Duration) Ticker {
+	return &systemTicker{ticker: time.NewTicker(d)}
+}
+
+// NewTimer  time.NewTimer()
+func (SystemClock) NewTimer(d time.Duration) Timer {
+	return &systemTimer{timer: time.NewTimer(d)}
+}
+
+// systemTicker  A time.Ticker, dressed up as a Ticker.
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *systemTicker) Chan() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *systemTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// systemTimer  A time.Timer, dressed up as a Timer.
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t *systemTimer) Chan() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t *systemTimer) Stop() {
+	t.timer.Stop()
+}
+
+// FakeClock  A clock that only moves when it's told to.  Tickers tick, and timers go off, as Advance carries the time past them.
+type FakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFakeClock  Creates a FakeClock, stopped at the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now:     now,
+		tickers: make([]*fakeTicker, 0),
+	}
+}
+
+// Now  The time the clock is stopped at.
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+// NewTicker  A ticker that ticks whenever the clock is advanced past the next multiple of d.
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t := &fakeTicker{
+		clock:  c,
+		c:      make(chan time.Time, 1),
+		period: d,
+		next:   c.now.Add(d),
+	}
+
+	c.tickers = append(c.tickers, t)
+
+	return t
+}
+
+// NewTimer  A timer that goes off once the clock is advanced by d or more.
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t := &fakeTicker{
+		clock:   c,
+		c:       make(chan time.Time, 1),
+		next:    c.now.Add(d),
+		oneShot: true,
+	}
+
+	c.tickers = append(c.tickers, t)
+
+	return t
+}
+
+// Pending  How many tickers and timers are waiting on the clock.  Handy for a test that needs to know somebody has started waiting before it moves the time on.
+func (c *FakeClock) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.tickers)
+}
+
+// Advance  Moves the clock on by d, ticking any tickers on the way.  Like a time.Ticker, a ticker that isn't being read drops ticks rather than queueing them up.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+
+	pending := make([]*fakeTicker, 0)
+
+	for _, t := range c.tickers {
+		for !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+
+			if t.oneShot {
+				break
+			}
+
+			t.next = t.next.Add(t.period)
+		}
+
+		// timers that have gone off are done with
+		if t.oneShot && !t.next.After(c.now) {
+			continue
+		}
+
+		pending = append(pending, t)
+	}
+
+	c.tickers = pending
+}
+
+// fakeTicker  A Ticker, or if it's oneShot, a Timer, driven by a FakeClock.
+type fakeTicker struct {
+	clock   *FakeClock
+	c       chan time.Time
+	period  time.Duration
+	next    time.Time
+	oneShot bool
+}
+
+func (t *fakeTicker) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	for i, ticker := range t.clock.tickers {
+		if ticker == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			return
+		}
+	}
+}
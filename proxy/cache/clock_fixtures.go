@@ -0,0 +1,18 @@
+package cache
+
+import "time"
+
+// testEpoch  When fake clocks start.  Any time will do, so long as it's always the same one.
+func testEpoch() time.Time {
+	return time.Date(2017, time.September, 1, 12, 0, 0, 0, time.UTC)
+}
+
+// testTickInterval  How often fake tickers tick
+func testTickInterval() time.Duration {
+	return time.Second * 10
+}
+
+// testRealWait  How long, in real time, to give a goroutine to notice that a fake clock has moved
+func testRealWait() time.Duration {
+	return time.Second * 2
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// waitFor  Polls until cond is true, or we get bored.  For waiting on goroutines that a FakeClock has woken up, in real time.
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(testRealWait())
+
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	return false
+}
+
+func TestFakeClock(t *testing.T) {
+	clock := NewFakeClock(testEpoch())
+
+	ticker := clock.NewTicker(testTickInterval())
+
+	clock.Advance(testTickInterval() / 2)
+
+	select {
+	case <-ticker.Chan():
+		t.Errorf("ticked early")
+	default:
+	}
+
+	clock.Advance(testTickInterval() * 3)
+
+	select {
+	case tick := <-ticker.Chan():
+		assert.Equal(t, testEpoch().Add(testTickInterval()), tick, "first tick is at the first interval")
+	default:
+		t.Errorf("didn't tick")
+	}
+
+	select {
+	case <-ticker.Chan():
+		t.Errorf("ticks queued up, rather than being dropped")
+	default:
+	}
+
+	assert.Equal(t, testEpoch().Add(testTickInterval()*7/2), clock.Now(), "clock moved on by what it was advanced")
+
+	ticker.Stop()
+	clock.Advance(testTickInterval())
+
+	select {
+	case <-ticker.Chan():
+		t.Errorf("ticked after being stopped")
+	default:
+	}
+}
+
+func TestFakeClock_Timer(t *testing.T) {
+	clock := NewFakeClock(testEpoch())
+
+	timer := clock.NewTimer(testTickInterval())
+	stopped := clock.NewTimer(testTickInterval())
+
+	assert.Equal(t, 2, clock.Pending(), "both timers are waiting")
+
+	stopped.Stop()
+
+	assert.Equal(t, 1, clock.Pending(), "stopped timer isn't")
+
+	clock.Advance(testTickInterval() - time.Nanosecond)
+
+	select {
+	case <-timer.Chan():
+		t.Errorf("went off early")
+	default:
+	}
+
+	clock.Advance(time.Nanosecond)
+
+	select {
+	case tick := <-timer.Chan():
+		assert.Equal(t, testEpoch().Add(testTickInterval()), tick, "went off on time")
+	default:
+		t.Errorf("didn't go off")
+	}
+
+	assert.Equal(t, 0, clock.Pending(), "a timer that's gone off isn't waiting any more")
+
+	clock.Advance(testTickInterval())
+
+	select {
+	case <-timer.Chan():
+		t.Errorf("went off twice")
+	case <-stopped.Chan():
+		t.Errorf("went off after being stopped")
+	default:
+	}
+}
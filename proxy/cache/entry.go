@@ -1,19 +1,53 @@
 package cache
 
 import (
+	"fmt"
+	"hash/fnv"
 	"time"
 )
 
+// entryOverhead  A rough guess at what an entry costs before counting it's key and value.  The entry itself, it's map slot, and it's place in the eviction policy.
+const entryOverhead = 128
+
 // CacheEntry  a struct representing a single cached entry
 type CacheEntry struct {
 	Expires time.Time
 	Value   interface{}
 	Key     string
+	// Type  What kind of value it is, in Redis' terms, as the FetchFunc said.  Empty if it didn't.
+	Type string
+	// Size  Roughly how many bytes the entry takes up, as worked out by EstimateSize.
+	Size int64
+	// Negative  The key doesn't exist upstream, and the entry is there to remember that.  It has no Value.
+	Negative bool
+	// Stale  Set on the copy Get hands back when it serves an entry past it's expiry.  Entries in the cache are never marked.
+	Stale bool
+	// Rule  The rule the key matched when it was fetched.  nil if it matched none.
+	Rule *Rule
+	// Fetched  When the value was fetched from upstream.
+	Fetched time.Time
+	// Hash  A hash of the value, as worked out by ContentHash, for telling one version of it from another.  Empty for negative entries.
+	Hash string
+	// Truncated  The Value is only the start of what's upstream, as the FetchFunc said.  Anything that needs the whole of it has to go upstream for it.
+	Truncated bool
+	// Hits  How many times the entry has been read from the cache since it was fetched.  Only to be trusted on a copy from Peek, since it's counted under the cache's lock.
+	Hits uint64
+	// clock  What the entry tells the time by.  The system clock if it's not set.
+	clock Clock
+	// refreshedAhead  Whether the entry came from a refresh ahead, and hasn't been read since.
+	refreshedAhead bool
+	// expired  Whether the entry's been counted as expired, and is only waiting on the fetch that'll replace it.
+	expired bool
+}
+
+// Missing  True if there's no value to be had, because there's no entry at all, or it's a negative one.
+func (e *CacheEntry) Missing() bool {
+	return e == nil || e.Negative
 }
 
 // Fresh  Returns true if the current time is less than the entry's expiration.  Returns false otherwise.
 func (e *CacheEntry) Fresh() bool {
-	ttl := time.Now().Sub(e.Expires)
+	ttl := e.now().Sub(e.Expires)
 
 	if ttl < 0 {
 		return true
@@ -21,3 +55,96 @@ func (e *CacheEntry) Fresh() bool {
 
 	return false
 }
+
+// Remaining  How long until the entry expires.  Never less than 0.
+func (e *CacheEntry) Remaining() time.Duration {
+	remaining := e.Expires.Sub(e.now())
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return remaining
+}
+
+// Age  How long since the value was fetched.
+func (e *CacheEntry) Age() time.Duration {
+	return e.now().Sub(e.Fetched)
+}
+
+// staleCopy  A copy of the entry, marked stale, for handing out.  The caller is responsible for holding the cache's lock.
+func (e *CacheEntry) staleCopy() *CacheEntry {
+	stale := *e
+	stale.Stale = true
+
+	return &stale
+}
+
+// now  The time by the entry's clock.
+func (e *CacheEntry) now() time.Time {
+	if e.clock == nil {
+		return time.Now()
+	}
+
+	return e.clock.Now()
+}
+
+// ContentHash  A hash of a value, as 16 hex digits.  Strings and byte slices hash their bytes, and anything else it's printed form, which for maps has the keys in order, so the same value always hashes the same.  It's FNV, which is fast, and plenty good enough to tell versions of a value apart, but no good for anything to do with security.
+func ContentHash(value interface{}) string {
+	h := fnv.New64a()
+
+	switch v := value.(type) {
+	case string:
+		h.Write([]byte(v))
+	case []byte:
+		h.Write(v)
+	default:
+		fmt.Fprintf(h, "%T %v", v, v)
+	}
+
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// EstimateSize  Roughly how many bytes an entry for key and value would take up.  Strings and byte slices count their length, collections count their contents, and anything else counts however long it is when printed.  It's an estimate, not an accounting, but it's consistent, which is what matters for keeping the cache under a budget.
+func EstimateSize(key string, value interface{}) int64 {
+	return entryOverhead + int64(len(key)) + valueSize(value)
+}
+
+// valueSize  The size of just the value, recursing into collections.
+func valueSize(value interface{}) int64 {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(len(v))
+	case []byte:
+		return int64(len(v))
+	case []string:
+		var size int64
+		for _, s := range v {
+			size += int64(len(s)) + 16
+		}
+		return size
+	case []interface{}:
+		var size int64
+		for _, item := range v {
+			size += valueSize(item) + 16
+		}
+		return size
+	case map[string]string:
+		var size int64
+		for k, item := range v {
+			size += int64(len(k)+len(item)) + 32
+		}
+		return size
+	case map[string]interface{}:
+		var size int64
+		for k, item := range v {
+			size += int64(len(k)) + valueSize(item) + 32
+		}
+		return size
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return 8
+	default:
+		return int64(len(fmt.Sprint(v)))
+	}
+}
@@ -22,11 +22,31 @@ func testKey() string {
 	return "fargle"
 }
 
-// testEntry  A fully formed CacheEntry to be used for testing
-func testEntry() CacheEntry {
+// testEntry  A fully formed CacheEntry to be used for testing, telling the time by the given clock
+func testEntry(clock Clock) CacheEntry {
 	return CacheEntry{
-		Expires: time.Now().Add(testInterval()),
+		Expires: clock.Now().Add(testInterval()),
 		Value:   testValue(),
 		Key:     testKey(),
+		Fetched: clock.Now(),
+		clock:   clock,
+	}
+}
+
+// testSizes  Values, and how much EstimateSize should count for them on top of the key and overhead
+func testSizes() map[string]struct {
+	value interface{}
+	size  int64
+} {
+	return map[string]struct {
+		value interface{}
+		size  int64
+	}{
+		"nil":    {nil, 0},
+		"string": {testValue(), int64(len(testValue()))},
+		"bytes":  {[]byte(testValue()), int64(len(testValue()))},
+		"int":    {10, 8},
+		"slice":  {[]string{"foo", "bar"}, 6 + 2*16},
+		"nested": {[]interface{}{"foo", []interface{}{"bar"}}, 3 + 16 + 3 + 16 + 16},
 	}
 }
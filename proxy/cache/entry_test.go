@@ -6,13 +6,44 @@ import (
 	"time"
 )
 
-// TestCacheEntry_Expired  Checks that a newly created entry is fresh, waits a few seconds for it to expire, and checks that it's expired
+// TestCacheEntry_Expired  Checks that a newly created entry is fresh, moves the clock on a few seconds for it to expire, and checks that it's expired
 func TestCacheEntry_Expired(t *testing.T) {
-	entry := testEntry()
+	clock := NewFakeClock(testEpoch())
+
+	entry := testEntry(clock)
 
 	assert.True(t, entry.Fresh(), "Test entry is still good")
+	assert.Equal(t, testInterval(), entry.Remaining(), "Test entry has it's whole ttl left")
+
+	clock.Advance(testInterval() - time.Nanosecond)
+
+	assert.True(t, entry.Fresh(), "Test entry is still good, just")
 
-	time.Sleep(time.Second * 3)
+	clock.Advance(time.Nanosecond)
 
 	assert.False(t, entry.Fresh(), "Test entry is expired")
+	assert.Equal(t, time.Duration(0), entry.Remaining(), "Test entry has no time left")
+	assert.Equal(t, testInterval(), entry.Age(), "Test entry is as old as it's ttl")
+}
+
+func TestEstimateSize(t *testing.T) {
+	for name, tc := range testSizes() {
+		expected := entryOverhead + int64(len(testKey())) + tc.size
+
+		assert.Equal(t, expected, EstimateSize(testKey(), tc.value), "size of %s", name)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	assert.Equal(t, ContentHash(testValue()), ContentHash([]byte(testValue())), "a string hashes the same as it's bytes")
+	assert.NotEqual(t, ContentHash(testValue()), ContentHash(testKey()), "different strings hash differently")
+	assert.Len(t, ContentHash(testValue()), 16, "hashes are 16 hex digits")
+
+	// maps have no order, but their hashes do
+	hash := ContentHash(map[string]string{"a": "1", "b": "2", "c": "3"})
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, hash, ContentHash(map[string]string{"c": "3", "b": "2", "a": "1"}), "the same map always hashes the same")
+	}
+
+	assert.NotEqual(t, ContentHash([]string{"1"}), ContentHash([]interface{}{"1"}), "values that print the same, but aren't, hash differently")
 }
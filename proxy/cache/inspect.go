@@ -0,0 +1,67 @@
+package cache
+
+// Keys  Every key in the cache, sub keys included, in no particular order.  Expired entries the janitor hasn't got to yet are in there too.
+func (c *Cache) Keys() (keys []string) {
+	c.RLock()
+	defer c.RUnlock()
+
+	keys = make([]string, 0, len(c.Entries))
+	for key := range c.Entries {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// Peek  A copy of a key's entry, as it is in the cache, or nil if there isn't one.  Unlike Get, it never fetches anything, and it doesn't count as a read, so the eviction policy, hit counts and refresh ahead are none the wiser.
+func (c *Cache) Peek(key string) (entry *CacheEntry) {
+	c.RLock()
+	defer c.RUnlock()
+
+	cached, ok := c.Entries[key]
+	if !ok {
+		return entry
+	}
+
+	peeked := *cached
+
+	return &peeked
+}
+
+// ForceRefresh  Fetches a key from upstream and caches it, however fresh the entry for it is.  A fetch of it that's already underway is left to finish, but isn't cached, since it may be from before whatever called for the refresh.  Waits for the fetch, as Fetch does.
+func (c *Cache) ForceRefresh(key string) (entry *CacheEntry, err error) {
+	c.fetchLock.Lock()
+
+	if underway, ok := c.inFlight[key]; ok {
+		underway.invalidated = true
+	}
+
+	call := c.newFetchCall(key, false)
+
+	c.fetchLock.Unlock()
+
+	go c.runFetch(key, call)
+
+	return c.await(key, call)
+}
+
+// Keys  The keys of every shard, all together.
+func (s *ShardedCache) Keys() (keys []string) {
+	keys = make([]string, 0)
+
+	for _, shard := range s.Shards {
+		keys = append(keys, shard.Keys()...)
+	}
+
+	return keys
+}
+
+// Peek  Just like Cache.Peek, from whichever shard owns the key.
+func (s *ShardedCache) Peek(key string) (entry *CacheEntry) {
+	return s.Shard(key).Peek(key)
+}
+
+// ForceRefresh  Just like Cache.ForceRefresh, on whichever shard owns the key.
+func (s *ShardedCache) ForceRefresh(key string) (entry *CacheEntry, err error) {
+	return s.Shard(key).ForceRefresh(key)
+}
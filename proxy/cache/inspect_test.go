@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCache_Keys(t *testing.T) {
+	s := NewShardedCache(4, 0, time.Second*3, unitTestFetchFunc, time.Second*5, "")
+	defer s.Close()
+
+	expected := []string{testBar(), testFoo(), testWip()}
+
+	for _, key := range expected {
+		_, err := s.Get(key)
+		assert.Nil(t, err, "no error fetching %s", key)
+	}
+
+	keys := s.Keys()
+	sort.Strings(keys)
+
+	assert.Equal(t, expected, keys, "every key, from every shard")
+}
+
+func TestCache_Peek(t *testing.T) {
+	clock := NewFakeClock(testEpoch())
+
+	c := NewCache(3, time.Second*3, unitTestFetchFunc, time.Second*5, "", WithClock(clock))
+	defer c.Close()
+
+	assert.Nil(t, c.Peek(testFoo()), "nothing to peek at before it's fetched")
+	assert.Equal(t, 0, c.Len(), "and peeking didn't fetch it")
+
+	for i := 0; i < 3; i++ {
+		_, err := c.Get(testFoo())
+		assert.Nil(t, err, "no error getting %s", testFoo())
+	}
+
+	clock.Advance(time.Second)
+
+	entry := c.Peek(testFoo())
+	if assert.NotNil(t, entry, "peeked at the entry") {
+		assert.Equal(t, testFoo(), entry.Value, "it has the value")
+		assert.Equal(t, uint64(2), entry.Hits, "the first get was a miss, and the other two hits")
+		assert.Equal(t, testEpoch(), entry.Fetched, "it was fetched when it was")
+		assert.Equal(t, time.Second, entry.Age(), "and is as old as it is")
+	}
+
+	entry = c.Peek(testFoo())
+	assert.Equal(t, uint64(2), entry.Hits, "peeking isn't a hit")
+
+	entry.Hits = 100
+	assert.Equal(t, uint64(2), c.Peek(testFoo()).Hits, "and what's peeked at is only a copy")
+}
+
+func TestCache_ForceRefresh(t *testing.T) {
+	c, _, upstream := staleTestCache(false)
+
+	_, err := c.Get(testFoo())
+	assert.Nil(t, err, "no error fetching")
+
+	entry, err := c.ForceRefresh(testFoo())
+	if assert.Nil(t, err, "no error refreshing") {
+		assert.Equal(t, testVersion(testFoo(), 2), entry.Value, "fresh as it was, it was fetched again")
+	}
+
+	entry, err = c.Get(testFoo())
+	if assert.Nil(t, err, "no error getting") {
+		assert.Equal(t, testVersion(testFoo(), 2), entry.Value, "and the new version was cached")
+	}
+
+	assert.Equal(t, int32(2), upstream.Calls(), "it took one trip upstream")
+}
+
+func TestCache_ForceRefreshInFlight(t *testing.T) {
+	c, _, upstream := staleTestCache(true)
+
+	results := make(chan *CacheEntry, 1)
+
+	go func() {
+		entry, _ := c.Get(testFoo())
+		results <- entry
+	}()
+
+	assert.True(t, waitFor(func() bool { return upstream.Calls() == 1 }), "fetch started")
+
+	refreshed := make(chan *CacheEntry, 1)
+
+	go func() {
+		entry, _ := c.ForceRefresh(testFoo())
+		refreshed <- entry
+	}()
+
+	assert.True(t, waitFor(func() bool { return upstream.Calls() == 2 }), "refresh didn't wait for the fetch underway")
+
+	// whichever comes back first, the fetch that was underway isn't cached
+	upstream.allow(2)
+	<-results
+
+	entry := <-refreshed
+	if assert.NotNil(t, entry, "refresh came back") {
+		assert.Equal(t, testVersion(testFoo(), 2), entry.Value, "with the second version")
+	}
+
+	cached := c.Peek(testFoo())
+	if assert.NotNil(t, cached, "something was cached") {
+		assert.Equal(t, testVersion(testFoo(), 2), cached.Value, "and it was what the refresh fetched")
+	}
+}
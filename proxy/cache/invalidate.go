@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"regexp"
+	"sync/atomic"
+)
+
+// Invalidate  Removes a key from the cache because it's changed upstream.  Unlike Delete, a fetch of the key that's already underway won't put it back, since what it fetched may be from before the change.  Any sub keys read from it go too.  Returns true if there was an entry to remove.
+func (c *Cache) Invalidate(key string) (removed bool) {
+	atomic.AddUint64(&c.counters.invalidations, 1)
+
+	removed, _ = c.purge(key, &c.counters.invalidated)
+
+	return removed
+}
+
+// Purge  Removes a key, and any sub keys read from it, because somebody said to.  Like Invalidate, a fetch that's already underway won't put them back, but it isn't counted as an invalidation.  Returns how many entries went.
+func (c *Cache) Purge(key string) (purged int) {
+	_, purged = c.purge(key, &c.counters.purges)
+
+	return purged
+}
+
+// purge  Does the work of Invalidate and Purge.  removed says whether the key itself was there, and purged how many entries went, sub keys and all, which is added to counter.
+func (c *Cache) purge(key string, counter *uint64) (removed bool, purged int) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.fetchLock.Lock()
+	for inFlight, call := range c.inFlight {
+		if inFlight == key || BaseKey(inFlight) == key {
+			call.invalidated = true
+		}
+	}
+	c.fetchLock.Unlock()
+
+	for subKey := range c.subKeys[key] {
+		if c.remove(subKey) {
+			purged++
+		}
+	}
+
+	removed = c.remove(key)
+	if removed {
+		purged++
+	}
+
+	atomic.AddUint64(counter, uint64(purged))
+
+	return removed, purged
+}
+
+// PurgeMatching  Purges every key that matches a Redis style glob, as KEYS would match it, along with their sub keys.  Returns how many entries went.
+func (c *Cache) PurgeMatching(glob string) (purged int, err error) {
+	pattern, err := regexp.Compile(globToRegex(glob))
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("bad pattern %q", glob))
+		return purged, err
+	}
+
+	return c.purgeMatching(pattern), err
+}
+
+// purgeMatching  Does the work of PurgeMatching, once the pattern's compiled.
+func (c *Cache) purgeMatching(pattern *regexp.Regexp) (purged int) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.fetchLock.Lock()
+	for inFlight, call := range c.inFlight {
+		if pattern.MatchString(BaseKey(inFlight)) {
+			call.invalidated = true
+		}
+	}
+	c.fetchLock.Unlock()
+
+	for key := range c.Entries {
+		if pattern.MatchString(BaseKey(key)) && c.remove(key) {
+			purged++
+		}
+	}
+
+	atomic.AddUint64(&c.counters.purges, uint64(purged))
+
+	return purged
+}
+
+// Flush  Invalidates everything, for when there's no telling what's changed upstream.  Returns how many entries went.
+func (c *Cache) Flush() (flushed int) {
+	return c.flush(&c.counters.invalidated)
+}
+
+// PurgeAll  Purges everything, because somebody said to.  Just like Flush, but counted as a purge rather than an invalidation.  Returns how many entries went.
+func (c *Cache) PurgeAll() (purged int) {
+	return c.flush(&c.counters.purges)
+}
+
+// flush  Does the work of Flush and PurgeAll.  How many entries went is added to counter.
+func (c *Cache) flush(counter *uint64) (flushed int) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.fetchLock.Lock()
+	for _, call := range c.inFlight {
+		call.invalidated = true
+	}
+	c.fetchLock.Unlock()
+
+	for key := range c.Entries {
+		if c.remove(key) {
+			flushed++
+		}
+	}
+
+	atomic.AddUint64(counter, uint64(flushed))
+
+	return flushed
+}
+
+// invalidatedDuring  Whether the key was invalidated while the call was fetching it.  The caller is responsible for holding the write lock, which is what keeps Invalidate from slipping in between asking and inserting.
+func (c *Cache) invalidatedDuring(call *fetchCall) bool {
+	c.fetchLock.Lock()
+	defer c.fetchLock.Unlock()
+
+	return call.invalidated
+}
+
+// Invalidate  Just like Cache.Invalidate, on whichever shard owns the key.
+func (s *ShardedCache) Invalidate(key string) (removed bool) {
+	return s.Shard(key).Invalidate(key)
+}
+
+// Purge  Just like Cache.Purge, on whichever shard owns the key.
+func (s *ShardedCache) Purge(key string) (purged int) {
+	return s.Shard(key).Purge(key)
+}
+
+// PurgeMatching  Just like Cache.PurgeMatching, on every shard.  Returns how many entries went, all told.
+func (s *ShardedCache) PurgeMatching(glob string) (purged int, err error) {
+	pattern, err := regexp.Compile(globToRegex(glob))
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("bad pattern %q", glob))
+		return purged, err
+	}
+
+	for _, shard := range s.Shards {
+		purged += shard.purgeMatching(pattern)
+	}
+
+	return purged, err
+}
+
+// Flush  Flushes every shard.  Returns how many entries went, all told.
+func (s *ShardedCache) Flush() (flushed int) {
+	for _, shard := range s.Shards {
+		flushed += shard.Flush()
+	}
+
+	return flushed
+}
+
+// PurgeAll  Purges every shard.  Returns how many entries went, all told.
+func (s *ShardedCache) PurgeAll() (purged int) {
+	for _, shard := range s.Shards {
+		purged += shard.PurgeAll()
+	}
+
+	return purged
+}
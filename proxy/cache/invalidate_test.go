@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCache_Invalidate(t *testing.T) {
+	c, _, upstream := staleTestCache(false)
+
+	_, err := c.Get(testFoo())
+	assert.Nil(t, err, "no error fetching")
+
+	assert.True(t, c.Invalidate(testFoo()), "cached key was invalidated")
+	assert.False(t, c.Invalidate(testBar()), "uncached key had nothing to invalidate")
+	assert.Equal(t, 0, c.Len(), "invalidated key is gone")
+	assert.Equal(t, uint64(2), c.Stats().Invalidations, "both invalidations were counted")
+
+	entry, err := c.Get(testFoo())
+	if assert.Nil(t, err, "no error refetching") {
+		assert.Equal(t, testVersion(testFoo(), 2), entry.Value, "invalidated key was fetched afresh")
+	}
+
+	assert.Equal(t, int32(2), upstream.Calls(), "and it took a trip upstream")
+}
+
+func TestCache_InvalidateInFlight(t *testing.T) {
+	c, _, upstream := staleTestCache(true)
+
+	results := make(chan *CacheEntry, 1)
+
+	go func() {
+		entry, _ := c.Get(testFoo())
+		results <- entry
+	}()
+
+	// the key changes upstream after the fetch has started, but before it's come back
+	assert.True(t, waitFor(func() bool { return upstream.Calls() == 1 }), "fetch started")
+	c.Invalidate(testFoo())
+	upstream.allow(1)
+
+	entry := <-results
+	if assert.NotNil(t, entry, "the waiter still gets what was fetched") {
+		assert.Equal(t, testVersion(testFoo(), 1), entry.Value, "which is the first version")
+	}
+
+	assert.Equal(t, 0, c.Len(), "but it wasn't cached, as it might be out of date")
+
+	upstream.allow(1)
+
+	entry, err := c.Get(testFoo())
+	if assert.Nil(t, err, "no error refetching") {
+		assert.Equal(t, testVersion(testFoo(), 2), entry.Value, "next read fetched afresh")
+	}
+
+	assert.Equal(t, 1, c.Len(), "and that one was cached")
+}
+
+func TestCache_Flush(t *testing.T) {
+	c := NewCache(0, testJanitorTtl(), keyTestFetchFunc, testJanitorTtl(), "", WithLogger(testQuietLogger()))
+
+	for _, key := range testStressKeys() {
+		_, err := c.Get(key)
+		assert.Nil(t, err, "no error fetching %s", key)
+	}
+
+	assert.Equal(t, len(testStressKeys()), c.Flush(), "everything was flushed")
+	assert.Equal(t, 0, c.Len(), "nothing left")
+	assert.Equal(t, 0, c.Policy.Len(), "policy forgot the lot")
+	assert.Equal(t, int64(0), c.Bytes(), "and gave all the bytes back")
+}
+
+func TestCache_Purge(t *testing.T) {
+	c := NewCache(0, testJanitorTtl(), keyTestFetchFunc, testJanitorTtl(), "", WithLogger(testQuietLogger()))
+
+	keys := append([]string{testFoo(), testBar()}, testSubKeys()...)
+	for _, key := range keys {
+		_, err := c.Get(key)
+		assert.Nil(t, err, "no error fetching %q", key)
+	}
+
+	assert.Equal(t, len(testSubKeys())+1, c.Purge(testFoo()), "the key went, and every read of it")
+	assert.Equal(t, 0, c.Purge(testWip()), "an uncached key had nothing to purge")
+	assert.Equal(t, []string{testBar()}, c.Keys(), "everything else stayed")
+	assert.Equal(t, uint64(0), c.Stats().Invalidations, "purges aren't invalidations")
+}
+
+func TestCache_PurgeMatching(t *testing.T) {
+	s := NewShardedCache(4, 0, testJanitorTtl(), keyTestFetchFunc, testJanitorTtl(), "", WithLogger(testQuietLogger()))
+	defer s.Close()
+
+	for _, key := range testStressKeys() {
+		_, err := s.Get(key)
+		assert.Nil(t, err, "no error fetching %s", key)
+	}
+
+	_, err := s.Get(SubKey("key-1", "hget", "name"))
+	assert.Nil(t, err, "no error fetching a read of key-1")
+
+	// key-1, key-10 to key-19, and key-1's read
+	purged, err := s.PurgeMatching("key-1*")
+	assert.Nil(t, err, "no error purging")
+	assert.Equal(t, 12, purged, "everything matching went, reads and all")
+	assert.Equal(t, len(testStressKeys())-11, s.Len(), "and nothing else")
+
+	purged, err = s.PurgeMatching("key-[2-3]?")
+	assert.Nil(t, err, "no error purging a class")
+	assert.Equal(t, 20, purged, "key-20 to key-39 went")
+
+	_, err = s.PurgeMatching("key-[z-a]")
+	assert.NotNil(t, err, "a pattern that makes no sense is an error")
+}
@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sweepBudget  How long a sweep keeps going round before it leaves the rest for the next tick, however much stale it's still finding.  Redis gives it's active expiry cycle 25ms too.
+const sweepBudget = time.Millisecond * 25
+
+// janitor  Sweeps stale entries out of a cache in the background, so that keys nobody asks for any more don't sit there taking up room until they're evicted.
+type janitor struct {
+	interval   time.Duration
+	sampleSize int
+	budget     time.Duration
+	stop       chan struct{}
+	done       chan struct{}
+	once       sync.Once
+}
+
+// WithJanitor  Sweep stale entries out of the cache every interval.  Each sweep looks at sampleSize entries, and keeps going for as long as more than a quarter of them turn out to be stale, which is how Redis does it, for up to 25ms.  A sampleSize of 0 looks at every entry, every time.  Close the cache to stop the sweeping.
+func WithJanitor(interval time.Duration, sampleSize int) Option {
+	return func(c *Cache) {
+		if interval <= 0 {
+			c.janitor = nil
+			return
+		}
+
+		c.janitor = &janitor{
+			interval:   interval,
+			sampleSize: sampleSize,
+			budget:     sweepBudget,
+			stop:       make(chan struct{}),
+			done:       make(chan struct{}),
+		}
+	}
+}
+
+// startJanitor  Starts the janitor, if there is one.  The ticker is made here, rather than in the goroutine, so that a FakeClock advanced straight after NewCache returns is sure to tick it.
+func (c *Cache) startJanitor() {
+	if c.janitor == nil {
+		return
+	}
+
+	ticker := c.clock.NewTicker(c.janitor.interval)
+
+	go func() {
+		defer close(c.janitor.done)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.janitor.stop:
+				return
+			case <-ticker.Chan():
+				purged := c.Sweep()
+				if purged > 0 {
+					c.logger.Printf("Janitor swept %d stale entries", purged)
+				}
+			}
+		}
+	}()
+}
+
+// Sweep  Purges stale entries, as the janitor does on every tick.  Returns how many went.
+func (c *Cache) Sweep() (purged int) {
+	sampleSize := 0
+	budget := time.Duration(0)
+
+	if c.janitor != nil {
+		sampleSize = c.janitor.sampleSize
+		budget = c.janitor.budget
+	}
+
+	// anything that might still be served stale stays put until it can't be
+	now := c.clock.Now().Add(-c.keepStale())
+
+	// the budget is real time spent holding the lock, whatever the cache's clock says
+	started := time.Now()
+
+	for {
+		checked, expired := c.sweepRound(now, sampleSize)
+		purged += expired
+
+		// if a good chunk of the sample was stale, there's probably more where that came from
+		if sampleSize <= 0 || checked < sampleSize || expired*4 <= checked {
+			return purged
+		}
+
+		// but not so much more that everyone else should wait on it.  The next tick can have the rest.
+		if budget > 0 && time.Since(started) >= budget {
+			c.logger.Printf("Sweep ran out of time after purging %d entries.  Leaving the rest for next time.", purged)
+			return purged
+		}
+	}
+}
+
+// sweepRound  One go round of a sweep.  Looks at up to sampleSize entries, or all of them if it's 0, and purges those that expired before now.  The write lock is only held for the round, so reads and writes get a look in between rounds.
+func (c *Cache) sweepRound(now time.Time, sampleSize int) (checked int, expired int) {
+	c.Lock()
+	defer c.Unlock()
+
+	// map iteration starts somewhere random, so this is a fresh sample every time round
+	for key, entry := range c.Entries {
+		if sampleSize > 0 && checked >= sampleSize {
+			break
+		}
+
+		checked++
+
+		if !now.Before(entry.Expires) {
+			// one that's waiting on a refetch was counted when it was found expired
+			if !entry.expired {
+				atomic.AddUint64(&c.counters.expirations, 1)
+			}
+
+			c.remove(key)
+			expired++
+		}
+	}
+
+	return checked, expired
+}
+
+// Close  Stops the janitor, and waits for it to finish any sweep it's in the middle of.  The cache still works afterwards, it just isn't swept any more.  Safe to call more than once.
+func (c *Cache) Close() {
+	if c.janitor == nil {
+		return
+	}
+
+	c.janitor.once.Do(func() {
+		close(c.janitor.stop)
+	})
+
+	<-c.janitor.done
+}
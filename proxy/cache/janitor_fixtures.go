@@ -0,0 +1,32 @@
+package cache
+
+import (
+	"fmt"
+	"time"
+)
+
+// testJanitorTtl  How long entries live in the janitor tests.  Measured on the fake clock, so it can be as long as we like.
+func testJanitorTtl() time.Duration {
+	return time.Minute
+}
+
+// testJanitorInterval  How often the janitor sweeps, on the fake clock
+func testJanitorInterval() time.Duration {
+	return time.Second * 10
+}
+
+// testJanitorKeys  Keys to load up the cache with, in two batches fetched at different times
+func testJanitorKeys(batch string) []string {
+	keys := make([]string, 0)
+
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("%s-%d", batch, i))
+	}
+
+	return keys
+}
+
+// testJanitorSample  A sample size smaller than a batch, so a sweep has to go round more than once
+func testJanitorSample() int {
+	return 5
+}
@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"log"
+	"testing"
+	"time"
+)
+
+// janitorTestCache  A cache on a fake clock, holding an older batch of keys that goes stale a while before a newer one.
+func janitorTestCache(t *testing.T, options ...Option) (c *Cache, clock *FakeClock) {
+	clock = NewFakeClock(testEpoch())
+
+	options = append([]Option{WithClock(clock), WithLogger(testQuietLogger())}, options...)
+
+	c = NewCache(0, testJanitorTtl(), keyTestFetchFunc, time.Second*1, "", options...)
+
+	for _, batch := range []string{"old", "new"} {
+		for _, key := range testJanitorKeys(batch) {
+			_, err := c.Get(key)
+			if err != nil {
+				log.Printf("Error fetching key %s: %s", key, err)
+				t.Fail()
+			}
+		}
+
+		clock.Advance(testJanitorTtl() / 2)
+	}
+
+	// by now the old batch is a whole ttl old, and the new batch half that.
+	return c, clock
+}
+
+func TestCache_Sweep(t *testing.T) {
+	c, clock := janitorTestCache(t)
+
+	purged := c.Sweep()
+
+	assert.Equal(t, len(testJanitorKeys("old")), purged, "the old batch was swept")
+	assert.Equal(t, len(testJanitorKeys("new")), c.Len(), "the new batch is still there")
+	assert.Equal(t, c.Len(), c.Policy.Len(), "policy forgot about the swept entries")
+
+	var total int64
+	for _, entry := range c.Entries {
+		total += entry.Size
+	}
+
+	assert.Equal(t, total, c.Bytes(), "swept entries gave their bytes back")
+
+	assert.Equal(t, 0, c.Sweep(), "nothing more to sweep")
+
+	clock.Advance(testJanitorTtl())
+
+	assert.Equal(t, len(testJanitorKeys("new")), c.Sweep(), "the new batch goes too, in time")
+	assert.Equal(t, 0, c.Len(), "cache is empty")
+}
+
+func TestCache_SweepKeepsStale(t *testing.T) {
+	c, clock := janitorTestCache(t, WithStaleIfError(testJanitorTtl()))
+
+	assert.Equal(t, 0, c.Sweep(), "entries that might yet be served stale aren't swept")
+
+	clock.Advance(testJanitorTtl())
+
+	assert.Equal(t, len(testJanitorKeys("old")), c.Sweep(), "until they're too stale to serve")
+}
+
+func TestCache_SweepSample(t *testing.T) {
+	c, clock := janitorTestCache(t, WithJanitor(time.Hour, testJanitorSample()))
+	defer c.Close()
+
+	purged := c.Sweep()
+
+	// Sampling is random, and stops once a sample turns up mostly fresh, so how many go, if any, varies.  Nothing fresh will.
+	assert.True(t, purged <= len(testJanitorKeys("old")), "sampling only swept stale entries")
+
+	for _, key := range testJanitorKeys("new") {
+		_, ok := c.Entries[key]
+		assert.True(t, ok, "fresh %s wasn't swept", key)
+	}
+
+	// once everything's stale, every sample is too, so sampling keeps going until there's nothing left
+	clock.Advance(testJanitorTtl())
+
+	assert.Equal(t, len(testJanitorKeys("old"))+len(testJanitorKeys("new"))-purged, c.Sweep(), "sampling swept every stale entry")
+	assert.Equal(t, 0, c.Len(), "cache is empty")
+}
+
+func TestCache_SweepBudget(t *testing.T) {
+	c, clock := janitorTestCache(t, WithJanitor(time.Hour, testJanitorSample()))
+	defer c.Close()
+
+	clock.Advance(testJanitorTtl())
+
+	// everything's stale, so every sample is, and only the budget stops the sweep after the first round
+	c.janitor.budget = time.Nanosecond
+
+	assert.Equal(t, testJanitorSample(), c.Sweep(), "out of time after one sample's worth")
+	assert.Equal(t, len(testJanitorKeys("old"))+len(testJanitorKeys("new"))-testJanitorSample(), c.Len(), "the rest is left for next time")
+
+	c.janitor.budget = sweepBudget
+
+	c.Sweep()
+	assert.Equal(t, 0, c.Len(), "and got on the next sweep")
+}
+
+func TestCache_Janitor(t *testing.T) {
+	c, clock := janitorTestCache(t, WithJanitor(testJanitorInterval(), 0))
+
+	assert.Equal(t, len(testJanitorKeys("old"))+len(testJanitorKeys("new")), c.Len(), "nothing swept before the janitor ticks")
+
+	clock.Advance(testJanitorInterval())
+
+	swept := waitFor(func() bool {
+		return c.Len() == len(testJanitorKeys("new"))
+	})
+
+	assert.True(t, swept, "janitor swept the old batch on it's next tick")
+
+	c.Close()
+	c.Close()
+
+	clock.Advance(testJanitorTtl())
+	time.Sleep(time.Millisecond * 50)
+
+	assert.Equal(t, len(testJanitorKeys("new")), c.Len(), "a closed janitor sweeps no more")
+
+	entry, err := c.Get(testFoo())
+	assert.Nil(t, err, "a closed cache still works")
+	assert.NotNil(t, entry, "a closed cache still fetches")
+}
@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WithJitter  Knock a random amount, up to fraction of the ttl, off every entry's expiry, so that entries fetched together don't all expire together and stampede upstream.  Say 0.1 for up to a tenth.  0 turns it off.
+func WithJitter(fraction float64) Option {
+	return func(c *Cache) {
+		c.JitterFraction = fraction
+	}
+}
+
+// WithJitterRange  Like WithJitter, but knocks off a random amount up to spread, whatever the ttl.  If both are set, whichever works out bigger wins.
+func WithJitterRange(spread time.Duration) Option {
+	return func(c *Cache) {
+		c.JitterRange = spread
+	}
+}
+
+// WithJitterSource  Draw jitter from the given source, rather than math/rand's own.  Seed it, and the jitter comes out the same every time, which is what the tests want.  A sharded cache shares the one source between it's shards.
+func WithJitterSource(source rand.Source) Option {
+	random := rand.New(&lockedSource{source: source})
+
+	return func(c *Cache) {
+		c.jitterRand = random
+	}
+}
+
+// lockedSource  A rand.Source that's safe to share.  The ones from rand.NewSource aren't.
+type lockedSource struct {
+	lock   sync.Mutex
+	source rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.source.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.source.Seed(seed)
+}
+
+// jittered  Takes the jitter off ttl.  Jitter only ever shortens a ttl, so an entry still never outlives the key upstream, and it's never more than the ttl itself.
+func (c *Cache) jittered(ttl time.Duration) time.Duration {
+	spread := time.Duration(float64(ttl) * c.JitterFraction)
+	if c.JitterRange > spread {
+		spread = c.JitterRange
+	}
+
+	if spread > ttl {
+		spread = ttl
+	}
+
+	if spread <= 0 {
+		return ttl
+	}
+
+	var n int64
+	if c.jitterRand != nil {
+		n = c.jitterRand.Int63n(int64(spread))
+	} else {
+		n = rand.Int63n(int64(spread))
+	}
+
+	return ttl - time.Duration(n)
+}
+
+// ParseJitter  Makes sense of jitter as a human would write it.  A percentage, like "10%", is a fraction for WithJitter.  A duration, like "500ms", is a spread for WithJitterRange.  "" or "0" is no jitter at all.
+func ParseJitter(jitter string) (fraction float64, spread time.Duration, err error) {
+	jitter = strings.TrimSpace(jitter)
+
+	if jitter == "" || jitter == "0" {
+		return fraction, spread, err
+	}
+
+	if strings.HasSuffix(jitter, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(jitter, "%")), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			err = errors.New(fmt.Sprintf("can't make sense of jitter %q.  Try a percentage like 10%%", jitter))
+			return fraction, spread, err
+		}
+
+		fraction = percent / 100
+
+		return fraction, spread, nil
+	}
+
+	spread, err = time.ParseDuration(jitter)
+	if err != nil || spread < 0 {
+		err = errors.New(fmt.Sprintf("can't make sense of jitter %q.  Try a percentage like 10%%, or a duration like 500ms", jitter))
+		return fraction, 0, err
+	}
+
+	return fraction, spread, nil
+}
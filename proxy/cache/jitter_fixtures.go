@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"fmt"
+	"time"
+)
+
+// testJitterSeed  Seeds the jitter source, so the spread comes out the same every run
+func testJitterSeed() int64 {
+	return 42
+}
+
+// testJitterTtl  How long entries live in the jitter tests, before jitter.  On a fake clock.
+func testJitterTtl() time.Duration {
+	return time.Minute
+}
+
+// testJitterFraction  Knock up to a tenth off
+func testJitterFraction() float64 {
+	return 0.1
+}
+
+// testJitterRange  Knock up to 15 seconds off.  More than testJitterFraction of testJitterTtl comes to.
+func testJitterRange() time.Duration {
+	return time.Second * 15
+}
+
+// testJitterKeys  Enough keys, all fetched at once, that they'd better not all expire at once
+func testJitterKeys() []string {
+	keys := make([]string, 0)
+
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("jitter-%d", i))
+	}
+
+	return keys
+}
+
+// testJitters  Jitter as a human would write it, and what ParseJitter should make of it
+func testJitters() map[string]struct {
+	fraction float64
+	spread   time.Duration
+} {
+	return map[string]struct {
+		fraction float64
+		spread   time.Duration
+	}{
+		"":       {0, 0},
+		"0":      {0, 0},
+		"10%":    {0.1, 0},
+		" 25 % ": {0.25, 0},
+		"500ms":  {0, time.Millisecond * 500},
+		"2s":     {0, time.Second * 2},
+	}
+}
+
+// testBadJitters  Jitter ParseJitter should refuse
+func testBadJitters() []string {
+	return []string{"%", "lots", "150%", "-5%", "-1s", "10"}
+}
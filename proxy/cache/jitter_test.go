@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// jitterTestExpiries  Fetches every one of testJitterKeys at once, on a fake clock, and hands back how long each one was given.
+func jitterTestExpiries(t *testing.T, options ...Option) (ttls map[string]time.Duration) {
+	clock := NewFakeClock(testEpoch())
+
+	options = append([]Option{WithClock(clock), WithLogger(testQuietLogger())}, options...)
+
+	c := NewCache(0, testJitterTtl(), keyTestFetchFunc, time.Second*1, "", options...)
+
+	ttls = make(map[string]time.Duration)
+
+	for _, key := range testJitterKeys() {
+		entry, err := c.Get(key)
+		if err != nil {
+			t.Errorf("Error fetching key %s: %s", key, err)
+			continue
+		}
+
+		ttls[key] = entry.Expires.Sub(testEpoch())
+	}
+
+	return ttls
+}
+
+func TestCache_Jitter(t *testing.T) {
+	// no jitter, and everything expires together
+	for key, ttl := range jitterTestExpiries(t) {
+		assert.Equal(t, testJitterTtl(), ttl, "%s got the full ttl", key)
+	}
+
+	for name, option := range map[string]Option{
+		"fraction": WithJitter(testJitterFraction()),
+		"range":    WithJitterRange(testJitterRange()),
+	} {
+		spread := time.Duration(float64(testJitterTtl()) * testJitterFraction())
+		if name == "range" {
+			spread = testJitterRange()
+		}
+
+		ttls := jitterTestExpiries(t, option, WithJitterSource(rand.NewSource(testJitterSeed())))
+
+		shortest := testJitterTtl()
+		longest := time.Duration(0)
+
+		for key, ttl := range ttls {
+			assert.True(t, ttl <= testJitterTtl(), "%s: jitter never makes %s live longer than the ttl", name, key)
+			assert.True(t, ttl > testJitterTtl()-spread, "%s: jitter never takes more than %s off %s", name, spread, key)
+
+			if ttl < shortest {
+				shortest = ttl
+			}
+
+			if ttl > longest {
+				longest = ttl
+			}
+		}
+
+		// a hundred draws ought to cover most of the spread
+		assert.True(t, longest-shortest > spread/2, "%s: expiries are spread out.  Got %s to %s", name, shortest, longest)
+
+		// and the same seed gets the same spread
+		again := jitterTestExpiries(t, option, WithJitterSource(rand.NewSource(testJitterSeed())))
+		assert.Equal(t, ttls, again, "%s: same seed, same expiries", name)
+	}
+}
+
+func TestCache_JitterBiggerThanTtl(t *testing.T) {
+	ttls := jitterTestExpiries(t, WithJitterRange(testJitterTtl()*2), WithJitterSource(rand.NewSource(testJitterSeed())))
+
+	for key, ttl := range ttls {
+		assert.True(t, ttl > 0, "%s still gets some time in the cache", key)
+	}
+}
+
+func TestCache_JitterRefreshAhead(t *testing.T) {
+	clock := NewFakeClock(testEpoch())
+	upstream := newTestUpstream(false)
+
+	// jitter of up to the whole ttl leaves plenty of entries with less than testRefreshAhead of it to start with
+	c := NewCache(0, testJitterTtl(), upstream.fetch, time.Second*1, "", WithClock(clock), WithLogger(testQuietLogger()), WithRefreshAhead(testRefreshAhead()), WithJitterRange(testJitterTtl()), WithJitterSource(rand.NewSource(testJitterSeed())))
+
+	for _, key := range testJitterKeys() {
+		for i := 0; i < 3; i++ {
+			_, err := c.Get(key)
+			assert.Nil(t, err, "no error getting %s", key)
+		}
+	}
+
+	assert.Equal(t, uint64(0), c.Stats().RefreshAheads, "nothing's refreshed just after it's fetched, however much jitter it got")
+	assert.Equal(t, int32(len(testJitterKeys())), upstream.Calls(), "so each key was fetched the once")
+
+	key := testJitterKeys()[0]
+	entry := c.Peek(key)
+
+	// into the last quarter of that entry's jittered life
+	clock.Advance(entry.Expires.Sub(entry.Fetched) * 4 / 5)
+
+	for i := 0; i < 3; i++ {
+		_, err := c.Get(key)
+		assert.Nil(t, err, "no error getting %s", key)
+	}
+
+	refreshed := waitFor(func() bool {
+		return c.Peek(key).Fetched.Equal(clock.Now())
+	})
+
+	assert.True(t, refreshed, "%s was refreshed", key)
+	assert.Equal(t, uint64(1), c.Stats().RefreshAheads, "the once")
+}
+
+func TestParseJitter(t *testing.T) {
+	for jitter, expected := range testJitters() {
+		fraction, spread, err := ParseJitter(jitter)
+		if err != nil {
+			t.Errorf("Error parsing %q: %s", jitter, err)
+		}
+
+		assert.Equal(t, expected.fraction, fraction, "fraction parsed from %q", jitter)
+		assert.Equal(t, expected.spread, spread, "spread parsed from %q", jitter)
+	}
+
+	for _, jitter := range testBadJitters() {
+		_, _, err := ParseJitter(jitter)
+		assert.Error(t, err, "%q is not jitter", jitter)
+	}
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"container/heap"
+)
+
+// LFUPolicy  Least Frequently Used.  The key that's been read the fewest times goes first.  Ties go to whichever of them was read longest ago.
+//
+// Counts never decay, so a key that was hot once and then went cold can hang around a long time.  If that's a problem for you, W-TinyLFU ages it's counts.
+type LFUPolicy struct {
+	items lfuHeap
+	keys  map[string]*lfuItem
+	tick  uint64
+}
+
+// lfuItem  A key, how often it's been read, and when it was last read.
+type lfuItem struct {
+	key   string
+	count uint64
+	tick  uint64
+	index int
+}
+
+// lfuHeap  A min heap of lfuItems, least frequent at the top.  Implements heap.Interface.
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count == h[j].count {
+		return h[i].tick < h[j].tick
+	}
+
+	return h[i].count < h[j].count
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+
+	return item
+}
+
+// NewLFUPolicy  Creates an LFU policy.
+func NewLFUPolicy(capacity int) EvictionPolicy {
+	return &LFUPolicy{
+		items: make(lfuHeap, 0),
+		keys:  make(map[string]*lfuItem),
+	}
+}
+
+// Add  New keys start with a count of one.
+func (p *LFUPolicy) Add(key string) {
+	p.tick++
+
+	if item, ok := p.keys[key]; ok {
+		item.count++
+		item.tick = p.tick
+		heap.Fix(&p.items, item.index)
+		return
+	}
+
+	item := &lfuItem{
+		key:   key,
+		count: 1,
+		tick:  p.tick,
+	}
+
+	heap.Push(&p.items, item)
+	p.keys[key] = item
+}
+
+// Access  Bumps the key's count.
+func (p *LFUPolicy) Access(key string) {
+	item, ok := p.keys[key]
+	if !ok {
+		return
+	}
+
+	p.tick++
+	item.count++
+	item.tick = p.tick
+	heap.Fix(&p.items, item.index)
+}
+
+// Remove  Forgets about a key.
+func (p *LFUPolicy) Remove(key string) {
+	item, ok := p.keys[key]
+	if !ok {
+		return
+	}
+
+	heap.Remove(&p.items, item.index)
+	delete(p.keys, key)
+}
+
+// Victim  The least frequently read key.
+func (p *LFUPolicy) Victim() (key string, ok bool) {
+	if len(p.items) == 0 {
+		return key, ok
+	}
+
+	item := heap.Pop(&p.items).(*lfuItem)
+	delete(p.keys, item.key)
+
+	return item.key, true
+}
+
+// Len  The number of keys being counted.
+func (p *LFUPolicy) Len() int {
+	return len(p.items)
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Option  An optional setting for a Cache.  Hand as many as you like to NewCache or NewShardedCache.  For a sharded cache, each option is applied to every shard.
+type Option func(c *Cache)
+
+// WithLogger  Log to the given logger instead of stderr.  Handy for keeping benchmarks and noisy tests quiet.
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Cache) {
+		c.logger = logger
+	}
+}
+
+// WithClock  Tell the time by the given clock instead of the system clock.  Mostly for tests, with a FakeClock.
+func WithClock(clock Clock) Option {
+	return func(c *Cache) {
+		c.clock = clock
+	}
+}
+
+// WithStaleWhileRevalidate  For up to grace after an entry expires, Get hands back the stale entry straight away, marked Stale, and fetches a fresh one in the background.
+func WithStaleWhileRevalidate(grace time.Duration) Option {
+	return func(c *Cache) {
+		c.StaleWhileRevalidate = grace
+	}
+}
+
+// WithStaleIfError  For up to maxStale after an entry expires, if fetching a fresh one fails, Get hands back the stale entry, marked Stale, rather than the error.
+func WithStaleIfError(maxStale time.Duration) Option {
+	return func(c *Cache) {
+		c.StaleIfError = maxStale
+	}
+}
+
+// WithRefreshAhead  A read during the last fraction of an entry's Ttl has it refreshed in the background, so that keys that are read often never expire.  Say 0.2 for the last fifth.  0 turns it off.
+func WithRefreshAhead(fraction float64) Option {
+	return func(c *Cache) {
+		c.RefreshAhead = fraction
+	}
+}
+
+// WithNegativeTtl  Remember keys that don't exist upstream for ttl, rather than asking after them on every read.  Usually shorter than the cache's Ttl, so a key that's created upstream shows up reasonably soon.  0 turns it off.
+func WithNegativeTtl(ttl time.Duration) Option {
+	return func(c *Cache) {
+		c.NegativeTtl = ttl
+	}
+}
+
+// WithIgnoreUpstreamTtl  Cache entries for the cache's Ttl, regardless of when the key expires upstream.
+func WithIgnoreUpstreamTtl() Option {
+	return func(c *Cache) {
+		c.IgnoreUpstreamTtl = true
+	}
+}
+
+// WithMaxBytes  Evict entries to keep the estimated size of the cache under maxBytes, as well as, or instead of, under the entry count.  0 means no limit.  A sharded cache gives each shard it's share.
+func WithMaxBytes(maxBytes int64) Option {
+	return func(c *Cache) {
+		c.MaxBytes = maxBytes
+	}
+}
+
+// WithFetchObserver  Have observer told about every fetch from upstream, as it finishes.  Meant for metrics.
+func WithFetchObserver(observer FetchObserver) Option {
+	return func(c *Cache) {
+		c.observer = observer
+	}
+}
+
+// byteUnits  Suffixes ParseBytes understands, and what they're worth.  Powers of 1024, as is traditional for memory.
+var byteUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+}
+
+// ParseBytes  Turns a human friendly size like "512mb" or "2G" into bytes.  A bare number is bytes.
+func ParseBytes(size string) (bytes int64, err error) {
+	size = strings.ToLower(strings.TrimSpace(size))
+
+	split := len(size)
+	for split > 0 && (size[split-1] < '0' || size[split-1] > '9') {
+		split--
+	}
+
+	number := strings.TrimSpace(size[:split])
+	unit := strings.TrimSpace(size[split:])
+
+	multiplier, ok := byteUnits[unit]
+	if !ok || number == "" {
+		err = errors.New(fmt.Sprintf("can't make sense of size %q.  Try something like 512mb", size))
+		return bytes, err
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		err = errors.New(fmt.Sprintf("can't make sense of size %q.  Try something like 512mb", size))
+		return bytes, err
+	}
+
+	if n > math.MaxInt64/multiplier {
+		err = errors.New(fmt.Sprintf("size %q is too big to count", size))
+		return bytes, err
+	}
+
+	bytes = n * multiplier
+
+	return bytes, nil
+}
+
+// defaultPolicyCapacity  What capacity policies are sized for when there's no limit on the number of entries, as with a cache that's limited by bytes alone.
+const defaultPolicyCapacity = 10000
+
+// policyCapacity  The capacity to size a policy for, given the cache's entry limit.
+func policyCapacity(maxEntries int) int {
+	if maxEntries <= 0 {
+		return defaultPolicyCapacity
+	}
+
+	return maxEntries
+}
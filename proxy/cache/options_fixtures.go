@@ -0,0 +1,20 @@
+package cache
+
+// testByteSizes  Sizes as a human would write them, and what ParseBytes should make of them
+func testByteSizes() map[string]int64 {
+	return map[string]int64{
+		"0":      0,
+		"512":    512,
+		"512b":   512,
+		"4k":     4 * 1024,
+		"4KB":    4 * 1024,
+		"512mb":  512 * 1024 * 1024,
+		" 2 G ":  2 * 1024 * 1024 * 1024,
+		"100 Mb": 100 * 1024 * 1024,
+	}
+}
+
+// testBadByteSizes  Sizes ParseBytes should refuse
+func testBadByteSizes() []string {
+	return []string{"", "mb", "1.5g", "-1", "12tb", "lots", "9999999999g", "9223372036854775807k"}
+}
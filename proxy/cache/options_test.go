@@ -0,0 +1,22 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseBytes(t *testing.T) {
+	for size, expected := range testByteSizes() {
+		actual, err := ParseBytes(size)
+		if err != nil {
+			t.Errorf("Error parsing %q: %s", size, err)
+		}
+
+		assert.Equal(t, expected, actual, "parsed %q", size)
+	}
+
+	for _, size := range testBadByteSizes() {
+		_, err := ParseBytes(size)
+		assert.Error(t, err, "%q is not a size", size)
+	}
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+)
+
+// EvictionPolicy  Decides what goes when the cache is full.  The cache tells the policy about every key that's added, read, or removed, and asks it for a victim whenever it needs room.
+//
+// The cache only ever calls a policy while holding it's own write lock, so policies needn't do any locking of their own.
+type EvictionPolicy interface {
+	// Add  A key has been put in the cache.
+	Add(key string)
+
+	// Access  A key that's in the cache has been read.
+	Access(key string)
+
+	// Remove  A key has left the cache for some reason other than eviction, like going stale, or being purged.
+	Remove(key string)
+
+	// Victim  Picks a key to evict, and forgets about it.  ok is false if there's nothing to pick.  Policies with an admission filter may well pick the key that was just added.
+	Victim() (key string, ok bool)
+
+	// Len  The number of keys the policy is tracking.
+	Len() int
+}
+
+// PolicyFactory  Makes a policy for a cache of the given capacity.  Every shard of a sharded cache gets it's own.
+type PolicyFactory func(capacity int) EvictionPolicy
+
+// Names of the policies that can be had from PolicyByName
+const (
+	PolicyLRU     = "lru"
+	PolicyLFU     = "lfu"
+	PolicyARC     = "arc"
+	PolicyTinyLFU = "tinylfu"
+)
+
+// policies  The built in policies, by name
+var policies = map[string]PolicyFactory{
+	PolicyLRU:     NewLRUPolicy,
+	PolicyLFU:     NewLFUPolicy,
+	PolicyARC:     NewARCPolicy,
+	PolicyTinyLFU: NewTinyLFUPolicy,
+}
+
+// PolicyByName  Looks up one of the built in policies by name.
+func PolicyByName(name string) (factory PolicyFactory, err error) {
+	factory, ok := policies[name]
+	if !ok {
+		err = errors.New(fmt.Sprintf("unknown eviction policy %q.  Choose from %v", name, PolicyNames()))
+		return factory, err
+	}
+
+	return factory, err
+}
+
+// PolicyNames  The names of all the built in policies, sorted.
+func PolicyNames() []string {
+	names := make([]string, 0)
+
+	for name := range policies {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// WithPolicy  Use the given eviction policy instead of the default LRU.
+func WithPolicy(factory PolicyFactory) Option {
+	return func(c *Cache) {
+		c.Policy = factory(policyCapacity(c.MaxEntries))
+	}
+}
+
+// LRUPolicy  Least Recently Used.  The key that's gone the longest without being read goes first.  This is what the cache has always done.
+type LRUPolicy struct {
+	ageList  *list.List
+	elements map[string]*list.Element
+}
+
+// NewLRUPolicy  Creates an LRU policy.  LRU doesn't care about capacity, but takes it anyway so it looks like all the others.
+func NewLRUPolicy(capacity int) EvictionPolicy {
+	return &LRUPolicy{
+		ageList:  list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+// Add  New keys go to the head of the age list.
+func (p *LRUPolicy) Add(key string) {
+	if element, ok := p.elements[key]; ok {
+		p.ageList.MoveToFront(element)
+		return
+	}
+
+	p.elements[key] = p.ageList.PushFront(key)
+}
+
+// Access  A read moves the key to the head of the age list, since it's now the freshest.
+func (p *LRUPolicy) Access(key string) {
+	if element, ok := p.elements[key]; ok {
+		p.ageList.MoveToFront(element)
+	}
+}
+
+// Remove  Forgets about a key.
+func (p *LRUPolicy) Remove(key string) {
+	if element, ok := p.elements[key]; ok {
+		p.ageList.Remove(element)
+		delete(p.elements, key)
+	}
+}
+
+// Victim  The eldest key, from the tail of the age list.
+func (p *LRUPolicy) Victim() (key string, ok bool) {
+	element := p.ageList.Back()
+	if element == nil {
+		return key, ok
+	}
+
+	key = element.Value.(string)
+	p.Remove(key)
+
+	return key, true
+}
+
+// Len  The number of keys in the age list.
+func (p *LRUPolicy) Len() int {
+	return p.ageList.Len()
+}
@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// testPolicyCapacity  Cache size for the hit ratio workloads.  Small next to the key space, so the policy has real choices to make.
+func testPolicyCapacity() int {
+	return 100
+}
+
+// testPolicies  Every built in policy, by name
+func testPolicies() map[string]PolicyFactory {
+	return policies
+}
+
+// testZipfTrace  Requests for keys drawn from a Zipf distribution.  A few keys are very popular, and there's a long tail of keys that hardly ever come up.
+func testZipfTrace() []string {
+	r := rand.New(rand.NewSource(42))
+	z := rand.NewZipf(r, 1.1, 1, 9999)
+
+	trace := make([]string, 0)
+
+	for i := 0; i < 50000; i++ {
+		trace = append(trace, fmt.Sprintf("zipf-%d", z.Uint64()))
+	}
+
+	return trace
+}
+
+// testScanTrace  A Zipf distributed hot set, interrupted every so often by a scan of keys that are each only ever asked for once.  That's what a batch job or a crawler looks like from here.
+func testScanTrace() []string {
+	r := rand.New(rand.NewSource(42))
+	z := rand.NewZipf(r, 1.1, 1, 999)
+
+	trace := make([]string, 0)
+	scanned := 0
+
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 2000; i++ {
+			trace = append(trace, fmt.Sprintf("hot-%d", z.Uint64()))
+		}
+
+		for i := 0; i < 500; i++ {
+			trace = append(trace, fmt.Sprintf("scan-%d", scanned))
+			scanned++
+		}
+	}
+
+	return trace
+}
+
+// testRequestInterval  How far the clock moves between one request of a trace and the next
+func testRequestInterval() time.Duration {
+	return time.Millisecond
+}
+
+// testRefetchTtl  Short enough that the hot keys of a trace expire, and are refetched, many times over.  A thousand requests' worth.
+func testRefetchTtl() time.Duration {
+	return time.Second
+}
+
+// testHitRatio  Replays a trace against a cache using the given policy, with entries that live for ttl, and works out what fraction of the requests were hits.  The clock moves on by testRequestInterval with every request.
+func testHitRatio(factory PolicyFactory, trace []string, ttl time.Duration) (ratio float64, err error) {
+	var misses int64
+
+	fetchFunc := func(key string, redisAddr string) (result FetchResult, err error) {
+		atomic.AddInt64(&misses, 1)
+		return FetchResult{Value: key}, err
+	}
+
+	clock := NewFakeClock(testEpoch())
+
+	c := NewCache(testPolicyCapacity(), ttl, fetchFunc, 0, "", WithPolicy(factory), WithClock(clock), WithLogger(testQuietLogger()))
+
+	for _, key := range trace {
+		_, err = c.Get(key)
+		if err != nil {
+			return ratio, err
+		}
+
+		clock.Advance(testRequestInterval())
+	}
+
+	ratio = 1 - float64(atomic.LoadInt64(&misses))/float64(len(trace))
+
+	return ratio, err
+}
@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestPolicyByName(t *testing.T) {
+	for _, name := range PolicyNames() {
+		factory, err := PolicyByName(name)
+		assert.Nil(t, err, "%s is a known policy", name)
+		assert.NotNil(t, factory(testPolicyCapacity()), "%s makes a policy", name)
+	}
+
+	_, err := PolicyByName("random")
+	assert.NotNil(t, err, "unknown policies are an error")
+}
+
+func TestLRUPolicy(t *testing.T) {
+	p := NewLRUPolicy(3)
+
+	p.Add(testFoo())
+	p.Add(testBar())
+	p.Add(testWip())
+	p.Access(testFoo())
+
+	victim, ok := p.Victim()
+	assert.True(t, ok, "there's a victim")
+	assert.Equal(t, testBar(), victim, "least recently used goes first")
+
+	p.Remove(testWip())
+
+	victim, ok = p.Victim()
+	assert.True(t, ok, "there's a victim")
+	assert.Equal(t, testFoo(), victim, "removed keys aren't victims")
+
+	_, ok = p.Victim()
+	assert.False(t, ok, "nothing left to evict")
+	assert.Equal(t, 0, p.Len(), "policy is empty")
+}
+
+// TestPolicy_Consistency runs every policy through a workload with removals and evictions, checking that they track exactly the keys the cache holds.
+func TestPolicy_Consistency(t *testing.T) {
+	for name, factory := range testPolicies() {
+		c := NewCache(testStressCapacity(), testStressTtl(), keyTestFetchFunc, 0, "", WithPolicy(factory), WithLogger(testQuietLogger()))
+
+		for i, key := range testScanTrace()[:5000] {
+			_, err := c.Get(key)
+			if err != nil {
+				log.Printf("Error fetching key %s: %s", key, err)
+				t.Fail()
+			}
+
+			if i%7 == 0 {
+				c.Delete(key)
+			}
+		}
+
+		assert.True(t, c.Len() <= testStressCapacity(), "%s: cache is within MaxEntries", name)
+		assert.Equal(t, c.Len(), c.Policy.Len(), "%s: policy tracks exactly what's in the cache", name)
+
+		// evict the lot, and make sure every victim was actually in the cache
+		for c.Policy.Len() > 0 {
+			victim, ok := c.Policy.Victim()
+			assert.True(t, ok, "%s: there's a victim", name)
+
+			_, exists := c.Entries[victim]
+			assert.True(t, exists, "%s: victim %s was in the cache", name, victim)
+			delete(c.Entries, victim)
+		}
+
+		assert.Equal(t, 0, len(c.Entries), "%s: every entry was evictable", name)
+	}
+}
+
+func TestPolicy_HitRatioZipf(t *testing.T) {
+	ratios := make(map[string]float64)
+
+	for name, factory := range testPolicies() {
+		ratio, err := testHitRatio(factory, testZipfTrace(), time.Hour)
+		if err != nil {
+			log.Printf("Error replaying trace: %s", err)
+			t.Fail()
+		}
+
+		log.Printf("Zipf hit ratio for %s: %.3f", name, ratio)
+		ratios[name] = ratio
+	}
+
+	assert.True(t, ratios[PolicyLFU] > ratios[PolicyLRU], "LFU beats LRU on a skewed workload")
+	assert.True(t, ratios[PolicyARC] >= ratios[PolicyLRU], "ARC is at least as good as LRU on a skewed workload")
+	assert.True(t, ratios[PolicyTinyLFU] > ratios[PolicyLRU], "W-TinyLFU beats LRU on a skewed workload")
+}
+
+func TestPolicy_HitRatioScan(t *testing.T) {
+	ratios := make(map[string]float64)
+
+	for name, factory := range testPolicies() {
+		ratio, err := testHitRatio(factory, testScanTrace(), time.Hour)
+		if err != nil {
+			log.Printf("Error replaying trace: %s", err)
+			t.Fail()
+		}
+
+		log.Printf("Scan hit ratio for %s: %.3f", name, ratio)
+		ratios[name] = ratio
+	}
+
+	assert.True(t, ratios[PolicyLFU] > ratios[PolicyLRU], "LFU isn't flushed by scans like LRU is")
+	assert.True(t, ratios[PolicyARC] > ratios[PolicyLRU], "ARC isn't flushed by scans like LRU is")
+	assert.True(t, ratios[PolicyTinyLFU] > ratios[PolicyLRU], "W-TinyLFU isn't flushed by scans like LRU is")
+}
+
+func TestPolicy_HitRatioRefetch(t *testing.T) {
+	ratios := make(map[string]float64)
+
+	for name, factory := range testPolicies() {
+		ratio, err := testHitRatio(factory, testZipfTrace(), testRefetchTtl())
+		if err != nil {
+			log.Printf("Error replaying trace: %s", err)
+			t.Fail()
+		}
+
+		log.Printf("Zipf hit ratio for %s, refetching every %s: %.3f", name, testRefetchTtl(), ratio)
+		ratios[name] = ratio
+	}
+
+	assert.True(t, ratios[PolicyLFU] > ratios[PolicyLRU], "LFU still beats LRU when hot keys keep expiring and being refetched")
+	assert.True(t, ratios[PolicyARC] >= ratios[PolicyLRU], "ARC is still at least as good as LRU when hot keys keep expiring and being refetched")
+	assert.True(t, ratios[PolicyTinyLFU] > ratios[PolicyLRU], "W-TinyLFU still beats LRU when hot keys keep expiring and being refetched")
+}
+
+func TestLFUPolicy(t *testing.T) {
+	p := NewLFUPolicy(3)
+
+	p.Add(testFoo())
+	p.Add(testBar())
+	p.Add(testWip())
+	p.Access(testFoo())
+	p.Access(testFoo())
+	p.Access(testWip())
+
+	victim, ok := p.Victim()
+	assert.True(t, ok, "there's a victim")
+	assert.Equal(t, testBar(), victim, "least frequently used goes first")
+
+	victim, _ = p.Victim()
+	assert.Equal(t, testWip(), victim, "then the next least frequent")
+}
+
+func TestARCPolicy(t *testing.T) {
+	p := NewARCPolicy(2).(*ARCPolicy)
+
+	p.Add(testFoo())
+	p.Add(testBar())
+	p.Access(testFoo())
+
+	victim, ok := p.Victim()
+	assert.True(t, ok, "there's a victim")
+	assert.Equal(t, testBar(), victim, "seen once goes before seen twice")
+	assert.True(t, p.lists[testBar()] == p.b1, "victim is remembered as a ghost")
+
+	// bar coming back means evicting it was a mistake, so t1 gets more room, and bar goes straight to t2
+	p.Add(testBar())
+	assert.Equal(t, 1, p.p, "target size of t1 grew")
+	assert.True(t, p.lists[testBar()] == p.t2, "returning ghost lands in t2")
+	assert.Equal(t, 2, p.Len(), "ghosts don't count towards Len")
+}
+
+func TestTinyLFUPolicy(t *testing.T) {
+	p := NewTinyLFUPolicy(3)
+
+	// foo and bar get popular, and settle into the main cache
+	for i := 0; i < 5; i++ {
+		p.Add(testFoo())
+		p.Access(testFoo())
+		p.Add(testBar())
+		p.Access(testBar())
+	}
+
+	// wip and zoz are one hit wonders.  wip gets pushed out of the window by zoz, and has to compete with the main cache.
+	p.Add(testWip())
+	p.Add(testZoz())
+
+	victim, ok := p.Victim()
+	assert.True(t, ok, "there's a victim")
+	assert.Equal(t, testWip(), victim, "a one hit wonder doesn't displace a popular key")
+}
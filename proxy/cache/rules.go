@@ -0,0 +1,257 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Rule  How keys matching a pattern are cached, when the cache's own settings don't suit them.  Keys are matched by Glob, as Redis' KEYS does it, or by Regex.  Zero values mean the cache's own setting.
+type Rule struct {
+	Name  string
+	Glob  string
+	Regex string
+	// Ttl  How long matching keys are cached for.  Still capped by the key's ttl upstream, unless that's being ignored.
+	Ttl time.Duration
+	// NegativeTtl  How long to remember that a matching key doesn't exist upstream.  Less than 0 means don't, whatever the cache does.
+	NegativeTtl time.Duration
+	// MaxSize  Values bigger than this many bytes are fetched, but not cached.
+	MaxSize int64
+	// Bypass  Matching keys are never cached at all.  Every read goes upstream.
+	Bypass  bool
+	pattern *regexp.Regexp
+}
+
+// Matches  True if the key matches the rule's pattern.
+func (r *Rule) Matches(key string) bool {
+	return r.pattern.MatchString(key)
+}
+
+// String  A one line summary of the rule, for logs and debug output.
+func (r *Rule) String() string {
+	if r == nil {
+		return "default"
+	}
+
+	return r.Name
+}
+
+// Rules  A table of rules.  The first one a key matches is the one that applies, so put the specific ones before the general ones.
+type Rules struct {
+	rules []*Rule
+}
+
+// NewRules  Compiles rules into a table, in order.  Every rule needs a name, and a Glob or a Regex, but not both.
+func NewRules(rules ...Rule) (table *Rules, err error) {
+	table = &Rules{
+		rules: make([]*Rule, 0),
+	}
+
+	for i := range rules {
+		rule := rules[i]
+
+		if rule.Name == "" {
+			err = errors.New(fmt.Sprintf("rule %d has no name", i+1))
+			return table, err
+		}
+
+		var expression string
+
+		switch {
+		case rule.Glob != "" && rule.Regex != "":
+			err = errors.New(fmt.Sprintf("rule %s has both a glob and a regex.  Pick one", rule.Name))
+			return table, err
+		case rule.Glob != "":
+			expression = globToRegex(rule.Glob)
+		case rule.Regex != "":
+			expression = rule.Regex
+		default:
+			err = errors.New(fmt.Sprintf("rule %s has nothing to match keys against.  Give it a glob or a regex", rule.Name))
+			return table, err
+		}
+
+		rule.pattern, err = regexp.Compile(expression)
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("rule %s has a bad pattern", rule.Name))
+			return table, err
+		}
+
+		table.rules = append(table.rules, &rule)
+	}
+
+	return table, err
+}
+
+// Match  The first rule the key matches, or nil if it matches none of them, or there aren't any.  A SubKey matches as the key it was read from.
+func (t *Rules) Match(key string) *Rule {
+	if t == nil {
+		return nil
+	}
+
+	key = BaseKey(key)
+
+	for _, rule := range t.rules {
+		if rule.Matches(key) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// Len  How many rules there are.
+func (t *Rules) Len() int {
+	if t == nil {
+		return 0
+	}
+
+	return len(t.rules)
+}
+
+// globToRegex  Turns a Redis style glob into an anchored regular expression.  * is any run of characters, ? is any one character, newlines included, [abc] and [a-z] are classes, [^abc] or [!abc] negated ones, and a backslash escapes the next character.  What's in a class is taken literally, bar ranges, and [] is just a pair of brackets.
+func globToRegex(glob string) string {
+	var expression strings.Builder
+
+	// keys are binary safe, so a * or ? has to match a newline as well as anything else, which . doesn't by default
+	expression.WriteString("(?s)^")
+
+	for i := 0; i < len(glob); i++ {
+		switch char := glob[i]; char {
+		case '*':
+			expression.WriteString(".*")
+		case '?':
+			expression.WriteString(".")
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+
+			expression.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expression.WriteString(regexp.QuoteMeta(glob[i:]))
+				i = len(glob)
+				break
+			}
+
+			class := glob[i+1 : i+1+end]
+
+			negated := strings.HasPrefix(class, "!") || strings.HasPrefix(class, "^")
+			if negated {
+				class = class[1:]
+			}
+
+			// a class of nothing at all isn't a class, just the brackets
+			if class == "" {
+				expression.WriteString(regexp.QuoteMeta(glob[i : i+end+2]))
+				i += end + 1
+				break
+			}
+
+			expression.WriteString("[")
+
+			if negated {
+				expression.WriteString("^")
+			}
+
+			expression.WriteString(globClass(class))
+			expression.WriteString("]")
+			i += end + 1
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+
+	expression.WriteString("$")
+
+	return expression.String()
+}
+
+// globClass  The inside of a glob's [...] class, as the inside of a regular expression's.  Ranges are left be, and everything else is taken literally, backslash escapes included, so things like [.*] and [\w] mean what they'd mean to Redis.
+func globClass(class string) string {
+	var escaped strings.Builder
+
+	for i := 0; i < len(class); i++ {
+		switch char := class[i]; char {
+		case '-', '^':
+			escaped.WriteByte(char)
+		case '\\':
+			if i+1 < len(class) {
+				i++
+			}
+
+			escaped.WriteString(regexp.QuoteMeta(class[i : i+1]))
+		default:
+			escaped.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+
+	return escaped.String()
+}
+
+// WithRules  Cache keys as the first rule they match says, and everything else as usual.  A sharded cache shares the one table between it's shards.
+func WithRules(rules *Rules) Option {
+	return func(c *Cache) {
+		c.Rules = rules
+	}
+}
+
+// RuleConfig  A Rule as it's written in a config file.  Durations are things like "1s" or "5m", and sizes things like "64kb".
+type RuleConfig struct {
+	Name        string `mapstructure:"name"`
+	Glob        string `mapstructure:"glob"`
+	Regex       string `mapstructure:"regex"`
+	Ttl         string `mapstructure:"ttl"`
+	NegativeTtl string `mapstructure:"negative-ttl"`
+	MaxSize     string `mapstructure:"max-size"`
+	Bypass      bool   `mapstructure:"bypass"`
+}
+
+// ParseRules  Makes a table of rules out of their config.
+func ParseRules(configs []RuleConfig) (table *Rules, err error) {
+	rules := make([]Rule, 0)
+
+	for i, config := range configs {
+		rule := Rule{
+			Name:   config.Name,
+			Glob:   config.Glob,
+			Regex:  config.Regex,
+			Bypass: config.Bypass,
+		}
+
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+
+		if config.Ttl != "" {
+			rule.Ttl, err = time.ParseDuration(config.Ttl)
+			if err != nil {
+				err = errors.Wrap(err, fmt.Sprintf("rule %s has a bad ttl", rule.Name))
+				return table, err
+			}
+		}
+
+		if config.NegativeTtl != "" {
+			rule.NegativeTtl, err = time.ParseDuration(config.NegativeTtl)
+			if err != nil {
+				err = errors.Wrap(err, fmt.Sprintf("rule %s has a bad negative-ttl", rule.Name))
+				return table, err
+			}
+		}
+
+		if config.MaxSize != "" {
+			rule.MaxSize, err = ParseBytes(config.MaxSize)
+			if err != nil {
+				err = errors.Wrap(err, fmt.Sprintf("rule %s has a bad max-size", rule.Name))
+				return table, err
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return NewRules(rules...)
+}
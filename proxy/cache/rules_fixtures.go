@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"time"
+)
+
+// testRules  A rules table like the one you'd want in real life.  Sessions are short lived, feature flags longer, locks never cached, and blobs only if they're small.  Missing sessions aren't remembered.
+func testRules() []Rule {
+	return []Rule{
+		{Name: "sessions", Glob: "session:*", Ttl: time.Second, NegativeTtl: -1},
+		{Name: "flags", Regex: `^flag:[a-z]+$`, Ttl: time.Minute, NegativeTtl: time.Second * 30},
+		{Name: "locks", Glob: "lock:*", Bypass: true},
+		{Name: "blobs", Glob: "blob:?", MaxSize: 4},
+		{Name: "shards", Glob: "shard:[0-3]"},
+		{Name: "not-shards", Glob: "shard:[!0-3]"},
+	}
+}
+
+// testRuleMatches  Keys, and the name of the testRules rule they should match.  "" for none.
+func testRuleMatches() map[string]string {
+	return map[string]string{
+		"session:abc":   "sessions",
+		"session:":      "sessions",
+		"session":       "",
+		"mysession:abc": "",
+		"flag:dark":     "flags",
+		"flag:dark9":    "",
+		"lock:a:b:c":    "locks",
+		"blob:1":        "blobs",
+		"blob:12":       "",
+		"shard:2":       "shards",
+		"shard:7":       "not-shards",
+		"foo":           "",
+
+		SubKey("flag:dark", "hget", "on"): "flags",
+		SubKey("blob:12", "hget", "1"):    "",
+	}
+}
+
+// testGlobs  Globs, and what they ought to come out as
+func testGlobs() map[string]string {
+	return map[string]string{
+		"foo":         `(?s)^foo$`,
+		"foo*":        `(?s)^foo.*$`,
+		"f?o":         `(?s)^f.o$`,
+		"a.b+c":       `(?s)^a\.b\+c$`,
+		`star\*`:      `(?s)^star\*$`,
+		"[abc]x":      `(?s)^[abc]x$`,
+		"[!abc]x":     `(?s)^[^abc]x$`,
+		"[unclosed":   `(?s)^\[unclosed$`,
+		"[a.]x":       `(?s)^[a\.]x$`,
+		"[*?]x":       `(?s)^[\*\?]x$`,
+		`[\w]x`:       `(?s)^[w]x$`,
+		"[a-z^]x":     `(?s)^[a-z^]x$`,
+		"[[]x":        `(?s)^[\[]x$`,
+		"[]x":         `(?s)^\[\]x$`,
+		"[!]x":        `(?s)^\[!\]x$`,
+		"user:*:name": `(?s)^user:.*:name$`,
+	}
+}
+
+// testBadRules  Rules NewRules should refuse
+func testBadRules() map[string]Rule {
+	return map[string]Rule{
+		"no name":    {Glob: "foo*"},
+		"no pattern": {Name: "nothing"},
+		"both":       {Name: "both", Glob: "foo*", Regex: "^foo"},
+		"bad regex":  {Name: "bad", Regex: "^foo("},
+	}
+}
+
+// testRuleConfigs  testRules, as they'd be written in a config file
+func testRuleConfigs() []RuleConfig {
+	return []RuleConfig{
+		{Name: "sessions", Glob: "session:*", Ttl: "1s", NegativeTtl: "-1ns"},
+		{Name: "flags", Regex: `^flag:[a-z]+$`, Ttl: "1m", NegativeTtl: "30s"},
+		{Name: "locks", Glob: "lock:*", Bypass: true},
+		{Name: "blobs", Glob: "blob:?", MaxSize: "4b"},
+		{Name: "shards", Glob: "shard:[0-3]"},
+		{Name: "not-shards", Glob: "shard:[!0-3]"},
+	}
+}
+
+// testBadRuleConfigs  Rule configs ParseRules should refuse
+func testBadRuleConfigs() map[string]RuleConfig {
+	return map[string]RuleConfig{
+		"bad ttl":          {Glob: "foo*", Ttl: "soon"},
+		"bad negative-ttl": {Glob: "foo*", NegativeTtl: "never"},
+		"bad max-size":     {Glob: "foo*", MaxSize: "huge"},
+	}
+}
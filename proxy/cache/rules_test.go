@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGlobToRegex(t *testing.T) {
+	for glob, expected := range testGlobs() {
+		assert.Equal(t, expected, globToRegex(glob), "glob %q", glob)
+
+		_, err := regexp.Compile(globToRegex(glob))
+		assert.Nil(t, err, "glob %q makes a regular expression that compiles", glob)
+	}
+}
+
+func TestGlobToRegex_Newlines(t *testing.T) {
+	for glob, key := range map[string]string{"user:*": "user:\nname", "user:?": "user:\n", "*name": "\nname", "[!a]x": "\nx"} {
+		pattern := regexp.MustCompile(globToRegex(glob))
+		assert.True(t, pattern.MatchString(key), "glob %q matches %q, newline and all, as it would in Redis", glob, key)
+	}
+}
+
+func TestRules_Match(t *testing.T) {
+	rules, err := NewRules(testRules()...)
+	if err != nil {
+		t.Fatalf("Error compiling rules: %s", err)
+	}
+
+	assert.Equal(t, len(testRules()), rules.Len(), "all the rules made it into the table")
+
+	for key, expected := range testRuleMatches() {
+		rule := rules.Match(key)
+
+		if expected == "" {
+			assert.Nil(t, rule, "%s matches no rule", key)
+			continue
+		}
+
+		if assert.NotNil(t, rule, "%s matches a rule", key) {
+			assert.Equal(t, expected, rule.Name, "%s matches the right rule", key)
+		}
+	}
+
+	// no table at all matches nothing
+	var none *Rules
+	assert.Nil(t, none.Match(testFoo()), "a nil table matches nothing")
+	assert.Equal(t, "default", none.Match(testFoo()).String(), "and says so")
+}
+
+func TestNewRules_Bad(t *testing.T) {
+	for name, rule := range testBadRules() {
+		_, err := NewRules(rule)
+		assert.Error(t, err, "rule with %s is refused", name)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(testRuleConfigs())
+	if err != nil {
+		t.Fatalf("Error parsing rules: %s", err)
+	}
+
+	expected, err := NewRules(testRules()...)
+	if err != nil {
+		t.Fatalf("Error compiling rules: %s", err)
+	}
+
+	// -1ns is as good as -1 for turning negative caching off
+	expected.rules[0].NegativeTtl = -time.Nanosecond
+
+	assert.Equal(t, expected, rules, "config makes the same rules as writing them out")
+
+	for name, config := range testBadRuleConfigs() {
+		_, err := ParseRules([]RuleConfig{config})
+		assert.Error(t, err, "config with a %s is refused", name)
+	}
+}
+
+func TestCache_Rules(t *testing.T) {
+	rules, err := NewRules(testRules()...)
+	if err != nil {
+		t.Fatalf("Error compiling rules: %s", err)
+	}
+
+	c, clock, upstream := staleTestCache(false, WithRules(rules), WithNegativeTtl(testNegativeTtl()))
+
+	// ttl comes from the rule, when there is one
+	for key, ttl := range map[string]time.Duration{
+		"session:abc": time.Second,
+		"flag:dark":   time.Minute,
+		testFoo():     testStaleTtl(),
+	} {
+		entry, err := c.Get(key)
+		if assert.Nil(t, err, "no error getting %s", key) {
+			assert.Equal(t, clock.Now().Add(ttl), entry.Expires, "%s is cached for %s", key, ttl)
+			assert.Equal(t, rules.Match(key), entry.Rule, "%s's entry knows which rule it was cached under", key)
+		}
+	}
+
+	// bypassed keys go upstream every time
+	calls := upstream.Calls()
+
+	for i := 1; i <= 3; i++ {
+		entry, err := c.Get("lock:abc")
+		if assert.Nil(t, err, "no error getting a bypassed key") {
+			assert.Equal(t, testVersion("lock:abc", calls+int32(i)), entry.Value, "bypassed key is fetched afresh")
+			assert.Equal(t, "locks", entry.Rule.Name, "and knows why")
+		}
+	}
+
+	_, cached := c.Entries["lock:abc"]
+	assert.False(t, cached, "bypassed key isn't cached")
+
+	// as are values too big for their rule
+	entry, err := c.Get("blob:1")
+	if assert.Nil(t, err, "no error getting a big value") {
+		assert.NotNil(t, entry.Value, "big value is handed back")
+	}
+
+	_, cached = c.Entries["blob:1"]
+	assert.False(t, cached, "but isn't cached")
+
+	// and missing keys are remembered, or not, as the rules say
+	atomic.StoreInt32(&upstream.missing, 1)
+
+	for key, ttl := range map[string]time.Duration{
+		"session:gone": 0,
+		"flag:gone":    time.Second * 30,
+		"lock:gone":    0,
+		testBar():      testNegativeTtl(),
+	} {
+		entry, err := c.Get(key)
+		assert.Nil(t, err, "no error getting missing %s", key)
+		assert.True(t, entry.Missing(), "%s is missing", key)
+
+		if ttl == 0 {
+			assert.Nil(t, entry, "missing %s isn't remembered", key)
+			continue
+		}
+
+		if assert.NotNil(t, entry, "missing %s is remembered", key) {
+			assert.Equal(t, clock.Now().Add(ttl), entry.Expires, "missing %s is remembered for %s", key, ttl)
+		}
+	}
+}
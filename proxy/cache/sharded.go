@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"time"
+)
+
+// ShardedCache  A cache split across a number of independent Caches, each with it's own lock, it's own age list, and it's own share of the entries.  Keys are spread over the shards by hash, so Gets for different keys mostly don't wait on each other.
+type ShardedCache struct {
+	Shards []*Cache
+}
+
+// NewShardedCache  Creates a cache with shardCount shards, splitting maxEntries, and any byte budget from WithMaxBytes, between them.  Shards are capped at maxEntries, since a shard that can't hold anything is no use to anyone.  Everything else is as for NewCache.
+func NewShardedCache(shardCount int, maxEntries int, maxAge time.Duration, fetchFunc FetchFunc, fetchTimeout time.Duration, redisAddr string, options ...Option) *ShardedCache {
+	if maxEntries > 0 && shardCount > maxEntries {
+		shardCount = maxEntries
+	}
+
+	if shardCount < 1 {
+		shardCount = 1
+	}
+
+	s := &ShardedCache{
+		Shards: make([]*Cache, shardCount),
+	}
+
+	// hand out any remainder one apiece, so the shards add up to maxEntries exactly
+	share := maxEntries / shardCount
+	remainder := maxEntries % shardCount
+
+	for i := range s.Shards {
+		shardEntries := share
+		if i < remainder {
+			shardEntries++
+		}
+
+		s.Shards[i] = NewCache(shardEntries, maxAge, fetchFunc, fetchTimeout, redisAddr, options...)
+	}
+
+	// same again for the byte budget, now the options have set it
+	maxBytes := s.Shards[0].MaxBytes
+	byteShare := maxBytes / int64(shardCount)
+	byteRemainder := maxBytes % int64(shardCount)
+
+	for i, shard := range s.Shards {
+		shard.MaxBytes = byteShare
+		if int64(i) < byteRemainder {
+			shard.MaxBytes++
+		}
+
+		// 0 is no limit at all, which is the last thing a budget smaller than the number of shards means
+		if maxBytes > 0 && shard.MaxBytes == 0 {
+			shard.MaxBytes = 1
+		}
+	}
+
+	return s
+}
+
+// Shard  The shard that's responsible for a key.  A SubKey is the responsibility of whichever shard has the key it was read from.
+func (s *ShardedCache) Shard(key string) *Cache {
+	if len(s.Shards) == 1 {
+		return s.Shards[0]
+	}
+
+	return s.Shards[hashKey(BaseKey(key))%uint32(len(s.Shards))]
+}
+
+// Get  Just like Cache.Get, from whichever shard owns the key.
+func (s *ShardedCache) Get(key string) (entry *CacheEntry, err error) {
+	return s.Shard(key).Get(key)
+}
+
+// Lookup  Just like Cache.Lookup, from whichever shard owns the key.
+func (s *ShardedCache) Lookup(key string) (entry *CacheEntry, hit bool, err error) {
+	return s.Shard(key).Lookup(key)
+}
+
+// Fetch  Just like Cache.Fetch, from whichever shard owns the key.
+func (s *ShardedCache) Fetch(key string) (entry *CacheEntry, err error) {
+	return s.Shard(key).Fetch(key)
+}
+
+// Rule  The rule a key falls under, if any.  Every shard has the same rules, so it doesn't much matter which one's asked.
+func (s *ShardedCache) Rule(key string) *Rule {
+	return s.Shard(key).Rules.Match(key)
+}
+
+// Len  The number of entries across all the shards.
+func (s *ShardedCache) Len() int {
+	total := 0
+
+	for _, shard := range s.Shards {
+		total += shard.Len()
+	}
+
+	return total
+}
+
+// Bytes  The estimated size of the entries across all the shards.
+func (s *ShardedCache) Bytes() int64 {
+	var total int64
+
+	for _, shard := range s.Shards {
+		total += shard.Bytes()
+	}
+
+	return total
+}
+
+// MaxBytes  The total byte budget across all the shards.  0 if there isn't one.
+func (s *ShardedCache) MaxBytes() int64 {
+	var total int64
+
+	for _, shard := range s.Shards {
+		total += shard.MaxBytes
+	}
+
+	return total
+}
+
+// MaxEntries  The total capacity across all the shards.
+func (s *ShardedCache) MaxEntries() int {
+	total := 0
+
+	for _, shard := range s.Shards {
+		total += shard.MaxEntries
+	}
+
+	return total
+}
+
+// Close  Stops the janitors of all the shards.
+func (s *ShardedCache) Close() {
+	for _, shard := range s.Shards {
+		shard.Close()
+	}
+}
+
+// hashKey  32 bit FNV-1a of the key.  Done by hand rather than through hash/fnv, so that it doesn't allocate on every Get.
+func hashKey(key string) uint32 {
+	hash := uint32(2166136261)
+
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+
+	return hash
+}
@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+func testShardCount() int {
+	return 4
+}
+
+// testShardCapacity  Doesn't divide evenly by testShardCount, on purpose
+func testShardCapacity() int {
+	return 10
+}
+
+// testShardShares  How testShardCapacity should be split over testShardCount shards
+func testShardShares() []int {
+	return []int{3, 3, 2, 2}
+}
+
+// testQuietLogger  A logger that goes nowhere, so benchmarks measure the cache and not the terminal
+func testQuietLogger() *log.Logger {
+	return log.New(ioutil.Discard, "", 0)
+}
+
+// testBenchKeys  Enough keys to spread over the shards, all of which fit in the cache at once
+func testBenchKeys() []string {
+	keys := make([]string, 0)
+
+	for i := 0; i < 1024; i++ {
+		keys = append(keys, fmt.Sprintf("bench-%d", i))
+	}
+
+	return keys
+}
+
+func testBenchShards() int {
+	return 32
+}
+
+// testBenchTtl  Long enough that nothing expires during a benchmark
+func testBenchTtl() time.Duration {
+	return time.Hour
+}
+
+// testParallelisms  Goroutines per GOMAXPROCS to run the benchmarks at
+func testParallelisms() []int {
+	return []int{1, 4, 16, 64}
+}
@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewShardedCache(t *testing.T) {
+	s := NewShardedCache(testShardCount(), testShardCapacity(), time.Second*3, unitTestFetchFunc, time.Second*1, "")
+
+	assert.Equal(t, testShardCount(), len(s.Shards), "asked for shard count is what we got")
+
+	for i, shard := range s.Shards {
+		assert.Equal(t, testShardShares()[i], shard.MaxEntries, "shard %d has it's share of the entries", i)
+	}
+
+	assert.Equal(t, testShardCapacity(), s.MaxEntries(), "shards add up to the requested capacity")
+
+	s = NewShardedCache(testShardCapacity()*2, testShardCapacity(), time.Second*3, unitTestFetchFunc, time.Second*1, "")
+
+	assert.Equal(t, testShardCapacity(), len(s.Shards), "no more shards than entries")
+
+	s = NewShardedCache(0, testShardCapacity(), time.Second*3, unitTestFetchFunc, time.Second*1, "")
+
+	assert.Equal(t, 1, len(s.Shards), "always at least one shard")
+}
+
+func TestNewShardedCache_MaxBytes(t *testing.T) {
+	s := NewShardedCache(testShardCount(), 0, time.Second*3, blobTestFetchFunc, time.Second*1, "", WithMaxBytes(testByteBudget()))
+
+	assert.Equal(t, testShardCount(), len(s.Shards), "no entry limit doesn't limit the shards")
+	assert.Equal(t, testByteBudget(), s.MaxBytes(), "shards add up to the byte budget")
+
+	for _, key := range testBlobKeys() {
+		_, err := s.Get(key)
+		if err != nil {
+			log.Printf("Error fetching key %s: %s", key, err)
+			t.Fail()
+		}
+	}
+
+	for i, shard := range s.Shards {
+		assert.True(t, shard.Bytes() <= shard.MaxBytes, "shard %d is within it's share of the budget", i)
+	}
+
+	assert.True(t, s.Bytes() <= testByteBudget(), "cache as a whole is within budget")
+}
+
+func TestNewShardedCache_TinyMaxBytes(t *testing.T) {
+	s := NewShardedCache(testShardCount(), 0, time.Second*3, blobTestFetchFunc, time.Second*1, "", WithMaxBytes(int64(testShardCount()/2)))
+
+	for i, shard := range s.Shards {
+		assert.True(t, shard.MaxBytes > 0, "shard %d has a budget, rather than no limit at all", i)
+	}
+}
+
+func TestShardedCache_Get(t *testing.T) {
+	s := NewShardedCache(testShardCount(), testShardCapacity(), time.Second*3, unitTestFetchFunc, time.Second*1, "")
+
+	for _, key := range []string{testFoo(), testBar(), testWip(), testZoz()} {
+		assert.True(t, s.Shard(key) == s.Shard(key), "a key always lands on the same shard")
+
+		entry, err := s.Get(key)
+		if err != nil {
+			log.Printf("Error fetching key %s: %s", key, err)
+			t.Fail()
+		}
+
+		if assert.NotNil(t, entry, "got an entry for %s", key) {
+			assert.Equal(t, key, entry.Value, "fetched string matches expectations")
+		}
+
+		shard := s.Shard(key)
+		shard.RLock()
+		_, ok := shard.Entries[key]
+		shard.RUnlock()
+
+		assert.True(t, ok, "entry went in the shard that owns it")
+	}
+
+	assert.Equal(t, 4, s.Len(), "four entries in cache")
+}
+
+func TestShardedCache_CacheLimit(t *testing.T) {
+	s := NewShardedCache(testShardCount(), testShardCapacity(), time.Second*3, keyTestFetchFunc, time.Second*1, "")
+
+	for _, key := range testStressKeys() {
+		_, err := s.Get(key)
+		if err != nil {
+			log.Printf("Error fetching key %s: %s", key, err)
+			t.Fail()
+		}
+	}
+
+	for i, shard := range s.Shards {
+		assert.Equal(t, shard.MaxEntries, shard.Len(), "shard %d is full, and no more", i)
+	}
+
+	assert.Equal(t, testShardCapacity(), s.Len(), "cache as a whole is full, and no more")
+}
+
+// TestShardedCache_ConcurrentStress is the same as TestCache_ConcurrentStress, over shards.  Run it with -race.
+func TestShardedCache_ConcurrentStress(t *testing.T) {
+	s := NewShardedCache(testShardCount(), testStressCapacity(), testStressTtl(), keyTestFetchFunc, time.Second*1, "", WithLogger(testQuietLogger()))
+
+	keys := testStressKeys()
+
+	wg := sync.WaitGroup{}
+
+	for w := 0; w < testStressWorkers(); w++ {
+		wg.Add(1)
+
+		go func(seed int64) {
+			defer wg.Done()
+
+			r := rand.New(rand.NewSource(seed))
+
+			for i := 0; i < testStressIterations(); i++ {
+				key := keys[r.Intn(1+r.Intn(len(keys)))]
+
+				entry, err := s.Get(key)
+				if err != nil {
+					log.Printf("Error fetching key %s: %s", key, err)
+					t.Fail()
+					continue
+				}
+
+				if entry == nil || entry.Value != key {
+					log.Printf("Wrong entry for %s: %v", key, entry)
+					t.Fail()
+				}
+			}
+		}(int64(w))
+	}
+
+	wg.Wait()
+
+	assert.True(t, s.Len() <= testStressCapacity(), "cache is within MaxEntries")
+}
+
+// benchmarkGets runs get over the bench keys at each of the test parallelisms.  Everything is a hit, so it's the locking that's being measured, not the fetching.
+func benchmarkGets(b *testing.B, get func(key string) (entry *CacheEntry, err error)) {
+	keys := testBenchKeys()
+
+	// warm it up
+	for _, key := range keys {
+		_, err := get(key)
+		if err != nil {
+			b.Fatalf("Error fetching key %s: %s", key, err)
+		}
+	}
+
+	for _, parallelism := range testParallelisms() {
+		b.Run(fmt.Sprintf("parallel-%d", parallelism), func(b *testing.B) {
+			b.SetParallelism(parallelism)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.Intn(len(keys))
+
+				for pb.Next() {
+					get(keys[i%len(keys)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkCache_Get(b *testing.B) {
+	c := NewCache(len(testBenchKeys()), testBenchTtl(), keyTestFetchFunc, time.Second*1, "", WithLogger(testQuietLogger()))
+
+	benchmarkGets(b, c.Get)
+}
+
+func BenchmarkShardedCache_Get(b *testing.B) {
+	// capacity to spare, as the keys won't hash perfectly evenly
+	s := NewShardedCache(testBenchShards(), len(testBenchKeys())*2, testBenchTtl(), keyTestFetchFunc, time.Second*1, "", WithLogger(testQuietLogger()))
+
+	benchmarkGets(b, s.Get)
+}
@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"sync/atomic"
+)
+
+// Stats  Counters for what a cache has been up to since it was made.
+type Stats struct {
+	// Hits  How many reads were answered from the cache, stale entries and negative ones included.
+	Hits uint64
+	// Misses  How many reads had to go upstream, whether or not they found anything there.
+	Misses uint64
+	// RefreshAheads  How many times a key was refreshed in the background because it was read close to it's expiry.
+	RefreshAheads uint64
+	// UsefulRefreshAheads  How many of those refreshed entries were read before they were replaced, purged or evicted.
+	UsefulRefreshAheads uint64
+	// NegativeHits  How many reads were answered by a negative entry, rather than asking upstream for a key that isn't there.
+	NegativeHits uint64
+	// NegativeEntries  How many of the entries in the cache right now are negative ones.
+	NegativeEntries int
+	// Invalidations  How many times a key was invalidated because it changed upstream, whether or not it was cached at the time.
+	Invalidations uint64
+	// Evictions  How many entries were evicted to keep the cache within it's limits.
+	Evictions uint64
+	// Expirations  How many entries were removed because they'd expired, whether by the janitor, or by a read that found them too stale to serve.
+	Expirations uint64
+	// Invalidated  How many entries were removed because they'd changed upstream, or might have, by Invalidate or Flush.
+	Invalidated uint64
+	// Purges  How many entries were removed because somebody said to, by Delete, Purge, PurgeMatching or PurgeAll.
+	Purges uint64
+	// FetchTimeouts  How many reads gave up waiting on a fetch after FetchTimeout.
+	FetchTimeouts uint64
+	// InFlight  How many fetches are underway right now.
+	InFlight int
+}
+
+// counters  The live counters behind Stats.  Bumped atomically, since they're bumped under different locks.
+type counters struct {
+	hits                uint64
+	misses              uint64
+	refreshAheads       uint64
+	usefulRefreshAheads uint64
+	negativeHits        uint64
+	invalidations       uint64
+	evictions           uint64
+	expirations         uint64
+	invalidated         uint64
+	purges              uint64
+	fetchTimeouts       uint64
+}
+
+// Stats  A snapshot of the cache's counters.
+func (c *Cache) Stats() Stats {
+	c.RLock()
+	negatives := c.negatives
+	c.RUnlock()
+
+	c.fetchLock.Lock()
+	inFlight := len(c.inFlight)
+	c.fetchLock.Unlock()
+
+	return Stats{
+		Hits:                atomic.LoadUint64(&c.counters.hits),
+		Misses:              atomic.LoadUint64(&c.counters.misses),
+		RefreshAheads:       atomic.LoadUint64(&c.counters.refreshAheads),
+		UsefulRefreshAheads: atomic.LoadUint64(&c.counters.usefulRefreshAheads),
+		NegativeHits:        atomic.LoadUint64(&c.counters.negativeHits),
+		NegativeEntries:     negatives,
+		Invalidations:       atomic.LoadUint64(&c.counters.invalidations),
+		Evictions:           atomic.LoadUint64(&c.counters.evictions),
+		Expirations:         atomic.LoadUint64(&c.counters.expirations),
+		Invalidated:         atomic.LoadUint64(&c.counters.invalidated),
+		Purges:              atomic.LoadUint64(&c.counters.purges),
+		FetchTimeouts:       atomic.LoadUint64(&c.counters.fetchTimeouts),
+		InFlight:            inFlight,
+	}
+}
+
+// Stats  The counters of all the shards, added up.
+func (s *ShardedCache) Stats() (stats Stats) {
+	for _, shard := range s.Shards {
+		stats = stats.plus(shard.Stats())
+	}
+
+	return stats
+}
+
+// plus  Two sets of stats, added together.
+func (s Stats) plus(other Stats) Stats {
+	return Stats{
+		Hits:                s.Hits + other.Hits,
+		Misses:              s.Misses + other.Misses,
+		RefreshAheads:       s.RefreshAheads + other.RefreshAheads,
+		UsefulRefreshAheads: s.UsefulRefreshAheads + other.UsefulRefreshAheads,
+		NegativeHits:        s.NegativeHits + other.NegativeHits,
+		NegativeEntries:     s.NegativeEntries + other.NegativeEntries,
+		Invalidations:       s.Invalidations + other.Invalidations,
+		Evictions:           s.Evictions + other.Evictions,
+		Expirations:         s.Expirations + other.Expirations,
+		Invalidated:         s.Invalidated + other.Invalidated,
+		Purges:              s.Purges + other.Purges,
+		FetchTimeouts:       s.FetchTimeouts + other.FetchTimeouts,
+		InFlight:            s.InFlight + other.InFlight,
+	}
+}
+
+// countLookup  Counts a read as a hit or a miss.
+func (c *Cache) countLookup(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.counters.hits, 1)
+		return
+	}
+
+	atomic.AddUint64(&c.counters.misses, 1)
+}
@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// testObservation  One fetch, as a FetchObserver saw it.
+type testObservation struct {
+	key    string
+	took   time.Duration
+	result FetchResult
+	err    error
+}
+
+// testObserver  A FetchObserver that remembers everything it's told.
+type testObserver struct {
+	sync.Mutex
+	observations []testObservation
+}
+
+// observe  The FetchObserver itself.
+func (o *testObserver) observe(key string, took time.Duration, result FetchResult, err error) {
+	o.Lock()
+	defer o.Unlock()
+
+	o.observations = append(o.observations, testObservation{key: key, took: took, result: result, err: err})
+}
+
+// Observations  Everything observed so far, in the order it was.
+func (o *testObserver) Observations() []testObservation {
+	o.Lock()
+	defer o.Unlock()
+
+	return append([]testObservation{}, o.observations...)
+}
+
+// clockedTestFetchFunc  A fetch func that knows about every key, like keyTestFetchFunc, but takes testFetchDelay on the given clock to do it, and fails for testBrokenKey.
+func clockedTestFetchFunc(clock *FakeClock) FetchFunc {
+	return func(key string, redisAddr string) (result FetchResult, err error) {
+		clock.Advance(testFetchDelay())
+
+		if key == testBrokenKey() {
+			return result, testFetchError()
+		}
+
+		return keyTestFetchFunc(key, redisAddr)
+	}
+}
@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCache_Stats(t *testing.T) {
+	clock := NewFakeClock(testEpoch())
+
+	c := NewCache(2, testStaleTtl(), keyTestFetchFunc, time.Second, "", WithClock(clock), WithLogger(testQuietLogger()))
+
+	for _, key := range []string{testFoo(), testBar(), testFoo()} {
+		_, err := c.Get(key)
+		assert.Nil(t, err, "no error getting %s", key)
+	}
+
+	assert.Equal(t, Stats{Hits: 1, Misses: 2}, c.Stats(), "one hit, and two misses")
+
+	// bar's the least recently used, so it makes way for wip
+	_, err := c.Get(testWip())
+	assert.Nil(t, err, "no error getting %s", testWip())
+
+	assert.Nil(t, c.Peek(testBar()), "bar was evicted")
+	assert.Equal(t, uint64(1), c.Stats().Evictions, "and that was counted")
+
+	assert.True(t, c.Delete(testWip()), "wip was deleted")
+	assert.False(t, c.Delete(testWip()), "and can't be deleted twice")
+	assert.Equal(t, uint64(1), c.Stats().Purges, "deleting it counts as a purge, once")
+
+	// a read that finds an expired entry removes it, and fetches a new one
+	clock.Advance(testStaleTtl())
+
+	_, err = c.Get(testFoo())
+	assert.Nil(t, err, "no error getting %s", testFoo())
+
+	// as does the janitor
+	clock.Advance(testStaleTtl())
+	assert.Equal(t, 1, c.Sweep(), "foo was swept")
+
+	for _, key := range []string{testBar(), testWip()} {
+		_, err = c.Get(key)
+		assert.Nil(t, err, "no error getting %s", key)
+	}
+
+	assert.Equal(t, 2, c.Flush(), "everything was flushed")
+
+	for _, key := range []string{testBar(), testWip()} {
+		_, err = c.Get(key)
+		assert.Nil(t, err, "no error getting %s", key)
+	}
+
+	assert.Equal(t, 1, c.Purge(testBar()), "bar was purged")
+	assert.True(t, c.Invalidate(testWip()), "and wip invalidated")
+
+	assert.Equal(t, Stats{Hits: 1, Misses: 8, Evictions: 1, Expirations: 2, Invalidations: 1, Invalidated: 3, Purges: 2}, c.Stats(), "everything was counted, and flushes and invalidations apart from purges")
+
+	for _, key := range []string{testBar(), testWip()} {
+		_, err = c.Get(key)
+		assert.Nil(t, err, "no error getting %s", key)
+	}
+
+	assert.Equal(t, 2, c.PurgeAll(), "everything was purged")
+	assert.Equal(t, uint64(4), c.Stats().Purges, "which counts as a purge")
+	assert.Equal(t, uint64(3), c.Stats().Invalidated, "rather than an invalidation")
+}
+
+func TestCache_StatsInFlight(t *testing.T) {
+	var calls int32
+
+	release := make(chan struct{})
+
+	c := NewCache(0, testStaleTtl(), gatedTestFetchFunc(&calls, release), 0, "", WithLogger(testQuietLogger()))
+
+	done := make(chan struct{})
+
+	go func() {
+		_, _ = c.Get(testFoo())
+		close(done)
+	}()
+
+	underway := waitFor(func() bool {
+		return c.Stats().InFlight == 1
+	})
+
+	assert.True(t, underway, "the fetch is counted while it's underway")
+
+	close(release)
+	<-done
+
+	assert.Equal(t, 0, c.Stats().InFlight, "and not once it's done")
+}
+
+func TestCache_FetchObserver(t *testing.T) {
+	clock := NewFakeClock(testEpoch())
+	observer := &testObserver{}
+
+	c := NewCache(0, testStaleTtl(), clockedTestFetchFunc(clock), 0, "", WithClock(clock), WithLogger(testQuietLogger()), WithFetchObserver(observer.observe))
+
+	for _, key := range []string{testFoo(), testFoo(), testBrokenKey()} {
+		_, _ = c.Get(key)
+	}
+
+	observations := observer.Observations()
+	if !assert.Len(t, observations, 2, "hits aren't fetches, so there's one for each key") {
+		return
+	}
+
+	assert.Equal(t, testFoo(), observations[0].key, "foo was fetched first")
+	assert.Equal(t, testFetchDelay(), observations[0].took, "and took as long as it took")
+	assert.Equal(t, testFoo(), observations[0].result.Value, "and found what there was to find")
+	assert.Nil(t, observations[0].err, "without any trouble")
+
+	assert.Equal(t, testBrokenKey(), observations[1].key, "the broken key was fetched next")
+	assert.EqualError(t, observations[1].err, testFetchError().Error(), "and it failed, as the fetch func said it did")
+
+	// batches are observed a key at a time
+	upstream := &testBatchUpstream{fetchFunc: keyTestFetchFunc}
+	c.BatchFetchFunc = upstream.fetch
+	c.LookupMany([]string{testBar(), testWip()})
+
+	assert.Len(t, observer.Observations(), 4, "both keys of the batch were observed")
+}
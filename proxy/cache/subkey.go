@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// subKeySeparator  What separates a key from the read in a sub key.  A NUL is about as unlikely as it gets in a key, but Redis keys can hold anything, and one's only a %00 away in a URL, so keys from clients are checked with CheckKey before they get anywhere near the cache.
+const subKeySeparator = "\x00"
+
+// CheckKey  Makes sure nothing in a key, or the read of part of it, as a client gave it, has the sub key separator in it.  A key that did could pass for a SubKey, and have a GET of "a\x00hget\x00f" run as an HGET.  Once it's in the cache there's no telling them apart, so everything that takes keys from clients checks them first.
+func CheckKey(parts ...string) (err error) {
+	for _, part := range parts {
+		if strings.Contains(part, subKeySeparator) {
+			err = errors.New(fmt.Sprintf("%q has a NUL in it, and keys can't", part))
+			return err
+		}
+	}
+
+	return err
+}
+
+// SubKey  The cache key for a read of part of a key, like one field of a hash, or a range of a list.  Every different read is cached on it's own, but they all go with the key they were read from.  They live on it's shard, fall under it's rule, and are invalidated along with it.
+func SubKey(key string, read ...string) string {
+	return strings.Join(append([]string{key}, read...), subKeySeparator)
+}
+
+// SplitSubKey  Splits a cache key back into the key it was read from, and the read.  For anything that isn't a SubKey, the read is empty.
+func SplitSubKey(cacheKey string) (key string, read []string) {
+	parts := strings.Split(cacheKey, subKeySeparator)
+
+	return parts[0], parts[1:]
+}
+
+// BaseKey  The key a cache key was read from.  For anything that isn't a SubKey, that's the key itself.
+func BaseKey(cacheKey string) string {
+	if i := strings.Index(cacheKey, subKeySeparator); i >= 0 {
+		return cacheKey[:i]
+	}
+
+	return cacheKey
+}
+
+// addSubKey  Notes that a sub key is cached, so it can be found when it's key is invalidated.  The caller is responsible for holding the write lock.
+func (c *Cache) addSubKey(cacheKey string) {
+	key := BaseKey(cacheKey)
+	if key == cacheKey {
+		return
+	}
+
+	if c.subKeys[key] == nil {
+		c.subKeys[key] = make(map[string]struct{})
+	}
+
+	c.subKeys[key][cacheKey] = struct{}{}
+}
+
+// dropSubKey  Notes that a sub key isn't cached any more.  The caller is responsible for holding the write lock.
+func (c *Cache) dropSubKey(cacheKey string) {
+	key := BaseKey(cacheKey)
+	if key == cacheKey {
+		return
+	}
+
+	delete(c.subKeys[key], cacheKey)
+
+	if len(c.subKeys[key]) == 0 {
+		delete(c.subKeys, key)
+	}
+}
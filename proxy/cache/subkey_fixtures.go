@@ -0,0 +1,10 @@
+package cache
+
+// testSubKeys  Reads of parts of testFoo, each of which is cached on it's own
+func testSubKeys() []string {
+	return []string{
+		SubKey(testFoo(), "hget", "name"),
+		SubKey(testFoo(), "lrange", "0", "9"),
+		SubKey(testFoo(), "sismember", ""),
+	}
+}
@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSubKey(t *testing.T) {
+	for _, subKey := range testSubKeys() {
+		key, read := SplitSubKey(subKey)
+		assert.Equal(t, testFoo(), key, "%q was read from %s", subKey, testFoo())
+		assert.NotEmpty(t, read, "%q is a read", subKey)
+		assert.Equal(t, subKey, SubKey(key, read...), "%q splits and joins back the same", subKey)
+		assert.Equal(t, testFoo(), BaseKey(subKey), "%q has %s for a base key", subKey, testFoo())
+	}
+
+	key, read := SplitSubKey(testFoo())
+	assert.Equal(t, testFoo(), key, "a plain key is it's own key")
+	assert.Empty(t, read, "with no read")
+	assert.Equal(t, testFoo(), BaseKey(testFoo()), "and it's own base key")
+}
+
+func TestCheckKey(t *testing.T) {
+	assert.Nil(t, CheckKey(testFoo()), "plain keys are fine")
+	assert.Nil(t, CheckKey(testFoo(), "hget", "name"), "and so are plain reads")
+	assert.Nil(t, CheckKey(), "as is nothing at all")
+
+	for _, subKey := range testSubKeys() {
+		assert.NotNil(t, CheckKey(subKey), "%q can't be passed off as a key", subKey)
+		assert.NotNil(t, CheckKey(testFoo(), "hget", subKey), "or a part of a read")
+	}
+}
+
+func TestCache_InvalidateSubKeys(t *testing.T) {
+	c := NewCache(0, time.Minute, keyTestFetchFunc, time.Second, "", WithLogger(testQuietLogger()))
+	defer c.Close()
+
+	for _, key := range append(testSubKeys(), testFoo(), testBar(), SubKey(testBar(), "hget", "name")) {
+		entry, err := c.Get(key)
+		if assert.Nil(t, err, "no error fetching %q", key) {
+			assert.Equal(t, key, entry.Value, "every read is cached on it's own")
+		}
+	}
+
+	assert.Equal(t, len(testSubKeys())+3, c.Len(), "everything was cached")
+
+	assert.True(t, c.Invalidate(testFoo()), "invalidated the key")
+	assert.Equal(t, 2, c.Len(), "along with every read of it, and nothing else")
+
+	// sub keys that have gone some other way aren't hanging about
+	c.Delete(SubKey(testBar(), "hget", "name"))
+	assert.Empty(t, c.subKeys, "sub keys aren't remembered once they're gone")
+
+	// invalidating a read on it's own leaves the key alone
+	c.Invalidate(SubKey(testBar(), "hget", "name"))
+	assert.Equal(t, 1, c.Len(), "the key's still cached")
+}
+
+func TestShardedCache_SubKeys(t *testing.T) {
+	s := NewShardedCache(testShardCount(), 0, time.Minute, keyTestFetchFunc, time.Second, "", WithLogger(testQuietLogger()))
+	defer s.Close()
+
+	for _, subKey := range testSubKeys() {
+		assert.True(t, s.Shard(subKey) == s.Shard(testFoo()), "%q lives with %s", subKey, testFoo())
+
+		_, err := s.Get(subKey)
+		assert.Nil(t, err, "no error fetching %q", subKey)
+	}
+
+	s.Invalidate(testFoo())
+	assert.Equal(t, 0, s.Len(), "invalidating the key took every read of it with it")
+}
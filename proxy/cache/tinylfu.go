@@ -0,0 +1,262 @@
+package cache
+
+import (
+	"container/list"
+)
+
+// Segments of a TinyLFUPolicy
+const (
+	segmentWindow = iota
+	segmentProbation
+	segmentProtected
+)
+
+// TinyLFUPolicy  W-TinyLFU, after Einziger, Friedman and Manes.  New keys land in a small LRU window.  Keys pushed out of the window become candidates for the main cache, a segmented LRU, and only get in if they've been asked for more often than the key they'd replace.  How often is estimated by a count-min sketch, which is halved every so often so that old popularity fades.
+//
+// A scan of keys that are only ever read once gets no further than the window, so it can't flush the hot set out of the main cache.
+type TinyLFUPolicy struct {
+	windowCapacity    int
+	protectedCapacity int
+	window            *list.List
+	probation         *list.List
+	protected         *list.List
+	elements          map[string]*list.Element
+	segments          map[string]int
+	sketch            *countMinSketch
+	// candidate  The last key pushed out of the window.  It has to beat the probation victim to stay.
+	candidate     string
+	haveCandidate bool
+}
+
+// NewTinyLFUPolicy  Creates a W-TinyLFU policy for a cache of the given capacity.  The window gets 1% of it, and the protected segment 80% of the rest.
+func NewTinyLFUPolicy(capacity int) EvictionPolicy {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	windowCapacity := maxInt(1, capacity/100)
+	mainCapacity := capacity - windowCapacity
+
+	return &TinyLFUPolicy{
+		windowCapacity:    windowCapacity,
+		protectedCapacity: mainCapacity * 8 / 10,
+		window:            list.New(),
+		probation:         list.New(),
+		protected:         list.New(),
+		elements:          make(map[string]*list.Element),
+		segments:          make(map[string]int),
+		sketch:            newCountMinSketch(capacity),
+	}
+}
+
+// Add  Counts the key, and puts it at the head of the window.  If that overflows the window, the eldest key in it moves to probation, and becomes the candidate for admission.
+func (p *TinyLFUPolicy) Add(key string) {
+	p.sketch.increment(key)
+
+	if _, ok := p.segments[key]; ok {
+		p.promote(key)
+		return
+	}
+
+	p.push(p.window, segmentWindow, key)
+
+	if p.window.Len() > p.windowCapacity {
+		eldest := p.window.Back().Value.(string)
+		p.forget(eldest)
+		p.push(p.probation, segmentProbation, eldest)
+		p.candidate = eldest
+		p.haveCandidate = true
+	}
+}
+
+// Access  Counts the key, and promotes it.
+func (p *TinyLFUPolicy) Access(key string) {
+	if _, ok := p.segments[key]; !ok {
+		return
+	}
+
+	p.sketch.increment(key)
+	p.promote(key)
+}
+
+// Remove  Forgets about a key.  It's count stays in the sketch.
+func (p *TinyLFUPolicy) Remove(key string) {
+	p.forget(key)
+
+	if p.candidate == key {
+		p.haveCandidate = false
+	}
+}
+
+// Victim  Pits the candidate against the eldest key in probation, and evicts whichever has been asked for less.  The candidate loses ties, since the incumbent has already proven itself once.
+func (p *TinyLFUPolicy) Victim() (key string, ok bool) {
+	switch {
+	case p.probation.Len() > 0:
+		incumbent := p.probation.Back().Value.(string)
+		key = incumbent
+
+		if p.haveCandidate && p.candidate != incumbent && p.segments[p.candidate] == segmentProbation {
+			if p.sketch.estimate(p.candidate) <= p.sketch.estimate(incumbent) {
+				key = p.candidate
+			}
+		}
+
+	case p.protected.Len() > 0:
+		key = p.protected.Back().Value.(string)
+
+	case p.window.Len() > 0:
+		key = p.window.Back().Value.(string)
+
+	default:
+		return key, ok
+	}
+
+	p.Remove(key)
+
+	return key, true
+}
+
+// Len  The number of keys across all the segments.
+func (p *TinyLFUPolicy) Len() int {
+	return p.window.Len() + p.probation.Len() + p.protected.Len()
+}
+
+// promote  A read in the window or protected segment moves the key to the head of it.  A read in probation moves the key up to protected, demoting protected's eldest to probation if there's no room.
+func (p *TinyLFUPolicy) promote(key string) {
+	switch p.segments[key] {
+	case segmentWindow:
+		p.window.MoveToFront(p.elements[key])
+
+	case segmentProtected:
+		p.protected.MoveToFront(p.elements[key])
+
+	case segmentProbation:
+		p.forget(key)
+		p.push(p.protected, segmentProtected, key)
+
+		if p.candidate == key {
+			p.haveCandidate = false
+		}
+
+		if p.protected.Len() > p.protectedCapacity {
+			eldest := p.protected.Back().Value.(string)
+			p.forget(eldest)
+			p.push(p.probation, segmentProbation, eldest)
+		}
+	}
+}
+
+// push  Puts a key at the head of a segment.
+func (p *TinyLFUPolicy) push(l *list.List, segment int, key string) {
+	p.elements[key] = l.PushFront(key)
+	p.segments[key] = segment
+}
+
+// forget  Takes a key out of whichever segment it's in.
+func (p *TinyLFUPolicy) forget(key string) {
+	segment, ok := p.segments[key]
+	if !ok {
+		return
+	}
+
+	switch segment {
+	case segmentWindow:
+		p.window.Remove(p.elements[key])
+	case segmentProbation:
+		p.probation.Remove(p.elements[key])
+	case segmentProtected:
+		p.protected.Remove(p.elements[key])
+	}
+
+	delete(p.elements, key)
+	delete(p.segments, key)
+}
+
+// countMinSketch  Estimates how often keys have been seen, in a fixed amount of memory.  Four rows of 4 bit counters, each key hashed to one counter per row.  The estimate is the smallest of the four, which can over count thanks to collisions, but never under counts.
+//
+// Once it's seen ten times as many increments as the cache holds, every counter is halved, so the counts reflect recent popularity rather than all time popularity.
+type countMinSketch struct {
+	rows       [4][]uint8
+	mask       uint32
+	additions  int
+	sampleSize int
+}
+
+// newCountMinSketch  Creates a sketch sized for a cache of the given capacity.
+func newCountMinSketch(capacity int) *countMinSketch {
+	// a power of two, at least as big as the capacity, so indexing is a mask rather than a mod
+	width := 16
+	for width < capacity {
+		width *= 2
+	}
+
+	s := &countMinSketch{
+		mask:       uint32(width - 1),
+		sampleSize: 10 * capacity,
+	}
+
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+
+	return s
+}
+
+// indexes  Where the key lands in each row.  Double hashing off of the FNV hash, so we only hash the key once.
+func (s *countMinSketch) indexes(key string) (indexes [4]uint32) {
+	h1 := hashKey(key)
+
+	// murmur3's finalizer, to get a second, independent-ish hash
+	h2 := h1
+	h2 ^= h2 >> 16
+	h2 *= 0x85ebca6b
+	h2 ^= h2 >> 13
+	h2 *= 0xc2b2ae35
+	h2 ^= h2 >> 16
+	h2 |= 1
+
+	for i := range indexes {
+		indexes[i] = (h1 + uint32(i)*h2) & s.mask
+	}
+
+	return indexes
+}
+
+// increment  Counts a sighting of the key.
+func (s *countMinSketch) increment(key string) {
+	for i, index := range s.indexes(key) {
+		if s.rows[i][index] < 15 {
+			s.rows[i][index]++
+		}
+	}
+
+	s.additions++
+
+	if s.additions >= s.sampleSize {
+		s.reset()
+	}
+}
+
+// estimate  How many times the key has been seen, give or take.
+func (s *countMinSketch) estimate(key string) uint8 {
+	estimate := uint8(15)
+
+	for i, index := range s.indexes(key) {
+		if s.rows[i][index] < estimate {
+			estimate = s.rows[i][index]
+		}
+	}
+
+	return estimate
+}
+
+// reset  Halves every counter.
+func (s *countMinSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] /= 2
+		}
+	}
+
+	s.additions /= 2
+}
@@ -17,6 +17,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
@@ -26,8 +27,36 @@ import (
 var cfgFile string
 var redisAddr string
 var cacheExpirationSeconds int
+var negativeExpirationSeconds int
+var ignoreUpstreamTtl bool
+var expirationJitter string
+var invalidate bool
+var invalidateFlush bool
+var notifyKeyspaceEvents string
+var tracking string
+var trackingPrefixes []string
 var cacheCapacity int
 var cachePort int
+var respPort int
+var adminPort int
+var metricsPort int
+var legacyStatus bool
+var cacheShards int
+var evictionPolicy string
+var maxMemory string
+var sweepInterval time.Duration
+var sweepSample int
+var staleWhileRevalidate time.Duration
+var staleIfError time.Duration
+var refreshAhead float64
+var poolSize int
+var minIdleConns int
+var dialTimeout time.Duration
+var readTimeout time.Duration
+var writeTimeout time.Duration
+var idleTimeout time.Duration
+var idleCheckFrequency time.Duration
+var maxElements int64
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
@@ -64,15 +93,43 @@ func init() {
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
-	//RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.foo.yaml)")
+	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "Config file, for things too involved for flags, like caching rules.  Default $HOME/.redisproxy.yaml, if there is one.")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	//RootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	RootCmd.PersistentFlags().StringVarP(&redisAddr, "redis", "r", "redis", "Redis address or hostname.  Default 'redis'")
 	RootCmd.PersistentFlags().IntVarP(&cachePort, "port", "p", 5000, "Port for the Cache to listen on. Default 5000")
+	RootCmd.PersistentFlags().IntVarP(&respPort, "resp-port", "P", 0, "Port for the Cache to speak the Redis protocol on, like 6380.  Anyone who can reach it can read through the cache, so it's opt in.  Default 0 (disabled).")
+	RootCmd.PersistentFlags().IntVar(&adminPort, "admin-port", 0, "Port for the admin API, for inspecting and purging the cache, and for metrics.  Keep it away from your clients.  Default 0 (disabled).")
+	RootCmd.PersistentFlags().IntVar(&metricsPort, "metrics-port", 5001, "Port for Prometheus metrics, at /metrics, and nothing else.  They're on the admin port as well, if there is one.  Default 5001.  0 disables it.")
+	RootCmd.PersistentFlags().BoolVar(&legacyStatus, "legacy-status", false, "Reply 200 to every text request over http, with (nil) for missing keys and an Error: line for failures, the way the proxy used to.  JSON and raw replies get proper statuses regardless.  Default false.")
 	RootCmd.PersistentFlags().IntVarP(&cacheExpirationSeconds, "expiration", "e", 5, "Cache item expiration in seconds.  Default 5.")
-	RootCmd.PersistentFlags().IntVarP(&cacheCapacity, "capacity", "c", 100, "Cache capacity. Default 100.")
+	RootCmd.PersistentFlags().IntVar(&negativeExpirationSeconds, "negative-expiration", 0, "How long to remember, in seconds, that a key doesn't exist in Redis.  Default 0 (don't.  Ask Redis every time).")
+	RootCmd.PersistentFlags().BoolVar(&ignoreUpstreamTtl, "ignore-upstream-ttl", false, "Cache keys for the full expiration, even if they expire sooner in Redis.  Default false (entries never outlive the key upstream).")
+	RootCmd.PersistentFlags().StringVar(&expirationJitter, "expiration-jitter", "0", "Knock up to this much off each entry's expiration, at random, so entries fetched together don't all expire together.  A percentage of the expiration, like 10%, or a duration, like 5s.  Default 0 (no jitter).")
+	RootCmd.PersistentFlags().BoolVar(&invalidate, "invalidate", false, "Subscribe to Redis' keyevent notifications, and drop keys from the cache as soon as they change.  Redis has to have notify-keyspace-events set for this, or see --notify-keyspace-events.  Default false.")
+	RootCmd.PersistentFlags().BoolVar(&invalidateFlush, "invalidate-flush", false, "With --invalidate, flush the whole cache whenever the subscription comes back after being interrupted, as changes may have been missed.  Default false.")
+	RootCmd.PersistentFlags().StringVar(&notifyKeyspaceEvents, "notify-keyspace-events", "", "With --invalidate, CONFIG SET Redis' notify-keyspace-events to this every time the proxy subscribes, e.g. Eg$xe.  Default '' (leave Redis' config alone).")
+	RootCmd.PersistentFlags().StringVar(&tracking, "tracking", "", "Have Redis 6 or better push invalidations for cached keys with client side caching.  'default' tracks the keys the proxy reads, 'broadcast' every key under --tracking-prefix.  Default '' (off).")
+	RootCmd.PersistentFlags().StringSliceVar(&trackingPrefixes, "tracking-prefix", []string{}, "With --tracking broadcast, a key prefix to hear about.  Give it more than once for more prefixes.  Default none (every key).")
+	RootCmd.PersistentFlags().IntVarP(&cacheCapacity, "capacity", "c", 100, "Cache capacity in entries.  0 for no limit, in which case you'll want --max-memory.  Default 100.")
+	RootCmd.PersistentFlags().StringVar(&maxMemory, "max-memory", "0", "Evict to keep the estimated size of the cache under this, e.g. 512mb or 2g.  Works alongside --capacity.  Default 0 (no limit).")
+	RootCmd.PersistentFlags().DurationVar(&sweepInterval, "sweep-interval", 0, "How often to sweep stale entries out of the cache in the background.  Default 0 (never.  Stale entries go when they're next read, or evicted).")
+	RootCmd.PersistentFlags().IntVar(&sweepSample, "sweep-sample", 20, "How many entries each sweep looks at, to start with.  0 looks at them all.  Default 20.")
+	RootCmd.PersistentFlags().DurationVar(&staleWhileRevalidate, "stale-while-revalidate", 0, "For this long after an entry expires, serve it stale while a fresh one is fetched in the background.  Default 0 (never).")
+	RootCmd.PersistentFlags().DurationVar(&staleIfError, "stale-if-error", 0, "For this long after an entry expires, serve it stale if fetching a fresh one fails.  Default 0 (never).")
+	RootCmd.PersistentFlags().Float64Var(&refreshAhead, "refresh-ahead", 0, "Refresh entries in the background when they're read in this last fraction of their expiration, e.g. 0.2 for the last fifth.  Default 0 (never).")
+	RootCmd.PersistentFlags().IntVar(&cacheShards, "shards", 1, "Number of independently locked shards to split the cache over.  Capacity is divided between them.  Default 1.")
+	RootCmd.PersistentFlags().StringVar(&evictionPolicy, "policy", "lru", "Eviction policy.  One of lru, lfu, arc or tinylfu.  Default lru.")
+	RootCmd.PersistentFlags().IntVar(&poolSize, "pool-size", 0, "Max connections to upstream Redis.  Default 0 (10 per CPU).")
+	RootCmd.PersistentFlags().IntVar(&minIdleConns, "min-idle", 0, "Idle connections to upstream Redis to keep around.  Default 0.")
+	RootCmd.PersistentFlags().DurationVar(&dialTimeout, "dial-timeout", time.Second*5, "Timeout for connecting to upstream Redis.  Default 5s.")
+	RootCmd.PersistentFlags().DurationVar(&readTimeout, "read-timeout", time.Second*3, "Timeout for reads from upstream Redis.  Default 3s.")
+	RootCmd.PersistentFlags().DurationVar(&writeTimeout, "write-timeout", time.Second*3, "Timeout for writes to upstream Redis.  Default 3s.")
+	RootCmd.PersistentFlags().DurationVar(&idleTimeout, "idle-timeout", time.Minute*5, "Idle upstream connections older than this are closed.  Default 5m.")
+	RootCmd.PersistentFlags().DurationVar(&idleCheckFrequency, "idle-check", time.Minute, "How often to reap idle upstream connections.  Default 1m.")
+	RootCmd.PersistentFlags().Int64Var(&maxElements, "max-elements", 10000, "Hashes, lists, sets, sorted sets and streams are cached up to this many elements.  0 caches them whole.  Default 10000.")
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -88,9 +145,9 @@ func initConfig() {
 			os.Exit(1)
 		}
 
-		// Search config in home directory with name ".foo" (without extension).
+		// Search config in home directory with name ".redisproxy" (without extension).
 		viper.AddConfigPath(home)
-		viper.SetConfigName(".foo")
+		viper.SetConfigName(".redisproxy")
 	}
 
 	viper.AutomaticEnv() // read in environment variables that match
@@ -16,10 +16,16 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/nikogura/redisproxy/proxy/cache"
 	"github.com/nikogura/redisproxy/proxy/service"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"log"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 )
 
 var runCmd = &cobra.Command{
@@ -36,13 +42,154 @@ Does not detatch from the console.
 		port := fmt.Sprintf(":%s", portString)
 
 		log.Printf("Starting Cache on port %s\n", port)
+		if respPort != 0 {
+			log.Printf("Speaking RESP on port :%d\n", respPort)
+		}
+		if adminPort != 0 {
+			log.Printf("Serving the admin API on port :%d\n", adminPort)
+		}
+		if metricsPort != 0 {
+			log.Printf("Serving metrics on port :%d\n", metricsPort)
+		}
 		log.Printf("Cache Expiration: %d seconds\n", cacheExpirationSeconds)
+		if negativeExpirationSeconds > 0 {
+			log.Printf("Negative Cache Expiration: %d seconds\n", negativeExpirationSeconds)
+		}
+		if ignoreUpstreamTtl {
+			log.Printf("Ignoring Upstream TTLs\n")
+		}
+		log.Printf("Cache Expiration Jitter: %s\n", expirationJitter)
+		if tracking != "" {
+			log.Printf("Client Tracking: %s %v\n", tracking, trackingPrefixes)
+		}
+		if invalidate {
+			log.Printf("Invalidating On Keyevent Notifications.  Flushing When Interrupted: %t\n", invalidateFlush)
+		}
 		log.Printf("Cache Capacity: %d entries\n", cacheCapacity)
+		log.Printf("Cache Memory Limit: %s\n", maxMemory)
+		log.Printf("Cache Shards: %d\n", cacheShards)
+		if sweepInterval > 0 {
+			log.Printf("Sweeping Stale Entries Every: %s\n", sweepInterval)
+		}
+		log.Printf("Eviction Policy: %s\n", evictionPolicy)
+		if staleWhileRevalidate > 0 {
+			log.Printf("Stale While Revalidate: %s\n", staleWhileRevalidate)
+		}
+		if staleIfError > 0 {
+			log.Printf("Stale If Error: %s\n", staleIfError)
+		}
+		if refreshAhead > 0 {
+			log.Printf("Refresh Ahead: last %.0f%% of expiration\n", refreshAhead*100)
+		}
 		log.Printf("Upstream Redis Instance: %q\n", redisAddr)
 
-		proxy := service.NewProxy(cachePort, cacheCapacity, cacheExpirationSeconds, 5, redisAddr)
+		policy, err := cache.PolicyByName(evictionPolicy)
+		if err != nil {
+			log.Fatalf("Error choosing eviction policy: %s", err)
+		}
+
+		maxBytes, err := cache.ParseBytes(maxMemory)
+		if err != nil {
+			log.Fatalf("Error parsing max memory: %s", err)
+		}
+
+		jitterFraction, jitterRange, err := cache.ParseJitter(expirationJitter)
+		if err != nil {
+			log.Fatalf("Error parsing expiration jitter: %s", err)
+		}
+
+		// rules only come from the config file.  They're too much for flags.
+		var ruleConfigs []cache.RuleConfig
+
+		err = viper.UnmarshalKey("rules", &ruleConfigs)
+		if err != nil {
+			log.Fatalf("Error reading caching rules: %s", err)
+		}
+
+		rules, err := cache.ParseRules(ruleConfigs)
+		if err != nil {
+			log.Fatalf("Error parsing caching rules: %s", err)
+		}
+
+		for _, config := range ruleConfigs {
+			log.Printf("Caching Rule: %+v\n", config)
+		}
+
+		upstream := service.UpstreamOptions{
+			PoolSize:           poolSize,
+			MinIdleConns:       minIdleConns,
+			DialTimeout:        dialTimeout,
+			ReadTimeout:        readTimeout,
+			WriteTimeout:       writeTimeout,
+			IdleTimeout:        idleTimeout,
+			IdleCheckFrequency: idleCheckFrequency,
+			MaxElements:        maxElements,
+		}
+
+		options := []cache.Option{
+			cache.WithPolicy(policy),
+			cache.WithMaxBytes(maxBytes),
+			cache.WithJanitor(sweepInterval, sweepSample),
+			cache.WithStaleWhileRevalidate(staleWhileRevalidate),
+			cache.WithStaleIfError(staleIfError),
+			cache.WithRefreshAhead(refreshAhead),
+			cache.WithNegativeTtl(time.Duration(negativeExpirationSeconds) * time.Second),
+			cache.WithJitter(jitterFraction),
+			cache.WithJitterRange(jitterRange),
+			cache.WithRules(rules),
+		}
+
+		if ignoreUpstreamTtl {
+			options = append(options, cache.WithIgnoreUpstreamTtl())
+		}
+
+		proxy := service.NewProxy(cachePort, respPort, cacheCapacity, cacheExpirationSeconds, 5, redisAddr, upstream, cacheShards, options...)
+		proxy.LegacyStatus = legacyStatus
+
+		if adminPort != 0 {
+			proxy.AdminPort = fmt.Sprintf(":%d", adminPort)
+		}
+
+		// the admin API has metrics already, and the port can't be listened on twice
+		if metricsPort != 0 && metricsPort != adminPort {
+			proxy.MetricsPort = fmt.Sprintf(":%d", metricsPort)
+		}
+
+		if invalidate {
+			invalidation := service.DefaultInvalidationOptions()
+			invalidation.FlushOnResubscribe = invalidateFlush
+			invalidation.NotifyKeyspaceEvents = notifyKeyspaceEvents
+
+			proxy.Invalidation = &invalidation
+		}
+
+		switch tracking {
+		case "":
+		case "default", "broadcast":
+			options := service.DefaultTrackingOptions()
+			options.Broadcast = tracking == "broadcast"
+			options.Prefixes = trackingPrefixes
+
+			proxy.Tracking = &options
+		default:
+			log.Fatalf("Unknown tracking mode %q.  Choose from default or broadcast", tracking)
+		}
+
+		// shut down politely when asked
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+		go func() {
+			sig := <-signals
+			log.Printf("Received %s.  Shutting down.\n", sig)
+
+			err := proxy.Close()
+			if err != nil {
+				log.Printf("Error closing proxy: %s", err)
+			}
+		}()
 
-		err := proxy.Run()
+		err = proxy.Run()
 		if err != nil {
 			log.Fatalf("Error Running proxy: %s", err)
 		}
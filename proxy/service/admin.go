@@ -0,0 +1,339 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/pkg/errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Paths on the admin listener.  Keys go on the end of keysPath and refreshPath, escaped as they would be in any other url.
+const (
+	keysPath    = "/keys"
+	flushPath   = "/flush"
+	refreshPath = "/refresh/"
+)
+
+// How many keys a page of keys has, unless the client says otherwise, and the most it can have if it does.
+const (
+	defaultKeysLimit = 100
+	maxKeysLimit     = 1000
+)
+
+// adminEntry  What the admin API says about an entry.  Everything but it's value, which is what the data port is for.
+type adminEntry struct {
+	Key string `json:"key"`
+	// Read  For partial reads, which read it was, and it's arguments.
+	Read []string `json:"read,omitempty"`
+	Type string   `json:"type"`
+	// Size  Roughly how many bytes the entry takes up in the cache.
+	Size int64 `json:"size"`
+	// Hits  How many times it's been read from the cache since it was fetched.
+	Hits    uint64    `json:"hits"`
+	Fetched time.Time `json:"fetched"`
+	Expires time.Time `json:"expires"`
+	AgeMs   int64     `json:"age_ms"`
+	TtlMs   int64     `json:"ttl_ms"`
+	// Expired  Past it's expiry, but not yet swept out, or still being served stale.
+	Expired bool   `json:"expired"`
+	Rule    string `json:"rule"`
+}
+
+// newAdminEntry  What the admin API says about an entry.  Negative entries aren't for showing, as there's nothing there.
+func newAdminEntry(entry *cache.CacheEntry) adminEntry {
+	key, read := cache.SplitSubKey(entry.Key)
+
+	return adminEntry{
+		Key:     key,
+		Read:    read,
+		Type:    entryType(entry),
+		Size:    entry.Size,
+		Hits:    entry.Hits,
+		Fetched: entry.Fetched,
+		Expires: entry.Expires,
+		AgeMs:   int64(entry.Age() / time.Millisecond),
+		TtlMs:   int64(entry.Remaining() / time.Millisecond),
+		Expired: !entry.Fresh(),
+		Rule:    entry.Rule.String(),
+	}
+}
+
+// adminKeysReply  A page of keys.  Total is how many keys there are with the prefix, all told.  Next is the offset of the next page, if there is one.
+type adminKeysReply struct {
+	Keys  []adminEntry `json:"keys"`
+	Total int          `json:"total"`
+	Next  int          `json:"next,omitempty"`
+}
+
+// adminPurgeReply  How many entries went, sub keys and all, when keys were purged or flushed.
+type adminPurgeReply struct {
+	Purged int `json:"purged"`
+}
+
+// AdminHandler  The http handler for the admin API, for seeing what's in the cache, and getting rid of it.  It's served on a port of it's own by RunAdmin, so that it can be kept away from whoever reads through the proxy.
+//
+//	GET    /keys?prefix=user:&offset=0&limit=100   a page of keys, sorted, with what's known about each
+//	DELETE /keys?pattern=user:*                    purges every key matching a glob
+//	GET    /keys/{key}                             what's known about one key
+//	DELETE /keys/{key}                             purges one key
+//	POST   /refresh/{key}                          fetches a key afresh from Redis, however fresh it is
+//	POST   /flush                                  purges the lot
+//	GET    /metrics                                metrics, for Prometheus to scrape
+//
+// Purging a key takes any partial reads of it along with it.  Every request but a scrape is logged, along with what came of it.
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(keysPath, p.handleAdminKeys)
+	mux.HandleFunc(keysPath+"/", p.handleAdminKey)
+	mux.HandleFunc(refreshPath, p.handleAdminRefresh)
+	mux.HandleFunc(flushPath, p.handleAdminFlush)
+	mux.HandleFunc(metricsPath, p.HandleMetrics)
+
+	return mux
+}
+
+// RunAdmin  Runs the admin API on it's own port.  It does not detatch from the console
+func (p *Proxy) RunAdmin() (err error) {
+	server := &http.Server{
+		Addr:    p.AdminPort,
+		Handler: p.AdminHandler(),
+	}
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return err
+	}
+
+	p.adminServer = server
+	p.lock.Unlock()
+
+	err = server.ListenAndServe()
+
+	// being shut down on purpose isn't an error
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+
+	return err
+}
+
+// adminMethod  Whether the request's method is one of those allowed.  If not, says so, with a 405.
+func adminMethod(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+	for _, method := range allowed {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	log.Printf("Admin: %s %s from %s isn't allowed\n", r.Method, r.URL, r.RemoteAddr)
+
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeFailure(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, jsonReply{Type: typeNone}, errors.New(fmt.Sprintf("%s isn't supported here.  Try %s", r.Method, strings.Join(allowed, " or "))))
+
+	return false
+}
+
+// adminKey  The key on the end of a path, after prefix.  %2F for a / in the key is fine, but so is a plain /, since nothing comes after the key.
+func adminKey(r *http.Request, prefix string) (key string, err error) {
+	key, err = url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), prefix))
+	if err != nil {
+		return key, err
+	}
+
+	if key == "" {
+		err = errors.New(fmt.Sprintf("no key.  Ask for %s{key}", prefix))
+		return key, err
+	}
+
+	err = cache.CheckKey(key)
+
+	return key, err
+}
+
+// writeAdmin  Replies to an admin request with JSON.  Admin replies are never to be cached, since the whole point is to see what's there now.
+func writeAdmin(w http.ResponseWriter, reply interface{}) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", contentTypes[formatJson])
+
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Printf("Admin: failed to write reply: %s\n", err)
+	}
+}
+
+// handleAdminKeys  Lists keys a page at a time, or purges those matching a pattern.
+func (p *Proxy) handleAdminKeys(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodGet, http.MethodHead, http.MethodDelete) {
+		return
+	}
+
+	query := r.URL.Query()
+
+	if r.Method == http.MethodDelete {
+		// no pattern isn't taken for 'everything'.  That's what flush is for.
+		pattern := query.Get("pattern")
+		if pattern == "" {
+			writeFailure(w, http.StatusBadRequest, codeBadRequest, jsonReply{Type: typeNone}, errors.New("no pattern.  Purge keys with DELETE /keys?pattern=glob, or everything with POST /flush"))
+			return
+		}
+
+		purged, err := p.Cache.PurgeMatching(pattern)
+		if err != nil {
+			writeFailure(w, http.StatusBadRequest, codeBadRequest, jsonReply{Type: typeNone}, err)
+			return
+		}
+
+		log.Printf("Admin: %s purged %d entries matching %q\n", r.RemoteAddr, purged, pattern)
+
+		writeAdmin(w, adminPurgeReply{Purged: purged})
+		return
+	}
+
+	offset, err := queryInt(query, "offset", 0)
+	if err == nil && offset < 0 {
+		err = errors.New(fmt.Sprintf("offset must be 0 or more, not %d", offset))
+	}
+
+	if err != nil {
+		writeFailure(w, http.StatusBadRequest, codeBadRequest, jsonReply{Type: typeNone}, err)
+		return
+	}
+
+	limit, err := queryInt(query, "limit", defaultKeysLimit)
+	if err == nil && (limit < 1 || limit > maxKeysLimit) {
+		err = errors.New(fmt.Sprintf("limit must be from 1 to %d, not %d", maxKeysLimit, limit))
+	}
+
+	if err != nil {
+		writeFailure(w, http.StatusBadRequest, codeBadRequest, jsonReply{Type: typeNone}, err)
+		return
+	}
+
+	prefix := query.Get("prefix")
+
+	// entries are picked out before they're paged, so that pages, and the total, only count what's listed.  An entry may have gone since the keys were listed, and keys that are only cached as missing from Redis aren't there to list at all.
+	entries := make([]*cache.CacheEntry, 0)
+	for _, key := range p.Cache.Keys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		entry := p.Cache.Peek(key)
+		if entry.Missing() {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	reply := adminKeysReply{
+		Keys:  make([]adminEntry, 0),
+		Total: len(entries),
+	}
+
+	for i := offset; i < len(entries) && len(reply.Keys) < limit; i++ {
+		reply.Keys = append(reply.Keys, newAdminEntry(entries[i]))
+	}
+
+	if offset+limit < len(entries) {
+		reply.Next = offset + limit
+	}
+
+	log.Printf("Admin: %s listed %d of %d keys starting %q, from %d\n", r.RemoteAddr, len(reply.Keys), reply.Total, prefix, offset)
+
+	writeAdmin(w, reply)
+}
+
+// handleAdminKey  Shows, or purges, a single key.
+func (p *Proxy) handleAdminKey(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodGet, http.MethodHead, http.MethodDelete) {
+		return
+	}
+
+	key, err := adminKey(r, keysPath+"/")
+	if err != nil {
+		writeFailure(w, http.StatusBadRequest, codeBadRequest, jsonReply{Type: typeNone}, err)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		purged := p.Cache.Purge(key)
+
+		log.Printf("Admin: %s purged %q, and %d entries with it\n", r.RemoteAddr, key, purged)
+
+		writeAdmin(w, adminPurgeReply{Purged: purged})
+		return
+	}
+
+	log.Printf("Admin: %s inspected %q\n", r.RemoteAddr, key)
+
+	entry := p.Cache.Peek(key)
+	if entry == nil {
+		writeFailure(w, http.StatusNotFound, codeNotFound, newJsonReply(key, p.Cache.Rule(key)), errors.New("not in the cache"))
+		return
+	}
+
+	if entry.Missing() {
+		writeFailure(w, http.StatusNotFound, codeNotFound, newJsonReply(key, p.Cache.Rule(key)), errors.New("cached as missing from Redis"))
+		return
+	}
+
+	writeAdmin(w, newAdminEntry(entry))
+}
+
+// handleAdminRefresh  Fetches a key afresh from Redis, and replies with what's cached now.
+func (p *Proxy) handleAdminRefresh(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	key, err := adminKey(r, refreshPath)
+	if err != nil {
+		writeFailure(w, http.StatusBadRequest, codeBadRequest, jsonReply{Type: typeNone}, err)
+		return
+	}
+
+	entry, err := p.Cache.ForceRefresh(key)
+	if err != nil {
+		log.Printf("Admin: %s failed to refresh %q: %s\n", r.RemoteAddr, key, err)
+
+		status, code := fetchFailure(err)
+		writeFailure(w, status, code, newJsonReply(key, p.Cache.Rule(key)), err)
+		return
+	}
+
+	// with negative caching on, a key that isn't in Redis comes back as a negative entry, rather than none at all
+	if entry.Missing() {
+		log.Printf("Admin: %s refreshed %q, which isn't in Redis\n", r.RemoteAddr, key)
+
+		writeFailure(w, http.StatusNotFound, codeNotFound, newJsonReply(key, p.Cache.Rule(key)), errNotFound)
+		return
+	}
+
+	log.Printf("Admin: %s refreshed %q\n", r.RemoteAddr, key)
+
+	writeAdmin(w, newAdminEntry(entry))
+}
+
+// handleAdminFlush  Purges everything.
+func (p *Proxy) handleAdminFlush(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	flushed := p.Cache.PurgeAll()
+
+	log.Printf("Admin: %s flushed the cache, and %d entries with it\n", r.RemoteAddr, flushed)
+
+	writeAdmin(w, adminPurgeReply{Purged: flushed})
+}
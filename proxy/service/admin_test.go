@@ -0,0 +1,374 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/phayes/freeport"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// adminTestProxy  A proxy with every one of testAdminKeys cached, on a fake clock, and the admin API's handler
+func adminTestProxy(t *testing.T, fetcher cache.FetchFunc, options ...cache.Option) (p *Proxy, clock *cache.FakeClock, handler http.Handler) {
+	clock = cache.NewFakeClock(testEpoch())
+
+	p = TestProxy(0, 0, testAdminCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), fetcher, append([]cache.Option{cache.WithClock(clock)}, options...)...)
+
+	for _, key := range testAdminKeys() {
+		_, err := p.Cache.Get(key)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %s", key, err)
+		}
+	}
+
+	return p, clock, p.AdminHandler()
+}
+
+// adminRequest  Makes a request of the admin API, and decodes the JSON that comes back into reply
+func adminRequest(handler http.Handler, method string, path string, reply interface{}) (status int, err error) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+
+	err = json.NewDecoder(w.Body).Decode(reply)
+
+	return w.Code, err
+}
+
+func TestProxy_AdminKeys(t *testing.T) {
+	p, _, handler := adminTestProxy(t, statusTestFetchFunc)
+	defer p.Close()
+
+	keys := testAdminKeys()
+
+	cases := []struct {
+		path  string
+		keys  []string
+		total int
+		next  int
+	}{
+		{"/keys", keys, len(keys), 0},
+		{"/keys?limit=2", keys[:2], len(keys), 2},
+		{"/keys?limit=2&offset=2", keys[2:4], len(keys), 4},
+		{"/keys?limit=2&offset=4", keys[4:], len(keys), 0},
+		{"/keys?offset=10", []string{}, len(keys), 0},
+		{"/keys?prefix=" + testWip()[:1], []string{testWip()}, 1, 0},
+		{"/keys?prefix=nope", []string{}, 0, 0},
+	}
+
+	for _, c := range cases {
+		var reply adminKeysReply
+
+		status, err := adminRequest(handler, http.MethodGet, c.path, &reply)
+		if !assert.Nil(t, err, "%s replies with JSON", c.path) {
+			continue
+		}
+
+		listed := make([]string, 0)
+		for _, entry := range reply.Keys {
+			listed = append(listed, entry.Key)
+		}
+
+		assert.Equal(t, http.StatusOK, status, "status for %s", c.path)
+		assert.Equal(t, c.keys, listed, "keys for %s", c.path)
+		assert.Equal(t, c.total, reply.Total, "total for %s", c.path)
+		assert.Equal(t, c.next, reply.Next, "next page for %s", c.path)
+	}
+
+	for _, path := range []string{"/keys?limit=0", "/keys?limit=1001", "/keys?limit=x", "/keys?offset=-1"} {
+		var reply jsonReply
+
+		status, err := adminRequest(handler, http.MethodGet, path, &reply)
+		if assert.Nil(t, err, "%s fails with JSON", path) {
+			assert.Equal(t, http.StatusBadRequest, status, "%s is a bad request", path)
+			assert.Equal(t, codeBadRequest, reply.Code, "and says so")
+		}
+	}
+}
+
+func TestProxy_AdminKey(t *testing.T) {
+	p, clock, handler := adminTestProxy(t, statusTestFetchFunc)
+	defer p.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err := p.Cache.Get(testFoo())
+		assert.Nil(t, err, "no error getting %s", testFoo())
+	}
+
+	clock.Advance(time.Second)
+
+	var entry adminEntry
+
+	status, err := adminRequest(handler, http.MethodGet, "/keys/"+testFoo(), &entry)
+	if assert.Nil(t, err, "entry is JSON") {
+		assert.Equal(t, http.StatusOK, status, "it's there")
+		assert.Equal(t, testFoo(), entry.Key, "it's the key asked for")
+		assert.Equal(t, TypeString, entry.Type, "it's a string")
+		assert.Equal(t, cache.EstimateSize(testFoo(), testFoo()), entry.Size, "it's as big as it is")
+		assert.Equal(t, uint64(2), entry.Hits, "it's been read from the cache twice")
+		assert.True(t, testEpoch().Equal(entry.Fetched), "it was fetched at the start")
+		assert.Equal(t, int64(1000), entry.AgeMs, "a second ago")
+		assert.Equal(t, int64(testMaxAge()-1)*1000, entry.TtlMs, "and has the rest of it's ttl left")
+		assert.False(t, entry.Expired, "so it hasn't expired")
+		assert.Equal(t, "default", entry.Rule, "it's under no rule in particular")
+	}
+
+	status, err = adminRequest(handler, http.MethodGet, "/keys/"+testFoo(), &entry)
+	if assert.Nil(t, err, "entry is JSON") {
+		assert.Equal(t, uint64(2), entry.Hits, "looking at it isn't a hit")
+	}
+
+	var missing jsonReply
+
+	status, err = adminRequest(handler, http.MethodGet, "/keys/"+testMissing(), &missing)
+	if assert.Nil(t, err, "missing entry fails with JSON") {
+		assert.Equal(t, http.StatusNotFound, status, "a key that isn't cached is a 404")
+		assert.Equal(t, codeNotFound, missing.Code, "and says so")
+	}
+
+	var purged adminPurgeReply
+
+	status, err = adminRequest(handler, http.MethodDelete, "/keys/"+testFoo(), &purged)
+	if assert.Nil(t, err, "purge replies with JSON") {
+		assert.Equal(t, http.StatusOK, status, "purged the key")
+		assert.Equal(t, 1, purged.Purged, "which was the one entry")
+	}
+
+	assert.Nil(t, p.Cache.Peek(testFoo()), "and it's gone")
+	assert.Equal(t, len(testAdminKeys())-1, p.Cache.Len(), "and nothing else went with it")
+
+	status, err = adminRequest(handler, http.MethodDelete, "/keys/"+testFoo(), &purged)
+	if assert.Nil(t, err, "purge replies with JSON") {
+		assert.Equal(t, http.StatusOK, status, "purging it again is fine")
+		assert.Equal(t, 0, purged.Purged, "but there's nothing to purge")
+	}
+
+	status, err = adminRequest(handler, http.MethodPut, "/keys/"+testBar(), &missing)
+	if assert.Nil(t, err, "405 is JSON") {
+		assert.Equal(t, http.StatusMethodNotAllowed, status, "keys can't be PUT")
+	}
+
+	status, err = adminRequest(handler, http.MethodGet, "/keys/", &missing)
+	if assert.Nil(t, err, "400 is JSON") {
+		assert.Equal(t, http.StatusBadRequest, status, "there has to be a key")
+	}
+
+	status, err = adminRequest(handler, http.MethodPost, "/refresh/"+testFoo()+"%00hget%00name", &missing)
+	if assert.Nil(t, err, "400 is JSON") {
+		assert.Equal(t, http.StatusBadRequest, status, "keys can't have a NUL in them")
+	}
+}
+
+func TestProxy_AdminPurge(t *testing.T) {
+	p, _, handler := adminTestProxy(t, statusTestFetchFunc)
+	defer p.Close()
+
+	// admin operations are logged
+	var logged bytes.Buffer
+
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	var purged adminPurgeReply
+
+	status, err := adminRequest(handler, http.MethodDelete, "/keys?pattern=[wz]*", &purged)
+	if assert.Nil(t, err, "purge replies with JSON") {
+		assert.Equal(t, http.StatusOK, status, "purged by pattern")
+		assert.Equal(t, 2, purged.Purged, "wip and zoz went")
+	}
+
+	assert.Nil(t, p.Cache.Peek(testWip()), "wip is gone")
+	assert.Contains(t, logged.String(), `purged 2 entries matching "[wz]*"`, "and it was logged")
+
+	var failure jsonReply
+
+	for _, path := range []string{"/keys", "/keys?pattern=", "/keys?pattern=[z-a]"} {
+		status, err = adminRequest(handler, http.MethodDelete, path, &failure)
+		if assert.Nil(t, err, "%s fails with JSON", path) {
+			assert.Equal(t, http.StatusBadRequest, status, "%s is a bad request", path)
+		}
+	}
+
+	assert.Equal(t, len(testAdminKeys())-2, p.Cache.Len(), "and none of them purged anything")
+
+	status, err = adminRequest(handler, http.MethodGet, "/flush", &failure)
+	if assert.Nil(t, err, "405 is JSON") {
+		assert.Equal(t, http.StatusMethodNotAllowed, status, "flushing takes a POST")
+	}
+
+	status, err = adminRequest(handler, http.MethodPost, "/flush", &purged)
+	if assert.Nil(t, err, "flush replies with JSON") {
+		assert.Equal(t, http.StatusOK, status, "flushed")
+		assert.Equal(t, len(testAdminKeys())-2, purged.Purged, "everything that was left went")
+	}
+
+	assert.Equal(t, 0, p.Cache.Len(), "nothing's left")
+	assert.Contains(t, logged.String(), "flushed the cache", "and that was logged too")
+}
+
+func TestProxy_AdminRefresh(t *testing.T) {
+	var calls int32
+
+	p, clock, handler := adminTestProxy(t, versionedTestFetchFunc(&calls))
+	defer p.Close()
+
+	_, err := p.Cache.Get(testFoo())
+	assert.Nil(t, err, "no error getting %s", testFoo())
+
+	clock.Advance(time.Second)
+
+	var entry adminEntry
+
+	status, err := adminRequest(handler, http.MethodPost, "/refresh/"+testFoo(), &entry)
+	if assert.Nil(t, err, "refresh replies with JSON") {
+		assert.Equal(t, http.StatusOK, status, "refreshed")
+		assert.True(t, testEpoch().Add(time.Second).Equal(entry.Fetched), "it was fetched just now")
+		assert.Equal(t, uint64(0), entry.Hits, "and hasn't been read since")
+	}
+
+	cached, err := p.Cache.Get(testFoo())
+	if assert.Nil(t, err, "no error getting %s", testFoo()) {
+		assert.Equal(t, fmt.Sprintf("%s-%d", testFoo(), len(testAdminKeys())+1), cached.Value, "and what was fetched was cached")
+	}
+
+	var failure jsonReply
+
+	status, err = adminRequest(handler, http.MethodPost, "/refresh/"+testMissing(), &failure)
+	if assert.Nil(t, err, "404 is JSON") {
+		assert.Equal(t, http.StatusNotFound, status, "refreshing a key that isn't in Redis is a 404")
+	}
+
+	status, err = adminRequest(handler, http.MethodPost, "/refresh/"+testBroken(), &failure)
+	if assert.Nil(t, err, "502 is JSON") {
+		assert.Equal(t, http.StatusBadGateway, status, "failing to refresh is a 502")
+		assert.Equal(t, codeUpstreamError, failure.Code, "and says why")
+	}
+
+	status, err = adminRequest(handler, http.MethodGet, "/refresh/"+testFoo(), &failure)
+	if assert.Nil(t, err, "405 is JSON") {
+		assert.Equal(t, http.StatusMethodNotAllowed, status, "refreshing takes a POST")
+	}
+}
+
+func TestProxy_AdminNegative(t *testing.T) {
+	p, _, handler := adminTestProxy(t, statusTestFetchFunc, cache.WithNegativeTtl(time.Minute))
+	defer p.Close()
+
+	_, err := p.Cache.Get(testMissing())
+	assert.Nil(t, err, "no error getting %s", testMissing())
+
+	if entry := p.Cache.Peek(testMissing()); assert.NotNil(t, entry, "%s is cached", testMissing()) {
+		assert.True(t, entry.Negative, "as missing")
+	}
+
+	var keys adminKeysReply
+
+	status, err := adminRequest(handler, http.MethodGet, "/keys", &keys)
+	if assert.Nil(t, err, "keys are JSON") {
+		assert.Equal(t, http.StatusOK, status, "listed")
+
+		for _, entry := range keys.Keys {
+			assert.NotEqual(t, testMissing(), entry.Key, "a key that isn't in Redis isn't listed")
+		}
+	}
+
+	var failure jsonReply
+
+	status, err = adminRequest(handler, http.MethodGet, "/keys/"+testMissing(), &failure)
+	if assert.Nil(t, err, "404 is JSON") {
+		assert.Equal(t, http.StatusNotFound, status, "inspecting a key that isn't in Redis is a 404")
+		assert.Equal(t, codeNotFound, failure.Code, "and says so")
+	}
+
+	status, err = adminRequest(handler, http.MethodPost, "/refresh/"+testMissing(), &failure)
+	if assert.Nil(t, err, "404 is JSON") {
+		assert.Equal(t, http.StatusNotFound, status, "refreshing a key that isn't in Redis is a 404, negative entry or not")
+		assert.Equal(t, codeNotFound, failure.Code, "and says so")
+	}
+}
+
+func TestProxy_AdminKeysNegative(t *testing.T) {
+	p, _, handler := adminTestProxy(t, statusTestFetchFunc, cache.WithNegativeTtl(time.Minute))
+	defer p.Close()
+
+	// it sorts in amongst the keys that are listed
+	_, err := p.Cache.Get(testMissing())
+	assert.Nil(t, err, "no error getting %s", testMissing())
+
+	keys := testAdminKeys()
+
+	cases := []struct {
+		path  string
+		keys  []string
+		total int
+		next  int
+	}{
+		{"/keys", keys, len(keys), 0},
+		{"/keys?limit=2", keys[:2], len(keys), 2},
+		{"/keys?limit=2&offset=2", keys[2:4], len(keys), 4},
+		{"/keys?limit=2&offset=4", keys[4:], len(keys), 0},
+		{"/keys?prefix=" + testMissing()[:1], []string{}, 0, 0},
+	}
+
+	for _, c := range cases {
+		var reply adminKeysReply
+
+		status, err := adminRequest(handler, http.MethodGet, c.path, &reply)
+		if !assert.Nil(t, err, "%s replies with JSON", c.path) {
+			continue
+		}
+
+		listed := make([]string, 0)
+		for _, entry := range reply.Keys {
+			listed = append(listed, entry.Key)
+		}
+
+		assert.Equal(t, http.StatusOK, status, "status for %s", c.path)
+		assert.Equal(t, c.keys, listed, "keys for %s, with %s left out, but not a page short", c.path, testMissing())
+		assert.Equal(t, c.total, reply.Total, "total for %s doesn't count %s", c.path, testMissing())
+		assert.Equal(t, c.next, reply.Next, "next page for %s", c.path)
+	}
+}
+
+func TestProxy_RunAdmin(t *testing.T) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get a free port: %s", err)
+	}
+
+	p := TestProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), statusTestFetchFunc)
+	p.AdminPort = fmt.Sprintf(":%d", port)
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- p.RunAdmin()
+	}()
+
+	var resp *http.Response
+
+	listening := waitFor(func() bool {
+		resp, err = http.Get(fmt.Sprintf("http://localhost:%d/keys", port))
+		return err == nil
+	})
+
+	if assert.True(t, listening, "admin API is listening") {
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "and answering")
+		resp.Body.Close()
+	}
+
+	p.Close()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err, "shutting it down isn't an error")
+	case <-time.After(testRealWait()):
+		t.Errorf("Admin API didn't stop when the proxy was closed")
+	}
+}
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/pkg/errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// batchPath  Where batch reads live.  A key called batch can only be read over RESP, or as part of a batch.
+const batchPath = "/batch"
+
+// maxBatchKeys  The most keys a batch can ask for.  Enough that nobody should need to split a batch up, without letting one request tie up the cache and the connection to Redis for everyone else.
+const maxBatchKeys = 1000
+
+// maxBatchBody  The biggest body a batch can be POSTed with.  A thousand keys of a kilobyte each, and room to spare.
+const maxBatchBody = 2 * 1024 * 1024
+
+// How each key in a batch fared.  A hit came out of the cache, a miss was fetched from Redis, and an error couldn't be had at all.  Keys that don't exist are a hit or a miss like any other, with no value.
+const (
+	batchHit   = "hit"
+	batchMiss  = "miss"
+	batchError = "error"
+)
+
+// batchReply  The reply to a batch read.  There's a result for every key asked for, in the order they were asked for.
+type batchReply struct {
+	Results []batchResult `json:"results"`
+}
+
+// batchResult  One key's part of a batch reply.  The same as a JSON reply for the key on it's own, along with how it fared.
+type batchResult struct {
+	Status string `json:"status"`
+	jsonReply
+}
+
+// parseBatch  The keys a batch read is for.  A GET has them in it's keys parameter, separated by commas, and can give it more than once.  A POST has them in it's body, as a JSON list, which is the way to ask for keys with commas in them.  Either way, there can be no more than maxBatchKeys of them.
+func parseBatch(r *http.Request) (keys []string, err error) {
+	keys = make([]string, 0)
+
+	if r.Method == http.MethodPost {
+		err = json.NewDecoder(r.Body).Decode(&keys)
+		if err != nil {
+			err = errors.New(fmt.Sprintf("can't make sense of the keys posted.  Expected a JSON list, like [\"a\", \"b\"]: %s", err))
+			return keys, err
+		}
+	} else {
+		for _, param := range r.URL.Query()["keys"] {
+			for _, key := range strings.Split(param, ",") {
+				if key != "" {
+					keys = append(keys, key)
+				}
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		err = errors.New("no keys.  Ask for /batch?keys=a,b,c, or POST a JSON list of them")
+		return keys, err
+	}
+
+	if len(keys) > maxBatchKeys {
+		err = errors.New(fmt.Sprintf("%d keys is too many for one batch.  Ask for %d at most", len(keys), maxBatchKeys))
+		return keys, err
+	}
+
+	err = cache.CheckKey(keys...)
+
+	return keys, err
+}
+
+// HandleBatch  The http handler for batch reads.  Keys that are in the cache are served from it, and the rest are fetched from Redis all together, by the cache's BatchFetchFunc.  The reply is always JSON, and always a 200 unless the request itself is wrong, since each key has a status of it's own.
+func (p *Proxy) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		writeFailure(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, jsonReply{Type: typeNone}, errors.New(fmt.Sprintf("%s isn't supported.  Batches are read with GET or POST", r.Method)))
+		return
+	}
+
+	// so a client can't have us read, and decode, as big a body as it likes
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBody)
+
+	keys, err := parseBatch(r)
+	if err != nil {
+		writeFailure(w, http.StatusBadRequest, codeBadRequest, jsonReply{Type: typeNone}, err)
+		return
+	}
+
+	log.Printf("Received batch request for %d keys\n", len(keys))
+
+	reply := batchReply{
+		Results: make([]batchResult, 0),
+	}
+
+	for _, lookup := range p.Cache.LookupMany(keys) {
+		result := batchResult{
+			Status:    batchMiss,
+			jsonReply: newJsonReply(lookup.Key, p.Cache.Rule(lookup.Key)),
+		}
+
+		result.Hit = lookup.Hit
+
+		switch {
+		case lookup.Err != nil:
+			_, code := fetchFailure(lookup.Err)
+
+			result.Status = batchError
+			result.Error = lookup.Err.Error()
+			result.Code = code
+
+		case lookup.Hit:
+			result.Status = batchHit
+		}
+
+		if lookup.Err == nil && !lookup.Entry.Missing() {
+			result.setEntry(lookup.Entry)
+		}
+
+		reply.Results = append(reply.Results, result)
+	}
+
+	// the keys in a batch all expire at different times, so there's no saying how long the lot is good for
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", contentTypes[formatJson])
+
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Printf("Failed to write batch reply: %s\n", err)
+	}
+}
+
+// BatchFetcher  The function that fetches batches of keys from redis, for the cache's LookupMany.  The counterpart of Fetcher.
+//
+// Every key's value is fetched with one MGET, and it's type and remaining TTL alongside, all pipelined into a single round trip.  For strings, which is most things, that's all it takes.  Anything else takes another trip, as it would with Fetcher, and a cache.SubKey is a partial read, fetched by fetchRead.
+func (p *Proxy) BatchFetcher(keys []string, redisAddr string) (results []cache.BatchResult, err error) {
+	results = make([]cache.BatchResult, len(keys))
+
+	// which of the keys are whole keys, and can be had with MGET
+	whole := make([]int, 0)
+
+	for i, key := range keys {
+		if base, read := cache.SplitSubKey(key); len(read) > 0 {
+			results[i].FetchResult, results[i].Err = p.fetchRead(base, read)
+			continue
+		}
+
+		whole = append(whole, i)
+	}
+
+	if len(whole) == 0 {
+		return results, err
+	}
+
+	pipe := p.Client.Pipeline()
+	defer pipe.Close()
+
+	var tracking *redis.Cmd
+
+	if redirect := p.trackingRedirect(); redirect != nil {
+		tracking = pipe.Do(redirect...)
+	}
+
+	names := make([]string, len(whole))
+	kinds := make([]*redis.StatusCmd, len(whole))
+	pttls := make([]*redis.DurationCmd, len(whole))
+
+	for j, i := range whole {
+		names[j] = keys[i]
+		kinds[j] = pipe.Type(keys[i])
+		pttls[j] = pipe.PTTL(keys[i])
+	}
+
+	mget := pipe.MGet(names...)
+
+	_, _ = pipe.Exec()
+
+	if tracking != nil && tracking.Err() != nil {
+		log.Printf("Failed to have Redis track a batch of %d keys: %s\n", len(whole), tracking.Err())
+	}
+
+	// MGET doesn't fail for anything to do with a particular key, so if it did, it's the whole batch
+	values, err := mget.Result()
+	if err != nil {
+		return results, err
+	}
+
+	for j, i := range whole {
+		result := &results[i]
+
+		result.Type, result.Err = kinds[j].Result()
+		if result.Err != nil {
+			continue
+		}
+
+		switch result.Type {
+		case typeNone:
+			result.Type = ""
+			continue
+
+		case TypeString:
+			value, ok := values[j].(string)
+			if !ok {
+				result.Type = ""
+				continue
+			}
+
+			result.Value = value
+
+		default:
+			result.Value, result.Truncated, result.Err = p.fetchTyped(keys[i], result.Type)
+			if result.Err != nil {
+				continue
+			}
+		}
+
+		result.TTL = upstreamTtl(pttls[j])
+	}
+
+	return results, err
+}
@@ -0,0 +1,237 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBatch(t *testing.T) {
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		keys   []string
+		fails  bool
+	}{
+		{http.MethodGet, "/batch?keys=foo,bar", "", []string{"foo", "bar"}, false},
+		{http.MethodGet, "/batch?keys=foo&keys=a,b%2Cc", "", []string{"foo", "a", "b", "c"}, false},
+		{http.MethodGet, "/batch?keys=foo,,bar,", "", []string{"foo", "bar"}, false},
+		{http.MethodGet, "/batch", "", []string{}, true},
+		{http.MethodGet, "/batch?keys=", "", []string{}, true},
+		{http.MethodPost, "/batch", `["foo", "a,b", "x/y"]`, []string{"foo", "a,b", "x/y"}, false},
+		{http.MethodPost, "/batch", `[]`, []string{}, true},
+		{http.MethodPost, "/batch", `{"keys": ["foo"]}`, []string{}, true},
+		{http.MethodPost, "/batch", ``, []string{}, true},
+		{http.MethodGet, "/batch?keys=foo,a%00hget%00b", "", []string{"foo", "a\x00hget\x00b"}, true},
+		{http.MethodPost, "/batch", `["foo", "a\u0000hget\u0000b"]`, []string{"foo", "a\x00hget\x00b"}, true},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+
+		keys, err := parseBatch(r)
+		assert.Equal(t, c.fails, err != nil, "%s %s %s fails: %t", c.method, c.path, c.body, c.fails)
+		assert.Equal(t, c.keys, keys, "%s %s %s is for %v", c.method, c.path, c.body, c.keys)
+	}
+}
+
+func TestProxy_HandleBatch(t *testing.T) {
+	fetcher := &testBatchFetcher{}
+
+	p := TestProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), statusTestFetchFunc, cache.WithBatchFetchFunc(fetcher.fetch))
+	defer p.Close()
+
+	_, err := p.Cache.Get(testFoo())
+	if err != nil {
+		t.Fatalf("Failed to get %s: %s", testFoo(), err)
+	}
+
+	expected := []struct {
+		key    string
+		status string
+		value  interface{}
+		code   string
+	}{
+		{testFoo(), batchHit, testFoo(), ""},
+		{testBar(), batchMiss, testBar(), ""},
+		{testMissing(), batchMiss, nil, ""},
+		{testBroken(), batchError, nil, codeUpstreamError},
+	}
+
+	keys := make([]string, 0)
+	for _, e := range expected {
+		keys = append(keys, e.key)
+	}
+
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/batch?keys="+strings.Join(keys, ","), nil),
+		httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(`["`+strings.Join(keys, `", "`)+`"]`)),
+	}
+
+	for _, r := range requests {
+		w := httptest.NewRecorder()
+		p.Handle(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code, "%s of a batch is fine, whatever happened to each key", r.Method)
+		assert.Equal(t, contentTypes[formatJson], w.Header().Get("Content-Type"), "it's JSON")
+		assert.Equal(t, "no-store", w.Header().Get("Cache-Control"), "and isn't to be cached")
+
+		var reply batchReply
+
+		err := json.NewDecoder(w.Body).Decode(&reply)
+		if !assert.Nil(t, err, "%s reply is JSON", r.Method) || !assert.Len(t, reply.Results, len(expected), "a result for every key") {
+			continue
+		}
+
+		for i, e := range expected {
+			result := reply.Results[i]
+
+			assert.Equal(t, e.key, result.Key, "%s result %d is for %s", r.Method, i, e.key)
+			assert.Equal(t, e.code, result.Code, "%s code for %s", r.Method, e.key)
+
+			// second time around, everything that was fetched is a hit
+			if r.Method == http.MethodGet || e.status == batchError {
+				assert.Equal(t, e.status, result.Status, "%s status for %s", r.Method, e.key)
+			}
+
+			if e.value == nil {
+				assert.Nil(t, result.Value, "%s has no value", e.key)
+				assert.Equal(t, typeNone, result.Type, "%s is nothing", e.key)
+				continue
+			}
+
+			assert.Equal(t, e.value, result.Value, "%s value for %s", r.Method, e.key)
+			assert.Equal(t, TypeString, result.Type, "%s type for %s", r.Method, e.key)
+			assert.True(t, result.TtlMs > 0, "%s has time left", e.key)
+		}
+	}
+
+	assert.Equal(t, [][]string{{testBar(), testMissing(), testBroken()}, {testMissing(), testBroken()}}, fetcher.Batches(), "misses were fetched in one batch per request")
+}
+
+func TestProxy_HandleBatchFailures(t *testing.T) {
+	p := TestProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), statusTestFetchFunc)
+	defer p.Close()
+
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{http.MethodPut, "/batch", `["foo"]`, http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{http.MethodGet, "/batch", "", http.StatusBadRequest, codeBadRequest},
+		{http.MethodPost, "/batch", "foo,bar", http.StatusBadRequest, codeBadRequest},
+	}
+
+	tooMany, err := json.Marshal(testManyKeys(maxBatchKeys + 1))
+	if err != nil {
+		t.Fatalf("Failed to encode keys: %s", err)
+	}
+
+	tooBig, err := json.Marshal([]string{strings.Repeat("x", maxBatchBody)})
+	if err != nil {
+		t.Fatalf("Failed to encode keys: %s", err)
+	}
+
+	cases = append(cases, []struct {
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{http.MethodGet, "/batch?keys=" + strings.Join(testManyKeys(maxBatchKeys+1), ","), "", http.StatusBadRequest, codeBadRequest},
+		{http.MethodPost, "/batch", string(tooMany), http.StatusBadRequest, codeBadRequest},
+		{http.MethodPost, "/batch", string(tooBig), http.StatusBadRequest, codeBadRequest},
+	}...)
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		p.Handle(w, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+
+		assert.Equal(t, c.status, w.Code, "status for %s %s", c.method, c.path)
+
+		var reply jsonReply
+
+		err := json.NewDecoder(w.Body).Decode(&reply)
+		if assert.Nil(t, err, "%s %s fails with JSON", c.method, c.path) {
+			assert.Equal(t, c.code, reply.Code, "%s %s fails with %s", c.method, c.path, c.code)
+		}
+	}
+}
+
+func TestProxy_HandleBatchMaxKeys(t *testing.T) {
+	p := TestProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), statusTestFetchFunc)
+	defer p.Close()
+
+	w := httptest.NewRecorder()
+	p.Handle(w, httptest.NewRequest(http.MethodGet, "/batch?keys="+strings.Join(testManyKeys(maxBatchKeys), ","), nil))
+
+	assert.Equal(t, http.StatusOK, w.Code, "a batch of %d keys is fine", maxBatchKeys)
+
+	var reply batchReply
+
+	err := json.NewDecoder(w.Body).Decode(&reply)
+	if assert.Nil(t, err, "batch replies with JSON") {
+		assert.Equal(t, maxBatchKeys, len(reply.Results), "with a result for every key")
+	}
+}
+
+func TestProxy_BatchFetcher(t *testing.T) {
+	upstream, p, client := typesTestProxy(t)
+	defer upstream.Close()
+	defer p.Close()
+	defer client.Close()
+
+	upstream.SetTTL(testFoo(), testUpstreamTtl())
+
+	keys := []string{testFoo(), TypeHash, testMissing(), TypeList, cache.SubKey(TypeHash, readHGet, "name"), testBar()}
+
+	results, err := p.BatchFetcher(keys, upstream.Addr())
+	if !assert.Nil(t, err, "no error fetching the batch") || !assert.Len(t, results, len(keys), "a result for every key") {
+		return
+	}
+
+	for i, result := range results {
+		assert.Nil(t, result.Err, "no error fetching %q", keys[i])
+	}
+
+	assert.Equal(t, testFoo(), results[0].Value, "got a string")
+	assert.Equal(t, TypeString, results[0].Type, "and knew it for one")
+	assert.True(t, results[0].TTL > 0 && results[0].TTL <= testUpstreamTtl(), "along with it's ttl upstream, %s", results[0].TTL)
+
+	assert.Equal(t, testHash(), results[1].Value, "got a hash")
+	assert.Equal(t, TypeHash, results[1].Type, "and knew it for one")
+
+	assert.Nil(t, results[2].Value, "got nothing for a missing key")
+
+	assert.Equal(t, testList()[:testMaxElements()], results[3].Value, "got as much of a list as we're allowed")
+
+	assert.Equal(t, testHash()["name"], results[4].Value, "got a field of a hash")
+
+	assert.Equal(t, testBar(), results[5].Value, "got another string")
+	assert.Equal(t, time.Duration(0), results[5].TTL, "that doesn't expire")
+
+	// and over http, where misses go through the cache
+	w := httptest.NewRecorder()
+	p.Handle(w, httptest.NewRequest(http.MethodGet, "/batch?keys="+testFoo()+","+TypeSet+","+testMissing(), nil))
+
+	var reply batchReply
+
+	err = json.NewDecoder(w.Body).Decode(&reply)
+	if assert.Nil(t, err, "batch reply is JSON") && assert.Len(t, reply.Results, 3, "with a result for every key") {
+		assert.Equal(t, testFoo(), reply.Results[0].Value, "string came back")
+		assert.Equal(t, TypeSet, reply.Results[1].Type, "and a set")
+		assert.Equal(t, typeNone, reply.Results[2].Type, "and nothing for a missing key")
+	}
+
+	assert.Equal(t, 2, p.Cache.Len(), "everything that exists was cached")
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"fmt"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// entityTag  The ETag for an entry, as written in the given format.  The same value written another way is a different representation, with it's own tag.  Text, being the default, gets the plain hash.
+func entityTag(entry *cache.CacheEntry, format string) string {
+	if format == formatText {
+		return fmt.Sprintf("%q", entry.Hash)
+	}
+
+	return fmt.Sprintf("\"%s-%s\"", entry.Hash, format)
+}
+
+// writeCacheHeaders  Tells downstream caches what they need to know to share the load.  ETag, Last-Modified as of when the value was fetched, Age, and a max-age that, with Age taken off, leaves them keeping it for exactly as long as it has left here.  Then, if the request was conditional, and the client has what it would get already, replies 304, and returns true.
+func writeCacheHeaders(w http.ResponseWriter, r *http.Request, entry *cache.CacheEntry, format string) (notModified bool) {
+	etag := entityTag(entry, format)
+
+	age := int64(entry.Age() / time.Second)
+	remaining := int64(entry.Remaining() / time.Second)
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", entry.Fetched.UTC().Format(http.TimeFormat))
+	w.Header().Set("Age", fmt.Sprintf("%d", age))
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", age+remaining))
+	w.Header().Set("Vary", "Accept")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if !unmodified(r, etag, entry.Fetched) {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+
+	return true
+}
+
+// unmodified  Whether a conditional request's client already has the current version.  If-None-Match wins if it's there, as RFC 7232 says.  Otherwise If-Modified-Since, to the second, since that's all Last-Modified has.
+func unmodified(r *http.Request, etag string, fetched time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if since := r.Header.Get("If-Modified-Since"); since != "" {
+		t, err := http.ParseTime(since)
+		if err != nil {
+			return false
+		}
+
+		return !fetched.Truncate(time.Second).After(t)
+	}
+
+	return false
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"fmt"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEntityTag(t *testing.T) {
+	entry := &cache.CacheEntry{Hash: cache.ContentHash(testFoo())}
+
+	tags := make(map[string]bool)
+	for _, format := range []string{formatText, formatJson, formatRaw} {
+		tags[entityTag(entry, format)] = true
+	}
+
+	assert.Len(t, tags, 3, "every format has it's own tag")
+	assert.Equal(t, fmt.Sprintf("%q", entry.Hash), entityTag(entry, formatText), "text's tag is the hash")
+}
+
+func TestProxy_HandleCacheHeaders(t *testing.T) {
+	clock := cache.NewFakeClock(testEpoch())
+
+	p := TestProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), statusTestFetchFunc, cache.WithClock(clock))
+	defer p.Close()
+
+	w := httptest.NewRecorder()
+	p.Handle(w, httptest.NewRequest(http.MethodGet, "/"+testFoo(), nil))
+
+	etag := w.Header().Get("ETag")
+	maxAge := fmt.Sprintf("max-age=%d", testMaxAge())
+
+	assert.Equal(t, http.StatusOK, w.Code, "got the key")
+	assert.Equal(t, fmt.Sprintf("%q", cache.ContentHash(testFoo())), etag, "tagged with the value's hash")
+	assert.Equal(t, testEpoch().Format(http.TimeFormat), w.Header().Get("Last-Modified"), "modified when it was fetched")
+	assert.Equal(t, "0", w.Header().Get("Age"), "fresh from upstream")
+	assert.Equal(t, maxAge, w.Header().Get("Cache-Control"), "cacheable for as long as it's cached here")
+	assert.Equal(t, "Accept", w.Header().Get("Vary"), "and it depends what was asked for")
+
+	clock.Advance(time.Second * 2)
+
+	// a client, or a downstream cache, asking whether what it has is still good
+	cases := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		status  int
+	}{
+		{"unconditional", "/" + testFoo(), map[string]string{}, http.StatusOK},
+		{"matching etag", "/" + testFoo(), map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"weak etag", "/" + testFoo(), map[string]string{"If-None-Match": "W/" + etag}, http.StatusNotModified},
+		{"one of several etags", "/" + testFoo(), map[string]string{"If-None-Match": `"nope", ` + etag}, http.StatusNotModified},
+		{"any etag", "/" + testFoo(), map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"other etag", "/" + testFoo(), map[string]string{"If-None-Match": `"nope"`}, http.StatusOK},
+		{"text etag for json", "/" + testFoo() + "?format=json", map[string]string{"If-None-Match": etag}, http.StatusOK},
+		{"modified since fetch", "/" + testFoo(), map[string]string{"If-Modified-Since": testEpoch().Format(http.TimeFormat)}, http.StatusNotModified},
+		{"modified before fetch", "/" + testFoo(), map[string]string{"If-Modified-Since": testEpoch().Add(-time.Second).Format(http.TimeFormat)}, http.StatusOK},
+		{"etag wins", "/" + testFoo(), map[string]string{"If-None-Match": `"nope"`, "If-Modified-Since": testEpoch().Format(http.TimeFormat)}, http.StatusOK},
+		{"bad date", "/" + testFoo(), map[string]string{"If-Modified-Since": "yesterday"}, http.StatusOK},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, c.path, nil)
+		for header, value := range c.headers {
+			r.Header.Set(header, value)
+		}
+
+		w := httptest.NewRecorder()
+		p.Handle(w, r)
+
+		assert.Equal(t, c.status, w.Code, "status for %s", c.name)
+		assert.Equal(t, "2", w.Header().Get("Age"), "age for %s", c.name)
+		assert.Equal(t, maxAge, w.Header().Get("Cache-Control"), "max-age for %s, with age taken off, is what it has left", c.name)
+
+		if c.status == http.StatusNotModified {
+			assert.Empty(t, w.Body.String(), "%s has no body", c.name)
+		}
+	}
+
+	// failures aren't for keeping
+	w = httptest.NewRecorder()
+	p.Handle(w, httptest.NewRequest(http.MethodGet, "/"+testBroken(), nil))
+
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"), "failures aren't cached")
+	assert.Empty(t, w.Header().Get("ETag"), "or tagged")
+}
+
+func TestProxy_HandleHead(t *testing.T) {
+	p := TestProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), statusTestFetchFunc)
+	defer p.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(p.Handle))
+	defer server.Close()
+
+	get, err := http.Get(server.URL + "/" + testFoo())
+	if err != nil {
+		t.Fatalf("Failed to GET: %s", err)
+	}
+
+	body, _ := ioutil.ReadAll(get.Body)
+	get.Body.Close()
+
+	head, err := http.Head(server.URL + "/" + testFoo())
+	if err != nil {
+		t.Fatalf("Failed to HEAD: %s", err)
+	}
+
+	headBody, _ := ioutil.ReadAll(head.Body)
+	head.Body.Close()
+
+	assert.Equal(t, http.StatusOK, head.StatusCode, "HEAD is fine")
+	assert.Empty(t, headBody, "and has no body")
+	assert.Equal(t, fmt.Sprintf("%d", len(body)), head.Header.Get("Content-Length"), "but says how long it'd be")
+
+	for _, header := range []string{"ETag", "Last-Modified", "Cache-Control", ruleHeader} {
+		assert.Equal(t, get.Header.Get(header), head.Header.Get(header), "%s is the same as for GET", header)
+	}
+
+	head, err = http.Head(server.URL + "/" + testMissing())
+	if assert.Nil(t, err, "no error on HEAD of a missing key") {
+		assert.Equal(t, http.StatusNotFound, head.StatusCode, "HEAD of a missing key is a 404")
+		head.Body.Close()
+	}
+}
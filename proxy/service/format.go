@@ -0,0 +1,214 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/pkg/errors"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// What an http reply can be written as.  Text is redis-cli's way of showing things, and what you get unless you ask for something else.
+const (
+	formatText = "text"
+	formatJson = "json"
+	formatRaw  = "raw"
+)
+
+// contentTypes  The content type of each format.
+var contentTypes = map[string]string{
+	formatText: "text/plain",
+	formatJson: "application/json",
+	formatRaw:  "application/octet-stream",
+}
+
+// replyFormat  How the client would like it's reply.  ?format=json or ?format=raw if it says, otherwise the first of application/json or application/octet-stream in it's Accept header.  Text if it's neither, or doesn't care.
+func replyFormat(r *http.Request) string {
+	switch r.URL.Query().Get("format") {
+	case formatJson:
+		return formatJson
+	case formatRaw:
+		return formatRaw
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+
+		for format, contentType := range contentTypes {
+			if contentType == mediaType {
+				return format
+			}
+		}
+	}
+
+	return formatText
+}
+
+// requestKey  The key a plain request is for, which is the whole of it, query and all.  A format parameter is the exception, since it's for us, not part of the key.
+func requestKey(r *http.Request) string {
+	key := strings.TrimPrefix(r.RequestURI, "/")
+
+	i := strings.Index(key, "?")
+	if i < 0 {
+		return key
+	}
+
+	params := make([]string, 0)
+	for _, param := range strings.Split(key[i+1:], "&") {
+		if !strings.HasPrefix(param, "format=") {
+			params = append(params, param)
+		}
+	}
+
+	if len(params) == 0 {
+		return key[:i]
+	}
+
+	return key[:i+1] + strings.Join(params, "&")
+}
+
+// jsonReply  A reply, in JSON.  Value is whatever the key holds, as the closest thing JSON has to it.  Hashes are objects, lists and sets arrays, sorted sets arrays of members and scores, and streams arrays of IDs and fields.
+type jsonReply struct {
+	Key string `json:"key"`
+	// Read  For partial reads, which read it was, and it's arguments, like ["hget", "name"].
+	Read  []string    `json:"read,omitempty"`
+	Value interface{} `json:"value"`
+	// Type  What kind of value it is, in Redis' terms.  "none" if there isn't one.
+	Type string `json:"type"`
+	// Hit  Whether it came out of the cache, rather than from upstream.
+	Hit   bool `json:"hit"`
+	Stale bool `json:"stale"`
+	// TtlMs  How many milliseconds the entry has left in the cache.
+	TtlMs   int64      `json:"ttl_ms"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Rule    string     `json:"rule"`
+	// Error  What went wrong, if anything did, and Code, which of the things that can go wrong it was.
+	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"`
+}
+
+// newJsonReply  A reply for a cache key, with nothing in it yet.
+func newJsonReply(cacheKey string, rule *cache.Rule) jsonReply {
+	key, read := cache.SplitSubKey(cacheKey)
+
+	return jsonReply{
+		Key:  key,
+		Read: read,
+		Type: typeNone,
+		Rule: rule.String(),
+	}
+}
+
+// setEntry  Fills in what the reply says about the entry.  It's value, type, how stale it is, and how long it has left.
+func (reply *jsonReply) setEntry(entry *cache.CacheEntry) {
+	expires := entry.Expires
+
+	reply.Value = jsonValue(entry.Value)
+	reply.Type = entryType(entry)
+	reply.Stale = entry.Stale
+	reply.TtlMs = int64(entry.Remaining() / time.Millisecond)
+	reply.Expires = &expires
+}
+
+// jsonScore  A sorted set member, in JSON
+type jsonScore struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// jsonMessage  A stream entry, in JSON
+type jsonMessage struct {
+	ID     string            `json:"id"`
+	Values map[string]string `json:"values"`
+}
+
+// jsonValue  A cached value, as something encoding/json will write sensibly.
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []redis.Z:
+		scores := make([]jsonScore, 0)
+		for _, z := range v {
+			scores = append(scores, jsonScore{Member: fmt.Sprint(z.Member), Score: z.Score})
+		}
+
+		return scores
+
+	case []redis.XMessage:
+		messages := make([]jsonMessage, 0)
+		for _, message := range v {
+			values := make(map[string]string)
+			for field, value := range message.Values {
+				values[field] = fmt.Sprint(value)
+			}
+
+			messages = append(messages, jsonMessage{ID: message.ID, Values: values})
+		}
+
+		return messages
+	}
+
+	return value
+}
+
+// handleFormatted  Replies to a request for JSON, or raw bytes.
+func (p *Proxy) handleFormatted(w http.ResponseWriter, r *http.Request, format string, cacheKey string) {
+	rule := p.Cache.Rule(cacheKey)
+
+	log.Printf("Received %s request for %q, under rule %s\n", format, cacheKey, rule)
+
+	w.Header().Set(ruleHeader, rule.String())
+
+	entry, hit, err := p.Cache.Lookup(cacheKey)
+
+	reply := newJsonReply(cacheKey, rule)
+	reply.Hit = hit
+
+	if err != nil {
+		status, code := fetchFailure(err)
+		writeFailure(w, status, code, reply, err)
+		return
+	}
+
+	if entry.Missing() {
+		writeFailure(w, http.StatusNotFound, codeNotFound, reply, errNotFound)
+		return
+	}
+
+	// only strings have raw bytes.  Anything else is a 406, as there's no one right way to turn it into bytes, and the client should ask for JSON.
+	if _, ok := entry.Value.(string); !ok && format == formatRaw {
+		err := errors.New(fmt.Sprintf("a %s has no raw bytes.  Ask for application/json", entryType(entry)))
+		writeFailure(w, http.StatusNotAcceptable, codeNotAcceptable, reply, err)
+		return
+	}
+
+	if entry.Stale {
+		w.Header().Set("Warning", staleWarning)
+	}
+
+	if writeCacheHeaders(w, r, entry, format) {
+		return
+	}
+
+	if format == formatRaw {
+		w.Header().Set("Content-Type", contentTypes[formatRaw])
+		fmt.Fprint(w, entry.Value)
+		return
+	}
+
+	reply.setEntry(entry)
+
+	w.Header().Set("Content-Type", contentTypes[formatJson])
+
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Printf("Failed to write JSON for %q: %s\n", cacheKey, err)
+	}
+}
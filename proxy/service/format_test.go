@@ -0,0 +1,165 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReplyFormat(t *testing.T) {
+	cases := []struct {
+		path   string
+		accept string
+		format string
+	}{
+		{"/foo", "", formatText},
+		{"/foo", "*/*", formatText},
+		{"/foo", "application/json", formatJson},
+		{"/foo", "application/json; charset=utf-8", formatJson},
+		{"/foo", "text/html, application/octet-stream;q=0.9", formatRaw},
+		{"/foo", "text/plain, application/json", formatText},
+		{"/foo?format=json", "", formatJson},
+		{"/foo?format=raw", "application/json", formatRaw},
+		{"/foo?format=nonsense", "application/json", formatJson},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.path, nil)
+		r.Header.Set("Accept", c.accept)
+
+		assert.Equal(t, c.format, replyFormat(r), "%s, accepting %q", c.path, c.accept)
+	}
+}
+
+func TestRequestKey(t *testing.T) {
+	cases := map[string]string{
+		"/foo":                   "foo",
+		"/foo?format=json":       "foo",
+		"/foo?a=1&format=json&b": "foo?a=1&b",
+		"/foo?a=1":               "foo?a=1",
+		"/a%20b":                 "a%20b",
+	}
+
+	for path, key := range cases {
+		assert.Equal(t, key, requestKey(httptest.NewRequest("GET", path, nil)), "key for %s", path)
+	}
+}
+
+func TestProxy_HandleJson(t *testing.T) {
+	upstream, p, client := typesTestProxy(t)
+	defer upstream.Close()
+	defer p.Close()
+	defer client.Close()
+
+	cases := []struct {
+		path   string
+		status int
+		kind   string
+		value  interface{}
+		hit    bool
+	}{
+		{"/" + testFoo(), http.StatusOK, TypeString, testFoo(), false},
+		{"/" + testFoo(), http.StatusOK, TypeString, testFoo(), true},
+		{"/" + TypeHash, http.StatusOK, TypeHash, map[string]interface{}{"name": "ann", "age": "42"}, false},
+		{"/" + TypeList, http.StatusOK, TypeList, []interface{}{"one", "two", "three"}, false},
+		{"/" + TypeSortedSet, http.StatusOK, TypeSortedSet, []interface{}{
+			map[string]interface{}{"member": "bronze", "score": 1.0},
+			map[string]interface{}{"member": "silver", "score": 2.5},
+			map[string]interface{}{"member": "gold", "score": 10.0},
+		}, false},
+		{"/set/set/red", http.StatusOK, "", 1.0, false},
+		{"/hash/hash/name", http.StatusOK, TypeString, "ann", false},
+		{"/hash/hash/name", http.StatusOK, TypeString, "ann", true},
+		{"/" + testMissing(), http.StatusNotFound, typeNone, nil, false},
+		{"/hash/hash", http.StatusBadRequest, typeNone, nil, false},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.path, nil)
+		r.Header.Set("Accept", "application/json")
+
+		w := httptest.NewRecorder()
+		p.Handle(w, r)
+
+		assert.Equal(t, c.status, w.Code, "status for %s", c.path)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"), "%s is JSON", c.path)
+
+		var reply map[string]interface{}
+
+		err := json.NewDecoder(w.Body).Decode(&reply)
+		if !assert.Nil(t, err, "%s replied with JSON", c.path) {
+			continue
+		}
+
+		assert.Equal(t, c.value, reply["value"], "value for %s", c.path)
+		assert.Equal(t, c.hit, reply["hit"], "%s was a hit: %t", c.path, c.hit)
+
+		if c.kind != "" {
+			assert.Equal(t, c.kind, reply["type"], "type for %s", c.path)
+		}
+
+		if c.status == http.StatusOK {
+			assert.True(t, reply["ttl_ms"].(float64) > 0, "%s has a ttl", c.path)
+			assert.NotEmpty(t, reply["expires"], "and expires", c.path)
+		}
+
+		if c.status == http.StatusBadRequest {
+			assert.NotEmpty(t, reply["error"], "%s says what's wrong", c.path)
+		}
+	}
+}
+
+func TestProxy_HandleRaw(t *testing.T) {
+	upstream, p, client := typesTestProxy(t)
+	defer upstream.Close()
+	defer p.Close()
+	defer client.Close()
+
+	upstream.Set("binary", "\x00\xffnot text\n")
+
+	// failures have their code for a body
+	cases := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/binary?format=raw", http.StatusOK, "\x00\xffnot text\n"},
+		{"/" + testFoo() + "?format=raw", http.StatusOK, testFoo()},
+		{"/hash/hash/name?format=raw", http.StatusOK, "ann"},
+		{"/" + testMissing() + "?format=raw", http.StatusNotFound, codeNotFound},
+		{"/" + TypeHash + "?format=raw", http.StatusNotAcceptable, codeNotAcceptable},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		p.Handle(w, httptest.NewRequest("GET", c.path, nil))
+
+		assert.Equal(t, c.status, w.Code, "status for %s", c.path)
+
+		// failures come back as JSON, with a code, whatever was asked for
+		if c.status != http.StatusOK {
+			var reply jsonReply
+
+			err := json.NewDecoder(w.Body).Decode(&reply)
+			if assert.Nil(t, err, "%s fails with JSON", c.path) {
+				assert.Equal(t, c.body, reply.Code, "%s fails with %s", c.path, c.body)
+			}
+
+			continue
+		}
+
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		assert.Equal(t, c.body, string(body), "body for %s", c.path)
+		assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"), "%s is raw bytes", c.path)
+	}
+
+	// and without asking, it's still text
+	w := httptest.NewRecorder()
+	p.Handle(w, httptest.NewRequest("GET", "/binary", nil))
+
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	assert.Equal(t, "\"\\x00\\xffnot text\\n\"\n", string(body), "text is the default")
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"github.com/go-redis/redis"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// keyeventPattern  The channels Redis announces changes to keys in db 0 on, one per kind of event, with the key as the message.  Only if it's been told to with notify-keyspace-events, mind.
+const keyeventPattern = "__keyevent@0__:*"
+
+// InvalidationOptions  How the proxy keeps up with changes made to keys in Redis.
+type InvalidationOptions struct {
+	// FlushOnResubscribe  Flush the whole cache whenever the subscription comes back after being interrupted, since there's no telling what changed while it was down.
+	FlushOnResubscribe bool
+	// NotifyKeyspaceEvents  If set, what to CONFIG SET notify-keyspace-events to every time the proxy subscribes, so notifications survive Redis restarting with it's old config.  "Eg$xe" or thereabouts covers everything that matters.
+	NotifyKeyspaceEvents string
+	// RetryInterval  How long to wait between attempts to subscribe, when Redis can't be reached.
+	RetryInterval time.Duration
+}
+
+// DefaultInvalidationOptions  What you get if you don't have opinions of your own.  Nothing is flushed, and Redis' config is left alone.
+func DefaultInvalidationOptions() InvalidationOptions {
+	return InvalidationOptions{
+		RetryInterval: time.Second,
+	}
+}
+
+// RunInvalidation  Subscribes to keyevent notifications from Redis, and invalidates every key it hears about, so that writes upstream show up straight away rather than when the entry expires.  Should the subscription be interrupted, it's resumed as soon as Redis can be reached again.  It does not detatch from the console, and returns once the proxy is closed.
+func (p *Proxy) RunInvalidation(options InvalidationOptions) (err error) {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return err
+	}
+
+	pubsub := p.Client.PSubscribe(keyeventPattern)
+	p.pubsub = pubsub
+	p.lock.Unlock()
+
+	// subscribed is whether we've ever been, interrupted whether we've since stopped being, and down whether we've said so.
+	subscribed := false
+	interrupted := false
+	down := false
+
+	for {
+		message, err := pubsub.Receive()
+		if err != nil {
+			if p.isClosed() {
+				return nil
+			}
+
+			// go-redis reconnects and resubscribes by itself, as long as Redis is there to reconnect to.  We just need to know it happened.
+			if !down {
+				log.Printf("Keyevent subscription interrupted: %s\n", err)
+				down = true
+			}
+
+			interrupted = subscribed
+
+			select {
+			case <-p.stopped:
+				return nil
+			case <-time.After(options.RetryInterval):
+			}
+
+			continue
+		}
+
+		switch message := message.(type) {
+		case *redis.Subscription:
+			log.Printf("Subscribed to %s\n", message.Channel)
+
+			if options.NotifyKeyspaceEvents != "" {
+				err := p.Client.ConfigSet("notify-keyspace-events", options.NotifyKeyspaceEvents).Err()
+				if err != nil {
+					log.Printf("Failed to set notify-keyspace-events: %s\n", err)
+				}
+			}
+
+			if interrupted && options.FlushOnResubscribe {
+				flushed := p.Cache.Flush()
+				atomic.AddUint64(&p.flushes, 1)
+
+				log.Printf("Flushed %d entries that may have changed while the subscription was down\n", flushed)
+			}
+
+			subscribed = true
+			interrupted = false
+			down = false
+
+		case *redis.Message:
+			event := strings.TrimPrefix(message.Channel, strings.TrimSuffix(keyeventPattern, "*"))
+			log.Printf("Invalidating %s, on %s\n", message.Payload, event)
+
+			p.Cache.Invalidate(message.Payload)
+		}
+	}
+}
+
+// isClosed  Whether the proxy has been closed.
+func (p *Proxy) isClosed() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.closed
+}
@@ -0,0 +1,249 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/phayes/freeport"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor  Polls cond until it's true, or testRealWait is up.  Returns whether it came true.
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(testRealWait())
+
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	return false
+}
+
+// testNotifier  A stand in for Redis that does just enough to deliver keyevent notifications.  It answers PSUBSCRIBE and CONFIG SET, and publishes whatever it's told to to everyone subscribed.  The miniredis we have doesn't do pub/sub.
+type testNotifier struct {
+	listener      net.Listener
+	lock          sync.Mutex
+	subscribers   map[net.Conn]*bufio.Writer
+	subscriptions int
+	configs       []string
+}
+
+// newTestNotifier  Starts a testNotifier listening on a free port.
+func newTestNotifier(t *testing.T) *testNotifier {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get a free port: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+
+	n := &testNotifier{
+		listener:    listener,
+		subscribers: make(map[net.Conn]*bufio.Writer),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go n.serve(conn)
+		}
+	}()
+
+	return n
+}
+
+// Addr  Where the notifier is listening.
+func (n *testNotifier) Addr() string {
+	return n.listener.Addr().String()
+}
+
+// serve  Answers the commands on one connection.
+func (n *testNotifier) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		n.lock.Lock()
+
+		switch strings.ToLower(args[0]) {
+		case "psubscribe":
+			n.subscribers[conn] = writer
+			n.subscriptions++
+
+			for i, pattern := range args[1:] {
+				writeArrayHeader(writer, 3)
+				writeBulk(writer, "psubscribe")
+				writeBulk(writer, pattern)
+				writeInt(writer, int64(i+1))
+			}
+
+		case "config":
+			n.configs = append(n.configs, strings.Join(args[1:], " "))
+			writeSimple(writer, "OK")
+
+		default:
+			writeError(writer, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		}
+
+		writer.Flush()
+		n.lock.Unlock()
+	}
+}
+
+// publish  Announces an event on a key, as Redis would.
+func (n *testNotifier) publish(event string, key string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for _, writer := range n.subscribers {
+		writeArrayHeader(writer, 4)
+		writeBulk(writer, "pmessage")
+		writeBulk(writer, keyeventPattern)
+		writeBulk(writer, fmt.Sprintf("__keyevent@0__:%s", event))
+		writeBulk(writer, key)
+		writer.Flush()
+	}
+}
+
+// drop  Hangs up on every subscriber, as though Redis had gone away for a moment.
+func (n *testNotifier) drop() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for conn := range n.subscribers {
+		conn.Close()
+		delete(n.subscribers, conn)
+	}
+}
+
+// Subscriptions  How many times anyone has subscribed.
+func (n *testNotifier) Subscriptions() int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.subscriptions
+}
+
+// Configs  The CONFIG commands received, in order.
+func (n *testNotifier) Configs() []string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return append([]string{}, n.configs...)
+}
+
+// Close  Stops listening.
+func (n *testNotifier) Close() {
+	n.listener.Close()
+	n.drop()
+}
+
+// invalidationTestProxy  A proxy subscribed to a testNotifier, and holding testFoo and testBar.
+func invalidationTestProxy(t *testing.T, options InvalidationOptions) (p *Proxy, notifier *testNotifier, done chan error) {
+	notifier = newTestNotifier(t)
+
+	p = TestProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), notifier.Addr(), integTestFetchFunc)
+
+	done = make(chan error, 1)
+
+	go func() {
+		done <- p.RunInvalidation(options)
+	}()
+
+	if !waitFor(func() bool { return notifier.Subscriptions() == 1 }) {
+		t.Fatalf("Proxy never subscribed")
+	}
+
+	for _, key := range []string{testFoo(), testBar()} {
+		_, err := p.Cache.Get(key)
+		if err != nil {
+			t.Fatalf("Error getting %s: %s", key, err)
+		}
+	}
+
+	return p, notifier, done
+}
+
+func TestProxy_Invalidation(t *testing.T) {
+	p, notifier, done := invalidationTestProxy(t, testInvalidationOptions(false))
+	defer notifier.Close()
+
+	assert.True(t, waitFor(func() bool { return len(notifier.Configs()) == 1 }), "proxy set up notifications")
+	assert.Equal(t, []string{"set notify-keyspace-events Eg$xe"}, notifier.Configs(), "as asked")
+
+	notifier.publish("set", testFoo())
+
+	assert.True(t, waitFor(func() bool { return p.Cache.Len() == 1 }), "changed key was invalidated")
+
+	entry, err := p.Cache.Get(testBar())
+	if assert.Nil(t, err, "no error getting an unchanged key") {
+		assert.Equal(t, testBar(), entry.Value, "unchanged key is still cached")
+	}
+
+	notifier.publish("del", testBar())
+	notifier.publish("expired", testWip())
+
+	assert.True(t, waitFor(func() bool { return p.Cache.Stats().Invalidations == 3 }), "every event was an invalidation")
+	assert.Equal(t, 0, p.Cache.Len(), "deleted key was invalidated too")
+
+	// a dropped subscription is picked back up, but nothing is flushed unless asked
+	_, err = p.Cache.Get(testFoo())
+	assert.Nil(t, err, "no error getting a key")
+
+	notifier.drop()
+
+	assert.True(t, waitFor(func() bool { return notifier.Subscriptions() == 2 }), "proxy resubscribed")
+	assert.True(t, waitFor(func() bool { return len(notifier.Configs()) == 2 }), "and set up notifications again")
+	assert.Equal(t, 1, p.Cache.Len(), "without flushing the cache")
+
+	notifier.publish("set", testFoo())
+
+	assert.True(t, waitFor(func() bool { return p.Cache.Len() == 0 }), "and goes on invalidating")
+
+	p.Close()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err, "closing the proxy stops invalidation without an error")
+	case <-time.After(testRealWait()):
+		t.Errorf("Closing the proxy didn't stop invalidation")
+	}
+}
+
+func TestProxy_InvalidationFlush(t *testing.T) {
+	p, notifier, done := invalidationTestProxy(t, testInvalidationOptions(true))
+	defer notifier.Close()
+
+	assert.Equal(t, 2, p.Cache.Len(), "keys are cached")
+
+	notifier.drop()
+
+	assert.True(t, waitFor(func() bool { return notifier.Subscriptions() == 2 }), "proxy resubscribed")
+	assert.True(t, waitFor(func() bool { return p.Cache.Len() == 0 }), "and flushed the cache, since it can't know what it missed")
+	assert.Contains(t, p.info(), "invalidation_flushes:1\r\n", "INFO reports the flush")
+
+	p.Close()
+	<-done
+}
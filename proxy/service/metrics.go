@@ -0,0 +1,202 @@
+package service
+
+import (
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// metricsPath  Where RunMetrics, and the admin API, serve metrics, in Prometheus' text format.
+const metricsPath = "/metrics"
+
+// Why entries left the cache, as the reason label of redisproxy_cache_evictions_total has it.
+const (
+	evictedCapacity    = "capacity"
+	evictedExpiry      = "expiry"
+	evictedInvalidated = "invalidated"
+	evictedManual      = "manual"
+)
+
+// How a fetch from upstream turned out, as the result label of redisproxy_upstream_fetch_duration_seconds has it.
+const (
+	fetchFound   = "found"
+	fetchMissing = "missing"
+	fetchFailed  = "error"
+)
+
+// What went wrong upstream, as the type label of redisproxy_upstream_errors_total has it.
+const (
+	upstreamTimeout    = "timeout"
+	upstreamConnection = "connection"
+	upstreamOther      = "other"
+)
+
+// What the cache collector reports.  It's all read from the cache when Prometheus scrapes, rather than kept up to date as things happen.
+var (
+	cacheHitsDesc             = prometheus.NewDesc("redisproxy_cache_hits_total", "Reads answered from the cache, stale and negative entries included.", nil, nil)
+	cacheMissesDesc           = prometheus.NewDesc("redisproxy_cache_misses_total", "Reads that had to go upstream.", nil, nil)
+	cacheNegativeHitsDesc     = prometheus.NewDesc("redisproxy_cache_negative_hits_total", "Reads answered by a negative entry, for a key that isn't in Redis.", nil, nil)
+	cacheEvictionsDesc        = prometheus.NewDesc("redisproxy_cache_evictions_total", "Entries that left the cache, by why they did.", []string{"reason"}, nil)
+	cacheEntriesDesc          = prometheus.NewDesc("redisproxy_cache_entries", "Entries in the cache right now.", nil, nil)
+	cacheBytesDesc            = prometheus.NewDesc("redisproxy_cache_bytes", "Roughly how many bytes the entries in the cache take up.", nil, nil)
+	upstreamInFlightDesc      = prometheus.NewDesc("redisproxy_upstream_fetches_in_flight", "Fetches from upstream underway right now.", nil, nil)
+	upstreamFetchTimeoutsDesc = prometheus.NewDesc("redisproxy_upstream_fetch_timeouts_total", "Reads that gave up waiting on a fetch from upstream after the fetch timeout.", nil, nil)
+	cacheRefreshAheadsDesc    = prometheus.NewDesc("redisproxy_cache_refresh_aheads_total", "Keys refreshed in the background because they were read close to their expiry.", nil, nil)
+	cacheInvalidationsDesc    = prometheus.NewDesc("redisproxy_cache_invalidations_total", "Keys invalidated because they changed upstream.", nil, nil)
+)
+
+// latencyBuckets  Histogram buckets from 100µs up to a few seconds.  Most of what the proxy does takes well under a millisecond, which Prometheus' default buckets don't tell apart.
+func latencyBuckets() []float64 {
+	return prometheus.ExponentialBuckets(0.0001, 2, 16)
+}
+
+// proxyMetrics  What the proxy keeps for Prometheus.  Each proxy has a registry of it's own, rather than using the global one, so there can be more than one of them, as there are in the tests.
+type proxyMetrics struct {
+	handler         http.Handler
+	requestDuration *prometheus.HistogramVec
+	fetchDuration   *prometheus.HistogramVec
+	upstreamErrors  *prometheus.CounterVec
+	// timed  Handle's handler, timed by requestDuration.
+	timed http.Handler
+}
+
+// newProxyMetrics  Metrics for the given proxy.  The cache's are read from p.Cache when they're scraped, so it needn't exist yet.
+func newProxyMetrics(p *Proxy) (m *proxyMetrics) {
+	m = &proxyMetrics{
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "redisproxy_http_request_duration_seconds",
+			Help:    "How long http requests took, by status code.",
+			Buckets: latencyBuckets(),
+		}, []string{"code"}),
+		fetchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "redisproxy_upstream_fetch_duration_seconds",
+			Help:    "How long fetches from upstream took, by whether they found the key, didn't, or failed.",
+			Buckets: latencyBuckets(),
+		}, []string{"result"}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "redisproxy_upstream_errors_total",
+			Help: "Fetches from upstream that failed, by what went wrong.",
+		}, []string{"type"}),
+	}
+
+	// every result and type shows up from the start, rather than when it first happens, so rate() has something to work with
+	for _, result := range []string{fetchFound, fetchMissing, fetchFailed} {
+		m.fetchDuration.WithLabelValues(result)
+	}
+
+	for _, kind := range []string{upstreamTimeout, upstreamConnection, upstreamOther} {
+		m.upstreamErrors.WithLabelValues(kind)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(cacheCollector{proxy: p}, m.requestDuration, m.fetchDuration, m.upstreamErrors)
+
+	m.handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	m.timed = promhttp.InstrumentHandlerDuration(m.requestDuration, http.HandlerFunc(p.handle))
+
+	return m
+}
+
+// observeFetch  The cache's FetchObserver.  Times the fetch, and counts it if it failed.
+func (m *proxyMetrics) observeFetch(key string, took time.Duration, result cache.FetchResult, err error) {
+	outcome := fetchFound
+
+	switch {
+	case err != nil:
+		outcome = fetchFailed
+		m.upstreamErrors.WithLabelValues(upstreamErrorType(err)).Inc()
+	case result.Value == nil:
+		outcome = fetchMissing
+	}
+
+	m.fetchDuration.WithLabelValues(outcome).Observe(took.Seconds())
+}
+
+// upstreamErrorType  What kind of thing went wrong upstream.  Timeouts, trouble with the connection, or anything else, like Redis replying with an error.
+func upstreamErrorType(err error) string {
+	cause := errors.Cause(err)
+
+	if netErr, ok := cause.(net.Error); ok {
+		if netErr.Timeout() {
+			return upstreamTimeout
+		}
+
+		return upstreamConnection
+	}
+
+	if cause == io.EOF || cause == io.ErrUnexpectedEOF {
+		return upstreamConnection
+	}
+
+	return upstreamOther
+}
+
+// cacheCollector  Reports what the cache has been up to, from it's Stats.
+type cacheCollector struct {
+	proxy *Proxy
+}
+
+// Describe  Part of prometheus.Collector.
+func (c cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{cacheHitsDesc, cacheMissesDesc, cacheNegativeHitsDesc, cacheEvictionsDesc, cacheEntriesDesc, cacheBytesDesc, upstreamInFlightDesc, upstreamFetchTimeoutsDesc, cacheRefreshAheadsDesc, cacheInvalidationsDesc} {
+		ch <- desc
+	}
+}
+
+// Collect  Part of prometheus.Collector.
+func (c cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.proxy.Cache.Stats()
+
+	ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(cacheNegativeHitsDesc, prometheus.CounterValue, float64(stats.NegativeHits))
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions), evictedCapacity)
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Expirations), evictedExpiry)
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Invalidated), evictedInvalidated)
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Purges), evictedManual)
+	ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(c.proxy.Cache.Len()))
+	ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(c.proxy.Cache.Bytes()))
+	ch <- prometheus.MustNewConstMetric(upstreamInFlightDesc, prometheus.GaugeValue, float64(stats.InFlight))
+	ch <- prometheus.MustNewConstMetric(upstreamFetchTimeoutsDesc, prometheus.CounterValue, float64(stats.FetchTimeouts))
+	ch <- prometheus.MustNewConstMetric(cacheRefreshAheadsDesc, prometheus.CounterValue, float64(stats.RefreshAheads))
+	ch <- prometheus.MustNewConstMetric(cacheInvalidationsDesc, prometheus.CounterValue, float64(stats.Invalidations))
+}
+
+// HandleMetrics  Serves the proxy's metrics, for Prometheus to scrape.  Scrapes aren't themselves timed, or logged, since they'd only be noise.
+func (p *Proxy) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	p.metrics.handler.ServeHTTP(w, r)
+}
+
+// RunMetrics  Serves metrics on a port of their own, so that they can be scraped without the admin API being open.  It does not detatch from the console
+func (p *Proxy) RunMetrics() (err error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, p.HandleMetrics)
+
+	server := &http.Server{
+		Addr:    p.MetricsPort,
+		Handler: mux,
+	}
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return err
+	}
+
+	p.metricsServer = server
+	p.lock.Unlock()
+
+	err = server.ListenAndServe()
+
+	// being shut down on purpose isn't an error
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+
+	return err
+}
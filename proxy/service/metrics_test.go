@@ -0,0 +1,244 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/phayes/freeport"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeMetrics  Scrapes the proxy's metrics, as Prometheus would, and hands them back by series, labels and all, like `redisproxy_cache_evictions_total{reason="manual"}`.
+func scrapeMetrics(t *testing.T, p *Proxy) (series map[string]float64) {
+	w := httptest.NewRecorder()
+	p.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Scraping metrics got a %d", w.Code)
+	}
+
+	series = make(map[string]float64)
+
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		split := strings.LastIndex(line, " ")
+
+		value, err := strconv.ParseFloat(line[split+1:], 64)
+		if err != nil {
+			t.Fatalf("Can't make sense of metric %q: %s", line, err)
+		}
+
+		series[line[:split]] = value
+	}
+
+	return series
+}
+
+func TestProxy_HandleMetrics(t *testing.T) {
+	p := TestProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), statusTestFetchFunc)
+	defer p.Close()
+
+	before := scrapeMetrics(t, p)
+
+	for _, name := range []string{
+		"redisproxy_cache_hits_total",
+		"redisproxy_cache_misses_total",
+		`redisproxy_cache_evictions_total{reason="capacity"}`,
+		`redisproxy_cache_evictions_total{reason="invalidated"}`,
+		`redisproxy_upstream_errors_total{type="timeout"}`,
+		`redisproxy_upstream_fetch_duration_seconds_count{result="error"}`,
+		"redisproxy_upstream_fetches_in_flight",
+	} {
+		value, ok := before[name]
+		if assert.True(t, ok, "%s is there from the start", name) {
+			assert.Equal(t, float64(0), value, "at 0")
+		}
+	}
+
+	requests := []struct {
+		key    string
+		status int
+	}{
+		{testFoo(), http.StatusOK},
+		{testFoo(), http.StatusOK},
+		{testMissing(), http.StatusNotFound},
+		{testBroken(), http.StatusBadGateway},
+		{testSlow(), http.StatusGatewayTimeout},
+	}
+
+	for _, r := range requests {
+		w := httptest.NewRecorder()
+		p.Handle(w, httptest.NewRequest(http.MethodGet, "/"+r.key, nil))
+
+		assert.Equal(t, r.status, w.Code, "status for %s", r.key)
+	}
+
+	p.Cache.Purge(testFoo())
+	p.Cache.Invalidate(testMissing())
+
+	_, err := p.Cache.Get(testBar())
+	assert.Nil(t, err, "no error getting %s", testBar())
+
+	p.Cache.Invalidate(testBar())
+
+	after := scrapeMetrics(t, p)
+
+	changes := map[string]float64{
+		"redisproxy_cache_hits_total":                                        1,
+		"redisproxy_cache_misses_total":                                      5,
+		`redisproxy_cache_evictions_total{reason="manual"}`:                  1,
+		`redisproxy_cache_evictions_total{reason="invalidated"}`:             1,
+		"redisproxy_cache_invalidations_total":                               2,
+		`redisproxy_cache_evictions_total{reason="capacity"}`:                0,
+		`redisproxy_upstream_fetch_duration_seconds_count{result="found"}`:   2,
+		`redisproxy_upstream_fetch_duration_seconds_count{result="missing"}`: 1,
+		`redisproxy_upstream_fetch_duration_seconds_count{result="error"}`:   2,
+		`redisproxy_upstream_errors_total{type="other"}`:                     1,
+		`redisproxy_upstream_errors_total{type="timeout"}`:                   1,
+		`redisproxy_upstream_errors_total{type="connection"}`:                0,
+		`redisproxy_http_request_duration_seconds_count{code="200"}`:         2,
+		`redisproxy_http_request_duration_seconds_count{code="404"}`:         1,
+		`redisproxy_http_request_duration_seconds_count{code="502"}`:         1,
+		`redisproxy_http_request_duration_seconds_count{code="504"}`:         1,
+		"redisproxy_upstream_fetches_in_flight":                              0,
+		"redisproxy_cache_entries":                                           0,
+		"redisproxy_cache_bytes":                                             0,
+	}
+
+	for name, change := range changes {
+		assert.Equal(t, change, after[name]-before[name], "change in %s", name)
+	}
+
+	// scraping isn't a request like any other
+	assert.Equal(t, after[`redisproxy_http_request_duration_seconds_count{code="200"}`], scrapeMetrics(t, p)[`redisproxy_http_request_duration_seconds_count{code="200"}`], "scrapes aren't timed")
+}
+
+func TestProxy_MetricsKey(t *testing.T) {
+	p := TestProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), statusTestFetchFunc)
+	defer p.Close()
+
+	// metrics are on the admin port, so on the data port, /metrics is a key like any other
+	w := httptest.NewRecorder()
+	p.Handle(w, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+
+	assert.Equal(t, http.StatusNotFound, w.Code, "there's no key called metrics")
+	assert.NotContains(t, w.Body.String(), "redisproxy_cache_hits_total", "and no metrics either")
+	assert.Equal(t, uint64(1), p.Cache.Stats().Misses, "it was looked up like any other key")
+}
+
+func TestProxy_HandleMetricsFormat(t *testing.T) {
+	p := TestProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), statusTestFetchFunc)
+	defer p.Close()
+
+	w := httptest.NewRecorder()
+	p.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+
+	assert.Equal(t, http.StatusOK, w.Code, "metrics are there")
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain"), "in Prometheus' text format, not %s", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "# TYPE redisproxy_cache_hits_total counter", "with types")
+	assert.Contains(t, w.Body.String(), "# TYPE redisproxy_upstream_fetch_duration_seconds histogram", "histograms included")
+}
+
+func TestProxy_MetricsEvictions(t *testing.T) {
+	clock := cache.NewFakeClock(testEpoch())
+
+	p := TestProxy(0, 0, 2, testMaxAge(), testTimeout(), testRedisAddr(), statusTestFetchFunc, cache.WithClock(clock))
+	defer p.Close()
+
+	for _, key := range []string{testFoo(), testBar(), testWip()} {
+		_, err := p.Cache.Get(key)
+		assert.Nil(t, err, "no error getting %s", key)
+	}
+
+	metrics := scrapeMetrics(t, p)
+
+	assert.Equal(t, float64(1), metrics[`redisproxy_cache_evictions_total{reason="capacity"}`], "one entry made way for another")
+	assert.Equal(t, float64(2), metrics["redisproxy_cache_entries"], "which left two")
+	assert.Equal(t, float64(p.Cache.Bytes()), metrics["redisproxy_cache_bytes"], "taking up what they take up")
+
+	clock.Advance(time.Duration(testMaxAge()) * time.Second)
+
+	for _, shard := range p.Cache.Shards {
+		shard.Sweep()
+	}
+
+	metrics = scrapeMetrics(t, p)
+
+	assert.Equal(t, float64(2), metrics[`redisproxy_cache_evictions_total{reason="expiry"}`], "both of those expired")
+	assert.Equal(t, float64(0), metrics["redisproxy_cache_entries"], "which left none")
+}
+
+func TestUpstreamErrorType(t *testing.T) {
+	cases := []struct {
+		err  error
+		kind string
+	}{
+		{testTimeoutError{}, upstreamTimeout},
+		{errors.Wrap(testTimeoutError{}, "failed to fetch"), upstreamTimeout},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, upstreamConnection},
+		{io.EOF, upstreamConnection},
+		{errors.Wrap(io.ErrUnexpectedEOF, "failed to fetch"), upstreamConnection},
+		{errors.New("WRONGTYPE Operation against a key holding the wrong kind of value"), upstreamOther},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.kind, upstreamErrorType(c.err), "%q is a %s error", c.err, c.kind)
+	}
+}
+
+func TestProxy_RunMetrics(t *testing.T) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get a free port: %s", err)
+	}
+
+	p := TestProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), statusTestFetchFunc)
+	p.MetricsPort = fmt.Sprintf(":%d", port)
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- p.RunMetrics()
+	}()
+
+	var resp *http.Response
+
+	listening := waitFor(func() bool {
+		resp, err = http.Get(fmt.Sprintf("http://localhost:%d%s", port, metricsPath))
+		return err == nil
+	})
+
+	if assert.True(t, listening, "metrics are listening") {
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "and answering")
+		resp.Body.Close()
+
+		resp, err = http.Get(fmt.Sprintf("http://localhost:%d%s", port, keysPath))
+		if assert.Nil(t, err, "no error asking for keys") {
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode, "the admin API isn't there")
+			resp.Body.Close()
+		}
+	}
+
+	p.Close()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err, "shutting it down isn't an error")
+	case <-time.After(testRealWait()):
+		t.Errorf("Metrics didn't stop when the proxy was closed")
+	}
+}
@@ -0,0 +1,397 @@
+package service
+
+import (
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/pkg/errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Partial reads of a key, each of which is cached on it's own, under a cache.SubKey made of the key, the read, and it's arguments.
+const (
+	readHGet          = "hget"
+	readLRange        = "lrange"
+	readZRangeByScore = "zrangebyscore"
+	readSIsMember     = "sismember"
+)
+
+// readPaths  The http path each partial read is under, and the read.
+var readPaths = map[string]string{
+	"hash": readHGet,
+	"list": readLRange,
+	"zset": readZRangeByScore,
+	"set":  readSIsMember,
+}
+
+// readUsage  What the url for each partial read looks like, for when somebody gets it wrong.
+var readUsage = map[string]string{
+	readHGet:          "/hash/{key}/{field}",
+	readLRange:        "/list/{key}?start=0&stop=-1",
+	readZRangeByScore: "/zset/{key}?min=-inf&max=+inf",
+	readSIsMember:     "/set/{key}/{member}",
+}
+
+// parseRead  Makes a cache key out of a partial read's url.  ok is false if it isn't one, and it's path is just a key.  err is for urls that look like partial reads, but aren't right.  Keys and fields with a / in them need it escaped, as %2F.
+func parseRead(u *url.URL) (cacheKey string, ok bool, err error) {
+	segments := strings.Split(strings.TrimPrefix(u.EscapedPath(), "/"), "/")
+
+	read, ok := readPaths[segments[0]]
+	if !ok || len(segments) < 2 {
+		return cacheKey, false, err
+	}
+
+	for i := range segments {
+		segments[i], err = url.PathUnescape(segments[i])
+		if err != nil {
+			return cacheKey, true, err
+		}
+	}
+
+	err = cache.CheckKey(segments[1:]...)
+	if err != nil {
+		return cacheKey, true, err
+	}
+
+	query := u.Query()
+	usage := errors.New(fmt.Sprintf("expected %s", readUsage[read]))
+
+	switch read {
+	case readHGet, readSIsMember:
+		if len(segments) != 3 {
+			err = usage
+			return cacheKey, true, err
+		}
+
+		return cache.SubKey(segments[1], read, segments[2]), true, err
+
+	case readLRange:
+		if len(segments) != 2 {
+			err = usage
+			return cacheKey, true, err
+		}
+
+		start, err := queryInt(query, "start", 0)
+		if err != nil {
+			return cacheKey, true, err
+		}
+
+		stop, err := queryInt(query, "stop", -1)
+		if err != nil {
+			return cacheKey, true, err
+		}
+
+		return cache.SubKey(segments[1], read, strconv.Itoa(start), strconv.Itoa(stop)), true, err
+
+	case readZRangeByScore:
+		if len(segments) != 2 {
+			err = usage
+			return cacheKey, true, err
+		}
+
+		min, err := queryScore(query, "min", "-inf")
+		if err != nil {
+			return cacheKey, true, err
+		}
+
+		max, err := queryScore(query, "max", "+inf")
+		if err != nil {
+			return cacheKey, true, err
+		}
+
+		return cache.SubKey(segments[1], read, min, max), true, err
+	}
+
+	return cacheKey, false, err
+}
+
+// queryInt  An integer query parameter, or def if there isn't one.  Integers are put back together as strings, so that 007 and 7 share an entry.
+func queryInt(query url.Values, name string, def int) (value int, err error) {
+	s := query.Get(name)
+	if s == "" {
+		return def, err
+	}
+
+	value, err = strconv.Atoi(s)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("%s must be an integer, not %q", name, s))
+		return value, err
+	}
+
+	return value, err
+}
+
+// queryScore  A score query parameter, as ZRANGEBYSCORE takes it, or def if there isn't one.  A number, -inf or +inf, optionally with a ( in front to leave it out of the range.
+func queryScore(query url.Values, name string, def string) (value string, err error) {
+	value = query.Get(name)
+	if value == "" {
+		return def, err
+	}
+
+	// + turns into a space in a query string, unless it's escaped, and nobody remembers to
+	value = strings.Replace(value, " ", "+", -1)
+
+	switch strings.TrimPrefix(value, "(") {
+	case "-inf", "+inf", "inf":
+		return value, err
+	}
+
+	_, err = strconv.ParseFloat(strings.TrimPrefix(value, "("), 64)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("%s must be a score, not %q", name, value))
+		return value, err
+	}
+
+	return value, err
+}
+
+// HandleRead  The http handler for partial reads.  The reply is what redis-cli would print for the read.
+func (p *Proxy) HandleRead(w http.ResponseWriter, r *http.Request, cacheKey string) {
+	key, read := cache.SplitSubKey(cacheKey)
+	rule := p.Cache.Rule(cacheKey)
+
+	log.Printf("Received request for %s of %s %v, under rule %s\n", read[0], key, read[1:], rule)
+
+	w.Header().Set(ruleHeader, rule.String())
+
+	entry, err := p.Cache.Get(cacheKey)
+	if err != nil {
+		p.writeTextFailure(w, cacheKey, rule, err)
+		return
+	}
+
+	if entry.Missing() {
+		p.writeTextMissing(w, cacheKey, rule)
+		return
+	}
+
+	// all we have is some of it, so ask Redis for the lot
+	if entry.Truncated {
+		result, err := p.readUpstream(key, read, 0, false)
+		if err != nil {
+			p.writeTextFailure(w, cacheKey, rule, err)
+			return
+		}
+
+		if result.Value == nil {
+			p.writeTextMissing(w, cacheKey, rule)
+			return
+		}
+
+		fmt.Fprintf(w, "%s\n", formatReply(replyValue(result.Value)))
+		return
+	}
+
+	if entry.Stale {
+		w.Header().Set("Warning", staleWarning)
+	}
+
+	if writeCacheHeaders(w, r, entry, formatText) {
+		return
+	}
+
+	fmt.Fprintf(w, "%s\n", formatReply(replyValue(entry.Value)))
+}
+
+// fetchRead  Fetches a partial read of a key, along with the key's remaining TTL, in one round trip.  Ranges are cut off at maxElements, like whole keys are, and marked Truncated if there was more to them.
+func (p *Proxy) fetchRead(key string, read []string) (result cache.FetchResult, err error) {
+	return p.readUpstream(key, read, p.maxElements, true)
+}
+
+// readUpstream  Does a partial read of a key in Redis, along with the key's remaining TTL, in one round trip.  Ranges are cut off at limit elements, unless it's 0, and Redis is never asked for more than one past it, which is enough to tell if there's more.  track has Redis track the key, which is only worth it for what's going in the cache.
+func (p *Proxy) readUpstream(key string, read []string, limit int64, track bool) (result cache.FetchResult, err error) {
+	pipe := p.Client.Pipeline()
+	defer pipe.Close()
+
+	var tracking *redis.Cmd
+
+	if redirect := p.trackingRedirect(); track && redirect != nil {
+		tracking = pipe.Do(redirect...)
+	}
+
+	var cmd redis.Cmder
+
+	var length *redis.IntCmd
+
+	var start, stop int64
+
+	switch {
+	case read[0] == readHGet && len(read) == 2:
+		result.Type = TypeString
+		cmd = pipe.HGet(key, read[1])
+
+	case read[0] == readLRange && len(read) == 3:
+		start, err = strconv.ParseInt(read[1], 10, 64)
+		if err != nil {
+			return result, err
+		}
+
+		stop, err = strconv.ParseInt(read[2], 10, 64)
+		if err != nil {
+			return result, err
+		}
+
+		result.Type = TypeList
+
+		// counting back further than limit from the end, there's no telling where the range starts without the list's length
+		if limit > 0 && start+limit < 0 {
+			var n int64
+
+			n, err = p.Client.LLen(key).Result()
+			if err != nil {
+				return result, err
+			}
+
+			start, stop = lrangeAbsolute(start, stop, n)
+		}
+
+		fetchStop, trim := lrangeStop(start, stop, limit)
+		if trim {
+			length = pipe.LLen(key)
+		}
+
+		cmd = pipe.LRange(key, start, fetchStop)
+
+	case read[0] == readZRangeByScore && len(read) == 3:
+		result.Type = TypeSortedSet
+
+		by := redis.ZRangeBy{Min: read[1], Max: read[2]}
+		if limit > 0 {
+			by.Count = limit + 1
+		}
+
+		cmd = pipe.ZRangeByScoreWithScores(key, by)
+
+	case read[0] == readSIsMember && len(read) == 2:
+		cmd = pipe.SIsMember(key, read[1])
+
+	default:
+		err = errors.New(fmt.Sprintf("can't read %v of %s", read, key))
+		return result, err
+	}
+
+	pttl := pipe.PTTL(key)
+
+	_, _ = pipe.Exec()
+
+	if tracking != nil && tracking.Err() != nil {
+		log.Printf("Failed to have Redis track %s: %s\n", key, tracking.Err())
+	}
+
+	switch cmd := cmd.(type) {
+	case *redis.StringCmd:
+		result.Value, err = cmd.Result()
+		if err == redis.Nil {
+			return cache.FetchResult{}, nil
+		}
+
+	case *redis.StringSliceCmd:
+		var elements []string
+
+		elements, err = cmd.Result()
+
+		// the range was stretched to the other side of zero, so cut it back to what was asked for
+		if err == nil && length != nil {
+			var n int64
+
+			n, err = length.Result()
+
+			if want := lrangeLength(start, stop, n); int64(len(elements)) > want {
+				elements = elements[:want]
+			}
+		}
+
+		if limit > 0 && int64(len(elements)) > limit {
+			elements, result.Truncated = elements[:limit], true
+		}
+
+		result.Value = elements
+
+	case *redis.ZSliceCmd:
+		var elements []redis.Z
+
+		elements, err = cmd.Result()
+		if limit > 0 && int64(len(elements)) > limit {
+			elements, result.Truncated = elements[:limit], true
+		}
+
+		result.Value = elements
+
+	case *redis.BoolCmd:
+		var member bool
+
+		member, err = cmd.Result()
+
+		// the way Redis says it
+		result.Value = int64(0)
+		if member {
+			result.Value = int64(1)
+		}
+	}
+
+	if err != nil {
+		return result, err
+	}
+
+	result.TTL = upstreamTtl(pttl)
+
+	return result, err
+}
+
+// lrangeStop  Where an LRANGE from start to stop should stop, so it brings back no more than limit+1 elements.  A start that counts back from the end has to be no further back than limit, which lrangeAbsolute sees to.  Where stop counts back from the end and start doesn't, there's no telling how many elements are between them without the list's length, so the range is stretched to limit+1 elements, and trim is true, for it to be cut back with lrangeLength.
+func lrangeStop(start int64, stop int64, limit int64) (fetchStop int64, trim bool) {
+	end := start + limit
+
+	switch {
+	case limit <= 0, start < 0:
+		return stop, false
+
+	case stop < 0:
+		return end, true
+
+	case stop > end:
+		return end, false
+	}
+
+	return stop, false
+}
+
+// lrangeAbsolute  start and stop counted from the start of a list of length n, the way LRANGE would count them.  A range with nothing in it comes out as n to n, which LRANGE has nothing for either.
+func lrangeAbsolute(start int64, stop int64, n int64) (absStart int64, absStop int64) {
+	if start < 0 {
+		start += n
+	}
+
+	if start < 0 {
+		start = 0
+	}
+
+	if stop < 0 {
+		stop += n
+	}
+
+	if stop < start {
+		return n, n
+	}
+
+	return start, stop
+}
+
+// lrangeLength  How many elements LRANGE from start to stop gives back for a list of length n.
+func lrangeLength(start int64, stop int64, n int64) (length int64) {
+	start, stop = lrangeAbsolute(start, stop, n)
+
+	if stop >= n {
+		stop = n - 1
+	}
+
+	if stop < start {
+		return 0
+	}
+
+	return stop - start + 1
+}
@@ -0,0 +1,226 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseRead(t *testing.T) {
+	cases := []struct {
+		path     string
+		cacheKey string
+		isRead   bool
+		fails    bool
+	}{
+		{"/foo", "", false, false},
+		{"/hash", "", false, false},
+		{"/hashes/foo/bar", "", false, false},
+		{"/hash/foo/bar", cache.SubKey("foo", readHGet, "bar"), true, false},
+		{"/hash/a%2Fb/c%20d", cache.SubKey("a/b", readHGet, "c d"), true, false},
+		{"/hash/foo", "", true, true},
+		{"/hash/foo/bar/baz", "", true, true},
+		{"/set/foo/bar", cache.SubKey("foo", readSIsMember, "bar"), true, false},
+		{"/set/foo", "", true, true},
+		{"/list/foo", cache.SubKey("foo", readLRange, "0", "-1"), true, false},
+		{"/list/foo?start=007&stop=9", cache.SubKey("foo", readLRange, "7", "9"), true, false},
+		{"/list/foo?start=x", "", true, true},
+		{"/list/foo/bar", "", true, true},
+		{"/zset/foo", cache.SubKey("foo", readZRangeByScore, "-inf", "+inf"), true, false},
+		{"/zset/foo?min=(1.5&max=+inf", cache.SubKey("foo", readZRangeByScore, "(1.5", "+inf"), true, false},
+		{"/zset/foo?min=abc", "", true, true},
+		{"/hash/a%00hget%00b/c", "", true, true},
+		{"/hash/a/b%00c", "", true, true},
+		{"/list/a%00hget%00b", "", true, true},
+	}
+
+	for _, c := range cases {
+		u, err := url.Parse(c.path)
+		if err != nil {
+			t.Fatalf("Bad test url %s: %s", c.path, err)
+		}
+
+		cacheKey, isRead, err := parseRead(u)
+		assert.Equal(t, c.isRead, isRead, "%s is a partial read: %t", c.path, c.isRead)
+		assert.Equal(t, c.fails, err != nil, "%s fails: %t", c.path, c.fails)
+		assert.Equal(t, c.cacheKey, cacheKey, "%s is cached under %q", c.path, c.cacheKey)
+	}
+}
+
+func TestProxy_HandleRead(t *testing.T) {
+	upstream, p, client := typesTestProxy(t)
+	defer upstream.Close()
+	defer p.Close()
+	defer client.Close()
+
+	upstream.HSet("a/b", "c", "d")
+
+	// failures have a code instead of a body
+	cases := []struct {
+		path   string
+		status int
+		body   string
+		code   string
+	}{
+		{"/hash/hash/name", http.StatusOK, "\"ann\"\n", ""},
+		{"/hash/a%2Fb/c", http.StatusOK, "\"d\"\n", ""},
+		{"/list/list?start=1&stop=2", http.StatusOK, "1) \"two\"\n2) \"three\"\n", ""},
+		{"/list/list?start=-1", http.StatusOK, "1) \"five\"\n", ""},
+		{"/list/list", http.StatusOK, "1) \"one\"\n2) \"two\"\n3) \"three\"\n4) \"four\"\n5) \"five\"\n", ""},
+		{"/list/missing", http.StatusOK, "(empty list or set)\n", ""},
+		{"/zset/zset?min=2&max=10", http.StatusOK, "1) \"silver\"\n2) \"2.5\"\n3) \"gold\"\n4) \"10\"\n", ""},
+		{"/zset/zset?min=(2.5", http.StatusOK, "1) \"gold\"\n2) \"10\"\n", ""},
+		{"/zset/zset?max=1", http.StatusOK, "1) \"bronze\"\n2) \"1\"\n", ""},
+		{"/set/set/red", http.StatusOK, "(integer) 1\n", ""},
+		{"/set/set/pink", http.StatusOK, "(integer) 0\n", ""},
+		{"/" + testFoo(), http.StatusOK, "\"" + testFoo() + "\"\n", ""},
+		{"/hash/hash/nope", http.StatusNotFound, "", codeNotFound},
+		{"/hash/missing/name", http.StatusNotFound, "", codeNotFound},
+		{"/hash/list/name", http.StatusBadGateway, "", codeUpstreamError},
+		{"/hash/hash", http.StatusBadRequest, "", codeBadRequest},
+		{"/list/list?stop=x", http.StatusBadRequest, "", codeBadRequest},
+		{"/zset/zset?min=abc", http.StatusBadRequest, "", codeBadRequest},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		p.Handle(w, httptest.NewRequest("GET", c.path, nil))
+
+		assert.Equal(t, c.status, w.Code, "status for %s", c.path)
+
+		if c.code == "" {
+			body, _ := ioutil.ReadAll(w.Result().Body)
+			assert.Equal(t, c.body, string(body), "body for %s", c.path)
+			continue
+		}
+
+		var reply jsonReply
+
+		err := json.NewDecoder(w.Body).Decode(&reply)
+		if assert.Nil(t, err, "%s fails with JSON", c.path) {
+			assert.Equal(t, c.code, reply.Code, "%s fails with %s", c.path, c.code)
+			assert.NotEmpty(t, reply.Error, "and says why")
+		}
+	}
+}
+
+func TestProxy_HandleReadTruncated(t *testing.T) {
+	upstream, p, client := typesTestProxy(t)
+	defer upstream.Close()
+	defer p.Close()
+	defer client.Close()
+
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		p.Handle(w, httptest.NewRequest("GET", path, nil))
+
+		body, _ := ioutil.ReadAll(w.Result().Body)
+
+		return string(body)
+	}
+
+	assert.Equal(t, "1) \"two\"\n2) \"three\"\n3) \"four\"\n4) \"five\"\n", get("/list/list?start=1"), "more than max-elements comes from Redis")
+
+	entry := p.Cache.Peek(cache.SubKey(TypeList, readLRange, "1", "-1"))
+	if assert.NotNil(t, entry, "the read was cached") {
+		assert.True(t, entry.Truncated, "cut off")
+		assert.Equal(t, []string{"two", "three", "four"}, entry.Value, "at max-elements")
+	}
+
+	upstream.ZAdd(TypeSortedSet, 20, "platinum")
+
+	assert.Equal(t, "1) \"bronze\"\n2) \"1\"\n3) \"silver\"\n4) \"2.5\"\n5) \"gold\"\n6) \"10\"\n7) \"platinum\"\n8) \"20\"\n", get("/zset/zset"), "as does a sorted set")
+
+	entry = p.Cache.Peek(cache.SubKey(TypeSortedSet, readZRangeByScore, "-inf", "+inf"))
+	if assert.NotNil(t, entry, "the read was cached") {
+		assert.True(t, entry.Truncated, "cut off")
+		assert.Len(t, entry.Value, int(testMaxElements()), "at max-elements")
+	}
+}
+
+func TestProxy_ReadUpstreamRanges(t *testing.T) {
+	upstream, p, client := typesTestProxy(t)
+	defer upstream.Close()
+	defer p.Close()
+	defer client.Close()
+
+	key := "long"
+	for i := 0; i < 20; i++ {
+		upstream.Push(key, fmt.Sprintf("%d", i))
+	}
+
+	limit := testMaxElements()
+
+	for start := int64(-25); start <= 25; start++ {
+		for stop := int64(-25); stop <= 25; stop++ {
+			whole, err := p.Client.LRange(key, start, stop).Result()
+			if err != nil {
+				t.Fatalf("Failed to read %s from %d to %d: %s", key, start, stop, err)
+			}
+
+			from, to := start, stop
+			if start+limit < 0 {
+				from, to = lrangeAbsolute(start, stop, 20)
+			}
+
+			fetchStop, _ := lrangeStop(from, to, limit)
+
+			fetched, err := p.Client.LRange(key, from, fetchStop).Result()
+			if err != nil {
+				t.Fatalf("Failed to read %s from %d to %d: %s", key, from, fetchStop, err)
+			}
+
+			assert.True(t, int64(len(fetched)) <= limit+1, "%d to %d asks Redis for no more than %d", start, stop, limit+1)
+
+			result, err := p.readUpstream(key, []string{readLRange, fmt.Sprintf("%d", start), fmt.Sprintf("%d", stop)}, limit, false)
+			if err != nil {
+				t.Fatalf("Failed to read %s from %d to %d: %s", key, start, stop, err)
+			}
+
+			truncated := int64(len(whole)) > limit
+			if truncated {
+				whole = whole[:limit]
+			}
+
+			assert.Equal(t, whole, result.Value, "%d to %d", start, stop)
+			assert.Equal(t, truncated, result.Truncated, "%d to %d is truncated: %t", start, stop, truncated)
+		}
+	}
+}
+
+func TestProxy_HandleReadCaching(t *testing.T) {
+	upstream, p, client := typesTestProxy(t)
+	defer upstream.Close()
+	defer p.Close()
+	defer client.Close()
+
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		p.Handle(w, httptest.NewRequest("GET", path, nil))
+
+		body, _ := ioutil.ReadAll(w.Result().Body)
+
+		return string(body)
+	}
+
+	assert.Equal(t, "\"ann\"\n", get("/hash/hash/name"), "read a field")
+	assert.Equal(t, "\"42\"\n", get("/hash/hash/age"), "and another")
+	assert.Equal(t, 2, p.Cache.Len(), "each field is cached on it's own")
+
+	upstream.HSet(TypeHash, "name", "bob")
+
+	assert.Equal(t, "\"ann\"\n", get("/hash/hash/name"), "the field came from the cache")
+	assert.Equal(t, 2, p.Cache.Len(), "and there's nothing new in it")
+
+	// invalidating the key takes every read of it along with it
+	p.Cache.Invalidate(TypeHash)
+	assert.Equal(t, 0, p.Cache.Len(), "invalidating the hash invalidated it's fields")
+
+	assert.Equal(t, "\"bob\"\n", get("/hash/hash/name"), "the field was fetched afresh")
+}
@@ -0,0 +1,701 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxBulkLength The largest bulk string we'll accept from a client.  Same as Redis' default proto-max-bulk-len.
+const maxBulkLength = 512 * 1024 * 1024
+
+// maxInlineLength The longest inline command we'll accept from a client.
+const maxInlineLength = 64 * 1024
+
+// RunResp runs the RESP (REdis Serialization Protocol) listener for the proxy, so that real Redis clients can talk to it.  It does not detatch from the console
+func (p *Proxy) RunResp() (err error) {
+	listener, err := net.Listen("tcp", p.RespPort)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("failed to listen on %s", p.RespPort))
+		return err
+	}
+
+	defer listener.Close()
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return err
+	}
+
+	p.respListener = listener
+	p.lock.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			p.lock.Lock()
+			closed := p.closed
+			p.lock.Unlock()
+
+			// being shut down on purpose isn't an error
+			if closed {
+				return nil
+			}
+
+			err = errors.Wrap(err, "failed to accept RESP connection")
+			return err
+		}
+
+		go p.HandleResp(conn)
+	}
+}
+
+// HandleResp handles a single RESP client connection, reading commands and writing replies until the client quits or goes away.
+func (p *Proxy) HandleResp(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading RESP command: %s", err)
+				writeError(writer, fmt.Sprintf("ERR Protocol error: %s", err))
+				writer.Flush()
+			}
+
+			return
+		}
+
+		// empty inline commands are simply ignored, just like Redis does it.
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := p.dispatch(writer, args)
+
+		// only flush once the client has nothing more buffered, so pipelined commands get pipelined replies.
+		if reader.Buffered() == 0 || quit {
+			err = writer.Flush()
+			if err != nil {
+				log.Printf("Error writing RESP reply: %s", err)
+				return
+			}
+		}
+
+		if quit {
+			return
+		}
+	}
+}
+
+// dispatch runs a single command, writing its reply.  Returns true if the connection should be closed afterwards.
+func (p *Proxy) dispatch(w *bufio.Writer, args []string) (quit bool) {
+	command := strings.ToLower(args[0])
+
+	log.Printf("Received RESP command %s\n", command)
+
+	// nothing that takes a key, or a field, has any use for a NUL, and a key with one in could pass for a cache.SubKey
+	if command != "ping" && command != "echo" {
+		err := cache.CheckKey(args[1:]...)
+		if err != nil {
+			writeError(w, fmt.Sprintf("ERR %s", err))
+			return quit
+		}
+	}
+
+	switch command {
+	case "ping":
+		switch len(args) {
+		case 1:
+			writeSimple(w, "PONG")
+		case 2:
+			writeBulk(w, args[1])
+		default:
+			writeArgError(w, command)
+		}
+
+	case "echo":
+		if len(args) != 2 {
+			writeArgError(w, command)
+			return quit
+		}
+
+		writeBulk(w, args[1])
+
+	case "select":
+		if len(args) != 2 {
+			writeArgError(w, command)
+			return quit
+		}
+
+		db, err := strconv.Atoi(args[1])
+		if err != nil {
+			writeError(w, "ERR invalid DB index")
+			return quit
+		}
+
+		// The proxy only ever reads from db 0 upstream, so that's the only one we can honestly claim to serve.
+		if db != 0 {
+			writeError(w, "ERR DB index is out of range")
+			return quit
+		}
+
+		writeSimple(w, "OK")
+
+	case "quit":
+		writeSimple(w, "OK")
+		quit = true
+
+	case "get":
+		if len(args) != 2 {
+			writeArgError(w, command)
+			return quit
+		}
+
+		entry, ok := p.typedGet(w, args[1], TypeString)
+		if !ok {
+			return quit
+		}
+
+		if entry.Missing() {
+			writeNil(w)
+			return quit
+		}
+
+		writeValue(w, entry.Value)
+
+	case "mget":
+		if len(args) < 2 {
+			writeArgError(w, command)
+			return quit
+		}
+
+		// Fetch them all before writing anything, so an error doesn't leave a half written array on the wire.
+		values := make([]interface{}, 0)
+
+		for _, key := range args[1:] {
+			entry, err := p.Cache.Get(key)
+			if err != nil {
+				writeError(w, fmt.Sprintf("ERR %s", err))
+				return quit
+			}
+
+			// as far as MGET's concerned, anything that isn't a string may as well not be there
+			if entry.Missing() || entryType(entry) != TypeString {
+				values = append(values, nil)
+				continue
+			}
+
+			values = append(values, entry.Value)
+		}
+
+		writeArrayHeader(w, len(values))
+
+		for _, value := range values {
+			writeValue(w, value)
+		}
+
+	case "exists":
+		if len(args) < 2 {
+			writeArgError(w, command)
+			return quit
+		}
+
+		count := 0
+
+		for _, key := range args[1:] {
+			entry, err := p.Cache.Get(key)
+			if err != nil {
+				writeError(w, fmt.Sprintf("ERR %s", err))
+				return quit
+			}
+
+			if !entry.Missing() {
+				count++
+			}
+		}
+
+		writeInt(w, int64(count))
+
+	case "ttl":
+		if len(args) != 2 {
+			writeArgError(w, command)
+			return quit
+		}
+
+		entry, err := p.Cache.Get(args[1])
+		if err != nil {
+			writeError(w, fmt.Sprintf("ERR %s", err))
+			return quit
+		}
+
+		// -2 is what Redis says for a key that doesn't exist
+		if entry.Missing() {
+			writeInt(w, -2)
+			return quit
+		}
+
+		// This is the time remaining in *our* cache, rounded to the nearest second as Redis does it.
+		remaining := entry.Remaining()
+
+		writeInt(w, int64((remaining+time.Millisecond*500)/time.Second))
+
+	case "type":
+		if len(args) != 2 {
+			writeArgError(w, command)
+			return quit
+		}
+
+		entry, err := p.Cache.Get(args[1])
+		if err != nil {
+			writeError(w, fmt.Sprintf("ERR %s", err))
+			return quit
+		}
+
+		if entry.Missing() {
+			writeSimple(w, typeNone)
+			return quit
+		}
+
+		writeSimple(w, entryType(entry))
+
+	case "hgetall", "smembers":
+		if len(args) != 2 {
+			writeArgError(w, command)
+			return quit
+		}
+
+		kind := TypeHash
+		if command == "smembers" {
+			kind = TypeSet
+		}
+
+		entry, ok := p.typedGet(w, args[1], kind)
+		if !ok {
+			return quit
+		}
+
+		if entry.Missing() {
+			writeArrayHeader(w, 0)
+			return quit
+		}
+
+		// all we have is some of it, so ask Redis for the lot
+		if entry.Truncated {
+			p.passThrough(w, args)
+			return quit
+		}
+
+		writeValue(w, replyValue(entry.Value))
+
+	case "hget":
+		if len(args) != 3 {
+			writeArgError(w, command)
+			return quit
+		}
+
+		entry, ok := p.typedGet(w, args[1], TypeHash)
+		if !ok {
+			return quit
+		}
+
+		if entry.Missing() {
+			writeNil(w)
+			return quit
+		}
+
+		switch hash := entry.Value.(type) {
+		case map[string]string:
+			if value, ok := hash[args[2]]; ok {
+				writeBulk(w, value)
+				return quit
+			}
+		case map[string]interface{}:
+			if value, ok := hash[args[2]]; ok {
+				writeValue(w, value)
+				return quit
+			}
+		}
+
+		// the field may be in the part of the hash we didn't cache
+		if entry.Truncated {
+			p.passThrough(w, args)
+			return quit
+		}
+
+		writeNil(w)
+
+	case "lrange", "zrange":
+		withScores := len(args) == 5 && command == "zrange" && strings.ToLower(args[4]) == "withscores"
+
+		if len(args) != 4 && !withScores {
+			writeArgError(w, command)
+			return quit
+		}
+
+		start, err := strconv.Atoi(args[2])
+		if err != nil {
+			writeError(w, "ERR value is not an integer or out of range")
+			return quit
+		}
+
+		stop, err := strconv.Atoi(args[3])
+		if err != nil {
+			writeError(w, "ERR value is not an integer or out of range")
+			return quit
+		}
+
+		kind := TypeList
+		if command == "zrange" {
+			kind = TypeSortedSet
+		}
+
+		entry, ok := p.typedGet(w, args[1], kind)
+		if !ok {
+			return quit
+		}
+
+		if entry.Missing() {
+			writeArrayHeader(w, 0)
+			return quit
+		}
+
+		// the start of a truncated list is all there, but anything past it, or counted back from the end, isn't
+		if entry.Truncated && (start < 0 || stop < 0 || stop >= entryLength(entry)) {
+			p.passThrough(w, args)
+			return quit
+		}
+
+		switch elements := entry.Value.(type) {
+		case []string:
+			from, to := rangeBounds(start, stop, len(elements))
+			writeValue(w, elements[from:to])
+		case []interface{}:
+			from, to := rangeBounds(start, stop, len(elements))
+			writeValue(w, elements[from:to])
+		case []redis.Z:
+			from, to := rangeBounds(start, stop, len(elements))
+			reply := replyValue(elements[from:to]).([]interface{})
+
+			// the scores are every other element
+			if !withScores {
+				members := make([]interface{}, 0)
+				for i := 0; i < len(reply); i += 2 {
+					members = append(members, reply[i])
+				}
+
+				reply = members
+			}
+
+			writeValue(w, reply)
+		default:
+			writeArrayHeader(w, 0)
+		}
+
+	case "xrange":
+		count := 0
+
+		switch {
+		case len(args) == 4:
+		case len(args) == 6 && strings.ToLower(args[4]) == "count":
+			n, err := strconv.Atoi(args[5])
+			if err != nil {
+				writeError(w, "ERR value is not an integer or out of range")
+				return quit
+			}
+
+			count = n
+		default:
+			writeArgError(w, command)
+			return quit
+		}
+
+		entry, ok := p.typedGet(w, args[1], TypeStream)
+		if !ok {
+			return quit
+		}
+
+		if entry.Missing() {
+			writeArrayHeader(w, 0)
+			return quit
+		}
+
+		stream, _ := entry.Value.([]redis.XMessage)
+
+		messages, err := streamRange(stream, args[2], args[3], count)
+		if err != nil {
+			writeError(w, err.Error())
+			return quit
+		}
+
+		// a truncated stream can only answer for as far as it goes, or for as many messages as were asked for
+		if entry.Truncated && !(count > 0 && len(messages) >= count) && !streamReaches(stream, args[3]) {
+			p.passThrough(w, args)
+			return quit
+		}
+
+		writeValue(w, replyValue(messages))
+
+	case "object":
+		// Only things Redis doesn't have.  RESP2 has nowhere to say that a GET reply is stale, or which rule it was cached under, so this is where you ask.
+		if len(args) != 3 {
+			writeError(w, "ERR only OBJECT FRESHNESS <key> and OBJECT RULE <key> are supported")
+			return quit
+		}
+
+		switch strings.ToLower(args[1]) {
+		case "freshness":
+			// a peek, so asking doesn't fetch the key, or count as a read of it.  It's only how things stood when asked, mind.  A GET straight after might find it refreshed, or expired past serving.
+			entry := p.Cache.Peek(args[2])
+
+			switch {
+			case entry == nil || entry.Missing():
+				writeNil(w)
+			case !entry.Fresh():
+				writeSimple(w, "stale")
+			default:
+				writeSimple(w, "fresh")
+			}
+
+		case "rule":
+			// doesn't need the key to exist, or fetch it.  The rule's all in the name.
+			writeBulk(w, p.Cache.Rule(args[2]).String())
+
+		default:
+			writeError(w, "ERR only OBJECT FRESHNESS <key> and OBJECT RULE <key> are supported")
+		}
+
+	case "info":
+		// Just enough of Redis' INFO to tell how full the cache is.  Any section asked for gets the lot.
+		writeBulk(w, p.info())
+
+	case "command":
+		// redis-cli asks for this on startup.  An empty list is a perfectly legal, if unhelpful, answer.
+		writeArrayHeader(w, 0)
+
+	default:
+		writeError(w, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+
+	return quit
+}
+
+// wrongType  What Redis says when a command is used on the wrong kind of value.
+const wrongType = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+// typedGet  Gets a key for a command that only works on one kind of value.  If there's an error, or the key holds some other kind of value, it's written as the reply, and ok is false.  A missing key is fine, and comes back Missing.
+func (p *Proxy) typedGet(w *bufio.Writer, key string, kind string) (entry *cache.CacheEntry, ok bool) {
+	entry, err := p.Cache.Get(key)
+	if err != nil {
+		writeError(w, fmt.Sprintf("ERR %s", err))
+		return entry, false
+	}
+
+	if !entry.Missing() && entryType(entry) != kind {
+		writeError(w, wrongType)
+		return entry, false
+	}
+
+	return entry, true
+}
+
+// passThrough  Sends a command to Redis as it is, and writes whatever Redis says as the reply.  For reads the cache has only part of the answer to, like a range of a truncated list.
+func (p *Proxy) passThrough(w *bufio.Writer, args []string) {
+	command := make([]interface{}, 0)
+	for _, arg := range args {
+		command = append(command, arg)
+	}
+
+	reply, err := p.Client.Do(command...).Result()
+
+	switch {
+	case err == redis.Nil:
+		writeNil(w)
+	case err != nil && upstreamErrorType(err) == upstreamOther:
+		// Redis said no.  It can say so in it's own words.
+		writeError(w, err.Error())
+	case err != nil:
+		writeError(w, fmt.Sprintf("ERR %s", err))
+	default:
+		writeValue(w, reply)
+	}
+}
+
+// info The body of an INFO reply, in Redis' own "field:value" format.
+func (p *Proxy) info() string {
+	stats := p.Cache.Stats()
+
+	// negative entries are keys that *don't* exist, so they don't count
+	keys := p.Cache.Len() - stats.NegativeEntries
+
+	lines := []string{
+		"# Memory",
+		fmt.Sprintf("used_memory:%d", p.Cache.Bytes()),
+		fmt.Sprintf("maxmemory:%d", p.Cache.MaxBytes()),
+		"",
+		"# Stats",
+		fmt.Sprintf("refresh_ahead_issued:%d", stats.RefreshAheads),
+		fmt.Sprintf("refresh_ahead_useful:%d", stats.UsefulRefreshAheads),
+		fmt.Sprintf("negative_entries:%d", stats.NegativeEntries),
+		fmt.Sprintf("negative_hits:%d", stats.NegativeHits),
+		fmt.Sprintf("invalidations:%d", stats.Invalidations),
+		fmt.Sprintf("invalidation_flushes:%d", atomic.LoadUint64(&p.flushes)),
+		"",
+		"# Keyspace",
+		fmt.Sprintf("db0:keys=%d,expires=%d,avg_ttl=0", keys, keys),
+	}
+
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// readCommand reads a single command from the client, either as a RESP array of bulk strings, or as an inline command like telnet would send.
+func readCommand(r *bufio.Reader) (args []string, err error) {
+	line, err := readLine(r)
+	if err != nil {
+		return args, err
+	}
+
+	if !strings.HasPrefix(line, "*") {
+		if len(line) > maxInlineLength {
+			err = errors.New("too big inline request")
+			return args, err
+		}
+
+		args = strings.Fields(line)
+		return args, err
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > 1024*1024 {
+		err = errors.New("invalid multibulk length")
+		return args, err
+	}
+
+	args = make([]string, 0)
+
+	for i := 0; i < count; i++ {
+		line, err = readLine(r)
+		if err != nil {
+			return args, err
+		}
+
+		if !strings.HasPrefix(line, "$") {
+			err = errors.New(fmt.Sprintf("expected '$', got '%s'", line))
+			return args, err
+		}
+
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 || length > maxBulkLength {
+			err = errors.New("invalid bulk length")
+			return args, err
+		}
+
+		// grown as the bytes turn up, rather than all at once, so a client can't have us allocate more than it's actually sent just by saying it's about to.
+		var bulk bytes.Buffer
+
+		_, err = io.CopyN(&bulk, r, int64(length))
+		if err != nil {
+			return args, err
+		}
+
+		// and it's trailing \r\n, which has to actually be one, or we've lost our place in the stream
+		terminator := make([]byte, 2)
+
+		_, err = io.ReadFull(r, terminator)
+		if err != nil {
+			return args, err
+		}
+
+		if string(terminator) != "\r\n" {
+			err = errors.New("bulk string not terminated by CRLF")
+			return args, err
+		}
+
+		args = append(args, bulk.String())
+	}
+
+	return args, err
+}
+
+// readLine reads a single \r\n terminated line, stripping the terminator.
+func readLine(r *bufio.Reader) (line string, err error) {
+	line, err = r.ReadString('\n')
+	if err != nil {
+		return line, err
+	}
+
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+
+	return line, err
+}
+
+// writeValue writes a cached value in it's RESP form.  Scalars go out as bulk strings, since that's what GET would give you from Redis itself.
+func writeValue(w *bufio.Writer, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		writeNil(w)
+	case string:
+		writeBulk(w, v)
+	case []byte:
+		writeBulk(w, string(v))
+	case []string:
+		writeArrayHeader(w, len(v))
+		for _, s := range v {
+			writeBulk(w, s)
+		}
+	case []interface{}:
+		writeArrayHeader(w, len(v))
+		for _, i := range v {
+			writeValue(w, i)
+		}
+	default:
+		writeBulk(w, fmt.Sprint(v))
+	}
+}
+
+func writeSimple(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+func writeError(w *bufio.Writer, s string) {
+	// newlines would break the framing of an error reply
+	s = strings.Replace(s, "\r", " ", -1)
+	s = strings.Replace(s, "\n", " ", -1)
+
+	fmt.Fprintf(w, "-%s\r\n", s)
+}
+
+func writeArgError(w *bufio.Writer, command string) {
+	writeError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", command))
+}
+
+func writeInt(w *bufio.Writer, i int64) {
+	fmt.Fprintf(w, ":%d\r\n", i)
+}
+
+func writeBulk(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func writeNil(w *bufio.Writer) {
+	fmt.Fprint(w, "$-1\r\n")
+}
+
+func writeArrayHeader(w *bufio.Writer, length int) {
+	fmt.Fprintf(w, "*%d\r\n", length)
+}
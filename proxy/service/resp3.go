@@ -0,0 +1,173 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"strconv"
+)
+
+// RESP3 is only spoken on the one connection the proxy uses for client tracking, and only in the one direction.  Clients of the proxy still get RESP2.
+
+// resp3Push  A RESP3 push message, like the invalidations Redis sends a tracking client.  Pushes are out of band, so one can turn up between a command and it's reply.
+type resp3Push []interface{}
+
+// resp3Error  An error reply.  It's a value, not an error, so that a command Redis refused can be told apart from a connection that's broken.
+type resp3Error string
+
+func (e resp3Error) Error() string {
+	return string(e)
+}
+
+// readResp3 reads a single RESP3 value.  Simple, bulk and verbatim strings and big numbers come back as strings, integers as int64, doubles as float64, booleans as bool, and null as nil.  Arrays and sets come back as []interface{}, maps as map[string]interface{}, and pushes as resp3Push.  Attributes are read, and thrown away.
+func readResp3(r *bufio.Reader) (value interface{}, err error) {
+	line, err := readLine(r)
+	if err != nil {
+		return value, err
+	}
+
+	if line == "" {
+		err = errors.New("empty RESP3 line")
+		return value, err
+	}
+
+	kind, rest := line[0], line[1:]
+
+	switch kind {
+	case '+':
+		return rest, err
+
+	case '-':
+		return resp3Error(rest), err
+
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+
+	case ',':
+		// inf and -inf are spelled the way ParseFloat likes them already
+		return strconv.ParseFloat(rest, 64)
+
+	case '#':
+		switch rest {
+		case "t":
+			return true, err
+		case "f":
+			return false, err
+		}
+
+		err = errors.New(fmt.Sprintf("bad RESP3 boolean %q", rest))
+		return value, err
+
+	case '(':
+		return rest, err
+
+	case '_':
+		return nil, err
+
+	case '$', '!', '=':
+		length, err := strconv.Atoi(rest)
+		if err != nil || length > maxBulkLength {
+			err = errors.New(fmt.Sprintf("bad RESP3 length %q", rest))
+			return value, err
+		}
+
+		// RESP2's null bulk string, which RESP3 servers still send now and again
+		if length < 0 {
+			return nil, err
+		}
+
+		buf := make([]byte, length+2)
+
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return value, err
+		}
+
+		s := string(buf[:length])
+
+		switch kind {
+		case '!':
+			return resp3Error(s), err
+		case '=':
+			// verbatim strings start with their format, like "txt:"
+			if len(s) >= 4 && s[3] == ':' {
+				s = s[4:]
+			}
+		}
+
+		return s, err
+
+	case '*', '~', '>':
+		length, err := strconv.Atoi(rest)
+		if err != nil || length > 1024*1024 {
+			err = errors.New(fmt.Sprintf("bad RESP3 length %q", rest))
+			return value, err
+		}
+
+		// RESP2's null array
+		if length < 0 {
+			return nil, err
+		}
+
+		values := make([]interface{}, 0)
+
+		for i := 0; i < length; i++ {
+			element, err := readResp3(r)
+			if err != nil {
+				return value, err
+			}
+
+			values = append(values, element)
+		}
+
+		if kind == '>' {
+			return resp3Push(values), err
+		}
+
+		return values, err
+
+	case '%', '|':
+		length, err := strconv.Atoi(rest)
+		if err != nil || length < 0 || length > 1024*1024 {
+			err = errors.New(fmt.Sprintf("bad RESP3 length %q", rest))
+			return value, err
+		}
+
+		values := make(map[string]interface{})
+
+		for i := 0; i < length; i++ {
+			key, err := readResp3(r)
+			if err != nil {
+				return value, err
+			}
+
+			element, err := readResp3(r)
+			if err != nil {
+				return value, err
+			}
+
+			values[fmt.Sprint(key)] = element
+		}
+
+		// attributes describe whatever comes next, which is what the caller actually wants
+		if kind == '|' {
+			return readResp3(r)
+		}
+
+		return values, err
+	}
+
+	err = errors.New(fmt.Sprintf("unknown RESP3 type %q", string(kind)))
+
+	return value, err
+}
+
+// writeCommand writes a command the way a client does, as an array of bulk strings.
+func writeCommand(w *bufio.Writer, args ...string) {
+	writeArrayHeader(w, len(args))
+
+	for _, arg := range args {
+		writeBulk(w, arg)
+	}
+}
@@ -0,0 +1,24 @@
+package service
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestReadResp3(t *testing.T) {
+	for wire, expected := range testResp3Replies() {
+		actual, err := readResp3(bufio.NewReader(strings.NewReader(wire)))
+		if err != nil {
+			t.Errorf("Error reading %q: %s", wire, err)
+		}
+
+		assert.Equal(t, expected, actual, "read %q", wire)
+	}
+
+	for _, wire := range testBadResp3Replies() {
+		_, err := readResp3(bufio.NewReader(strings.NewReader(wire)))
+		assert.Error(t, err, "%q is no good", wire)
+	}
+}
@@ -0,0 +1,384 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/phayes/freeport"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// respTestProxy spins up a proxy with only it's RESP listener running, and hands back a go-redis client pointed at it.
+func respTestProxy(t *testing.T, options ...cache.Option) (p *Proxy, client *redis.Client) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get a free port: %s", err)
+	}
+
+	p = TestProxy(0, port, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), integTestFetchFunc, options...)
+
+	go p.RunResp()
+
+	addr := fmt.Sprintf("localhost%s", p.RespPort)
+
+	// wait for the listener to come up, rather than sleeping a fixed amount and hoping
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	client = redis.NewClient(&redis.Options{
+		Addr: addr,
+	})
+
+	return p, client
+}
+
+func TestResp_Ping(t *testing.T) {
+	_, client := respTestProxy(t)
+	defer client.Close()
+
+	pong, err := client.Ping().Result()
+	if err != nil {
+		log.Printf("Error pinging proxy: %s", err)
+		t.Fail()
+	}
+
+	assert.Equal(t, "PONG", pong, "PING gets PONG")
+
+	echo, err := client.Echo(testEcho()).Result()
+	if err != nil {
+		log.Printf("Error echoing: %s", err)
+		t.Fail()
+	}
+
+	assert.Equal(t, testEcho(), echo, "ECHO echoes")
+
+	pong, err = client.Do("PING", testEcho()).String()
+	if err != nil {
+		log.Printf("Error pinging proxy with a message: %s", err)
+		t.Fail()
+	}
+
+	assert.Equal(t, testEcho(), pong, "PING with a message returns the message")
+}
+
+func TestResp_Get(t *testing.T) {
+	_, client := respTestProxy(t)
+	defer client.Close()
+
+	value, err := client.Get(testFoo()).Result()
+	if err != nil {
+		log.Printf("Error fetching key %s: %s", testFoo(), err)
+		t.Fail()
+	}
+
+	assert.Equal(t, testFoo(), value, "fetched string matches expectations")
+
+	number, err := client.Get("ten").Int64()
+	if err != nil {
+		log.Printf("Error fetching key ten: %s", err)
+		t.Fail()
+	}
+
+	assert.Equal(t, int64(testTen()), number, "numbers come back as bulk strings that parse as numbers")
+
+	_, err = client.Get(testMissing()).Result()
+	assert.Equal(t, redis.Nil, err, "missing key is a nil bulk reply")
+}
+
+func TestResp_MGet(t *testing.T) {
+	_, client := respTestProxy(t)
+	defer client.Close()
+
+	values, err := client.MGet(testFoo(), testMissing(), testBar()).Result()
+	if err != nil {
+		log.Printf("Error fetching keys: %s", err)
+		t.Fail()
+	}
+
+	assert.Equal(t, []interface{}{testFoo(), nil, testBar()}, values, "MGET results are in order, with nil for the missing key")
+}
+
+func TestResp_Exists(t *testing.T) {
+	_, client := respTestProxy(t)
+	defer client.Close()
+
+	count, err := client.Exists(testFoo(), testBar(), testMissing()).Result()
+	if err != nil {
+		log.Printf("Error checking existence: %s", err)
+		t.Fail()
+	}
+
+	assert.Equal(t, int64(2), count, "two of the three keys exist")
+}
+
+func TestResp_TTL(t *testing.T) {
+	_, client := respTestProxy(t)
+	defer client.Close()
+
+	ttl, err := client.TTL(testFoo()).Result()
+	if err != nil {
+		log.Printf("Error getting ttl: %s", err)
+		t.Fail()
+	}
+
+	assert.True(t, ttl > 0, "ttl of a present key is positive")
+	assert.True(t, ttl <= time.Duration(testMaxAge())*time.Second, "ttl is no more than the configured max age")
+
+	// go straight to the raw reply, as client versions differ on how they scale negative ttls
+	missing, err := client.Do("TTL", testMissing()).Int64()
+	if err != nil {
+		log.Printf("Error getting ttl: %s", err)
+		t.Fail()
+	}
+
+	assert.Equal(t, int64(-2), missing, "ttl of a missing key is -2")
+}
+
+func TestResp_Info(t *testing.T) {
+	p, client := respTestProxy(t)
+	defer client.Close()
+
+	_, err := client.Get(testFoo()).Result()
+	if err != nil {
+		log.Printf("Error getting key: %s", err)
+		t.Fail()
+	}
+
+	info, err := client.Info().Result()
+	if err != nil {
+		log.Printf("Error getting info: %s", err)
+		t.Fail()
+	}
+
+	assert.Contains(t, info, fmt.Sprintf("used_memory:%d\r\n", p.Cache.Bytes()), "INFO reports the cache's size")
+	assert.Contains(t, info, "maxmemory:0\r\n", "INFO reports no byte limit")
+	assert.Contains(t, info, "refresh_ahead_issued:0\r\n", "INFO reports refresh aheads")
+	assert.Contains(t, info, "db0:keys=1,", "INFO reports the number of keys")
+}
+
+func TestResp_SubKeySeparator(t *testing.T) {
+	upstream, p, client := typesTestProxy(t)
+	defer upstream.Close()
+	defer p.Close()
+	defer client.Close()
+
+	// a GET of this would be an HGET of the hash's name field, if it got as far as the cache
+	subKey := cache.SubKey(TypeHash, readHGet, "name")
+
+	_, err := client.Get(subKey).Result()
+	if assert.NotNil(t, err, "GET of a key with a NUL in it fails") {
+		assert.True(t, strings.HasPrefix(err.Error(), "ERR"), "with an error, not a nil: %s", err)
+	}
+
+	_, err = client.HGet(TypeHash, "na\x00me").Result()
+	assert.NotNil(t, err, "HGET of a field with a NUL in it fails too")
+
+	_, err = client.MGet(testFoo(), subKey).Result()
+	assert.NotNil(t, err, "as does MGET, if any of them have one")
+
+	assert.Nil(t, p.Cache.Peek(subKey), "nothing was read")
+	assert.Equal(t, 0, p.Cache.Len(), "or cached")
+
+	echo, err := client.Echo("a\x00b").Result()
+	assert.Nil(t, err, "ECHO doesn't take a key, so it doesn't mind")
+	assert.Equal(t, "a\x00b", echo, "and says what it's told")
+}
+
+func TestResp_ObjectFreshness(t *testing.T) {
+	clock := cache.NewFakeClock(testEpoch())
+
+	p, client := respTestProxy(t, cache.WithClock(clock), cache.WithStaleWhileRevalidate(testStaleGrace()))
+	defer client.Close()
+
+	err := client.Do("OBJECT", "FRESHNESS", testFoo()).Err()
+	assert.Equal(t, redis.Nil, err, "keys that aren't cached have no freshness")
+	assert.Equal(t, 0, p.Cache.Len(), "and asking doesn't fetch them")
+
+	_, err = client.Get(testFoo()).Result()
+	assert.Nil(t, err, "no error getting %s", testFoo())
+
+	freshness, err := client.Do("OBJECT", "FRESHNESS", testFoo()).String()
+	assert.Nil(t, err, "no error asking after freshness")
+	assert.Equal(t, "fresh", freshness, "just fetched is fresh")
+
+	clock.Advance(time.Duration(testMaxAge())*time.Second + time.Second)
+
+	freshness, err = client.Do("OBJECT", "FRESHNESS", testFoo()).String()
+	assert.Nil(t, err, "no error asking after freshness")
+	assert.Equal(t, "stale", freshness, "expired, but within the grace period, is stale")
+
+	value, err := client.Get(testFoo()).Result()
+	assert.Nil(t, err, "stale values are still served to GET")
+	assert.Equal(t, testFoo(), value, "GET gets the value")
+
+	hits := p.Cache.Stats().Hits
+
+	_, err = client.Do("OBJECT", "FRESHNESS", testFoo()).String()
+	assert.Nil(t, err, "no error asking after freshness")
+	assert.Equal(t, hits, p.Cache.Stats().Hits, "asking isn't a read")
+
+	_, err = client.Get(testMissing()).Result()
+	assert.Equal(t, redis.Nil, err, "%s isn't there", testMissing())
+
+	err = client.Do("OBJECT", "FRESHNESS", testMissing()).Err()
+	assert.Equal(t, redis.Nil, err, "missing keys have no freshness")
+
+	err = client.Do("OBJECT", "ENCODING", testFoo()).Err()
+	assert.NotNil(t, err, "other OBJECT subcommands are errors")
+}
+
+func TestResp_ObjectRule(t *testing.T) {
+	rules, err := cache.NewRules(testRules()...)
+	if err != nil {
+		t.Fatalf("Error compiling rules: %s", err)
+	}
+
+	p, client := respTestProxy(t, cache.WithRules(rules))
+	defer client.Close()
+
+	for key, expected := range map[string]string{testFoo(): "foos", testBar(): "bars", testWip(): "default"} {
+		rule, err := client.Do("OBJECT", "RULE", key).String()
+		assert.Nil(t, err, "no error asking after %s's rule", key)
+		assert.Equal(t, expected, rule, "%s falls under the right rule", key)
+	}
+
+	assert.Equal(t, 0, p.Cache.Len(), "asking after a rule doesn't fetch anything")
+
+	value, err := client.Get(testBar()).Result()
+	assert.Nil(t, err, "bypassed keys are still served")
+	assert.Equal(t, testBar(), value, "GET gets the value")
+	assert.Equal(t, 0, p.Cache.Len(), "but they aren't cached")
+}
+
+func TestResp_Negative(t *testing.T) {
+	p, client := respTestProxy(t, cache.WithNegativeTtl(time.Second*time.Duration(testMaxAge())))
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Get(testMissing()).Result()
+		assert.Equal(t, redis.Nil, err, "missing key is nil")
+	}
+
+	values, err := client.MGet(testFoo(), testMissing()).Result()
+	assert.Nil(t, err, "no error on MGET")
+	assert.Equal(t, []interface{}{testFoo(), nil}, values, "missing key is nil in MGET too")
+
+	count, err := client.Exists(testMissing()).Result()
+	assert.Nil(t, err, "no error on EXISTS")
+	assert.Equal(t, int64(0), count, "missing key doesn't exist")
+
+	missing, err := client.Do("TTL", testMissing()).Int64()
+	assert.Nil(t, err, "no error on TTL")
+	assert.Equal(t, int64(-2), missing, "missing key has no ttl")
+
+	assert.Equal(t, uint64(4), p.Cache.Stats().NegativeHits, "all but the first were answered from the cache")
+
+	info, err := client.Info().Result()
+	assert.Nil(t, err, "no error on INFO")
+	assert.Contains(t, info, "negative_entries:1\r\n", "INFO reports the negative entry")
+	assert.Contains(t, info, "db0:keys=1,", "but doesn't count it as a key")
+}
+
+func TestResp_Select(t *testing.T) {
+	_, client := respTestProxy(t)
+	defer client.Close()
+
+	err := client.Do("SELECT", 0).Err()
+	assert.Nil(t, err, "SELECT 0 is fine")
+
+	err = client.Do("SELECT", 1).Err()
+	assert.NotNil(t, err, "SELECT 1 is an error")
+
+	err = client.Do("FLUSHALL").Err()
+	assert.NotNil(t, err, "unknown commands are errors")
+
+	err = client.Do("GET").Err()
+	assert.NotNil(t, err, "wrong number of args is an error")
+}
+
+// TestResp_Raw talks to the listener directly, to check inline commands, pipelining and QUIT.
+func TestResp_Raw(t *testing.T) {
+	p, client := respTestProxy(t)
+	client.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost%s", p.RespPort))
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "PING\r\n*2\r\n$3\r\nGET\r\n$3\r\n%s\r\nQUIT\r\n", testFoo())
+
+	reader := bufio.NewReader(conn)
+
+	for _, expected := range testRawReplies() {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			log.Printf("Error reading reply: %s", err)
+			t.Fail()
+		}
+
+		assert.Equal(t, expected, line, "raw reply matches expectations")
+	}
+
+	_, err = reader.ReadString('\n')
+	assert.NotNil(t, err, "connection is closed after QUIT")
+}
+
+func TestReadCommand(t *testing.T) {
+	cases := []struct {
+		input string
+		args  []string
+		fails bool
+	}{
+		{"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n", []string{"GET", "foo"}, false},
+		{"*1\r\n$0\r\n\r\n", []string{""}, false},
+		{"GET foo\r\n", []string{"GET", "foo"}, false},
+		{"*1\r\n$-1\r\n", []string{}, true},
+		{fmt.Sprintf("*1\r\n$%d\r\n", maxBulkLength+1), []string{}, true},
+		{"*1\r\n$5\r\nfoo\r\n", []string{}, true},
+		{"*1\r\n$3\r\nfooXY", []string{}, true},
+		{"*2\r\n$3\r\nfoo\n$3\r\nbar\r\n", []string{}, true},
+	}
+
+	for _, c := range cases {
+		args, err := readCommand(bufio.NewReader(strings.NewReader(c.input)))
+		assert.Equal(t, c.fails, err != nil, "%q fails: %t", c.input, c.fails)
+
+		if !c.fails {
+			assert.Equal(t, c.args, args, "%q is %v", c.input, c.args)
+		}
+	}
+}
+
+func TestReadCommandHugeBulk(t *testing.T) {
+	// a client that says it's sending as big a bulk string as there can be, and then doesn't
+	input := fmt.Sprintf("*1\r\n$%d\r\nabc", maxBulkLength)
+
+	var before, after runtime.MemStats
+
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	_, err := readCommand(bufio.NewReader(strings.NewReader(input)))
+
+	runtime.ReadMemStats(&after)
+
+	assert.NotNil(t, err, "a bulk string that never arrives is an error")
+	assert.True(t, after.TotalAlloc-before.TotalAlloc < 1024*1024, "and nothing like it's size was allocated waiting for it, just %d bytes", after.TotalAlloc-before.TotalAlloc)
+}
@@ -4,76 +4,316 @@ import (
 	"fmt"
 	"github.com/go-redis/redis"
 	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/pkg/errors"
 	"log"
+	"net"
 	"net/http"
 	"reflect"
-	"regexp"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 )
 
 // Proxy struct to represent the proxy server itself
 type Proxy struct {
-	Cache     *cache.Cache
-	RedisAddr string
-	Port      string
+	Cache        *cache.ShardedCache
+	Client       *redis.Client
+	RedisAddr    string
+	Port         string
+	RespPort     string
+	lock         sync.Mutex
+	closed       bool
+	httpServer   *http.Server
+	respListener net.Listener
+	// Invalidation  If set, Run keeps the cache up with changes in Redis, as RunInvalidation does.
+	Invalidation *InvalidationOptions
+	pubsub       *redis.PubSub
+	// Tracking  If set, Run has Redis track what the proxy caches, as RunTracking does.
+	Tracking     *TrackingOptions
+	trackingConn net.Conn
+	trackingID   int64
+	stopped      chan struct{}
+	flushes      uint64
+	maxElements  int64
+	// AdminPort  Where Run serves the admin API, as RunAdmin does.  Empty for nowhere, which is the default, since it can empty the cache.
+	AdminPort   string
+	adminServer *http.Server
+	// MetricsPort  Where Run serves metrics, as RunMetrics does, for those that don't want the admin API open.  Empty for nowhere.
+	MetricsPort   string
+	metricsServer *http.Server
+	metrics       *proxyMetrics
+	// LegacyStatus  Reply 200 to every text request, with (nil) for missing keys and an Error: line for failures, the way the proxy always used to.  JSON and raw replies get proper statuses regardless.
+	LegacyStatus bool
 }
 
-// NewProxy creates, guess what?  a new proxy.  Uses the default redis fetcher client.
-func NewProxy(port int, maxEntries int, maxAge int, timeout int, redisAddr string) *Proxy {
-	portString := strconv.Itoa(port)
+// NewProxy creates, guess what?  a new proxy.  Fetches from redis over a pooled client configured by upstream.  The cache is split over the given number of shards.  A respPort of 0 disables the RESP listener.
+func NewProxy(port int, respPort int, maxEntries int, maxAge int, timeout int, redisAddr string, upstream UpstreamOptions, shards int, options ...cache.Option) *Proxy {
+	proxy := &Proxy{
+		Client:      NewUpstreamClient(redisAddr, upstream),
+		Port:        listenAddr(port),
+		RespPort:    listenAddr(respPort),
+		RedisAddr:   redisAddr,
+		stopped:     make(chan struct{}),
+		maxElements: upstream.MaxElements,
+	}
+
+	proxy.metrics = newProxyMetrics(proxy)
 
-	realPort := fmt.Sprintf(":%s", portString)
+	// batches are fetched as batches, unless somebody says otherwise
+	options = append([]cache.Option{cache.WithBatchFetchFunc(proxy.BatchFetcher), cache.WithFetchObserver(proxy.metrics.observeFetch)}, options...)
+
+	proxy.Cache = cache.NewShardedCache(shards, maxEntries, time.Duration(maxAge)*time.Second, proxy.Fetcher, time.Duration(timeout)*time.Second, redisAddr, options...)
+
+	return proxy
+}
 
+// TestProxy is just like NewProxy, but allows you to hand in a custom fetch func for testing.  It always has a single shard, so the cache behaves as one LRU.  Batches are fetched a key at a time with the fetch func, unless you hand in cache.WithBatchFetchFunc as well.
+func TestProxy(port int, respPort int, maxEntries int, maxAge int, timeout int, redisAddr string, fetcher cache.FetchFunc, options ...cache.Option) *Proxy {
 	proxy := &Proxy{
-		Cache:     cache.NewCache(maxEntries, time.Duration(maxAge)*time.Second, Fetcher, time.Duration(timeout)*time.Second, redisAddr),
-		Port:      realPort,
+		Client:    NewUpstreamClient(redisAddr, DefaultUpstreamOptions()),
+		Port:      listenAddr(port),
+		RespPort:  listenAddr(respPort),
 		RedisAddr: redisAddr,
+		stopped:   make(chan struct{}),
 	}
 
+	proxy.metrics = newProxyMetrics(proxy)
+
+	options = append([]cache.Option{cache.WithFetchObserver(proxy.metrics.observeFetch)}, options...)
+
+	proxy.Cache = cache.NewShardedCache(1, maxEntries, time.Duration(maxAge)*time.Second, fetcher, time.Duration(timeout)*time.Second, redisAddr, options...)
+
 	return proxy
 }
 
-// TestProxy is just like NewProxy, but allows you to hand in a custom fetch func for testing.
-func TestProxy(port int, maxEntries int, maxAge int, timeout int, redisAddr string, fetcher cache.FetchFunc) *Proxy {
+// listenAddr turns a port number into something net.Listen can use.  Port 0 means 'not listening', and comes back as an empty string.
+func listenAddr(port int) string {
+	if port == 0 {
+		return ""
+	}
+
 	portString := strconv.Itoa(port)
 
-	realPort := fmt.Sprintf(":%s", portString)
+	return fmt.Sprintf(":%s", portString)
+}
 
-	proxy := &Proxy{
-		Cache:     cache.NewCache(maxEntries, time.Duration(maxAge)*time.Second, fetcher, time.Duration(timeout)*time.Second, redisAddr),
-		Port:      realPort,
-		RedisAddr: redisAddr,
+// Run actually runs the http server for the proxy, and the RESP server, the admin API, metrics, invalidation and tracking alongside it if configured.  It does not detatch from the console
+func (p *Proxy) Run() (err error) {
+	errs := make(chan error, 6)
+
+	if p.RespPort != "" {
+		go func() {
+			errs <- p.RunResp()
+		}()
 	}
 
-	return proxy
+	if p.AdminPort != "" {
+		go func() {
+			errs <- p.RunAdmin()
+		}()
+	}
+
+	if p.MetricsPort != "" {
+		go func() {
+			errs <- p.RunMetrics()
+		}()
+	}
+
+	if p.Invalidation != nil {
+		go func() {
+			errs <- p.RunInvalidation(*p.Invalidation)
+		}()
+	}
+
+	if p.Tracking != nil {
+		go func() {
+			errs <- p.RunTracking(*p.Tracking)
+		}()
+	}
+
+	go func() {
+		errs <- p.RunHttp()
+	}()
+
+	// Any one of them dying is fatal.
+	err = <-errs
+
+	return err
 }
 
-// Run actually runs the http server for the proxy.  It does not detatch from the console
-func (p *Proxy) Run() (err error) {
-	http.HandleFunc("/", p.Handle)
-	err = http.ListenAndServe(p.Port, nil)
+// RunHttp runs just the http server for the proxy.  It does not detatch from the console
+func (p *Proxy) RunHttp() (err error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", p.Handle)
+
+	server := &http.Server{
+		Addr:    p.Port,
+		Handler: mux,
+	}
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return err
+	}
+
+	p.httpServer = server
+	p.lock.Unlock()
+
+	err = server.ListenAndServe()
+
+	// being shut down on purpose isn't an error
+	if err == http.ErrServerClosed {
+		err = nil
+	}
 
 	return err
 }
 
-// Handle is the http handler for all incoming requests.
+// Close shuts down the listeners, the admin API, the keyevent subscription, client tracking, the cache's janitors, and the upstream connection pool.
+func (p *Proxy) Close() (err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return err
+	}
+
+	p.closed = true
+	close(p.stopped)
+
+	if p.httpServer != nil {
+		p.httpServer.Close()
+	}
+
+	if p.adminServer != nil {
+		p.adminServer.Close()
+	}
+
+	if p.metricsServer != nil {
+		p.metricsServer.Close()
+	}
+
+	if p.respListener != nil {
+		p.respListener.Close()
+	}
+
+	if p.pubsub != nil {
+		p.pubsub.Close()
+	}
+
+	if p.trackingConn != nil {
+		p.trackingConn.Close()
+	}
+
+	p.Cache.Close()
+
+	err = p.Client.Close()
+
+	return err
+}
+
+// staleWarning  The Warning header that goes on a stale response.
+const staleWarning = `110 - "Response is Stale"`
+
+// ruleHeader  The header that says which caching rule a key fell under.  "default" if none.
+const ruleHeader = "X-Cache-Rule"
+
+// Handle is the http handler for all incoming requests.  Replies are text, as redis-cli would show them, unless the client asks for JSON or raw bytes, with it's Accept header or a format parameter.
+//
+// Successful replies have ETag, Last-Modified, Age and Cache-Control headers, so downstream caches can share the load, and conditional requests get a 304 if the client has the current version already.  HEAD is a GET without the body, which the http server sees to.
+//
+// Many keys can be read at once from /batch, as HandleBatch does.  Every request is timed for the metrics, which are served on the admin port, rather than here, where they'd take a key's path.
+//
+// Missing keys are a 404, bad requests a 400, methods other than GET and HEAD a 405, and failures upstream a 502, or a 504 if they're timeouts.  Whatever the format, anything but a 200 has a JSON error body, as writeFailure writes it.  Unless LegacyStatus is set, in which case text replies are always a 200, as they always used to be.
 func (p *Proxy) Handle(w http.ResponseWriter, r *http.Request) {
-	key := strings.TrimPrefix(r.RequestURI, "/")
+	p.metrics.timed.ServeHTTP(w, r)
+}
 
-	log.Printf("Received request for %s\n", key)
+// handle  Does the work of Handle, with the metrics timing it.
+func (p *Proxy) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == batchPath {
+		p.HandleBatch(w, r)
+		return
+	}
+
+	format := replyFormat(r)
+	legacy := p.LegacyStatus && format == formatText
+
+	if !legacy && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeFailure(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, jsonReply{Type: typeNone}, errors.New(fmt.Sprintf("%s isn't supported.  Keys are read with GET", r.Method)))
+		return
+	}
+
+	// partial reads of a key have paths of their own
+	cacheKey, isRead, err := parseRead(r.URL)
+	if err == nil && !isRead {
+		cacheKey = requestKey(r)
+
+		if cacheKey == "" && !legacy {
+			err = errors.New("no key.  Ask for /{key}")
+		} else {
+			err = cache.CheckKey(cacheKey)
+		}
+	}
+
+	if err != nil {
+		if legacy {
+			http.Error(w, fmt.Sprintf("Error: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		writeFailure(w, http.StatusBadRequest, codeBadRequest, jsonReply{Type: typeNone}, err)
+		return
+	}
+
+	if format != formatText {
+		p.handleFormatted(w, r, format, cacheKey)
+		return
+	}
+
+	if isRead {
+		p.HandleRead(w, r, cacheKey)
+		return
+	}
+
+	key := cacheKey
+
+	rule := p.Cache.Rule(key)
+
+	log.Printf("Received request for %s, under rule %s\n", key, rule)
+
+	w.Header().Set(ruleHeader, rule.String())
 
 	entry, err := p.Cache.Get(key)
 	if err != nil {
-		fmt.Fprintf(w, "Error: %s\n", err)
+		p.writeTextFailure(w, key, rule, err)
 		return
 	}
 
-	if entry != nil {
+	if !entry.Missing() {
 		log.Printf("Get result: %s", entry.Value)
 		value := entry.Value
 
+		// RFC 7234's way of saying 'this is all we've got right now'
+		if entry.Stale {
+			w.Header().Set("Warning", staleWarning)
+		}
+
+		if writeCacheHeaders(w, r, entry, format) {
+			log.Printf("Not modified\n")
+			return
+		}
+
+		// anything but a string is shown the way redis-cli would show it
+		if kind := entryType(entry); kind != TypeString {
+			fmt.Fprintf(w, "(%s)\n%s\n", kind, formatReply(replyValue(value)))
+			log.Printf("Done with request\n")
+
+			return
+		}
+
 		valtype := reflect.TypeOf(value).String()
 
 		if valtype == "string" {
@@ -88,37 +328,7 @@ func (p *Proxy) Handle(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("No result, sending nil\n")
 
-	fmt.Fprint(w, "(nil)\n")
+	p.writeTextMissing(w, key, rule)
 	log.Printf("Done with request\n")
 
 }
-
-// Fetcher The function that actually gets info from redis.  This is used when the proxy is run for reals.  In testing it's replaced by an in memory function reading from a test fixture
-func Fetcher(key string, redisAddr string) (value interface{}, err error) {
-	r := regexp.MustCompile(`.+:\d+`)
-
-	var fqRedisAddr string
-
-	if r.MatchString(redisAddr) {
-		fqRedisAddr = redisAddr
-	} else {
-		fqRedisAddr = fmt.Sprintf("%s:6379", redisAddr)
-	}
-
-	client := redis.NewClient(&redis.Options{
-		Addr:     fqRedisAddr,
-		Password: "",
-		DB:       0,
-	})
-
-	fetchedval, err := client.Get(key).Result()
-	if err == redis.Nil {
-		return value, nil
-	} else if err != nil {
-		return value, err
-	}
-
-	value = fetchedval
-
-	return value, err
-}
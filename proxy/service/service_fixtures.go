@@ -1,6 +1,16 @@
 package service
 
-import "log"
+import (
+	"fmt"
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/pkg/errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 func testCapacity() int {
 	return 3
@@ -60,13 +70,338 @@ func testCacheData() (info map[string]interface{}) {
 	return info
 }
 
-func integTestFetchFunc(key string, redisAddr string) (value interface{}, err error) {
+func integTestFetchFunc(key string, redisAddr string) (result cache.FetchResult, err error) {
 	log.Printf("in integTestFetchFunc")
 	data := testCacheData()
 
 	if elem, ok := data[key]; ok {
-		return elem, nil
+		result.Value = elem
+		return result, nil
 	}
 
-	return value, err
+	return result, err
+}
+
+func testMissing() string {
+	return "nonexistent"
+}
+
+// testBroken  A key that can't be fetched, as statusTestFetchFunc has it
+func testBroken() string {
+	return "broken"
+}
+
+// testSlow  A key that times out, as statusTestFetchFunc has it
+func testSlow() string {
+	return "slow"
+}
+
+// testTimeoutError  A network error that's a timeout, like a read from Redis that took too long
+type testTimeoutError struct{}
+
+func (e testTimeoutError) Error() string   { return "i/o timeout" }
+func (e testTimeoutError) Timeout() bool   { return true }
+func (e testTimeoutError) Temporary() bool { return true }
+
+// statusTestFetchFunc  Just like integTestFetchFunc, apart from testBroken, which fails, and testSlow, which times out.
+func statusTestFetchFunc(key string, redisAddr string) (result cache.FetchResult, err error) {
+	switch key {
+	case testBroken():
+		err = errors.New("ERR something broke")
+		return result, err
+	case testSlow():
+		err = testTimeoutError{}
+		return result, err
+	}
+
+	return integTestFetchFunc(key, redisAddr)
+}
+
+func testEcho() string {
+	return "hello there"
+}
+
+// testRawReplies  What comes back on the wire for PING, GET foo and QUIT, line by line
+func testRawReplies() []string {
+	return []string{
+		"+PONG\r\n",
+		"$3\r\n",
+		"foo\r\n",
+		"+OK\r\n",
+	}
+}
+
+// testUpstreamOptions  A deliberately small pool, so it's easy to see it being reused
+func testUpstreamOptions() UpstreamOptions {
+	options := DefaultUpstreamOptions()
+	options.PoolSize = 2
+	options.MinIdleConns = 1
+
+	return options
+}
+
+// testRedisAddrs  Addresses as given, and as they should be once the port is filled in
+func testRedisAddrs() map[string]string {
+	return map[string]string{
+		"redis":          "redis:6379",
+		"redis:6380":     "redis:6380",
+		"10.0.0.1":       "10.0.0.1:6379",
+		"localhost:1234": "localhost:1234",
+	}
+}
+
+// testUpstream  Spins up an in memory Redis, loaded up with the string values from testCacheData
+func testUpstream() (upstream *miniredis.Miniredis, err error) {
+	upstream, err = miniredis.Run()
+	if err != nil {
+		return upstream, err
+	}
+
+	for key, value := range testCacheData() {
+		if s, ok := value.(string); ok {
+			upstream.Set(key, s)
+		}
+	}
+
+	return upstream, err
+}
+
+// testEpoch  When fake clocks start
+func testEpoch() time.Time {
+	return time.Date(2017, time.September, 1, 12, 0, 0, 0, time.UTC)
+}
+
+// testStaleGrace  How long past expiry stale entries can be served, on a fake clock
+func testStaleGrace() time.Duration {
+	return time.Second * 10
+}
+
+// testUpstreamTtl  How long a key has left upstream.  A good deal less than testMaxAge.
+func testUpstreamTtl() time.Duration {
+	return time.Millisecond * 200
+}
+
+// testRules  Caching rules for the rule tests.  testFoo is cached briefly, and testBar not at all.
+func testRules() []cache.Rule {
+	return []cache.Rule{
+		{Name: "foos", Glob: "fo*", Ttl: time.Second},
+		{Name: "bars", Glob: "bar", Bypass: true},
+	}
+}
+
+// testRealWait  How long the tests will wait, in real time, for something that happens in the background
+func testRealWait() time.Duration {
+	return time.Second * 5
+}
+
+// testInvalidationOptions  Invalidation options for the tests.  Retries are quick, so the tests needn't wait around.
+func testInvalidationOptions(flush bool) InvalidationOptions {
+	return InvalidationOptions{
+		FlushOnResubscribe:   flush,
+		NotifyKeyspaceEvents: "Eg$xe",
+		RetryInterval:        time.Millisecond * 10,
+	}
+}
+
+// testResp3Replies  RESP3 replies as they come over the wire, and what readResp3 should make of them
+func testResp3Replies() map[string]interface{} {
+	return map[string]interface{}{
+		"+OK\r\n":       "OK",
+		"-ERR nope\r\n": resp3Error("ERR nope"),
+		":42\r\n":       int64(42),
+		",3.5\r\n":      3.5,
+		"#t\r\n":        true,
+		"#f\r\n":        false,
+		"(3492890328409238509324850943850943825024385\r\n": "3492890328409238509324850943850943825024385",
+		"_\r\n":                                nil,
+		"$-1\r\n":                              nil,
+		"*-1\r\n":                              nil,
+		"$3\r\nfoo\r\n":                        "foo",
+		"$0\r\n\r\n":                           "",
+		"!9\r\nERR oh no\r\n":                  resp3Error("ERR oh no"),
+		"=7\r\ntxt:bar\r\n":                    "bar",
+		"*2\r\n:1\r\n$3\r\nfoo\r\n":            []interface{}{int64(1), "foo"},
+		"~1\r\n+foo\r\n":                       []interface{}{"foo"},
+		"%2\r\n+proto\r\n:3\r\n+id\r\n:7\r\n":  map[string]interface{}{"proto": int64(3), "id": int64(7)},
+		"|1\r\n+ttl\r\n:3600\r\n$3\r\nfoo\r\n": "foo",
+		">2\r\n$10\r\ninvalidate\r\n*1\r\n$3\r\nfoo\r\n": resp3Push{"invalidate", []interface{}{"foo"}},
+		">2\r\n$10\r\ninvalidate\r\n_\r\n":               resp3Push{"invalidate", nil},
+	}
+}
+
+// testBadResp3Replies  Things readResp3 should refuse
+func testBadResp3Replies() []string {
+	return []string{"", "\r\n", "?what\r\n", ":lots\r\n", "#maybe\r\n", "$5\r\nfoo\r\n", "*2\r\n:1\r\n", "%1\r\n+key\r\n"}
+}
+
+// testTrackingPrefixes  Prefixes for the broadcast tracking tests
+func testTrackingPrefixes() []string {
+	return []string{"fo", "ba"}
+}
+
+// testTrackingOptions  Tracking options for the tests.  Retries are quick, so the tests needn't wait around.
+func testTrackingOptions(broadcast bool) TrackingOptions {
+	options := TrackingOptions{
+		RetryInterval: time.Millisecond * 10,
+		Timeout:       time.Second,
+	}
+
+	if broadcast {
+		options.Broadcast = true
+		options.Prefixes = testTrackingPrefixes()
+	}
+
+	return options
+}
+
+// testStreamKey  The key testResp3Server keeps testStream under
+func testStreamKey() string {
+	return "events"
+}
+
+// testStream  A stream, as XRANGE replies with it.  Fields are in order, so they come out the same as replyValue sorts them.
+func testStream() []interface{} {
+	return []interface{}{
+		[]interface{}{"1526919030474-55", []interface{}{"action", "login", "user", "ann"}},
+		[]interface{}{"1526919030474-56", []interface{}{"action", "logout", "user", "bob"}},
+	}
+}
+
+// testHash  A hash for testing, as it's fetched
+func testHash() map[string]string {
+	return map[string]string{
+		"name": "ann",
+		"age":  "42",
+	}
+}
+
+// testList  A list for testing, longer than testMaxElements
+func testList() []string {
+	return []string{"one", "two", "three", "four", "five"}
+}
+
+// testSet  A set for testing, in the order SMEMBERS gives it back from miniredis
+func testSet() []string {
+	return []string{"blue", "green", "red"}
+}
+
+// testSortedSet  A sorted set for testing, in order
+func testSortedSet() []redis.Z {
+	return []redis.Z{
+		{Score: 1, Member: "bronze"},
+		{Score: 2.5, Member: "silver"},
+		{Score: 10, Member: "gold"},
+	}
+}
+
+// testBigHashKey  Where testBigHash lives
+func testBigHashKey() string {
+	return "bighash"
+}
+
+// testBigHash  A hash for testing, with more fields than testMaxElements
+func testBigHash() map[string]string {
+	return map[string]string{
+		"name":  "ann",
+		"age":   "42",
+		"city":  "oslo",
+		"pet":   "cat",
+		"shoes": "9",
+	}
+}
+
+// testBigSetKey  Where testBigSet lives
+func testBigSetKey() string {
+	return "bigset"
+}
+
+// testBigSet  A set for testing, with more members than testMaxElements
+func testBigSet() []string {
+	return []string{"blue", "green", "indigo", "orange", "red", "violet", "yellow"}
+}
+
+// testBigSortedSetKey  Where testBigSortedSet lives
+func testBigSortedSetKey() string {
+	return "bigzset"
+}
+
+// testBigSortedSet  A sorted set for testing, in order, with more members than testMaxElements
+func testBigSortedSet() []redis.Z {
+	return []redis.Z{
+		{Score: 1, Member: "bronze"},
+		{Score: 2.5, Member: "silver"},
+		{Score: 10, Member: "gold"},
+		{Score: 20, Member: "platinum"},
+		{Score: 50, Member: "diamond"},
+	}
+}
+
+// testMaxElements  How many elements of a list, sorted set or stream the types tests cache
+func testMaxElements() int64 {
+	return 3
+}
+
+// testManyKeys  n keys, for batches that are as big as they're allowed to be, or bigger
+func testManyKeys(n int) []string {
+	keys := make([]string, 0)
+
+	for i := 0; i < n; i++ {
+		keys = append(keys, fmt.Sprintf("key-%d", i))
+	}
+
+	return keys
+}
+
+// testBatchFetcher  A pretend BatchFetchFunc, that fetches each key with statusTestFetchFunc, and remembers which keys each batch asked for
+type testBatchFetcher struct {
+	sync.Mutex
+	batches [][]string
+}
+
+// fetch  The BatchFetchFunc
+func (f *testBatchFetcher) fetch(keys []string, redisAddr string) (results []cache.BatchResult, err error) {
+	f.Lock()
+	f.batches = append(f.batches, keys)
+	f.Unlock()
+
+	for _, key := range keys {
+		var result cache.BatchResult
+
+		result.FetchResult, result.Err = statusTestFetchFunc(key, redisAddr)
+		results = append(results, result)
+	}
+
+	return results, err
+}
+
+// Batches  The keys each batch asked for, so far
+func (f *testBatchFetcher) Batches() [][]string {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.batches
+}
+
+// testAdminCapacity  Room for everything in testCacheData, and then some
+func testAdminCapacity() int {
+	return 10
+}
+
+// testAdminKeys  The keys the admin tests cache, in order
+func testAdminKeys() []string {
+	return []string{"bar", "foo", "ten", "wip", "zoz"}
+}
+
+// versionedTestFetchFunc  Just like statusTestFetchFunc, but strings come back with how many fetches there've been on the end, like foo-1, so it's plain when something's been fetched again.
+func versionedTestFetchFunc(calls *int32) cache.FetchFunc {
+	return func(key string, redisAddr string) (result cache.FetchResult, err error) {
+		version := atomic.AddInt32(calls, 1)
+
+		result, err = statusTestFetchFunc(key, redisAddr)
+		if s, ok := result.Value.(string); ok {
+			result.Value = fmt.Sprintf("%s-%d", s, version)
+		}
+
+		return result, err
+	}
 }
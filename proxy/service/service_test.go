@@ -2,11 +2,13 @@ package service
 
 import (
 	"fmt"
+	"github.com/nikogura/redisproxy/proxy/cache"
 	"github.com/phayes/freeport"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
@@ -35,7 +37,8 @@ func setUp() {
 	log.Printf("Running with port %d\n", port)
 	log.Printf("Creating proxy with the following:\n\tPort: %d\n\tCapacity: %d\n\tAge: %d\r\tTimeout: %d\r\tRedis: %s\n", port, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr())
 
-	proxy = TestProxy(port, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), integTestFetchFunc)
+	// No RESP listener here.  The RESP tests bring their own proxy, so they don't muddy the entry counts below.
+	proxy = TestProxy(port, 0, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), integTestFetchFunc)
 
 	log.Printf("Running proxy\n")
 
@@ -77,7 +80,7 @@ func TestCacheAndLimit(t *testing.T) {
 
 	assert.Equal(t, fmt.Sprintf("\"%s\"\n", key1), string(body), "Http response for key meets expectations.")
 
-	assert.True(t, len(proxy.Cache.Entries) == 1, "one entry in cache")
+	assert.True(t, proxy.Cache.Len() == 1, "one entry in cache")
 
 	// ************** Entry Two **************************
 
@@ -102,7 +105,7 @@ func TestCacheAndLimit(t *testing.T) {
 
 	assert.Equal(t, fmt.Sprintf("\"%s\"\n", key2), string(body), "Http response for key meets expectations.")
 
-	assert.True(t, len(proxy.Cache.Entries) == 2, "two entries in cache")
+	assert.True(t, proxy.Cache.Len() == 2, "two entries in cache")
 
 	// ************** Entry Three **************************
 	key3 := testWip()
@@ -126,7 +129,7 @@ func TestCacheAndLimit(t *testing.T) {
 
 	assert.Equal(t, fmt.Sprintf("\"%s\"\n", key3), string(body), "Http response for key meets expectations.")
 
-	assert.True(t, len(proxy.Cache.Entries) == 3, "three entries in cache")
+	assert.True(t, proxy.Cache.Len() == 3, "three entries in cache")
 
 	// ************** Entry Four **************************
 	key4 := testZoz()
@@ -150,6 +153,79 @@ func TestCacheAndLimit(t *testing.T) {
 
 	assert.Equal(t, fmt.Sprintf("\"%s\"\n", key4), string(body), "Http response for key meets expectations.")
 
-	assert.True(t, len(proxy.Cache.Entries) == 3, "three entries in cache")
+	assert.True(t, proxy.Cache.Len() == 3, "three entries in cache")
 
 }
+
+func TestProxy_HandleStale(t *testing.T) {
+	clock := cache.NewFakeClock(testEpoch())
+
+	p := TestProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), integTestFetchFunc, cache.WithClock(clock), cache.WithStaleWhileRevalidate(testStaleGrace()))
+	defer p.Close()
+
+	uri := fmt.Sprintf("/%s", testFoo())
+
+	recorder := httptest.NewRecorder()
+	p.Handle(recorder, httptest.NewRequest(http.MethodGet, uri, nil))
+
+	assert.Equal(t, fmt.Sprintf("%q\n", testFoo()), recorder.Body.String(), "Http response for key meets expectations.")
+	assert.Equal(t, "", recorder.Header().Get("Warning"), "fresh response has no warning")
+
+	clock.Advance(time.Duration(testMaxAge())*time.Second + time.Second)
+
+	recorder = httptest.NewRecorder()
+	p.Handle(recorder, httptest.NewRequest(http.MethodGet, uri, nil))
+
+	assert.Equal(t, fmt.Sprintf("%q\n", testFoo()), recorder.Body.String(), "stale response has the same body")
+	assert.Equal(t, staleWarning, recorder.Header().Get("Warning"), "stale response says so")
+}
+
+func TestProxy_HandleNegative(t *testing.T) {
+	p := TestProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), integTestFetchFunc, cache.WithNegativeTtl(time.Second*time.Duration(testMaxAge())))
+	defer p.Close()
+
+	uri := fmt.Sprintf("/%s", testMissing())
+
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		p.Handle(recorder, httptest.NewRequest(http.MethodGet, uri, nil))
+
+		assert.Equal(t, http.StatusNotFound, recorder.Code, "missing key is not found")
+	}
+
+	// the way it used to be
+	p.LegacyStatus = true
+
+	recorder := httptest.NewRecorder()
+	p.Handle(recorder, httptest.NewRequest(http.MethodGet, uri, nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code, "missing key is fine, with legacy status")
+	assert.Equal(t, "(nil)\n", recorder.Body.String(), "and nil")
+
+	p.LegacyStatus = false
+
+	stats := p.Cache.Stats()
+
+	assert.Equal(t, 1, stats.NegativeEntries, "missing key was cached as missing")
+	assert.Equal(t, uint64(2), stats.NegativeHits, "and the later requests were answered from the cache")
+}
+
+func TestProxy_HandleRule(t *testing.T) {
+	rules, err := cache.NewRules(testRules()...)
+	if err != nil {
+		t.Fatalf("Error compiling rules: %s", err)
+	}
+
+	p := TestProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), integTestFetchFunc, cache.WithRules(rules))
+	defer p.Close()
+
+	for key, expected := range map[string]string{testFoo(): "foos", testBar(): "bars", testWip(): "default"} {
+		recorder := httptest.NewRecorder()
+		p.Handle(recorder, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/%s", key), nil))
+
+		assert.Equal(t, fmt.Sprintf("%q\n", key), recorder.Body.String(), "%s is served", key)
+		assert.Equal(t, expected, recorder.Header().Get(ruleHeader), "%s says which rule it fell under", key)
+	}
+
+	assert.Equal(t, 2, p.Cache.Len(), "everything but the bypassed key was cached")
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"net/http"
+)
+
+// What can go wrong with an http request, as it's written in the code of an error body.  There's one for each status Handle fails with.
+const (
+	codeBadRequest       = "bad_request"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeNotAcceptable    = "not_acceptable"
+	codeUpstreamError    = "upstream_error"
+	codeUpstreamTimeout  = "upstream_timeout"
+)
+
+// errNotFound  The error for a key that isn't there.  Not really an error, as far as the cache is concerned, but it is for whoever asked for it.
+var errNotFound = errors.New("no such key")
+
+// fetchFailure  The status, and code, for a fetch that failed.  Timeouts, whether the cache gave up waiting, or the connection to Redis did, are a 504.  Anything else is a 502.
+func fetchFailure(err error) (status int, code string) {
+	cause := errors.Cause(err)
+
+	if cause == cache.ErrFetchTimeout {
+		return http.StatusGatewayTimeout, codeUpstreamTimeout
+	}
+
+	if netErr, ok := cause.(net.Error); ok && netErr.Timeout() {
+		return http.StatusGatewayTimeout, codeUpstreamTimeout
+	}
+
+	return http.StatusBadGateway, codeUpstreamError
+}
+
+// writeFailure  Replies with an error body.  It's JSON whatever format was asked for, since there's no sense making clients parse errors three different ways.  It has the same shape as any other JSON reply, with Error and Code filled in.
+func writeFailure(w http.ResponseWriter, status int, code string, reply jsonReply, err error) {
+	reply.Error = err.Error()
+	reply.Code = code
+
+	// whatever went wrong may not be wrong for long
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", contentTypes[formatJson])
+	w.WriteHeader(status)
+
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Printf("Failed to write error reply for %q: %s\n", reply.Key, err)
+	}
+}
+
+// writeTextFailure  Replies to a text request that failed upstream.  With LegacyStatus, that's a 200 with an Error: line.
+func (p *Proxy) writeTextFailure(w http.ResponseWriter, cacheKey string, rule *cache.Rule, err error) {
+	if p.LegacyStatus {
+		fmt.Fprintf(w, "Error: %s\n", err)
+		return
+	}
+
+	status, code := fetchFailure(err)
+	writeFailure(w, status, code, newJsonReply(cacheKey, rule), err)
+}
+
+// writeTextMissing  Replies to a text request for a missing key.  With LegacyStatus, that's a 200 with (nil), as redis-cli would say it.
+func (p *Proxy) writeTextMissing(w http.ResponseWriter, cacheKey string, rule *cache.Rule) {
+	if p.LegacyStatus {
+		fmt.Fprint(w, "(nil)\n")
+		return
+	}
+
+	writeFailure(w, http.StatusNotFound, codeNotFound, newJsonReply(cacheKey, rule), errNotFound)
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchFailure(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{errors.Wrap(cache.ErrFetchTimeout, "Timeout fetching foo"), http.StatusGatewayTimeout, codeUpstreamTimeout},
+		{errors.Wrap(testTimeoutError{}, "Failed to fetch foo"), http.StatusGatewayTimeout, codeUpstreamTimeout},
+		{errors.New("ERR something broke"), http.StatusBadGateway, codeUpstreamError},
+	}
+
+	for _, c := range cases {
+		status, code := fetchFailure(c.err)
+		assert.Equal(t, c.status, status, "status for %s", c.err)
+		assert.Equal(t, c.code, code, "code for %s", c.err)
+	}
+}
+
+func TestProxy_HandleStatus(t *testing.T) {
+	p := TestProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), testRedisAddr(), statusTestFetchFunc)
+	defer p.Close()
+
+	// a code means it fails, and body is ignored
+	cases := []struct {
+		legacy bool
+		method string
+		path   string
+		status int
+		body   string
+		code   string
+	}{
+		{false, http.MethodGet, "/" + testFoo(), http.StatusOK, fmt.Sprintf("%q\n", testFoo()), ""},
+		{false, http.MethodHead, "/" + testFoo(), http.StatusOK, fmt.Sprintf("%q\n", testFoo()), ""},
+		{false, http.MethodGet, "/" + testMissing(), http.StatusNotFound, "", codeNotFound},
+		{false, http.MethodGet, "/" + testBroken(), http.StatusBadGateway, "", codeUpstreamError},
+		{false, http.MethodGet, "/" + testSlow(), http.StatusGatewayTimeout, "", codeUpstreamTimeout},
+		{false, http.MethodGet, "/", http.StatusBadRequest, "", codeBadRequest},
+		{false, http.MethodGet, "/hash/" + testFoo(), http.StatusBadRequest, "", codeBadRequest},
+		{false, http.MethodPost, "/" + testFoo(), http.StatusMethodNotAllowed, "", codeMethodNotAllowed},
+		{false, http.MethodDelete, "/" + testFoo(), http.StatusMethodNotAllowed, "", codeMethodNotAllowed},
+		{false, http.MethodGet, "/" + testMissing() + "?format=json", http.StatusNotFound, "", codeNotFound},
+		{false, http.MethodGet, "/" + testBroken() + "?format=raw", http.StatusBadGateway, "", codeUpstreamError},
+		{true, http.MethodGet, "/" + testFoo(), http.StatusOK, fmt.Sprintf("%q\n", testFoo()), ""},
+		{true, http.MethodPost, "/" + testFoo(), http.StatusOK, fmt.Sprintf("%q\n", testFoo()), ""},
+		{true, http.MethodGet, "/" + testMissing(), http.StatusOK, "(nil)\n", ""},
+		{true, http.MethodGet, "/" + testBroken(), http.StatusOK, fmt.Sprintf("Error: Failed to fetch %s: ERR something broke\n", testBroken()), ""},
+		{true, http.MethodGet, "/" + testMissing() + "?format=json", http.StatusNotFound, "", codeNotFound},
+		{true, http.MethodPost, "/" + testFoo() + "?format=json", http.StatusMethodNotAllowed, "", codeMethodNotAllowed},
+	}
+
+	for _, c := range cases {
+		p.LegacyStatus = c.legacy
+
+		w := httptest.NewRecorder()
+		p.Handle(w, httptest.NewRequest(c.method, c.path, nil))
+
+		assert.Equal(t, c.status, w.Code, "status for %s %s, legacy %t", c.method, c.path, c.legacy)
+
+		if c.code == "" {
+			assert.Equal(t, c.body, w.Body.String(), "body for %s %s, legacy %t", c.method, c.path, c.legacy)
+			continue
+		}
+
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"), "%s %s fails with JSON", c.method, c.path)
+
+		var reply jsonReply
+
+		err := json.NewDecoder(w.Body).Decode(&reply)
+		if assert.Nil(t, err, "%s %s fails with JSON, legacy %t", c.method, c.path, c.legacy) {
+			assert.Equal(t, c.code, reply.Code, "%s %s fails with %s, legacy %t", c.method, c.path, c.code, c.legacy)
+			assert.NotEmpty(t, reply.Error, "and says why")
+		}
+
+		if c.status == http.StatusMethodNotAllowed {
+			assert.Equal(t, "GET, HEAD", w.Header().Get("Allow"), "%s says what is allowed", c.method)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// TrackingOptions  How the proxy has Redis track the keys it's cached, using client side caching (CLIENT TRACKING), which needs Redis 6 or better.
+type TrackingOptions struct {
+	// Broadcast  Have Redis announce changes to every key starting with one of Prefixes, rather than just the keys the proxy has read.  Less work for Redis, but more invalidations for keys that were never cached.
+	Broadcast bool
+	// Prefixes  In broadcast mode, the key prefixes to hear about.  None means every key.
+	Prefixes []string
+	// RetryInterval  How long to wait between attempts to connect, when Redis can't be reached.
+	RetryInterval time.Duration
+	// Timeout  How long connecting, and setting up tracking, can take.
+	Timeout time.Duration
+}
+
+// DefaultTrackingOptions  What you get if you don't have opinions of your own.  Redis tracks the keys the proxy has read.
+func DefaultTrackingOptions() TrackingOptions {
+	return TrackingOptions{
+		RetryInterval: time.Second,
+		Timeout:       time.Second * 5,
+	}
+}
+
+// RunTracking  Keeps a RESP3 connection open to Redis for it to push invalidations down, and invalidates whatever keys it names.  In the default mode, every fetch has Redis track the key it read, and send invalidations for it down this connection.  In broadcast mode, Redis sends invalidations for every key under the prefixes, fetched or not.  Either way, entries are dropped as soon as they change, and their TTL is just a safety net.
+//
+// Should the connection drop, it's reopened as soon as Redis can be reached, and the whole cache is flushed, since there's no telling what changed in the meantime.  It does not detatch from the console, and returns once the proxy is closed.
+func (p *Proxy) RunTracking(options TrackingOptions) (err error) {
+	tracked := false
+
+	for {
+		if p.isClosed() {
+			return nil
+		}
+
+		conn, reader, id, err := p.startTracking(options)
+		if err != nil {
+			log.Printf("Failed to start client tracking: %s\n", err)
+
+			select {
+			case <-p.stopped:
+				return nil
+			case <-time.After(options.RetryInterval):
+			}
+
+			continue
+		}
+
+		// anything cached while nobody was listening for invalidations is suspect
+		if tracked {
+			flushed := p.Cache.Flush()
+			atomic.AddUint64(&p.flushes, 1)
+
+			log.Printf("Flushed %d entries that may have changed while client tracking was down\n", flushed)
+		}
+
+		tracked = true
+		atomic.StoreInt64(&p.trackingID, id)
+
+		log.Printf("Client tracking started, as client %d\n", id)
+
+		err = p.receiveInvalidations(reader)
+
+		atomic.StoreInt64(&p.trackingID, 0)
+		conn.Close()
+
+		if p.isClosed() {
+			return nil
+		}
+
+		log.Printf("Client tracking interrupted: %s\n", err)
+	}
+}
+
+// startTracking  Connects to Redis, switches to RESP3, and finds out the connection's client id, which is what fetches redirect their invalidations to.  In broadcast mode it turns tracking on for the prefixes too.
+func (p *Proxy) startTracking(options TrackingOptions) (conn net.Conn, reader *bufio.Reader, id int64, err error) {
+	conn, err = net.DialTimeout("tcp", FullRedisAddr(p.RedisAddr), options.Timeout)
+	if err != nil {
+		return conn, reader, id, err
+	}
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		conn.Close()
+		err = errors.New("proxy closed")
+		return conn, reader, id, err
+	}
+
+	p.trackingConn = conn
+	p.lock.Unlock()
+
+	reader = bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	// the handshake has a deadline.  Waiting for invalidations doesn't.
+	conn.SetDeadline(time.Now().Add(options.Timeout))
+
+	_, err = p.trackingCommand(reader, writer, "HELLO", "3")
+	if err != nil {
+		conn.Close()
+		err = errors.Wrap(err, "Redis doesn't speak RESP3.  Client tracking needs Redis 6 or better")
+		return conn, reader, id, err
+	}
+
+	reply, err := p.trackingCommand(reader, writer, "CLIENT", "ID")
+	if err != nil {
+		conn.Close()
+		return conn, reader, id, err
+	}
+
+	id, ok := reply.(int64)
+	if !ok {
+		conn.Close()
+		err = errors.New(fmt.Sprintf("CLIENT ID replied %v, which isn't an id", reply))
+		return conn, reader, id, err
+	}
+
+	if options.Broadcast {
+		args := []string{"CLIENT", "TRACKING", "ON", "BCAST"}
+		for _, prefix := range options.Prefixes {
+			args = append(args, "PREFIX", prefix)
+		}
+
+		_, err = p.trackingCommand(reader, writer, args...)
+		if err != nil {
+			conn.Close()
+			return conn, reader, id, err
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, reader, id, err
+}
+
+// trackingCommand  Sends a command down the tracking connection, and reads it's reply.  Any pushes that turn up first are dealt with on the way.
+func (p *Proxy) trackingCommand(reader *bufio.Reader, writer *bufio.Writer, args ...string) (reply interface{}, err error) {
+	writeCommand(writer, args...)
+
+	err = writer.Flush()
+	if err != nil {
+		return reply, err
+	}
+
+	for {
+		reply, err = readResp3(reader)
+		if err != nil {
+			return reply, err
+		}
+
+		if push, ok := reply.(resp3Push); ok {
+			p.handlePush(push)
+			continue
+		}
+
+		if refused, ok := reply.(resp3Error); ok {
+			err = errors.Wrap(refused, fmt.Sprintf("%s failed", args[0]))
+			return reply, err
+		}
+
+		return reply, err
+	}
+}
+
+// receiveInvalidations  Reads pushes off the tracking connection until it breaks.
+func (p *Proxy) receiveInvalidations(reader *bufio.Reader) (err error) {
+	for {
+		reply, err := readResp3(reader)
+		if err != nil {
+			return err
+		}
+
+		if push, ok := reply.(resp3Push); ok {
+			p.handlePush(push)
+		}
+	}
+}
+
+// handlePush  Acts on a push from Redis.  Only invalidations matter.  They name the keys that changed, or if they name none, say that everything did, as after a FLUSHALL.
+func (p *Proxy) handlePush(push resp3Push) {
+	if len(push) < 2 || push[0] != "invalidate" {
+		return
+	}
+
+	keys, ok := push[1].([]interface{})
+	if !ok {
+		flushed := p.Cache.Flush()
+		log.Printf("Redis invalidated everything.  Flushed %d entries\n", flushed)
+
+		return
+	}
+
+	for _, key := range keys {
+		if key, ok := key.(string); ok {
+			log.Printf("Invalidating %s, on Redis' say so\n", key)
+			p.Cache.Invalidate(key)
+		}
+	}
+}
+
+// trackingRedirect  The CLIENT TRACKING command that has Redis send invalidations for whatever a fetch reads to the tracking connection.  nil if it's not needed, because tracking's off, or broadcasting, or down.
+func (p *Proxy) trackingRedirect() []interface{} {
+	if p.Tracking == nil || p.Tracking.Broadcast {
+		return nil
+	}
+
+	id := atomic.LoadInt64(&p.trackingID)
+	if id == 0 {
+		return nil
+	}
+
+	return []interface{}{"client", "tracking", "on", "redirect", strconv.FormatInt(id, 10)}
+}
@@ -0,0 +1,333 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/phayes/freeport"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testResp3Server  A stand in for Redis 6, that does just enough client side caching for the tracking tests.  Connections that say HELLO 3 get RESP3, and pushes.  Everybody else gets RESP2.  It keeps track of the tracking commands it's sent, and can push invalidations, or hang up, on demand.  If it's old, it doesn't know HELLO, like Redis 5.
+//
+// Every key is a string that's it's own value, apart from testStreamKey, which is testStream.  The miniredis we have doesn't do streams, so this is where they're tested too.
+type testResp3Server struct {
+	listener net.Listener
+	old      bool
+	lock     sync.Mutex
+	nextID   int64
+	resp3    map[net.Conn]*bufio.Writer
+	hellos   int
+	tracking []string
+	xranges  []string
+}
+
+// newTestResp3Server  Starts a testResp3Server listening on a free port.
+func newTestResp3Server(t *testing.T, old bool) *testResp3Server {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get a free port: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+
+	s := &testResp3Server{
+		listener: listener,
+		old:      old,
+		resp3:    make(map[net.Conn]*bufio.Writer),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+// Addr  Where the server is listening.
+func (s *testResp3Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// serve  Answers the commands on one connection.
+func (s *testResp3Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	s.lock.Lock()
+	s.nextID++
+	id := s.nextID
+	s.lock.Unlock()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		command := strings.ToLower(strings.Join(args, " "))
+
+		s.lock.Lock()
+
+		switch {
+		case command == "hello 3" && !s.old:
+			s.resp3[conn] = writer
+			s.hellos++
+			fmt.Fprint(writer, "%2\r\n+proto\r\n:3\r\n+server\r\n+redis\r\n")
+
+		case command == "client id":
+			// a push can turn up at any time, even in the middle of the handshake
+			if _, ok := s.resp3[conn]; ok {
+				fmt.Fprint(writer, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$5\r\nearly\r\n")
+			}
+
+			writeInt(writer, id)
+
+		case strings.HasPrefix(command, "client tracking on"):
+			s.tracking = append(s.tracking, fmt.Sprintf("%d: %s", id, command))
+			writeSimple(writer, "OK")
+
+		case strings.HasPrefix(command, "type "):
+			if args[1] == testStreamKey() {
+				writeSimple(writer, TypeStream)
+			} else {
+				writeSimple(writer, TypeString)
+			}
+
+		case strings.HasPrefix(command, "get "):
+			if args[1] == testStreamKey() {
+				writeError(writer, "WRONGTYPE Operation against a key holding the wrong kind of value")
+			} else {
+				writeBulk(writer, args[1])
+			}
+
+		case strings.HasPrefix(command, "xrange "):
+			s.xranges = append(s.xranges, command)
+			writeStream(writer, testStream())
+
+		case strings.HasPrefix(command, "pttl "):
+			writeInt(writer, -1)
+
+		default:
+			writeError(writer, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		}
+
+		writer.Flush()
+		s.lock.Unlock()
+	}
+}
+
+// writeStream  Writes stream entries as XRANGE replies with them.
+func writeStream(w *bufio.Writer, stream []interface{}) {
+	writeArrayHeader(w, len(stream))
+
+	for _, entry := range stream {
+		entry := entry.([]interface{})
+		fields := entry[1].([]interface{})
+
+		writeArrayHeader(w, 2)
+		writeBulk(w, entry[0].(string))
+		writeArrayHeader(w, len(fields))
+
+		for _, field := range fields {
+			writeBulk(w, field.(string))
+		}
+	}
+}
+
+// XRanges  The XRANGE commands received, in order.
+func (s *testResp3Server) XRanges() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string{}, s.xranges...)
+}
+
+// push  Sends a push to every RESP3 connection.
+func (s *testResp3Server) push(push string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, writer := range s.resp3 {
+		fmt.Fprint(writer, push)
+		writer.Flush()
+	}
+}
+
+// invalidate  Pushes an invalidation for the keys.
+func (s *testResp3Server) invalidate(keys ...string) {
+	push := fmt.Sprintf(">2\r\n$10\r\ninvalidate\r\n*%d\r\n", len(keys))
+
+	for _, key := range keys {
+		push += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+	}
+
+	s.push(push)
+}
+
+// invalidateAll  Pushes the invalidation Redis sends after a FLUSHALL, which names no keys at all.
+func (s *testResp3Server) invalidateAll() {
+	s.push(">2\r\n$10\r\ninvalidate\r\n_\r\n")
+}
+
+// drop  Hangs up on every RESP3 connection, as though Redis had gone away for a moment.
+func (s *testResp3Server) drop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for conn := range s.resp3 {
+		conn.Close()
+		delete(s.resp3, conn)
+	}
+}
+
+// Hellos  How many connections have switched to RESP3.
+func (s *testResp3Server) Hellos() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.hellos
+}
+
+// Tracking  The CLIENT TRACKING commands received, in order, each prefixed with the id of the client that sent it.
+func (s *testResp3Server) Tracking() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string{}, s.tracking...)
+}
+
+// Close  Stops listening.
+func (s *testResp3Server) Close() {
+	s.listener.Close()
+	s.drop()
+}
+
+// trackingTestProxy  A proxy that fetches from a testResp3Server for real, with tracking running.
+func trackingTestProxy(t *testing.T, server *testResp3Server, options TrackingOptions) (p *Proxy, done chan error) {
+	p = NewProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), server.Addr(), DefaultUpstreamOptions(), 1)
+	p.Tracking = &options
+
+	done = make(chan error, 1)
+
+	go func() {
+		done <- p.RunTracking(options)
+	}()
+
+	return p, done
+}
+
+// closeTrackingTestProxy  Closes the proxy, and checks that tracking stops.
+func closeTrackingTestProxy(t *testing.T, p *Proxy, done chan error) {
+	p.Close()
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err, "closing the proxy stops tracking without an error")
+	case <-time.After(testRealWait()):
+		t.Errorf("Closing the proxy didn't stop tracking")
+	}
+}
+
+func TestProxy_Tracking(t *testing.T) {
+	server := newTestResp3Server(t, false)
+	defer server.Close()
+
+	p, done := trackingTestProxy(t, server, testTrackingOptions(false))
+
+	assert.True(t, waitFor(func() bool { return atomic.LoadInt64(&p.trackingID) != 0 }), "tracking started")
+	id := atomic.LoadInt64(&p.trackingID)
+
+	// fetches have their reads tracked, and the invalidations sent to the tracking connection
+	for _, key := range []string{testFoo(), testBar()} {
+		entry, err := p.Cache.Get(key)
+		if assert.Nil(t, err, "no error getting %s", key) {
+			assert.Equal(t, key, entry.Value, "got %s", key)
+		}
+	}
+
+	tracking := server.Tracking()
+	if assert.Len(t, tracking, 2, "both fetches were tracked") {
+		assert.True(t, strings.HasSuffix(tracking[0], fmt.Sprintf("client tracking on redirect %d", id)), "redirected to the tracking connection")
+	}
+
+	server.invalidate(testFoo())
+
+	assert.True(t, waitFor(func() bool { return p.Cache.Len() == 1 }), "invalidated key was dropped")
+	assert.Equal(t, uint64(2), p.Cache.Stats().Invalidations, "both the early invalidation and this one were counted")
+
+	server.invalidateAll()
+
+	assert.True(t, waitFor(func() bool { return p.Cache.Len() == 0 }), "invalidating everything dropped everything")
+
+	// a dropped connection is reopened, and the cache flushed, since there's no telling what was missed
+	_, err := p.Cache.Get(testFoo())
+	assert.Nil(t, err, "no error getting a key")
+
+	server.drop()
+
+	assert.True(t, waitFor(func() bool { return server.Hellos() == 2 }), "tracking reconnected")
+	assert.True(t, waitFor(func() bool { return p.Cache.Len() == 0 }), "and flushed the cache")
+	assert.True(t, waitFor(func() bool { return atomic.LoadInt64(&p.trackingID) > id }), "as a new client")
+
+	closeTrackingTestProxy(t, p, done)
+}
+
+func TestProxy_TrackingBroadcast(t *testing.T) {
+	server := newTestResp3Server(t, false)
+	defer server.Close()
+
+	p, done := trackingTestProxy(t, server, testTrackingOptions(true))
+
+	assert.True(t, waitFor(func() bool { return atomic.LoadInt64(&p.trackingID) != 0 }), "tracking started")
+	id := atomic.LoadInt64(&p.trackingID)
+
+	_, err := p.Cache.Get(testFoo())
+	assert.Nil(t, err, "no error getting a key")
+
+	assert.Equal(t, []string{fmt.Sprintf("%d: client tracking on bcast prefix fo prefix ba", id)}, server.Tracking(), "the tracking connection broadcasts, and fetches aren't tracked")
+
+	server.invalidate(testFoo())
+
+	assert.True(t, waitFor(func() bool { return p.Cache.Len() == 0 }), "broadcast invalidation dropped the key")
+
+	closeTrackingTestProxy(t, p, done)
+}
+
+func TestProxy_TrackingUnsupported(t *testing.T) {
+	server := newTestResp3Server(t, true)
+	defer server.Close()
+
+	p, done := trackingTestProxy(t, server, testTrackingOptions(false))
+
+	// there's no way to tell it isn't going to work, other than that it doesn't
+	time.Sleep(testTrackingOptions(false).RetryInterval * 5)
+
+	assert.Equal(t, int64(0), atomic.LoadInt64(&p.trackingID), "tracking never started")
+
+	entry, err := p.Cache.Get(testFoo())
+	if assert.Nil(t, err, "fetching works without tracking") {
+		assert.Equal(t, testFoo(), entry.Value, "got the key")
+	}
+
+	assert.Empty(t, server.Tracking(), "and nothing asked to be tracked")
+
+	closeTrackingTestProxy(t, p, done)
+}
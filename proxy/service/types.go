@@ -0,0 +1,407 @@
+package service
+
+import (
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/pkg/errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Names Redis' TYPE command gives the kinds of value it holds
+const (
+	TypeString    = "string"
+	TypeHash      = "hash"
+	TypeList      = "list"
+	TypeSet       = "set"
+	TypeSortedSet = "zset"
+	TypeStream    = "stream"
+	typeNone      = "none"
+)
+
+// fetchTyped  Fetches a key that isn't a string, by whatever means suits it's type.  Everything is cut off at maxElements, if that's set, and truncated says whether it was.  Lists, sorted sets and streams keep their first maxElements elements, and hashes and sets whichever maxElements fields or members a scan turns up first.  Hashes come back as map[string]string, lists and sets as []string, sorted sets as []redis.Z, and streams as []redis.XMessage.
+func (p *Proxy) fetchTyped(key string, kind string) (value interface{}, truncated bool, err error) {
+	// one more than we'll keep, so we can tell whether there was more.  LRANGE and ZRANGE take the index of the last element, where -1 is the end.
+	last := int64(-1)
+	if p.maxElements > 0 {
+		last = p.maxElements
+	}
+
+	switch kind {
+	case TypeHash:
+		if p.maxElements <= 0 {
+			value, err = p.Client.HGetAll(key).Result()
+			return value, truncated, err
+		}
+
+		return p.scanHash(key)
+
+	case TypeList:
+		elements, err := p.Client.LRange(key, 0, last).Result()
+		if p.maxElements > 0 && int64(len(elements)) > p.maxElements {
+			elements, truncated = elements[:p.maxElements], true
+		}
+
+		return elements, truncated, err
+
+	case TypeSet:
+		if p.maxElements <= 0 {
+			value, err = p.Client.SMembers(key).Result()
+			return value, truncated, err
+		}
+
+		return p.scanSet(key)
+
+	case TypeSortedSet:
+		elements, err := p.Client.ZRangeWithScores(key, 0, last).Result()
+		if p.maxElements > 0 && int64(len(elements)) > p.maxElements {
+			elements, truncated = elements[:p.maxElements], true
+		}
+
+		return elements, truncated, err
+
+	case TypeStream:
+		if p.maxElements <= 0 {
+			value, err = p.Client.XRange(key, "-", "+").Result()
+			return value, truncated, err
+		}
+
+		messages, err := p.Client.XRangeN(key, "-", "+", p.maxElements+1).Result()
+		if int64(len(messages)) > p.maxElements {
+			messages, truncated = messages[:p.maxElements], true
+		}
+
+		return messages, truncated, err
+	}
+
+	err = errors.New(fmt.Sprintf("can't cache %s, as it's a %s", key, kind))
+
+	return value, truncated, err
+}
+
+// scanHash  A hash, fetched with HSCAN until there's no more of it, or more than maxElements fields of it.  Big hashes are fetched a bit at a time, and never more than we'll keep, near enough, rather than all at once with HGETALL.
+func (p *Proxy) scanHash(key string) (hash map[string]string, truncated bool, err error) {
+	hash = make(map[string]string)
+
+	var cursor uint64
+
+	for {
+		var fields []string
+
+		fields, cursor, err = p.Client.HScan(key, cursor, "", p.maxElements+1).Result()
+		if err != nil {
+			return hash, truncated, err
+		}
+
+		// field, value, field, value...
+		for i := 0; i+1 < len(fields); i += 2 {
+			hash[fields[i]] = fields[i+1]
+		}
+
+		if int64(len(hash)) > p.maxElements {
+			break
+		}
+
+		if cursor == 0 {
+			return hash, truncated, err
+		}
+	}
+
+	for field := range hash {
+		if int64(len(hash)) <= p.maxElements {
+			break
+		}
+
+		delete(hash, field)
+	}
+
+	return hash, true, err
+}
+
+// scanSet  A set, fetched with SSCAN until there's no more of it, or more than maxElements members of it.  Like scanHash, but for sets.  A scan can turn up the same member twice, so they're only counted once.
+func (p *Proxy) scanSet(key string) (members []string, truncated bool, err error) {
+	members = make([]string, 0)
+	seen := make(map[string]struct{})
+
+	var cursor uint64
+
+	for {
+		var scanned []string
+
+		scanned, cursor, err = p.Client.SScan(key, cursor, "", p.maxElements+1).Result()
+		if err != nil {
+			return members, truncated, err
+		}
+
+		for _, member := range scanned {
+			if _, ok := seen[member]; ok {
+				continue
+			}
+
+			seen[member] = struct{}{}
+			members = append(members, member)
+		}
+
+		if int64(len(members)) > p.maxElements {
+			return members[:p.maxElements], true, err
+		}
+
+		if cursor == 0 {
+			return members, truncated, err
+		}
+	}
+}
+
+// replyValue  A cached value the way Redis would reply with it, to HGETALL, LRANGE, SMEMBERS, ZRANGE WITHSCORES or XRANGE as the case may be.  Strings, arrays, and arrays of those.  Hash fields come out sorted, since Redis doesn't promise any order.
+func replyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]string:
+		fields := make([]string, 0)
+		for field := range v {
+			fields = append(fields, field)
+		}
+
+		sort.Strings(fields)
+
+		reply := make([]interface{}, 0)
+		for _, field := range fields {
+			reply = append(reply, field, v[field])
+		}
+
+		return reply
+
+	case map[string]interface{}:
+		fields := make([]string, 0)
+		for field := range v {
+			fields = append(fields, field)
+		}
+
+		sort.Strings(fields)
+
+		reply := make([]interface{}, 0)
+		for _, field := range fields {
+			reply = append(reply, field, fmt.Sprint(v[field]))
+		}
+
+		return reply
+
+	case []redis.Z:
+		reply := make([]interface{}, 0)
+		for _, z := range v {
+			reply = append(reply, fmt.Sprint(z.Member), formatScore(z.Score))
+		}
+
+		return reply
+
+	case []redis.XMessage:
+		reply := make([]interface{}, 0)
+		for _, message := range v {
+			reply = append(reply, []interface{}{message.ID, replyValue(message.Values)})
+		}
+
+		return reply
+	}
+
+	return value
+}
+
+// formatScore  A sorted set score, as Redis writes it.  No trailing zeroes, and no exponent for anything reasonable.
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// formatReply  A reply as redis-cli would print it.  Strings are quoted, and arrays numbered, with nested arrays indented under their number.
+func formatReply(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "(nil)"
+
+	case string:
+		return strconv.Quote(v)
+
+	case int64:
+		return fmt.Sprintf("(integer) %d", v)
+
+	case []string:
+		reply := make([]interface{}, 0)
+		for _, s := range v {
+			reply = append(reply, s)
+		}
+
+		return formatReply(reply)
+
+	case []interface{}:
+		if len(v) == 0 {
+			return "(empty list or set)"
+		}
+
+		lines := make([]string, 0)
+		width := len(strconv.Itoa(len(v)))
+
+		for i, element := range v {
+			prefix := fmt.Sprintf("%*d) ", width, i+1)
+			indent := strings.Repeat(" ", len(prefix))
+
+			for j, line := range strings.Split(formatReply(element), "\n") {
+				if j == 0 {
+					lines = append(lines, prefix+line)
+				} else {
+					lines = append(lines, indent+line)
+				}
+			}
+		}
+
+		return strings.Join(lines, "\n")
+	}
+
+	return fmt.Sprint(value)
+}
+
+// entryType  What kind of value an entry holds, in Redis' terms.  Entries from fetchers that don't say are taken for what they look like.
+func entryType(entry *cache.CacheEntry) string {
+	if entry.Type != "" {
+		return entry.Type
+	}
+
+	switch entry.Value.(type) {
+	case map[string]string, map[string]interface{}:
+		return TypeHash
+	case []string, []interface{}:
+		return TypeList
+	case []redis.Z:
+		return TypeSortedSet
+	case []redis.XMessage:
+		return TypeStream
+	}
+
+	return TypeString
+}
+
+// entryLength  How many elements of a list or sorted set an entry holds.
+func entryLength(entry *cache.CacheEntry) int {
+	switch elements := entry.Value.(type) {
+	case []string:
+		return len(elements)
+	case []interface{}:
+		return len(elements)
+	case []redis.Z:
+		return len(elements)
+	}
+
+	return 0
+}
+
+// rangeBounds  Turns LRANGE or ZRANGE style start and stop indexes, which may count back from the end, into slice bounds for something of the given length.
+func rangeBounds(start int, stop int, length int) (from int, to int) {
+	if start < 0 {
+		start += length
+	}
+
+	if stop < 0 {
+		stop += length
+	}
+
+	if start < 0 {
+		start = 0
+	}
+
+	if stop >= length {
+		stop = length - 1
+	}
+
+	if start > stop || start >= length {
+		return 0, 0
+	}
+
+	return start, stop + 1
+}
+
+// streamID  A stream entry ID, as a pair of numbers that compare the way Redis compares them.  "-" and "+" are the lowest and highest there can be.  An ID without a sequence number is the lowest with that time if it's the start of a range, and the highest if it's the end.
+func streamID(id string, end bool) (ms uint64, seq uint64, err error) {
+	switch id {
+	case "-":
+		return 0, 0, err
+	case "+":
+		return ^uint64(0), ^uint64(0), err
+	}
+
+	parts := strings.SplitN(id, "-", 2)
+
+	ms, err = strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		err = errors.New("ERR Invalid stream ID specified as stream command argument")
+		return ms, seq, err
+	}
+
+	if len(parts) == 1 {
+		if end {
+			seq = ^uint64(0)
+		}
+
+		return ms, seq, err
+	}
+
+	seq, err = strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		err = errors.New("ERR Invalid stream ID specified as stream command argument")
+		return ms, seq, err
+	}
+
+	return ms, seq, err
+}
+
+// streamReaches  Whether a stream has a message at or past the end of a range, so that it holds all of the range there is.  A bad ID reaches nowhere.
+func streamReaches(stream []redis.XMessage, end string) bool {
+	if len(stream) == 0 {
+		return false
+	}
+
+	endMs, endSeq, err := streamID(end, true)
+	if err != nil {
+		return false
+	}
+
+	lastMs, lastSeq, err := streamID(stream[len(stream)-1].ID, false)
+	if err != nil {
+		return false
+	}
+
+	return lastMs > endMs || (lastMs == endMs && lastSeq >= endSeq)
+}
+
+// streamRange  The messages in a stream with IDs from start to end, inclusive, up to count of them if count is more than 0.
+func streamRange(stream []redis.XMessage, start string, end string, count int) (messages []redis.XMessage, err error) {
+	messages = make([]redis.XMessage, 0)
+
+	startMs, startSeq, err := streamID(start, false)
+	if err != nil {
+		return messages, err
+	}
+
+	endMs, endSeq, err := streamID(end, true)
+	if err != nil {
+		return messages, err
+	}
+
+	for _, message := range stream {
+		if count > 0 && len(messages) >= count {
+			break
+		}
+
+		ms, seq, err := streamID(message.ID, false)
+		if err != nil {
+			continue
+		}
+
+		afterStart := ms > startMs || (ms == startMs && seq >= startSeq)
+		beforeEnd := ms < endMs || (ms == endMs && seq <= endSeq)
+
+		if afterStart && beforeEnd {
+			messages = append(messages, message)
+		}
+	}
+
+	return messages, nil
+}
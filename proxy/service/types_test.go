@@ -0,0 +1,404 @@
+package service
+
+import (
+	"fmt"
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/phayes/freeport"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// typesTestProxy  Spins up miniredis holding one of each type, and a proxy in front of it with a RESP listener, caching testMaxElements of anything long.  Hands back a go-redis client pointed at the proxy.
+func typesTestProxy(t *testing.T) (upstream *miniredis.Miniredis, p *Proxy, client *redis.Client) {
+	upstream, err := testUpstream()
+	if err != nil {
+		t.Fatalf("Failed to start test redis: %s", err)
+	}
+
+	for field, value := range testHash() {
+		upstream.HSet(TypeHash, field, value)
+	}
+
+	upstream.Push(TypeList, testList()...)
+	upstream.SetAdd(TypeSet, testSet()...)
+
+	for _, z := range testSortedSet() {
+		upstream.ZAdd(TypeSortedSet, z.Score, z.Member.(string))
+	}
+
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get a free port: %s", err)
+	}
+
+	options := testUpstreamOptions()
+	options.MaxElements = testMaxElements()
+
+	p = NewProxy(0, port, testCapacity()*2, testMaxAge(), testTimeout(), upstream.Addr(), options, 1)
+
+	go p.RunResp()
+
+	addr := fmt.Sprintf("localhost%s", p.RespPort)
+
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	client = redis.NewClient(&redis.Options{
+		Addr: addr,
+	})
+
+	return upstream, p, client
+}
+
+func TestProxy_FetcherTypes(t *testing.T) {
+	upstream, p, client := typesTestProxy(t)
+	defer upstream.Close()
+	defer p.Close()
+	defer client.Close()
+
+	expected := map[string]interface{}{
+		TypeString:    testFoo(),
+		TypeHash:      testHash(),
+		TypeList:      testList()[:testMaxElements()],
+		TypeSet:       testSet(),
+		TypeSortedSet: testSortedSet(),
+	}
+
+	for kind, value := range expected {
+		key := kind
+		if kind == TypeString {
+			key = testFoo()
+		}
+
+		result, err := p.Fetcher(key, upstream.Addr())
+		if assert.Nil(t, err, "no error fetching a %s", kind) {
+			assert.Equal(t, kind, result.Type, "fetched a %s", kind)
+			assert.Equal(t, value, result.Value, "fetched the %s whole, or as much of it as there's room for", kind)
+			assert.Equal(t, kind == TypeList, result.Truncated, "only the list had more to it than there's room for")
+		}
+
+		entry, err := p.Cache.Get(key)
+		if assert.Nil(t, err, "no error getting a %s", kind) {
+			assert.Equal(t, kind, entry.Type, "the entry knows it's a %s", kind)
+		}
+	}
+
+	result, err := p.Fetcher(testMissing(), upstream.Addr())
+	assert.Nil(t, err, "no error fetching a missing key")
+	assert.Nil(t, result.Value, "missing key has no value")
+	assert.Equal(t, "", result.Type, "or type")
+}
+
+func TestProxy_HandleTypes(t *testing.T) {
+	upstream, p, client := typesTestProxy(t)
+	defer upstream.Close()
+	defer p.Close()
+	defer client.Close()
+
+	expected := map[string]string{
+		testFoo():     fmt.Sprintf("%q\n", testFoo()),
+		TypeHash:      "(hash)\n1) \"age\"\n2) \"42\"\n3) \"name\"\n4) \"ann\"\n",
+		TypeList:      "(list)\n1) \"one\"\n2) \"two\"\n3) \"three\"\n",
+		TypeSortedSet: "(zset)\n1) \"bronze\"\n2) \"1\"\n3) \"silver\"\n4) \"2.5\"\n5) \"gold\"\n6) \"10\"\n",
+	}
+
+	for key, body := range expected {
+		w := httptest.NewRecorder()
+		p.Handle(w, httptest.NewRequest("GET", "/"+key, nil))
+
+		got, _ := ioutil.ReadAll(w.Result().Body)
+		assert.Equal(t, body, string(got), "%s rendered like redis-cli would", key)
+	}
+}
+
+func TestResp_Types(t *testing.T) {
+	upstream, p, client := typesTestProxy(t)
+	defer upstream.Close()
+	defer p.Close()
+	defer client.Close()
+
+	for _, kind := range []string{TypeString, TypeHash, TypeList, TypeSet, TypeSortedSet} {
+		key := kind
+		if kind == TypeString {
+			key = testFoo()
+		}
+
+		got, err := client.Type(key).Result()
+		assert.Nil(t, err, "no error on TYPE %s", key)
+		assert.Equal(t, kind, got, "TYPE %s", key)
+	}
+
+	got, err := client.Type(testMissing()).Result()
+	assert.Nil(t, err, "no error on TYPE of a missing key")
+	assert.Equal(t, typeNone, got, "missing keys have no type")
+
+	hash, err := client.HGetAll(TypeHash).Result()
+	assert.Nil(t, err, "no error on HGETALL")
+	assert.Equal(t, testHash(), hash, "HGETALL gets the hash")
+
+	field, err := client.HGet(TypeHash, "name").Result()
+	assert.Nil(t, err, "no error on HGET")
+	assert.Equal(t, "ann", field, "HGET gets the field")
+
+	_, err = client.HGet(TypeHash, "nope").Result()
+	assert.Equal(t, redis.Nil, err, "HGET of a missing field is nil")
+
+	list, err := client.LRange(TypeList, 1, -1).Result()
+	assert.Nil(t, err, "no error on LRANGE")
+	assert.Equal(t, testList()[1:], list, "LRANGE to the end of a list that's only partly cached gets the rest of it from Redis")
+
+	list, err = client.LRange(TypeList, 0, testMaxElements()-1).Result()
+	assert.Nil(t, err, "no error on LRANGE")
+	assert.Equal(t, testList()[:testMaxElements()], list, "LRANGE over what's cached gets what's cached")
+
+	list, err = client.LRange(TypeList, 1, testMaxElements()).Result()
+	assert.Nil(t, err, "no error on LRANGE")
+	assert.Equal(t, testList()[1:testMaxElements()+1], list, "LRANGE just past what's cached gets it from Redis")
+
+	members, err := client.SMembers(TypeSet).Result()
+	assert.Nil(t, err, "no error on SMEMBERS")
+	assert.Equal(t, testSet(), members, "SMEMBERS gets the set")
+
+	zs, err := client.ZRangeWithScores(TypeSortedSet, 0, -1).Result()
+	assert.Nil(t, err, "no error on ZRANGE WITHSCORES")
+	assert.Equal(t, testSortedSet(), zs, "ZRANGE WITHSCORES gets the members and their scores")
+
+	zmembers, err := client.ZRange(TypeSortedSet, -2, -1).Result()
+	assert.Nil(t, err, "no error on ZRANGE")
+	assert.Equal(t, []string{"silver", "gold"}, zmembers, "ZRANGE gets just the members")
+
+	empty, err := client.LRange(testMissing(), 0, -1).Result()
+	assert.Nil(t, err, "no error on LRANGE of a missing key")
+	assert.Empty(t, empty, "missing keys are empty")
+
+	// wrong types are refused, as Redis would
+	_, err = client.Get(TypeHash).Result()
+	if assert.NotNil(t, err, "GET of a hash fails") {
+		assert.True(t, strings.HasPrefix(err.Error(), "WRONGTYPE"), "with WRONGTYPE")
+	}
+
+	_, err = client.HGetAll(TypeList).Result()
+	if assert.NotNil(t, err, "HGETALL of a list fails") {
+		assert.True(t, strings.HasPrefix(err.Error(), "WRONGTYPE"), "with WRONGTYPE")
+	}
+
+	values, err := client.MGet(testFoo(), TypeHash).Result()
+	assert.Nil(t, err, "no error on MGET")
+	assert.Equal(t, []interface{}{testFoo(), nil}, values, "MGET has nil for anything that isn't a string")
+}
+
+func TestResp_MissingTypes(t *testing.T) {
+	upstream, p, client := typesTestProxy(t)
+	defer upstream.Close()
+	defer p.Close()
+	defer client.Close()
+
+	messages, err := client.XRange(testMissing(), "-", "+").Result()
+	assert.Nil(t, err, "no error on XRANGE of a missing key")
+	assert.Empty(t, messages, "a missing stream has no messages")
+
+	list, err := client.LRange(testMissing(), 0, -1).Result()
+	assert.Nil(t, err, "no error on LRANGE of a missing key")
+	assert.Empty(t, list, "a missing list has no elements")
+
+	hash, err := client.HGetAll(testMissing()).Result()
+	assert.Nil(t, err, "no error on HGETALL of a missing key")
+	assert.Empty(t, hash, "a missing hash has no fields")
+
+	pong, err := client.Ping().Result()
+	assert.Nil(t, err, "the proxy is still there afterwards")
+	assert.Equal(t, "PONG", pong, "and answering")
+}
+
+func TestProxy_Streams(t *testing.T) {
+	server := newTestResp3Server(t, false)
+	defer server.Close()
+
+	options := testUpstreamOptions()
+	options.MaxElements = testMaxElements()
+
+	p := NewProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), server.Addr(), options, 1)
+	defer p.Close()
+
+	entry, err := p.Cache.Get(testStreamKey())
+	if assert.Nil(t, err, "no error getting a stream") {
+		assert.Equal(t, TypeStream, entry.Type, "the entry knows it's a stream")
+		assert.Equal(t, testStream(), replyValue(entry.Value), "and holds the stream")
+	}
+
+	assert.False(t, entry.Truncated, "all of it")
+	assert.Equal(t, []string{fmt.Sprintf("xrange %s - + count %d", testStreamKey(), testMaxElements()+1)}, server.XRanges(), "fetched as much of the stream as there's room for, and one more to tell if there's more")
+
+	messages, err := streamRange(entry.Value.([]redis.XMessage), "1526919030474-56", "+", 0)
+	assert.Nil(t, err, "no error ranging over a stream")
+	assert.Equal(t, testStream()[1:], replyValue(messages), "XRANGE from an ID on")
+}
+
+func TestResp_TruncatedTypes(t *testing.T) {
+	upstream, p, client := typesTestProxy(t)
+	defer upstream.Close()
+	defer p.Close()
+	defer client.Close()
+
+	for field, value := range testBigHash() {
+		upstream.HSet(testBigHashKey(), field, value)
+	}
+
+	upstream.SetAdd(testBigSetKey(), testBigSet()...)
+
+	for _, z := range testBigSortedSet() {
+		upstream.ZAdd(testBigSortedSetKey(), z.Score, z.Member.(string))
+	}
+
+	for key, length := range map[string]int{
+		testBigHashKey():      len(testBigHash()),
+		testBigSetKey():       len(testBigSet()),
+		testBigSortedSetKey(): len(testBigSortedSet()),
+	} {
+		entry, err := p.Cache.Get(key)
+		if assert.Nil(t, err, "no error getting %s", key) {
+			assert.True(t, entry.Truncated, "%s's %d elements are more than there's room for", key, length)
+			assert.Equal(t, int(testMaxElements()), reflect.ValueOf(entry.Value).Len(), "so only %d of them are cached", testMaxElements())
+		}
+	}
+
+	hash, err := client.HGetAll(testBigHashKey()).Result()
+	assert.Nil(t, err, "no error on HGETALL")
+	assert.Equal(t, testBigHash(), hash, "HGETALL of a truncated hash gets the lot from Redis")
+
+	for field, value := range testBigHash() {
+		got, err := client.HGet(testBigHashKey(), field).Result()
+		assert.Nil(t, err, "no error on HGET %s", field)
+		assert.Equal(t, value, got, "HGET gets %s, cached or not", field)
+	}
+
+	_, err = client.HGet(testBigHashKey(), "nope").Result()
+	assert.Equal(t, redis.Nil, err, "HGET of a field that isn't anywhere is nil")
+
+	members, err := client.SMembers(testBigSetKey()).Result()
+	assert.Nil(t, err, "no error on SMEMBERS")
+	sort.Strings(members)
+	assert.Equal(t, testBigSet(), members, "SMEMBERS of a truncated set gets the lot from Redis")
+
+	zs, err := client.ZRangeWithScores(testBigSortedSetKey(), 0, -1).Result()
+	assert.Nil(t, err, "no error on ZRANGE WITHSCORES")
+	assert.Equal(t, testBigSortedSet(), zs, "ZRANGE of a truncated sorted set to it's end gets the lot from Redis")
+
+	zmembers, err := client.ZRange(testBigSortedSetKey(), -1, -1).Result()
+	assert.Nil(t, err, "no error on ZRANGE")
+	assert.Equal(t, []string{testBigSortedSet()[len(testBigSortedSet())-1].Member.(string)}, zmembers, "counting back from the end counts from Redis' end, not ours")
+}
+
+func TestRangeBounds(t *testing.T) {
+	cases := []struct {
+		start int
+		stop  int
+		from  int
+		to    int
+	}{
+		{0, -1, 0, 5},
+		{1, 2, 1, 3},
+		{-2, -1, 3, 5},
+		{-100, 100, 0, 5},
+		{3, 1, 0, 0},
+		{5, 10, 0, 0},
+	}
+
+	for _, c := range cases {
+		from, to := rangeBounds(c.start, c.stop, 5)
+		assert.Equal(t, []int{c.from, c.to}, []int{from, to}, "range %d %d of 5", c.start, c.stop)
+	}
+}
+
+func TestStreamRange(t *testing.T) {
+	stream := []redis.XMessage{
+		{ID: "1-0"},
+		{ID: "1-1"},
+		{ID: "2-0"},
+		{ID: "3-5"},
+	}
+
+	ids := func(messages []redis.XMessage) []string {
+		found := make([]string, 0)
+		for _, message := range messages {
+			found = append(found, message.ID)
+		}
+
+		return found
+	}
+
+	cases := []struct {
+		start    string
+		end      string
+		count    int
+		expected []string
+	}{
+		{"-", "+", 0, []string{"1-0", "1-1", "2-0", "3-5"}},
+		{"-", "+", 2, []string{"1-0", "1-1"}},
+		{"1", "1", 0, []string{"1-0", "1-1"}},
+		{"1-1", "3", 0, []string{"1-1", "2-0", "3-5"}},
+		{"4", "+", 0, []string{}},
+	}
+
+	for _, c := range cases {
+		messages, err := streamRange(stream, c.start, c.end, c.count)
+		if assert.Nil(t, err, "no error on %s %s", c.start, c.end) {
+			assert.Equal(t, c.expected, ids(messages), "range %s %s count %d", c.start, c.end, c.count)
+		}
+	}
+
+	_, err := streamRange(stream, "nope", "+", 0)
+	assert.NotNil(t, err, "bad IDs are an error")
+}
+
+func TestStreamReaches(t *testing.T) {
+	var stream []redis.XMessage
+	for _, message := range testStream() {
+		stream = append(stream, redis.XMessage{ID: message.([]interface{})[0].(string)})
+	}
+
+	for end, expected := range map[string]bool{
+		"1526919030474-55": true,
+		"1526919030474-56": true,
+		"1526919030474":    false,
+		"1526919030474-57": false,
+		"+":                false,
+		"-":                true,
+		"nope":             false,
+	} {
+		assert.Equal(t, expected, streamReaches(stream, end), "stream reaches %s", end)
+	}
+
+	assert.False(t, streamReaches(nil, "-"), "an empty stream reaches nowhere")
+}
+
+func TestFormatReply(t *testing.T) {
+	cases := map[string]interface{}{
+		"(nil)":               nil,
+		`"foo"`:               "foo",
+		"(empty list or set)": []string{},
+		"1) \"a\"\n2) \"b\"":  []string{"a", "b"},
+		"1) 1) \"1-0\"\n   2) 1) \"f\"\n      2) \"v\"": []interface{}{
+			[]interface{}{"1-0", []interface{}{"f", "v"}},
+		},
+	}
+
+	for expected, value := range cases {
+		assert.Equal(t, expected, formatReply(value), "formatted %v", value)
+	}
+}
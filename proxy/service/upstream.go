@@ -0,0 +1,146 @@
+package service
+
+import (
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"log"
+	"regexp"
+	"time"
+)
+
+// UpstreamOptions  Knobs for the connection pool the proxy keeps to the upstream Redis.  Zero values get go-redis' defaults.
+type UpstreamOptions struct {
+	PoolSize           int
+	MinIdleConns       int
+	DialTimeout        time.Duration
+	ReadTimeout        time.Duration
+	WriteTimeout       time.Duration
+	IdleTimeout        time.Duration
+	IdleCheckFrequency time.Duration
+	// MaxElements  How much of a hash, list, set, sorted set or stream to fetch.  MaxElements of it are cached, and the rest ignored.  0 for the lot.
+	MaxElements int64
+}
+
+// DefaultUpstreamOptions  The pool settings you get if you don't have opinions of your own.
+func DefaultUpstreamOptions() UpstreamOptions {
+	return UpstreamOptions{
+		DialTimeout:        time.Second * 5,
+		ReadTimeout:        time.Second * 3,
+		WriteTimeout:       time.Second * 3,
+		IdleTimeout:        time.Minute * 5,
+		IdleCheckFrequency: time.Minute,
+		MaxElements:        10000,
+	}
+}
+
+// NewUpstreamClient creates the long lived, pooled client that the proxy uses to talk to Redis.  Nothing is dialed until it's first used.
+func NewUpstreamClient(redisAddr string, options UpstreamOptions) *redis.Client {
+	client := redis.NewClient(&redis.Options{
+		Addr:               FullRedisAddr(redisAddr),
+		Password:           "",
+		DB:                 0,
+		PoolSize:           options.PoolSize,
+		MinIdleConns:       options.MinIdleConns,
+		DialTimeout:        options.DialTimeout,
+		ReadTimeout:        options.ReadTimeout,
+		WriteTimeout:       options.WriteTimeout,
+		IdleTimeout:        options.IdleTimeout,
+		IdleCheckFrequency: options.IdleCheckFrequency,
+	})
+
+	return client
+}
+
+// FullRedisAddr tacks the default Redis port on to an address if it doesn't already have one.
+func FullRedisAddr(redisAddr string) string {
+	r := regexp.MustCompile(`.+:\d+`)
+
+	if r.MatchString(redisAddr) {
+		return redisAddr
+	}
+
+	return fmt.Sprintf("%s:6379", redisAddr)
+}
+
+// Fetcher The function that actually gets info from redis, over the proxy's pooled client.  This is used when the proxy is run for reals.  In testing it's replaced by an in memory function reading from a test fixture
+//
+// The key's type, it's remaining TTL, and it's value if it's a string, are fetched together in one pipelined round trip, so the cache can avoid holding on to it longer than Redis does.  Anything other than a string takes a second trip, to fetch it however suits it's type.  A cache.SubKey is a partial read of a key, and is fetched by fetchRead instead.
+func (p *Proxy) Fetcher(key string, redisAddr string) (result cache.FetchResult, err error) {
+	if base, read := cache.SplitSubKey(key); len(read) > 0 {
+		return p.fetchRead(base, read)
+	}
+
+	pipe := p.Client.Pipeline()
+	defer pipe.Close()
+
+	// have Redis tell the tracking connection when what we're about to read changes.  It's in the same round trip, so it's cheap.
+	var tracking *redis.Cmd
+
+	if redirect := p.trackingRedirect(); redirect != nil {
+		tracking = pipe.Do(redirect...)
+	}
+
+	kind := pipe.Type(key)
+	get := pipe.Get(key)
+	pttl := pipe.PTTL(key)
+
+	// Exec reports the first failed command, and a missing key, or one that isn't a string, counts as a failure for GET, so look at the commands themselves.
+	_, _ = pipe.Exec()
+
+	// not fatal.  The TTL will see to it, eventually.
+	if tracking != nil && tracking.Err() != nil {
+		log.Printf("Failed to have Redis track %s: %s\n", key, tracking.Err())
+	}
+
+	result.Type, err = kind.Result()
+	if err != nil {
+		return result, err
+	}
+
+	switch result.Type {
+	case typeNone:
+		result.Type = ""
+		return result, nil
+
+	case TypeString:
+		fetchedval, err := get.Result()
+		if err == redis.Nil {
+			result.Type = ""
+			return result, nil
+		} else if err != nil {
+			return result, err
+		}
+
+		result.Value = fetchedval
+
+	default:
+		result.Value, result.Truncated, err = p.fetchTyped(key, result.Type)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	result.TTL = upstreamTtl(pttl)
+
+	return result, nil
+}
+
+// upstreamTtl  Makes sense of a PTTL reply.  -1 (no expiry) and -2 (no key) both come back negative, and both mean there's no TTL to honor.  A key on it's very last millisecond gets that millisecond, rather than being taken for one that never expires.
+func upstreamTtl(pttl *redis.DurationCmd) time.Duration {
+	ttl, err := pttl.Result()
+	if err != nil || ttl < 0 {
+		return 0
+	}
+
+	if ttl == 0 {
+		return time.Millisecond
+	}
+
+	return ttl
+}
+
+// PoolStats  Statistics for the upstream connection pool.  Hits, misses, timeouts, and how many connections we're holding on to.
+func (p *Proxy) PoolStats() *redis.PoolStats {
+	return p.Client.PoolStats()
+}
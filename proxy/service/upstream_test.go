@@ -0,0 +1,120 @@
+package service
+
+import (
+	"github.com/nikogura/redisproxy/proxy/cache"
+	"github.com/stretchr/testify/assert"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestFullRedisAddr(t *testing.T) {
+	for addr, expected := range testRedisAddrs() {
+		assert.Equal(t, expected, FullRedisAddr(addr), "redis address is filled out")
+	}
+}
+
+func TestProxy_Fetcher(t *testing.T) {
+	upstream, err := testUpstream()
+	if err != nil {
+		t.Fatalf("Failed to start test redis: %s", err)
+	}
+
+	defer upstream.Close()
+
+	p := NewProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), upstream.Addr(), testUpstreamOptions(), 1)
+	defer p.Close()
+
+	for _, key := range []string{testFoo(), testBar(), testWip(), testZoz()} {
+		entry, err := p.Cache.Get(key)
+		if err != nil {
+			log.Printf("Error fetching key %s: %s", key, err)
+			t.Fail()
+		}
+
+		if assert.NotNil(t, entry, "got an entry for %s", key) {
+			assert.Equal(t, key, entry.Value, "fetched string matches expectations")
+		}
+	}
+
+	entry, err := p.Cache.Get(testMissing())
+	assert.Nil(t, err, "missing key isn't an error")
+	assert.Nil(t, entry, "missing key has no entry")
+
+	stats := p.PoolStats()
+
+	log.Printf("Pool stats: %+v", stats)
+
+	assert.True(t, stats.TotalConns <= uint32(testUpstreamOptions().PoolSize), "never more connections than the pool size")
+	assert.True(t, stats.Hits > 0, "connections were reused")
+}
+
+func TestProxy_FetcherTtl(t *testing.T) {
+	upstream, err := testUpstream()
+	if err != nil {
+		t.Fatalf("Failed to start test redis: %s", err)
+	}
+
+	defer upstream.Close()
+
+	upstream.SetTTL(testFoo(), testUpstreamTtl())
+
+	p := NewProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), upstream.Addr(), testUpstreamOptions(), 1)
+	defer p.Close()
+
+	result, err := p.Fetcher(testFoo(), upstream.Addr())
+	assert.Nil(t, err, "no error fetching a key with a ttl")
+	assert.Equal(t, testFoo(), result.Value, "fetched string matches expectations")
+	assert.Equal(t, testUpstreamTtl(), result.TTL, "fetched the key's ttl along with it")
+
+	result, err = p.Fetcher(testBar(), upstream.Addr())
+	assert.Nil(t, err, "no error fetching a key without a ttl")
+	assert.Equal(t, testBar(), result.Value, "fetched string matches expectations")
+	assert.Equal(t, time.Duration(0), result.TTL, "a key that doesn't expire has no ttl")
+
+	result, err = p.Fetcher(testMissing(), upstream.Addr())
+	assert.Nil(t, err, "no error fetching a missing key")
+	assert.Nil(t, result.Value, "missing key has no value")
+
+	// and the cache honors it, unless told not to
+	for ignore, expected := range map[bool]time.Duration{false: testUpstreamTtl(), true: time.Duration(testMaxAge()) * time.Second} {
+		clock := cache.NewFakeClock(testEpoch())
+
+		options := []cache.Option{cache.WithClock(clock)}
+		if ignore {
+			options = append(options, cache.WithIgnoreUpstreamTtl())
+		}
+
+		p := NewProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), upstream.Addr(), testUpstreamOptions(), 1, options...)
+
+		entry, err := p.Cache.Get(testFoo())
+		if assert.Nil(t, err, "no error getting a key with a ttl") {
+			assert.Equal(t, testEpoch().Add(expected), entry.Expires, "cached for as long as expected, ignoring upstream ttl: %t", ignore)
+		}
+
+		p.Close()
+	}
+}
+
+func TestProxy_Close(t *testing.T) {
+	upstream, err := testUpstream()
+	if err != nil {
+		t.Fatalf("Failed to start test redis: %s", err)
+	}
+
+	defer upstream.Close()
+
+	p := NewProxy(0, 0, testCapacity(), testMaxAge(), testTimeout(), upstream.Addr(), testUpstreamOptions(), 1)
+
+	_, err = p.Cache.Get(testFoo())
+	assert.Nil(t, err, "fetch works while the proxy is open")
+
+	err = p.Close()
+	assert.Nil(t, err, "proxy closes cleanly")
+
+	_, err = p.Cache.Get(testBar())
+	assert.NotNil(t, err, "fetches fail once the upstream client is closed")
+
+	err = p.Close()
+	assert.Nil(t, err, "closing twice is harmless")
+}
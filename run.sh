@@ -6,4 +6,4 @@ redis-cli -h redis set wip wip
 redis-cli -h redis set zoz zoz
 redis-cli -h redis set ten 10
 
-redisproxy run -c $SIZE -e $EXPIRATION -p $PORT -r $REDIS
+redisproxy run -c $SIZE -e $EXPIRATION -p $PORT -P $RESP_PORT -r $REDIS